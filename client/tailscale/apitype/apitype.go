@@ -4,7 +4,14 @@
 // Package apitype contains types for the Tailscale LocalAPI and control plane API.
 package apitype
 
-import "tailscale.com/tailcfg"
+import (
+	"net/netip"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/types/opt"
+)
 
 // LocalAPIHost is the Host header value used by the LocalAPI.
 const LocalAPIHost = "local-tailscaled.sock"
@@ -31,12 +38,221 @@ type FileTarget struct {
 }
 
 type WaitingFile struct {
+	// Name is the file's name. Files received as part of a directory
+	// transfer have slash-separated names relative to the Taildrop
+	// directory, such as "photos/2023/beach.jpg".
 	Name string
 	Size int64
 }
 
+// TaildropPartial is the JSON type returned by a GET of a peer's
+// /v0/put/ PeerAPI URL. It describes the part of the file that the peer
+// has already received, so a sender can resume an interrupted transfer.
+type TaildropPartial struct {
+	// Offset is the number of bytes of the file the peer has.
+	// Zero means there's nothing to resume.
+	Offset int64
+
+	// SHA256 is the hex-encoded SHA-256 of the first Offset bytes of
+	// the file. The sender should only resume if it matches the start
+	// of the file it's sending.
+	SHA256 string `json:",omitempty"`
+}
+
+// TaildropSHA256Header is the HTTP header in which a Taildrop sender passes
+// the hex-encoded SHA-256 of the whole file to the receiver, which rejects
+// the file if its contents don't match.
+const TaildropSHA256Header = "Taildrop-Sha256"
+
 // SetPushDeviceTokenRequest is the body POSTed to the LocalAPI endpoint /set-device-token.
 type SetPushDeviceTokenRequest struct {
 	// PushDeviceToken is the iOS/macOS APNs device token (and any future Android equivalent).
 	PushDeviceToken string
 }
+
+// DNSStatus is the JSON type returned by the LocalAPI /dns-status handler.
+// It describes the DNS configuration that tailscaled most recently applied.
+type DNSStatus struct {
+	// OSConfigurator is the name of the mechanism used to apply
+	// DNS settings to the OS (for example "resolvedManager").
+	OSConfigurator string
+	// SupportsSplitDNS is whether OSConfigurator can direct queries for
+	// only some domains to Tailscale's resolver.
+	SupportsSplitDNS bool
+
+	// DefaultResolvers are the resolvers used for queries that don't
+	// match any of Routes. If empty, the OS's own resolvers are used.
+	DefaultResolvers []*dnstype.Resolver `json:",omitempty"`
+	// Routes maps DNS name suffixes to the resolvers that handle them.
+	// A suffix with no resolvers is answered by MagicDNS only.
+	Routes map[string][]*dnstype.Resolver `json:",omitempty"`
+	// SearchDomains are the domains appended to single-label queries.
+	SearchDomains []string `json:",omitempty"`
+	// NumHosts is the number of names MagicDNS has records for.
+	NumHosts int
+
+	// ResolverRoutes is the forwarding table of the resolver at
+	// 100.100.100.100, keyed by DNS name suffix. It differs from Routes
+	// when the OS can't do split DNS and its own resolvers are used as
+	// a fallback for the root domain.
+	ResolverRoutes map[string][]*dnstype.Resolver `json:",omitempty"`
+
+	// OSNameservers, OSSearchDomains and OSMatchDomains are the settings
+	// installed in the OS.
+	OSNameservers   []netip.Addr `json:",omitempty"`
+	OSSearchDomains []string     `json:",omitempty"`
+	OSMatchDomains  []string     `json:",omitempty"`
+}
+
+// DNSQueryResponse is the JSON type returned by the LocalAPI /dns-query
+// handler.
+type DNSQueryResponse struct {
+	// Bytes is the raw DNS response message.
+	Bytes []byte
+	// Resolvers are the upstream resolvers that the query would be
+	// forwarded to if it's not answered by MagicDNS.
+	Resolvers []*dnstype.Resolver `json:",omitempty"`
+}
+
+// DNSQueryLogEntry is the JSON type streamed by the LocalAPI /dns-query-log
+// handler, one per DNS query handled by tailscaled's internal resolver.
+type DNSQueryLogEntry struct {
+	Time time.Time
+	// Source is the client that sent the query, and SourceNode is its
+	// node name if it's a tailnet peer.
+	Source     netip.AddrPort
+	SourceNode string `json:",omitempty"`
+	// Name and Type are the queried name and record type ("A", "AAAA",
+	// etc).
+	Name string
+	Type string
+	// RCode is the response code ("NOERROR", "NXDOMAIN", etc). It's
+	// empty if the query failed without a response; see Err.
+	RCode string `json:",omitempty"`
+	// Upstream is the address of the resolver that answered, if the
+	// query was forwarded.
+	Upstream string `json:",omitempty"`
+	// Local is whether the query was answered by MagicDNS, and Cached
+	// whether it was answered from the cache of forwarded responses.
+	Local  bool `json:",omitempty"`
+	Cached bool `json:",omitempty"`
+	// ExitNode is whether the query came from a peer using this node as
+	// an exit node.
+	ExitNode bool `json:",omitempty"`
+	Latency  time.Duration
+	Err      string `json:",omitempty"`
+}
+
+// DNSUpstreamStats is the JSON type returned by the LocalAPI
+// /dns-upstream-stats handler, for each upstream resolver that
+// tailscaled's internal resolver has forwarded queries to.
+type DNSUpstreamStats struct {
+	Upstream string // the resolver's address
+	Queries  int64  // queries sent, excluding those canceled
+	Errors   int64  // queries that failed, including with SERVFAIL
+	Answered int64  // responses used, being the first to arrive
+	// TotalLatency and MaxLatency are the total and largest latency of
+	// successful queries.
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+// DebugCaptureRingStatus is the JSON type returned by the LocalAPI
+// /debug-capture-ring handler, describing tailscaled's on-disk ring of
+// packet capture files.
+type DebugCaptureRingStatus struct {
+	Running bool
+	// Dir is the directory of the capture files.
+	Dir string `json:",omitempty"`
+	// Filter is the filter expression of the running capture, empty if it
+	// captures all packets.
+	Filter string `json:",omitempty"`
+	// FileSize and MaxFiles are the size at which a new file is started
+	// and the number of files kept.
+	FileSize int64 `json:",omitempty"`
+	MaxFiles int   `json:",omitempty"`
+	// Files are the paths of the capture files, oldest first.
+	Files []string `json:",omitempty"`
+	// Err is the error that stopped the capture writing packets, if any.
+	Err string `json:",omitempty"`
+}
+
+// DebugConntrack is the JSON type returned by the LocalAPI
+// /debug-conntrack handler, describing the flows tracked by the packet
+// filter and the hits of its rules.
+type DebugConntrack struct {
+	Flows []DebugConntrackFlow
+	Rules []DebugFilterRule
+}
+
+// DebugConntrackFlow is a flow tracked by the packet filter.
+type DebugConntrackFlow struct {
+	Proto string // "tcp", "udp", etc
+	// Src and Dst are the addresses of the flow's initiator and
+	// responder, and SrcNode and DstNode their node names, if known.
+	Src     netip.AddrPort
+	Dst     netip.AddrPort
+	SrcNode string `json:",omitempty"`
+	DstNode string `json:",omitempty"`
+	// Outgoing is whether the flow was initiated by this node.
+	Outgoing bool
+	// Created is when the flow was first seen, and LastSeen is when a
+	// packet of it was last seen.
+	Created  time.Time
+	LastSeen time.Time
+	// Rule is the packet filter rule that accepted an incoming flow, and
+	// RuleIndex its index in the filter's rules, or -1 for outgoing flows.
+	Rule      string `json:",omitempty"`
+	RuleIndex int
+}
+
+// DebugFilterRule is a rule of the packet filter.
+type DebugFilterRule struct {
+	Index int
+	Rule  string
+	// Hits is the number of packets the rule has accepted since the
+	// filter was last updated. For TCP, only SYN packets are counted.
+	Hits uint64
+}
+
+// DebugFilterCheck is the JSON type returned by the LocalAPI
+// /debug-filter-check handler, describing how the packet filter would
+// handle a packet.
+type DebugFilterCheck struct {
+	Response string // "Accept", "Drop", etc
+	Why      string // why the filter reached Response
+	// ShieldsUp is whether the filter is a shields up filter, which
+	// rejects all incoming connections.
+	ShieldsUp bool
+	// Rule is the rule that accepted the packet, and RuleIndex its index
+	// in the filter's rules, or -1 if no rule did.
+	Rule      string `json:",omitempty"`
+	RuleIndex int
+	// Caps are the capabilities the packet's source has when talking to
+	// its destination, for packets received from a peer.
+	Caps tailcfg.PeerCapMap `json:",omitempty"`
+}
+
+// NetcheckHistoryEntry is a netcheck report from the history kept by
+// tailscaled, as returned by the LocalAPI /netcheck-history handler.
+type NetcheckHistoryEntry struct {
+	Time time.Time // when the report completed
+	Full bool      // whether it was a full report, rather than incremental
+
+	// LinkChange is whether the network changed since the previous report
+	// in the history.
+	LinkChange bool `json:",omitempty"`
+
+	UDP           bool     // a UDP STUN round trip completed
+	IPv4          bool     // an IPv4 STUN round trip completed
+	IPv6          bool     // an IPv6 STUN round trip completed
+	GlobalV4      string   `json:",omitempty"` // ip:port of global IPv4
+	GlobalV6      string   `json:",omitempty"` // [ip]:port of global IPv6
+	CaptivePortal opt.Bool `json:",omitempty"`
+	PreferredDERP int      // or 0 for unknown
+
+	// RegionLatency is the latency to each DERP region that responded,
+	// keyed by DERP region ID. Incremental reports only probe some
+	// regions.
+	RegionLatency map[int]time.Duration `json:",omitempty"`
+}
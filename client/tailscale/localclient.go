@@ -31,10 +31,12 @@
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netutil"
+	"tailscale.com/net/speedtest"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tka"
+	"tailscale.com/types/dnstype"
 	"tailscale.com/types/key"
 	"tailscale.com/types/tkatype"
 )
@@ -248,6 +250,65 @@ func (lc *LocalClient) WhoIs(ctx context.Context, remoteAddr string) (*apitype.W
 	return decodeJSON[*apitype.WhoIsResponse](body)
 }
 
+// DNSStatus returns the DNS configuration that tailscaled most recently
+// applied.
+func (lc *LocalClient) DNSStatus(ctx context.Context) (*apitype.DNSStatus, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/dns-status")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.DNSStatus](body)
+}
+
+// QueryDNS looks up name using tailscaled's internal DNS resolver
+// (100.100.100.100). The queryType is a record type such as "A", "AAAA" or
+// "TXT". It returns the raw DNS response and the upstream resolvers the
+// query would be forwarded to if it's not answered by MagicDNS.
+func (lc *LocalClient) QueryDNS(ctx context.Context, name string, queryType string) (bytes []byte, resolvers []*dnstype.Resolver, err error) {
+	body, err := lc.get200(ctx, fmt.Sprintf("/localapi/v0/dns-query?name=%s&type=%s", url.QueryEscape(name), url.QueryEscape(queryType)))
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := decodeJSON[*apitype.DNSQueryResponse](body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.Bytes, res.Resolvers, nil
+}
+
+// StreamDNSQueryLog returns a stream of the DNS queries handled by
+// tailscaled's internal DNS resolver (100.100.100.100), as JSON-encoded
+// apitype.DNSQueryLogEntry values, starting with those recently logged.
+// Queries are only logged while they're being streamed.
+//
+// The caller must close the returned stream when done.
+func (lc *LocalClient) StreamDNSQueryLog(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+apitype.LocalAPIHost+"/localapi/v0/dns-query-log", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, errors.New(res.Status)
+	}
+	return res.Body, nil
+}
+
+// DNSUpstreamStats returns the latency and error stats of the upstream
+// resolvers that tailscaled's internal DNS resolver has forwarded queries
+// to.
+func (lc *LocalClient) DNSUpstreamStats(ctx context.Context) ([]apitype.DNSUpstreamStats, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/dns-upstream-stats")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[[]apitype.DNSUpstreamStats](body)
+}
+
 // Goroutines returns a dump of the Tailscale daemon's current goroutines.
 func (lc *LocalClient) Goroutines(ctx context.Context) ([]byte, error) {
 	return lc.get200(ctx, "/localapi/v0/goroutines")
@@ -550,15 +611,44 @@ func (lc *LocalClient) FileTargets(ctx context.Context) ([]apitype.FileTarget, e
 // PushFile sends Taildrop file r to target.
 //
 // A size of -1 means unknown.
-// The name parameter is the original filename, not escaped.
+// The name parameter is the original filename, not escaped. It may contain
+// slashes to put the file in a directory on the target.
 func (lc *LocalClient) PushFile(ctx context.Context, target tailcfg.StableNodeID, size int64, name string, r io.Reader) error {
-	req, err := http.NewRequestWithContext(ctx, "PUT", "http://"+apitype.LocalAPIHost+"/localapi/v0/file-put/"+string(target)+"/"+url.PathEscape(name), r)
+	return lc.PushFileWithOpts(ctx, target, size, name, r, PushFileOpts{})
+}
+
+// PushFileOpts contains options for sending a Taildrop file with
+// PushFileWithOpts.
+type PushFileOpts struct {
+	// Offset, if non-zero, resumes an interrupted transfer: r starts at
+	// Offset bytes into the file, and the target keeps the first Offset
+	// bytes it already received. It should come from PartialFile, after
+	// checking that the target's partial contents match the file.
+	Offset int64
+
+	// SHA256, if non-empty, is the hex-encoded SHA-256 of the whole file.
+	// The target rejects the file if what it received doesn't match.
+	SHA256 string
+}
+
+// PushFileWithOpts is like PushFile, but with options.
+//
+// The size is the size of r, not including any opts.Offset.
+func (lc *LocalClient) PushFileWithOpts(ctx context.Context, target tailcfg.StableNodeID, size int64, name string, r io.Reader, opts PushFileOpts) error {
+	u := "http://" + apitype.LocalAPIHost + "/localapi/v0/file-put/" + string(target) + "/" + escapeTaildropPath(name)
+	if opts.Offset != 0 {
+		u += "?offset=" + fmt.Sprint(opts.Offset)
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", u, r)
 	if err != nil {
 		return err
 	}
 	if size != -1 {
 		req.ContentLength = size
 	}
+	if opts.SHA256 != "" {
+		req.Header.Set(apitype.TaildropSHA256Header, opts.SHA256)
+	}
 	res, err := lc.doLocalRequestNiceError(req)
 	if err != nil {
 		return err
@@ -571,6 +661,29 @@ func (lc *LocalClient) PushFile(ctx context.Context, target tailcfg.StableNodeID
 	return bestError(fmt.Errorf("%s: %s", res.Status, all), all)
 }
 
+// PartialFile returns how much of the Taildrop file name target has
+// already received from an earlier, interrupted PushFile, so the transfer
+// can be resumed with PushFileWithOpts.
+//
+// Targets running versions of Tailscale without resume support return an
+// error.
+func (lc *LocalClient) PartialFile(ctx context.Context, target tailcfg.StableNodeID, name string) (*apitype.TaildropPartial, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/file-put/"+string(target)+"/"+escapeTaildropPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.TaildropPartial](body)
+}
+
+// escapeTaildropPath path-escapes each slash-separated element of name.
+func escapeTaildropPath(name string) string {
+	elems := strings.Split(name, "/")
+	for i, e := range elems {
+		elems[i] = url.PathEscape(e)
+	}
+	return strings.Join(elems, "/")
+}
+
 // CheckIPForwarding asks the local Tailscale daemon whether it looks like the
 // machine is properly configured to forward IP packets as a subnet router
 // or exit node.
@@ -731,6 +844,16 @@ func (lc *LocalClient) CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, er
 	return &derpMap, nil
 }
 
+// NetcheckHistory returns the netcheck reports recently made by the local
+// tailscaled, oldest first.
+func (lc *LocalClient) NetcheckHistory(ctx context.Context) ([]apitype.NetcheckHistoryEntry, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/netcheck-history")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[[]apitype.NetcheckHistoryEntry](body)
+}
+
 // CertPair returns a cert and private key for the provided DNS domain.
 //
 // It returns a cached certificate from disk if it's still valid.
@@ -862,6 +985,22 @@ func (lc *LocalClient) Ping(ctx context.Context, ip netip.Addr, pingtype tailcfg
 	return lc.PingWithOpts(ctx, ip, pingtype, PingOpts{})
 }
 
+// Speedtest runs a throughput test in direction dir for duration d against
+// the peer with Tailscale IP ip. The peer must allow it via the
+// tailcfg.PeerCapabilitySpeedtest capability, unless it's owned by the same
+// user.
+func (lc *LocalClient) Speedtest(ctx context.Context, ip netip.Addr, dir speedtest.Direction, d time.Duration) ([]speedtest.Result, error) {
+	v := url.Values{}
+	v.Set("ip", ip.String())
+	v.Set("direction", dir.String())
+	v.Set("duration", d.String())
+	body, err := lc.send(ctx, "POST", "/localapi/v0/speedtest?"+v.Encode(), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[[]speedtest.Result](body)
+}
+
 // NetworkLockStatus fetches information about the tailnet key authority, if one is configured.
 func (lc *LocalClient) NetworkLockStatus(ctx context.Context) (*ipnstate.NetworkLockStatus, error) {
 	body, err := lc.send(ctx, "GET", "/localapi/v0/tka/status", 200, nil)
@@ -1248,6 +1387,73 @@ func (lc *LocalClient) StreamDebugCapture(ctx context.Context) (io.ReadCloser, e
 	return res.Body, nil
 }
 
+// DebugConntrack returns the flows tracked by tailscaled's packet filter
+// and the hits of the filter's rules.
+func (lc *LocalClient) DebugConntrack(ctx context.Context) (*apitype.DebugConntrack, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/debug-conntrack")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.DebugConntrack](body)
+}
+
+// DebugFilterCheck reports how tailscaled's packet filter would handle a
+// packet with the IP protocol number proto from src to dst: one received
+// from a peer, or if outgoing is true, one sent to a peer.
+func (lc *LocalClient) DebugFilterCheck(ctx context.Context, proto uint8, src, dst netip.AddrPort, outgoing bool) (*apitype.DebugFilterCheck, error) {
+	v := url.Values{
+		"proto": {fmt.Sprint(proto)},
+		"src":   {src.String()},
+		"dst":   {dst.String()},
+		"dir":   {"in"},
+	}
+	if outgoing {
+		v.Set("dir", "out")
+	}
+	body, err := lc.get200(ctx, "/localapi/v0/debug-filter-check?"+v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.DebugFilterCheck](body)
+}
+
+// DebugCaptureRingStatus returns the status of tailscaled's on-disk ring
+// of packet capture files.
+func (lc *LocalClient) DebugCaptureRingStatus(ctx context.Context) (*apitype.DebugCaptureRingStatus, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/debug-capture-ring")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.DebugCaptureRingStatus](body)
+}
+
+// StartDebugCaptureRing makes tailscaled write the packets matching filter
+// to a ring of pcapng files, replacing any capture ring already running.
+// The filter syntax is that of the capture package's ParseFilter. If
+// fileSize or files are zero, tailscaled's defaults are used.
+func (lc *LocalClient) StartDebugCaptureRing(ctx context.Context, filter string, fileSize int64, files int) (*apitype.DebugCaptureRingStatus, error) {
+	v := url.Values{
+		"action": {"start"},
+		"filter": {filter},
+		"size":   {fmt.Sprint(fileSize)},
+		"files":  {fmt.Sprint(files)},
+	}
+	body, err := lc.send(ctx, "POST", "/localapi/v0/debug-capture-ring?"+v.Encode(), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.DebugCaptureRingStatus](body)
+}
+
+// StopDebugCaptureRing stops tailscaled's capture ring, keeping its files.
+func (lc *LocalClient) StopDebugCaptureRing(ctx context.Context) (*apitype.DebugCaptureRingStatus, error) {
+	body, err := lc.send(ctx, "POST", "/localapi/v0/debug-capture-ring?action=stop", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.DebugCaptureRingStatus](body)
+}
+
 // WatchIPNBus subscribes to the IPN notification bus. It returns a watcher
 // once the bus is connected successfully.
 //
@@ -48,14 +48,29 @@
 	runSTUN    = flag.Bool("stun", true, "whether to run a STUN server. It will bind to the same IP (if any) as the --addr flag value.")
 	runDERP    = flag.Bool("derp", true, "whether to run a DERP server. The only reason to set this false is if you're decommissioning a server but want to keep its bootstrap DNS functionality still running.")
 
+	stunAltPort = flag.Int("stun-alt-port", 3479, "The UDP port on which to also serve STUN, from which responses are sent to clients asking for a port change to classify their NAT's behavior (RFC 5780). It's bound to the same IP as --stun-port. Zero disables it.")
+
 	meshPSKFile    = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
 	meshWith       = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
+	meshWithFile   = flag.String("mesh-with-file", "", "optional path to a file listing hostnames to mesh with, separated by commas or whitespace; it's reread every --mesh-refresh-interval")
+	meshWithDNS    = flag.String("mesh-with-dns", "", "optional DNS name whose SRV record targets, or if it has none, whose addresses are the servers to mesh with; it's looked up every --mesh-refresh-interval")
+	meshRefresh    = flag.Duration("mesh-refresh-interval", 30*time.Second, "how often to update the mesh peers from --mesh-with-file and --mesh-with-dns")
 	bootstrapDNS   = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
 	unpublishedDNS = flag.String("unpublished-bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns and not publish in the list")
 	verifyClients  = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
 
+	clientAllowlist        = flag.String("client-allowlist", "", "if non-empty, a file path or http(s) URL of a list of node keys allowed to connect to this DERP server, one per line; keys prefixed with '!' are denied, and a line of '*' allows all others. Mesh peers are exempt.")
+	clientAllowlistRefresh = flag.Duration("client-allowlist-refresh", time.Minute, "how often to reload --client-allowlist; zero disables reloading. Connected clients that a reloaded list no longer allows are disconnected")
+
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
+
+	clientBytesLimit   = flag.Int("client-bytes-limit", 0, "if non-zero, rate limit in bytes per second for packets relayed from each client; mesh peers are exempt")
+	clientBytesBurst   = flag.Int("client-bytes-burst", 0, "burst limit in bytes for packets relayed from each client; defaults to one second's worth, and is at least the max DERP packet size")
+	clientPacketsLimit = flag.Int("client-packets-limit", 0, "if non-zero, rate limit in packets per second for packets relayed from each client; mesh peers are exempt")
+	clientPacketsBurst = flag.Int("client-packets-burst", 0, "burst limit in packets for packets relayed from each client; defaults to one second's worth")
+
+	trafficTopK = flag.Int("traffic-top-k", 0, "if non-zero, the number of heaviest clients and mesh peers to account traffic for, exported in metrics and at /debug/derp/top")
 )
 
 var (
@@ -68,6 +83,7 @@
 	stunReadError  = stunDisposition.Get("read_error")
 	stunNotSTUN    = stunDisposition.Get("not_stun")
 	stunWriteError = stunDisposition.Get("write_error")
+	stunChangeIP   = stunDisposition.Get("change_ip_unsupported")
 	stunSuccess    = stunDisposition.Get("success")
 
 	stunIPv4 = stunAddrFamily.Get("ipv4")
@@ -152,6 +168,20 @@ func main() {
 
 	s := derp.NewServer(cfg.PrivateKey, log.Printf)
 	s.SetVerifyClient(*verifyClients)
+	if *clientAllowlist != "" {
+		al, err := derp.NewAllowlist(*clientAllowlist, *clientAllowlistRefresh, log.Printf)
+		if err != nil {
+			log.Fatalf("loading --client-allowlist: %v", err)
+		}
+		s.SetClientVerifier(al)
+	}
+	s.SetTrafficTopK(*trafficTopK)
+	s.SetClientRateLimit(derp.ClientRateLimit{
+		BytesPerSecond:   *clientBytesLimit,
+		BytesBurst:       *clientBytesBurst,
+		PacketsPerSecond: *clientPacketsLimit,
+		PacketsBurst:     *clientPacketsBurst,
+	})
 
 	if *meshPSKFile != "" {
 		b, err := os.ReadFile(*meshPSKFile)
@@ -165,7 +195,8 @@ func main() {
 		s.SetMeshKey(key)
 		log.Printf("DERP mesh key configured")
 	}
-	if err := startMesh(s); err != nil {
+	mesh, err := startMesh(s)
+	if err != nil {
 		log.Fatalf("startMesh: %v", err)
 	}
 	expvar.Publish("derp", s.ExpVar())
@@ -220,9 +251,13 @@ func main() {
 		}
 	}))
 	debug.Handle("traffic", "Traffic check", http.HandlerFunc(s.ServeDebugTraffic))
+	debug.Handle("derp/top", "Top clients and mesh peers by traffic", http.HandlerFunc(s.ServeDebugTop))
+	if mesh != nil {
+		debug.Handle("derp/mesh", "Mesh peers and their health", mesh)
+	}
 
 	if *runSTUN {
-		go serveSTUN(listenHost, *stunPort)
+		go serveSTUN(listenHost, *stunPort, *stunAltPort)
 	}
 
 	quietLogger := log.New(logFilter{}, "", 0)
@@ -351,16 +386,39 @@ func probeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func serveSTUN(host string, port int) {
+func serveSTUN(host string, port, altPort int) {
 	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, fmt.Sprint(port)))
 	if err != nil {
 		log.Fatalf("failed to open STUN listener: %v", err)
 	}
 	log.Printf("running STUN server on %v", pc.LocalAddr())
-	serverSTUNListener(context.Background(), pc.(*net.UDPConn))
+	var alt *net.UDPConn
+	if altPort != 0 {
+		apc, err := net.ListenPacket("udp", net.JoinHostPort(host, fmt.Sprint(altPort)))
+		if err != nil {
+			log.Printf("failed to open alternate STUN listener; not supporting NAT behavior tests: %v", err)
+		} else {
+			log.Printf("running alternate STUN server on %v", apc.LocalAddr())
+			alt = apc.(*net.UDPConn)
+			go serverSTUNListener(context.Background(), alt, pc.(*net.UDPConn))
+		}
+	}
+	serverSTUNListener(context.Background(), pc.(*net.UDPConn), alt)
 }
 
-func serverSTUNListener(ctx context.Context, pc *net.UDPConn) {
+// serverSTUNListener serves STUN binding requests received on pc.
+//
+// If alt is non-nil, it's a listener on another port of the same IP, and
+// the RFC 5780 NAT behavior tests are supported with it: responses
+// advertise alt's port in OTHER-ADDRESS and are sent from alt if the
+// request's CHANGE-REQUEST asks for a port change. As the server has no
+// alternate IP, OTHER-ADDRESS has the unspecified IP, and requests to
+// change IP are dropped.
+func serverSTUNListener(ctx context.Context, pc, alt *net.UDPConn) {
+	var altPort uint16
+	if alt != nil {
+		altPort = uint16(alt.LocalAddr().(*net.UDPAddr).Port)
+	}
 	var buf [64 << 10]byte
 	var (
 		n   int
@@ -394,8 +452,24 @@ func serverSTUNListener(ctx context.Context, pc *net.UDPConn) {
 			stunIPv6.Add(1)
 		}
 		addr, _ := netip.AddrFromSlice(ua.IP)
-		res := stun.Response(txid, netip.AddrPortFrom(addr, uint16(ua.Port)))
-		_, err = pc.WriteTo(res, ua)
+		src := netip.AddrPortFrom(addr, uint16(ua.Port))
+		res, w := stun.Response(txid, src), pc
+		if alt != nil {
+			changeIP, changePort := stun.ParseChangeRequest(pkt)
+			if changeIP {
+				stunChangeIP.Add(1)
+				continue
+			}
+			if changePort {
+				w = alt
+			}
+			other := netip.IPv6Unspecified()
+			if addr.Unmap().Is4() {
+				other = netip.IPv4Unspecified()
+			}
+			res = stun.ResponseWithOtherAddress(txid, src, netip.AddrPortFrom(other, altPort))
+		}
+		_, err = w.WriteTo(res, ua)
 		if err != nil {
 			stunWriteError.Add(1)
 		} else {
@@ -8,8 +8,10 @@
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"strings"
 	"testing"
+	"time"
 
 	"tailscale.com/net/stun"
 )
@@ -47,7 +49,7 @@ func BenchmarkServerSTUN(b *testing.B) {
 	defer pc.Close()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	go serverSTUNListener(ctx, pc.(*net.UDPConn))
+	go serverSTUNListener(ctx, pc.(*net.UDPConn), nil)
 	addr := pc.LocalAddr().(*net.UDPAddr)
 
 	var resBuf [1500]byte
@@ -70,6 +72,67 @@ func BenchmarkServerSTUN(b *testing.B) {
 
 }
 
+func TestServerSTUNChangeRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listen := func() *net.UDPConn {
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		return pc.(*net.UDPConn)
+	}
+	pc, alt := listen(), listen()
+	go serverSTUNListener(ctx, pc, alt)
+	go serverSTUNListener(ctx, alt, pc)
+	port := netip.MustParseAddrPort(pc.LocalAddr().String()).Port()
+	altPort := netip.MustParseAddrPort(alt.LocalAddr().String()).Port()
+
+	cc := listen()
+	addr := pc.LocalAddr().(*net.UDPAddr)
+	var buf [1500]byte
+	for _, tt := range []struct {
+		name       string
+		changePort bool
+		wantPort   uint16 // of the response's source
+	}{
+		{"no_change", false, port},
+		{"change_port", true, altPort},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// Requests to change IP aren't answered, so the next
+			// response is to the second request.
+			if _, err := cc.WriteToUDP(stun.RequestChange(stun.NewTxID(), true, tt.changePort), addr); err != nil {
+				t.Fatal(err)
+			}
+			tx := stun.NewTxID()
+			if _, err := cc.WriteToUDP(stun.RequestChange(tx, false, tt.changePort), addr); err != nil {
+				t.Fatal(err)
+			}
+			cc.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, src, err := cc.ReadFromUDPAddrPort(buf[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := buf[:n]
+			gotTx, _, err := stun.ParseResponse(res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotTx != tx {
+				t.Fatalf("got response to %x; want %x", gotTx, tx)
+			}
+			if src.Port() != tt.wantPort {
+				t.Errorf("response from port %d; want %d", src.Port(), tt.wantPort)
+			}
+			if got, want := stun.ParseOtherAddress(res), netip.AddrPortFrom(netip.IPv4Unspecified(), altPort); got != want {
+				t.Errorf("OTHER-ADDRESS = %v; want %v", got, want)
+			}
+		})
+	}
+}
+
 func TestNoContent(t *testing.T) {
 	testCases := []struct {
 		name  string
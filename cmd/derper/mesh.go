@@ -4,51 +4,305 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"net/netip"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
 	"time"
 
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
+	"tailscale.com/metrics"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
 )
 
-func startMesh(s *derp.Server) error {
-	if *meshWith == "" {
-		return nil
+var (
+	meshPeerConnected = &metrics.LabelMap{Label: "peer"}
+	meshPeerClients   = &metrics.LabelMap{Label: "peer"}
+)
+
+func init() {
+	expvar.Publish("gauge_derper_mesh_peer_connected", meshPeerConnected)
+	expvar.Publish("gauge_derper_mesh_peer_clients", meshPeerClients)
+}
+
+// startMesh starts meshing with the peers configured by the --mesh-with*
+// flags, returning nil if there are none. If peers are discovered from a
+// file or DNS, it keeps the mesh up to date as they change.
+func startMesh(s *derp.Server) (*meshManager, error) {
+	if *meshWith == "" && *meshWithFile == "" && *meshWithDNS == "" {
+		return nil, nil
 	}
 	if !s.HasMeshKey() {
-		return errors.New("--mesh-with requires --mesh-psk-file")
+		return nil, errors.New("--mesh-with, --mesh-with-file and --mesh-with-dns require --mesh-psk-file")
+	}
+	m := &meshManager{
+		s:      s,
+		static: parseMeshPeers([]byte(*meshWith)),
+		file:   *meshWithFile,
+		dns:    *meshWithDNS,
 	}
-	for _, host := range strings.Split(*meshWith, ",") {
-		if err := startMeshWithHost(s, host); err != nil {
-			return err
+	if m.file != "" {
+		// Fail early on a missing or unreadable file, rather than start
+		// with no peers from it.
+		if _, err := os.ReadFile(m.file); err != nil {
+			return nil, err
 		}
 	}
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	m.refresh(ctx)
+	cancel()
+	if m.file != "" || m.dns != "" {
+		go m.refreshLoop(*meshRefresh)
+	}
+	return m, nil
+}
+
+// meshPeer is a DERP server to mesh with.
+type meshPeer struct {
+	host string     // host or host:port, for the URL and TLS server name
+	ip   netip.Addr // if valid, the address to dial rather than resolving host
+}
+
+func (p meshPeer) String() string {
+	if p.ip.IsValid() {
+		return fmt.Sprintf("%s@%s", p.host, p.ip)
+	}
+	return p.host
+}
+
+// parseMeshPeers parses a list of hosts separated by commas or whitespace,
+// ignoring comments from a '#' to the end of a line.
+func parseMeshPeers(b []byte) []meshPeer {
+	var peers []meshPeer
+	bs := bufio.NewScanner(bytes.NewReader(b))
+	for bs.Scan() {
+		line, _, _ := strings.Cut(bs.Text(), "#")
+		for _, host := range strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			peers = append(peers, meshPeer{host: host})
+		}
+	}
+	return peers
+}
+
+// lookupMeshPeers looks up the mesh peers named by the DNS name: the
+// targets of its SRV records if it has any, or otherwise each of its
+// addresses, to be reached using name as the TLS server name.
+func lookupMeshPeers(ctx context.Context, name string) ([]meshPeer, error) {
+	var r net.Resolver
+	var peers []meshPeer
+	if _, srvs, err := r.LookupSRV(ctx, "", "", name); err == nil && len(srvs) > 0 {
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			if srv.Port != 443 {
+				host = net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+			}
+			peers = append(peers, meshPeer{host: host})
+		}
+		return peers, nil
+	}
+	ips, err := r.LookupNetIP(ctx, "ip", name)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		peers = append(peers, meshPeer{host: name, ip: ip.Unmap()})
+	}
+	return peers, nil
+}
+
+// meshManager maintains the set of mesh peers that a DERP server forwards
+// packets through, starting and stopping a mesh client as each peer
+// appears and disappears.
+type meshManager struct {
+	s      *derp.Server
+	static []meshPeer // from --mesh-with
+	file   string     // --mesh-with-file, or empty
+	dns    string     // --mesh-with-dns, or empty
+
+	mu       sync.Mutex
+	lastFile []meshPeer // last peers read from file
+	lastDNS  []meshPeer // last peers looked up from dns
+	conns    map[meshPeer]*meshConn
+}
+
+// meshConn is a mesh client connection to a peer.
+type meshConn struct {
+	peer   meshPeer
+	c      *derphttp.Client
+	cancel context.CancelFunc
+	since  time.Time
+	self   atomic.Bool // whether the peer turned out to be this server
+
+	mu      sync.Mutex
+	clients set.Set[key.NodePublic] // clients forwarded to via the peer
+}
+
+func (mc *meshConn) numClients() int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return len(mc.clients)
+}
+
+// refreshLoop refreshes the mesh peers every interval, forever.
+func (m *meshManager) refreshLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		m.refresh(ctx)
+		cancel()
+	}
 }
 
-func startMeshWithHost(s *derp.Server, host string) error {
-	logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", host))
-	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+host+"/derp", logf)
+// refresh rereads the mesh peers from the file and DNS, if configured, and
+// updates the mesh to match. If either fails, the peers last read from it
+// are kept.
+func (m *meshManager) refresh(ctx context.Context) {
+	var filePeers, dnsPeers []meshPeer
+	var fileErr, dnsErr error
+	if m.file != "" {
+		var b []byte
+		b, fileErr = os.ReadFile(m.file)
+		filePeers = parseMeshPeers(b)
+	}
+	if m.dns != "" {
+		dnsPeers, dnsErr = lookupMeshPeers(ctx, m.dns)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fileErr != nil {
+		log.Printf("mesh: reading %s: %v; keeping %d peers from it", m.file, fileErr, len(m.lastFile))
+	} else {
+		m.lastFile = filePeers
+	}
+	if dnsErr != nil {
+		log.Printf("mesh: looking up %s: %v; keeping %d peers from it", m.dns, dnsErr, len(m.lastDNS))
+	} else {
+		m.lastDNS = dnsPeers
+	}
+
+	want := set.Set[meshPeer]{}
+	for _, peers := range [][]meshPeer{m.static, m.lastFile, m.lastDNS} {
+		for _, p := range peers {
+			want.Add(p)
+		}
+	}
+	for p, mc := range m.conns {
+		if !want.Contains(p) {
+			log.Printf("mesh: removing peer %v", p)
+			m.stopLocked(mc)
+		}
+	}
+	for p := range want {
+		if _, ok := m.conns[p]; ok {
+			continue
+		}
+		log.Printf("mesh: adding peer %v", p)
+		if err := m.startLocked(p); err != nil {
+			log.Printf("mesh: starting peer %v: %v", p, err)
+		}
+	}
+}
+
+// startLocked starts meshing with p. m.mu must be held.
+func (m *meshManager) startLocked(p meshPeer) error {
+	s := m.s
+	logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", p))
+	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+p.host+"/derp", logf)
 	if err != nil {
 		return err
 	}
 	c.MeshKey = s.MeshKey()
+	c.SetURLDialer(meshDialer(p))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mc := &meshConn{
+		peer:    p,
+		c:       c,
+		cancel:  cancel,
+		since:   time.Now(),
+		clients: set.Set[key.NodePublic]{},
+	}
+	add := func(k key.NodePublic, _ netip.AddrPort) {
+		s.AddPacketForwarder(k, c)
+		mc.mu.Lock()
+		mc.clients.Add(k)
+		mc.mu.Unlock()
+	}
+	remove := func(k key.NodePublic) {
+		s.RemovePacketForwarder(k, c)
+		mc.mu.Lock()
+		delete(mc.clients, k)
+		mc.mu.Unlock()
+	}
+	go func() {
+		c.RunWatchConnectionLoop(ctx, s.PublicKey(), logf, add, remove)
+		if ctx.Err() == nil {
+			// The loop only returns early if the peer is this server.
+			mc.self.Store(true)
+			c.Close()
+			meshPeerConnected.Delete(p.String())
+			meshPeerClients.Delete(p.String())
+		}
+		// Don't leave packets forwarded to a peer we no longer watch.
+		mc.mu.Lock()
+		defer mc.mu.Unlock()
+		for k := range mc.clients {
+			s.RemovePacketForwarder(k, c)
+		}
+		clear(mc.clients)
+	}()
+
+	meshPeerConnected.Set(p.String(), expvar.Func(func() any {
+		if c.IsConnected() {
+			return 1
+		}
+		return 0
+	}))
+	meshPeerClients.Set(p.String(), expvar.Func(func() any { return mc.numClients() }))
+	mak.Set(&m.conns, p, mc)
+	return nil
+}
+
+// stopLocked stops meshing with mc's peer. m.mu must be held.
+func (m *meshManager) stopLocked(mc *meshConn) {
+	mc.cancel()
+	mc.c.Close()
+	delete(m.conns, mc.peer)
+	meshPeerConnected.Delete(mc.peer.String())
+	meshPeerClients.Delete(mc.peer.String())
+}
 
-	// For meshed peers within a region, connect via VPC addresses.
-	c.SetURLDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+// meshDialer returns the dialer to reach the mesh peer p.
+func meshDialer(p meshPeer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
 		host, port, err := net.SplitHostPort(addr)
 		if err != nil {
 			return nil, err
 		}
 		var d net.Dialer
+		if p.ip.IsValid() {
+			return d.DialContext(ctx, network, net.JoinHostPort(p.ip.String(), port))
+		}
+
+		// For meshed peers within a region, connect via VPC addresses.
 		var r net.Resolver
 		if base, ok := strings.CutSuffix(host, ".tailscale.com"); ok && port == "443" {
 			subCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
@@ -66,10 +320,31 @@ func startMeshWithHost(s *derp.Server, host string) error {
 			}
 		}
 		return d.DialContext(ctx, network, addr)
-	})
+	}
+}
 
-	add := func(k key.NodePublic, _ netip.AddrPort) { s.AddPacketForwarder(k, c) }
-	remove := func(k key.NodePublic) { s.RemovePacketForwarder(k, c) }
-	go c.RunWatchConnectionLoop(context.Background(), s.PublicKey(), logf, add, remove)
-	return nil
+// ServeHTTP serves the mesh peers and their health, for the debug page.
+func (m *meshManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	conns := make([]*meshConn, 0, len(m.conns))
+	for _, mc := range m.conns {
+		conns = append(conns, mc)
+	}
+	m.mu.Unlock()
+	slices.SortFunc(conns, func(a, b *meshConn) int { return strings.Compare(a.peer.String(), b.peer.String()) })
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PEER\tSERVER KEY\tSTATUS\tCLIENTS\tSINCE")
+	for _, mc := range conns {
+		status := "disconnected"
+		switch {
+		case mc.self.Load():
+			status = "self"
+		case mc.c.IsConnected():
+			status = "connected"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%s\t%d\t%v\n", mc.peer, mc.c.ServerPublicKey().ShortString(), status, mc.numClients(), mc.since.Format(time.RFC3339))
+	}
+	tw.Flush()
 }
@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+func TestParseMeshPeers(t *testing.T) {
+	got := parseMeshPeers([]byte("derp1a.example.com,derp1b.example.com\n# comment\n derp1c.example.com:8443 # trailing\n\n"))
+	want := []meshPeer{
+		{host: "derp1a.example.com"},
+		{host: "derp1b.example.com"},
+		{host: "derp1c.example.com:8443"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMeshPeers = %v; want %v", got, want)
+	}
+}
+
+func TestMeshManagerRefresh(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetMeshKey("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	file := filepath.Join(t.TempDir(), "peers")
+	m := &meshManager{
+		s:      s,
+		static: []meshPeer{{host: "127.0.0.1:1"}},
+		file:   file,
+	}
+	defer func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, mc := range m.conns {
+			m.stopLocked(mc)
+		}
+	}()
+	peers := func() []string {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		var ret []string
+		for _, host := range []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"} {
+			if _, ok := m.conns[meshPeer{host: host}]; ok {
+				ret = append(ret, host)
+			}
+		}
+		return ret
+	}
+
+	if err := os.WriteFile(file, []byte("127.0.0.1:2\n127.0.0.1:3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m.refresh(context.Background())
+	if got, want := peers(), []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("peers = %v; want %v", got, want)
+	}
+	if meshPeerConnected.Map.Get("127.0.0.1:3") == nil {
+		t.Errorf("no connected metric for added peer")
+	}
+
+	if err := os.WriteFile(file, []byte("127.0.0.1:2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m.refresh(context.Background())
+	if got, want := peers(), []string{"127.0.0.1:1", "127.0.0.1:2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("peers = %v; want %v", got, want)
+	}
+	if meshPeerConnected.Map.Get("127.0.0.1:3") != nil {
+		t.Errorf("connected metric remains for removed peer")
+	}
+
+	// A missing file keeps the peers last read from it.
+	os.Remove(file)
+	m.refresh(context.Background())
+	if got, want := peers(), []string{"127.0.0.1:1", "127.0.0.1:2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("peers after file removal = %v; want %v", got, want)
+	}
+}
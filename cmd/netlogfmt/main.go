@@ -1,10 +1,15 @@
 // Copyright (c) Tailscale Inc & AUTHORS
 // SPDX-License-Identifier: BSD-3-Clause
 
-// netlogfmt parses a stream of JSON log messages from stdin and
-// formats the network traffic logs produced by "tailscale.com/wgengine/netlog"
-// according to the schema in "tailscale.com/types/netlogtype.Message"
-// in a more humanly readable format.
+// netlogfmt parses a stream of JSON log messages from stdin, or from the
+// files named as arguments, and formats the network traffic logs produced
+// by "tailscale.com/wgengine/netlog" according to the schema in
+// "tailscale.com/types/netlogtype.Message" in a more humanly readable format.
+//
+// The files may be those written locally by tailscaled when TS_NETLOG_FILE
+// is set. To read them in order, name the rotated files first, oldest first:
+//
+//	$ go run tailscale.com/cmd/netlogfmt netlog.json.2 netlog.json.1 netlog.json
 //
 // Example usage:
 //
@@ -65,17 +70,34 @@ func main() {
 	// The logic handles a stream of arbitrary JSON.
 	// So long as a JSON object seems like a network log message,
 	// then this will unmarshal and print it.
-	if err := processStream(os.Stdin); err != nil {
-		if err == io.EOF {
-			return
+	if flag.NArg() == 0 {
+		if err := processStream(os.Stdin); err != nil && err != io.EOF {
+			log.Fatalf("processStream: %v", err)
+		}
+		return
+	}
+	for _, name := range flag.Args() {
+		if err := processFile(name); err != nil {
+			log.Fatalf("processFile: %v", err)
 		}
-		log.Fatalf("processStream: %v", err)
 	}
 }
 
+func processFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := processStream(f); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
 func processStream(r io.Reader) (err error) {
 	defer try.Handle(&err)
-	dec := jsonv2.NewDecoder(os.Stdin)
+	dec := jsonv2.NewDecoder(r)
 	for {
 		processValue(dec)
 	}
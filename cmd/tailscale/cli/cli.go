@@ -116,9 +116,11 @@ func Run(args []string) (err error) {
 			configureCmd,
 			netcheckCmd,
 			ipCmd,
+			dnsCmd,
 			statusCmd,
 			pingCmd,
 			ncCmd,
+			speedtestCmd,
 			sshCmd,
 			funnelCmd(),
 			serveCmd,
@@ -130,6 +132,7 @@ func Run(args []string) (err error) {
 			netlockCmd,
 			licensesCmd,
 			exitNodeCmd,
+			whoisCmd,
 		},
 		FlagSet:   rootfs,
 		Exec:      func(context.Context, []string) error { return flag.ErrHelp },
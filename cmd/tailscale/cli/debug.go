@@ -22,11 +22,14 @@
 	"os"
 	"os/exec"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	xmaps "golang.org/x/exp/maps"
 	"golang.org/x/net/http/httpproxy"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/control/controlhttp"
@@ -37,6 +40,7 @@
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/must"
@@ -87,6 +91,43 @@
 				return fs
 			})(),
 		},
+		{
+			Name:      "dns-log",
+			Exec:      runDNSLog,
+			ShortHelp: "watch the DNS queries handled by tailscaled's resolver",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("dns-log")
+				fs.BoolVar(&dnsLogArgs.json, "json", false, "print entries as JSON")
+				fs.BoolVar(&dnsLogArgs.stats, "stats", false, "print the latency and error stats of upstream resolvers, and exit")
+				return fs
+			})(),
+		},
+		{
+			Name:      "conntrack",
+			Exec:      runConntrack,
+			ShortHelp: "print the flows tracked by the packet filter and its rule hits",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("conntrack")
+				fs.BoolVar(&conntrackArgs.json, "json", false, "print the flows and rules as JSON")
+				fs.BoolVar(&conntrackArgs.rules, "rules", false, "print the packet filter rules and their hits, instead of the flows")
+				return fs
+			})(),
+		},
+		{
+			Name:       "filter-check",
+			Exec:       runFilterCheck,
+			ShortUsage: "tailscale debug filter-check --src <node|ip> --dst <ip:port> [--proto tcp]",
+			ShortHelp:  "report how the packet filter would handle a packet",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("filter-check")
+				fs.StringVar(&filterCheckArgs.src, "src", "", "source node name or IP address, with an optional port")
+				fs.StringVar(&filterCheckArgs.dst, "dst", "", "destination IP address and port, or just an IP address for ICMP")
+				fs.StringVar(&filterCheckArgs.proto, "proto", "tcp", "IP protocol: tcp, udp, icmp, sctp, or a protocol number")
+				fs.StringVar(&filterCheckArgs.dir, "dir", "in", "packet direction: in (received from a peer) or out (sent to a peer)")
+				fs.BoolVar(&filterCheckArgs.json, "json", false, "print the result as JSON")
+				return fs
+			})(),
+		},
 		{
 			Name:      "metrics",
 			Exec:      runDaemonMetrics,
@@ -202,12 +243,34 @@
 			ShortHelp: "test a DERP configuration",
 		},
 		{
-			Name:      "capture",
-			Exec:      runCapture,
+			Name: "capture",
+			Exec: runCapture,
+			ShortUsage: "tailscale debug capture [-o <file>]\n" +
+				"tailscale debug capture --ring [--stop | --status] [<filter>]",
 			ShortHelp: "streams pcaps for debugging",
+			LongHelp: strings.TrimSpace(`
+Without --ring, capture streams the packets traversing tailscaled as pcap.
+
+With --ring, it starts a capture within tailscaled that writes pcapng files
+to a ring of size-bounded files in tailscaled's state directory, which keeps
+capturing after the command exits. The optional filter selects the packets
+captured, as a sequence of "peer <ip>", "proto <tcp|udp|icmp|sctp|number>"
+and "port <n>" clauses; clauses of the same kind are alternatives, and
+clauses of different kinds must all match:
+
+  tailscale debug capture --ring peer 100.101.102.103 and proto tcp and port 22
+
+Use --ring --stop to stop the capture, keeping its files, and --ring --status
+to list them.
+`),
 			FlagSet: (func() *flag.FlagSet {
 				fs := newFlagSet("capture")
 				fs.StringVar(&captureArgs.outFile, "o", "", "path to stream the pcap (or - for stdout), leave empty to start wireshark")
+				fs.BoolVar(&captureArgs.ring, "ring", false, "capture to a ring of pcapng files within tailscaled, instead of streaming")
+				fs.BoolVar(&captureArgs.stop, "stop", false, "with --ring, stop the capture")
+				fs.BoolVar(&captureArgs.status, "status", false, "with --ring, print the status of the capture")
+				fs.Int64Var(&captureArgs.ringFileSize, "ring-file-size", 0, "with --ring, the size in bytes at which a new file is started (0 for the default)")
+				fs.IntVar(&captureArgs.ringFiles, "ring-files", 0, "with --ring, the number of files kept (0 for the default)")
 				return fs
 			})(),
 		},
@@ -510,6 +573,255 @@ func runDaemonLogs(ctx context.Context, args []string) error {
 	}
 }
 
+var dnsLogArgs struct {
+	json  bool
+	stats bool
+}
+
+func runDNSLog(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	if dnsLogArgs.stats {
+		return printDNSUpstreamStats(ctx)
+	}
+	stream, err := localClient.StreamDNSQueryLog(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	fmt.Fprintln(os.Stderr, "Watching DNS queries; press Ctrl-C to stop.")
+	d := json.NewDecoder(stream)
+	for {
+		var e apitype.DNSQueryLogEntry
+		if err := d.Decode(&e); err != nil {
+			return err
+		}
+		if dnsLogArgs.json {
+			j, _ := json.Marshal(e)
+			outln(string(j))
+			continue
+		}
+		src := e.Source.String()
+		if e.SourceNode != "" {
+			src += " (" + e.SourceNode + ")"
+		}
+		var via string
+		switch {
+		case e.Local:
+			via = "MagicDNS"
+		case e.Cached:
+			via = "cache"
+		case e.Upstream != "":
+			via = e.Upstream
+		default:
+			via = "-"
+		}
+		result := e.RCode
+		if e.Err != "" {
+			result = "error: " + e.Err
+		}
+		var exitNode string
+		if e.ExitNode {
+			exitNode = " [exit node]"
+		}
+		printf("%s %s%s %s %s via %s: %s in %v\n", e.Time.Format("15:04:05.000"), src, exitNode, e.Type, e.Name, via, result, e.Latency.Round(time.Microsecond))
+	}
+}
+
+func printDNSUpstreamStats(ctx context.Context) error {
+	stats, err := localClient.DNSUpstreamStats(ctx)
+	if err != nil {
+		return err
+	}
+	if dnsLogArgs.json {
+		j, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+	if len(stats) == 0 {
+		outln("No queries forwarded yet.")
+		return nil
+	}
+	w := tabwriter.NewWriter(Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "UPSTREAM\tQUERIES\tERRORS\tANSWERED\tAVG LATENCY\tMAX LATENCY")
+	for _, st := range stats {
+		var avg time.Duration
+		if ok := st.Queries - st.Errors; ok > 0 {
+			avg = st.TotalLatency / time.Duration(ok)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%v\t%v\n", st.Upstream, st.Queries, st.Errors, st.Answered, avg.Round(time.Microsecond), st.MaxLatency.Round(time.Microsecond))
+	}
+	return w.Flush()
+}
+
+var conntrackArgs struct {
+	json  bool
+	rules bool
+}
+
+func runConntrack(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	ct, err := localClient.DebugConntrack(ctx)
+	if err != nil {
+		return err
+	}
+	if conntrackArgs.json {
+		var v any = ct.Flows
+		if conntrackArgs.rules {
+			v = ct.Rules
+		}
+		j, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(Stdout, 0, 0, 2, ' ', 0)
+	if conntrackArgs.rules {
+		fmt.Fprintln(w, "#\tHITS\tRULE")
+		for _, r := range ct.Rules {
+			fmt.Fprintf(w, "%d\t%d\t%s\n", r.Index, r.Hits, r.Rule)
+		}
+		return w.Flush()
+	}
+	if len(ct.Flows) == 0 {
+		outln("No flows tracked.")
+		return nil
+	}
+	addr := func(ipp netip.AddrPort, node string) string {
+		if node != "" {
+			return fmt.Sprintf("%s (%s)", ipp, node)
+		}
+		return ipp.String()
+	}
+	now := time.Now()
+	fmt.Fprintln(w, "PROTO\tSRC\tDST\tAGE\tIDLE\tACCEPTED BY")
+	for _, f := range ct.Flows {
+		by := "outgoing"
+		if !f.Outgoing {
+			by = fmt.Sprintf("rule #%d %s", f.RuleIndex, f.Rule)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%v\t%s\n", f.Proto, addr(f.Src, f.SrcNode), addr(f.Dst, f.DstNode),
+			now.Sub(f.Created).Round(time.Second), now.Sub(f.LastSeen).Round(time.Second), by)
+	}
+	return w.Flush()
+}
+
+var filterCheckArgs struct {
+	src   string
+	dst   string
+	proto string
+	dir   string
+	json  bool
+}
+
+func runFilterCheck(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	if filterCheckArgs.src == "" || filterCheckArgs.dst == "" {
+		return errors.New("--src and --dst are required")
+	}
+	var outgoing bool
+	switch filterCheckArgs.dir {
+	case "in":
+	case "out":
+		outgoing = true
+	default:
+		return fmt.Errorf("invalid --dir %q; want in or out", filterCheckArgs.dir)
+	}
+	src, err := filterCheckAddr(ctx, filterCheckArgs.src)
+	if err != nil {
+		return fmt.Errorf("invalid --src: %w", err)
+	}
+	dst, err := filterCheckAddr(ctx, filterCheckArgs.dst)
+	if err != nil {
+		return fmt.Errorf("invalid --dst: %w", err)
+	}
+	if src.Addr().Is4() != dst.Addr().Is4() {
+		return errors.New("--src and --dst must be of the same address family")
+	}
+	var proto ipproto.Proto
+	switch p := strings.ToLower(filterCheckArgs.proto); p {
+	case "tcp":
+		proto = ipproto.TCP
+	case "udp":
+		proto = ipproto.UDP
+	case "sctp":
+		proto = ipproto.SCTP
+	case "icmp":
+		proto = ipproto.ICMPv4
+		if dst.Addr().Is6() {
+			proto = ipproto.ICMPv6
+		}
+	default:
+		n, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid --proto %q", filterCheckArgs.proto)
+		}
+		proto = ipproto.Proto(n)
+	}
+
+	res, err := localClient.DebugFilterCheck(ctx, uint8(proto), src, dst, outgoing)
+	if err != nil {
+		return err
+	}
+	if filterCheckArgs.json {
+		j, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+	printf("%s %s -> %s (%s): %s (%s)\n", proto, src, dst, filterCheckArgs.dir, res.Response, res.Why)
+	if res.RuleIndex >= 0 {
+		printf("matched rule #%d: %s\n", res.RuleIndex, res.Rule)
+	}
+	caps := xmaps.Keys(res.Caps)
+	slices.Sort(caps)
+	for _, c := range caps {
+		printf("peer capability: %s\n", c)
+	}
+	if res.ShieldsUp {
+		outln("shields up: incoming connections are blocked")
+	}
+	return nil
+}
+
+// filterCheckAddr parses arg, an IP address or node name with an optional
+// port, for filter-check.
+func filterCheckAddr(ctx context.Context, arg string) (netip.AddrPort, error) {
+	if ap, err := netip.ParseAddrPort(arg); err == nil {
+		return ap, nil
+	}
+	host, port := arg, uint16(0)
+	if h, p, err := net.SplitHostPort(arg); err == nil {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("invalid port %q", p)
+		}
+		host, port = h, uint16(n)
+	}
+	ipStr, _, err := tailscaleIPFromArg(ctx, host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	ip, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ip.Unmap(), port), nil
+}
+
 var metricsArgs struct {
 	watch bool
 }
@@ -774,10 +1086,21 @@ func runSetExpire(ctx context.Context, args []string) error {
 }
 
 var captureArgs struct {
-	outFile string
+	outFile      string
+	ring         bool
+	stop         bool
+	status       bool
+	ringFileSize int64
+	ringFiles    int
 }
 
 func runCapture(ctx context.Context, args []string) error {
+	if captureArgs.ring {
+		return runCaptureRing(ctx, args)
+	}
+	if len(args) > 0 || captureArgs.stop || captureArgs.status {
+		return errors.New("filters, --stop and --status require --ring")
+	}
 	stream, err := localClient.StreamDebugCapture(ctx)
 	if err != nil {
 		return err
@@ -817,6 +1140,46 @@ func runCapture(ctx context.Context, args []string) error {
 	return err
 }
 
+func runCaptureRing(ctx context.Context, args []string) error {
+	var st *apitype.DebugCaptureRingStatus
+	var err error
+	switch {
+	case captureArgs.stop && captureArgs.status:
+		return errors.New("--stop and --status are mutually exclusive")
+	case captureArgs.stop || captureArgs.status:
+		if len(args) > 0 {
+			return errors.New("unexpected filter with --stop or --status")
+		}
+		if captureArgs.stop {
+			st, err = localClient.StopDebugCaptureRing(ctx)
+		} else {
+			st, err = localClient.DebugCaptureRingStatus(ctx)
+		}
+	default:
+		st, err = localClient.StartDebugCaptureRing(ctx, strings.Join(args, " "), captureArgs.ringFileSize, captureArgs.ringFiles)
+	}
+	if err != nil {
+		return err
+	}
+
+	if st.Running {
+		filter := st.Filter
+		if filter == "" {
+			filter = "all packets"
+		}
+		printf("Capturing %s to %s (%d files of %d bytes).\n", filter, st.Dir, st.MaxFiles, st.FileSize)
+	} else {
+		printf("Not capturing.\n")
+	}
+	if st.Err != "" {
+		printf("Capture stopped by error: %s\n", st.Err)
+	}
+	for _, f := range st.Files {
+		outln(f)
+	}
+	return nil
+}
+
 var debugPortmapArgs struct {
 	duration time.Duration
 	gwSelf   string
@@ -0,0 +1,242 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/exp/maps"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+)
+
+var dnsCmd = &ffcli.Command{
+	Name:       "dns",
+	ShortUsage: "dns <status|query> ...",
+	ShortHelp:  "Diagnose the internal DNS forwarder",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale dns' subcommands show the DNS configuration that Tailscale
+has applied and query Tailscale's internal DNS resolver (100.100.100.100),
+to help debug MagicDNS and split DNS.
+`),
+	Subcommands: []*ffcli.Command{
+		dnsStatusCmd,
+		dnsQueryCmd,
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("dns subcommand required; run 'tailscale dns -h' for details")
+	},
+}
+
+var dnsStatusCmd = &ffcli.Command{
+	Name:       "status",
+	ShortUsage: "dns status [--json]",
+	ShortHelp:  "Print the current DNS configuration",
+	LongHelp: strings.TrimSpace(`
+'tailscale dns status' prints the DNS configuration that Tailscale has
+applied: the split DNS routes and fallback resolvers used by 100.100.100.100,
+the search domains, and how the configuration was installed in the OS.
+`),
+	Exec: runDNSStatus,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("status")
+		fs.BoolVar(&dnsStatusArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var dnsStatusArgs struct {
+	json bool // output in JSON format
+}
+
+func runDNSStatus(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	st, err := localClient.DNSStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if dnsStatusArgs.json {
+		j, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintf(w, "OS configurator:\t%s\n", st.OSConfigurator)
+	fmt.Fprintf(w, "Split DNS supported:\t%v\n", st.SupportsSplitDNS)
+	fmt.Fprintf(w, "MagicDNS records:\t%d\n", st.NumHosts)
+	if len(st.DefaultResolvers) > 0 {
+		fmt.Fprintf(w, "Default resolvers:\t%s\n", resolverList(st.DefaultResolvers))
+	} else {
+		fmt.Fprintf(w, "Default resolvers:\t(OS default)\n")
+	}
+	if len(st.SearchDomains) > 0 {
+		fmt.Fprintf(w, "Search domains:\t%s\n", strings.Join(st.SearchDomains, ", "))
+	}
+	w.Flush()
+
+	if len(st.Routes) > 0 {
+		outln()
+		outln("Split DNS routes:")
+		printDNSRoutes(st.Routes)
+	}
+	if len(st.ResolverRoutes) > 0 {
+		outln()
+		outln("Resolver (100.100.100.100) routes:")
+		printDNSRoutes(st.ResolverRoutes)
+	}
+
+	outln()
+	outln("OS configuration:")
+	w = tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	var nameservers []string
+	for _, ip := range st.OSNameservers {
+		nameservers = append(nameservers, ip.String())
+	}
+	fmt.Fprintf(w, "  Nameservers:\t%s\n", strings.Join(nameservers, ", "))
+	fmt.Fprintf(w, "  Search domains:\t%s\n", strings.Join(st.OSSearchDomains, ", "))
+	fmt.Fprintf(w, "  Match domains:\t%s\n", strings.Join(st.OSMatchDomains, ", "))
+	w.Flush()
+	return nil
+}
+
+// printDNSRoutes prints a table of DNS suffixes and the resolvers that
+// handle them.
+func printDNSRoutes(routes map[string][]*dnstype.Resolver) {
+	w := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	suffixes := maps.Keys(routes)
+	slices.Sort(suffixes)
+	for _, suffix := range suffixes {
+		rs := routes[suffix]
+		if len(rs) == 0 {
+			fmt.Fprintf(w, "  %s\t(MagicDNS)\n", suffix)
+			continue
+		}
+		fmt.Fprintf(w, "  %s\t%s\n", suffix, resolverList(rs))
+	}
+	w.Flush()
+}
+
+func resolverList(rs []*dnstype.Resolver) string {
+	var addrs []string
+	for _, r := range rs {
+		addrs = append(addrs, r.Addr)
+	}
+	return strings.Join(addrs, ", ")
+}
+
+var dnsQueryCmd = &ffcli.Command{
+	Name:       "query",
+	ShortUsage: "dns query <name> [a|aaaa|cname|mx|ns|ptr|soa|srv|txt|any]",
+	ShortHelp:  "Perform a DNS query",
+	LongHelp: strings.TrimSpace(`
+'tailscale dns query' looks up a name using Tailscale's internal DNS resolver
+(100.100.100.100) and prints the answer, along with the upstream resolvers
+that the query is forwarded to if it's not answered by MagicDNS.
+
+The record type defaults to A.
+`),
+	Exec: runDNSQuery,
+}
+
+func runDNSQuery(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing name to query")
+	}
+	if len(args) > 2 {
+		return errors.New("too many arguments, expected a name and optional record type")
+	}
+	name := args[0]
+	queryType := "A"
+	if len(args) == 2 {
+		queryType = strings.ToUpper(args[1])
+	}
+	printf("DNS query for %q (%s) using internal resolver:\n\n", name, queryType)
+	res, resolvers, err := localClient.QueryDNS(ctx, name, queryType)
+	if err != nil {
+		return err
+	}
+
+	if len(resolvers) == 0 {
+		outln("Forwarding to: (none; answered by MagicDNS)")
+	} else {
+		outln("Forwarding to:")
+		for _, r := range resolvers {
+			printf("  - %s\n", r.Addr)
+		}
+	}
+	outln()
+
+	var p dnsmessage.Parser
+	hdr, err := p.Start(res)
+	if err != nil {
+		return fmt.Errorf("failed to parse DNS response: %w", err)
+	}
+	printf("Response code: %s\n", strings.TrimPrefix(hdr.RCode.String(), "RCode"))
+	if err := p.SkipAllQuestions(); err != nil {
+		return fmt.Errorf("failed to parse DNS response: %w", err)
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return fmt.Errorf("failed to parse DNS response: %w", err)
+	}
+	if len(answers) == 0 {
+		outln("No answers.")
+		return nil
+	}
+	outln()
+	w := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintf(w, "Name\tTTL\tClass\tType\tBody\n")
+	fmt.Fprintf(w, "----\t---\t-----\t----\t----\n")
+	for _, a := range answers {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n",
+			a.Header.Name,
+			a.Header.TTL,
+			strings.TrimPrefix(a.Header.Class.String(), "Class"),
+			strings.TrimPrefix(a.Header.Type.String(), "Type"),
+			dnsRecordBody(a.Body))
+	}
+	return w.Flush()
+}
+
+// dnsRecordBody returns a human-readable form of a DNS resource record's
+// data.
+func dnsRecordBody(b dnsmessage.ResourceBody) string {
+	switch r := b.(type) {
+	case *dnsmessage.AResource:
+		return netip.AddrFrom4(r.A).String()
+	case *dnsmessage.AAAAResource:
+		return netip.AddrFrom16(r.AAAA).String()
+	case *dnsmessage.CNAMEResource:
+		return r.CNAME.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", r.Pref, r.MX)
+	case *dnsmessage.NSResource:
+		return r.NS.String()
+	case *dnsmessage.PTRResource:
+		return r.PTR.String()
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d", r.NS, r.MBox, r.Serial)
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, r.Target)
+	case *dnsmessage.TXTResource:
+		return strings.Join(r.TXT, " ")
+	default:
+		return b.GoString()
+	}
+}
@@ -6,10 +6,13 @@
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"mime"
 	"net/http"
@@ -26,6 +29,7 @@
 	"github.com/mattn/go-isatty"
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"golang.org/x/time/rate"
+	"tailscale.com/client/tailscale"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/envknob"
 	"tailscale.com/net/tsaddr"
@@ -63,12 +67,12 @@ func (c *countingReader) Read(buf []byte) (int, error) {
 
 var fileCpCmd = &ffcli.Command{
 	Name:       "cp",
-	ShortUsage: "file cp <files...> <target>:",
-	ShortHelp:  "Copy file(s) to a host",
+	ShortUsage: "file cp <files-or-dirs...> <target>:",
+	ShortHelp:  "Copy file(s) or directories to a host",
 	Exec:       runCp,
 	FlagSet: (func() *flag.FlagSet {
 		fs := newFlagSet("cp")
-		fs.StringVar(&cpArgs.name, "name", "", "alternate filename to use, especially useful when <file> is \"-\" (stdin)")
+		fs.StringVar(&cpArgs.name, "name", "", "alternate file or directory name to use, especially useful when <file> is \"-\" (stdin)")
 		fs.BoolVar(&cpArgs.verbose, "verbose", false, "verbose output")
 		fs.BoolVar(&cpArgs.targets, "targets", false, "list possible file cp targets")
 		return fs
@@ -128,67 +132,141 @@ func runCp(ctx context.Context, args []string) error {
 	}
 
 	for _, fileArg := range files {
-		var fileContents *countingReader
-		var name = cpArgs.name
-		var contentLength int64 = -1
 		if fileArg == "-" {
-			fileContents = &countingReader{Reader: os.Stdin}
+			fileContents := &countingReader{Reader: os.Stdin}
+			name := cpArgs.name
 			if name == "" {
 				name, fileContents, err = pickStdinFilename()
 				if err != nil {
 					return err
 				}
 			}
-		} else {
-			f, err := os.Open(fileArg)
-			if err != nil {
-				if version.IsSandboxedMacOS() {
-					return errors.New("the GUI version of Tailscale on macOS runs in a macOS sandbox that can't read files")
-				}
+			if err := pushFile(ctx, stableID, name, -1, fileContents, tailscale.PushFileOpts{}); err != nil {
 				return err
 			}
-			defer f.Close()
-			fi, err := f.Stat()
-			if err != nil {
+			continue
+		}
+		fi, err := os.Stat(fileArg)
+		if err != nil {
+			if version.IsSandboxedMacOS() {
+				return errors.New("the GUI version of Tailscale on macOS runs in a macOS sandbox that can't read files")
+			}
+			return err
+		}
+		name := cpArgs.name
+		if name == "" {
+			name = filepath.Base(fileArg)
+		}
+		if !fi.IsDir() {
+			if err := pushLocalFile(ctx, stableID, fileArg, name); err != nil {
 				return err
 			}
-			if fi.IsDir() {
-				return errors.New("directories not supported")
+			continue
+		}
+		err = filepath.WalkDir(fileArg, func(p string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return err
 			}
-			contentLength = fi.Size()
-			fileContents = &countingReader{Reader: io.LimitReader(f, contentLength)}
-			if name == "" {
-				name = filepath.Base(fileArg)
+			if !de.Type().IsRegular() {
+				if !de.IsDir() && cpArgs.verbose {
+					log.Printf("skipping non-regular file %q", p)
+				}
+				return nil
 			}
-
-			if envknob.Bool("TS_DEBUG_SLOW_PUSH") {
-				fileContents = &countingReader{Reader: &slowReader{r: fileContents}}
+			rel, err := filepath.Rel(fileArg, p)
+			if err != nil {
+				return err
 			}
+			return pushLocalFile(ctx, stableID, p, path.Join(name, filepath.ToSlash(rel)))
+		})
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		if cpArgs.verbose {
-			log.Printf("sending %q to %v/%v/%v ...", name, target, ip, stableID)
-		}
+// pushLocalFile sends the local file at filePath to target as name,
+// resuming an earlier interrupted transfer of the same file if possible.
+// The target verifies the file's SHA-256.
+func pushLocalFile(ctx context.Context, target tailcfg.StableNodeID, filePath, name string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
 
-		var (
-			done = make(chan struct{}, 1)
-			wg   sync.WaitGroup
-		)
-		if isatty.IsTerminal(os.Stderr.Fd()) {
-			go printProgress(&wg, done, fileContents, name, contentLength)
-			wg.Add(1)
-		}
+	// Ask the target how much of the file it already has. Failure just
+	// means starting from scratch; old versions don't support resuming.
+	var offset int64
+	var wantPrefixSum string
+	if p, err := localClient.PartialFile(ctx, target, name); err == nil && p.Offset > 0 && p.Offset <= size {
+		offset, wantPrefixSum = p.Offset, p.SHA256
+	}
 
-		err := localClient.PushFile(ctx, stableID, contentLength, name, fileContents)
-		if err != nil {
-			return err
-		}
+	// Hash the whole file and, at the same time, the prefix the target
+	// has, to check that it's the start of this same file.
+	sum := sha256.New()
+	prefixSum := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(sum, prefixSum), f, offset); err != nil {
+		return err
+	}
+	if offset > 0 && hex.EncodeToString(prefixSum.Sum(nil)) != wantPrefixSum {
 		if cpArgs.verbose {
-			log.Printf("sent %q", name)
+			log.Printf("partial %q on target doesn't match; sending from start", name)
 		}
-		done <- struct{}{}
-		wg.Wait()
+		offset = 0
+	}
+	if _, err := io.Copy(sum, f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if offset > 0 && cpArgs.verbose {
+		log.Printf("resuming %q at byte %d", name, offset)
 	}
+
+	var r io.Reader = io.LimitReader(f, size-offset)
+	if envknob.Bool("TS_DEBUG_SLOW_PUSH") {
+		r = &slowReader{r: r}
+	}
+	return pushFile(ctx, target, name, size-offset, &countingReader{Reader: r}, tailscale.PushFileOpts{
+		Offset: offset,
+		SHA256: hex.EncodeToString(sum.Sum(nil)),
+	})
+}
+
+// pushFile sends contentLength bytes (or -1 for unknown) from r to target
+// as name, printing progress if stderr is a terminal.
+func pushFile(ctx context.Context, target tailcfg.StableNodeID, name string, contentLength int64, r *countingReader, opts tailscale.PushFileOpts) error {
+	if cpArgs.verbose {
+		log.Printf("sending %q to %v ...", name, target)
+	}
+
+	var (
+		done = make(chan struct{}, 1)
+		wg   sync.WaitGroup
+	)
+	if isatty.IsTerminal(os.Stderr.Fd()) {
+		go printProgress(&wg, done, r, name, contentLength)
+		wg.Add(1)
+	}
+
+	err := localClient.PushFileWithOpts(ctx, target, contentLength, name, r, opts)
+	if err != nil {
+		return err
+	}
+	if cpArgs.verbose {
+		log.Printf("sent %q", name)
+	}
+	done <- struct{}{}
+	wg.Wait()
 	return nil
 }
 
@@ -458,12 +536,24 @@ func openFileOrSubstitute(dir, base string, action onConflict) (*os.File, error)
 }
 
 func receiveFile(ctx context.Context, wf apitype.WaitingFile, dir string) (targetFile string, size int64, err error) {
+	// Files from directory transfers have slash-separated names.
+	// The daemon validates them, but be paranoid.
+	if !fs.ValidPath(wf.Name) || strings.Contains(wf.Name, `\`) {
+		return "", 0, fmt.Errorf("bad inbox file name %q", wf.Name)
+	}
 	rc, size, err := localClient.GetWaitingFile(ctx, wf.Name)
 	if err != nil {
 		return "", 0, fmt.Errorf("opening inbox file %q: %w", wf.Name, err)
 	}
 	defer rc.Close()
-	f, err := openFileOrSubstitute(dir, wf.Name, getArgs.conflict)
+	subDir, base := path.Split(wf.Name)
+	if subDir != "" {
+		dir = filepath.Join(dir, filepath.FromSlash(subDir))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", 0, err
+		}
+	}
+	f, err := openFileOrSubstitute(dir, base, getArgs.conflict)
 	if err != nil {
 		return "", 0, err
 	}
@@ -4,6 +4,7 @@
 package cli
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"flag"
@@ -11,11 +12,14 @@
 	"io"
 	"log"
 	"net/http"
+	"slices"
 	"sort"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	xmaps "golang.org/x/exp/maps"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn"
 	"tailscale.com/net/netcheck"
@@ -36,6 +40,7 @@
 		fs.StringVar(&netcheckArgs.format, "format", "", `output format; empty (for human-readable), "json" or "json-line"`)
 		fs.DurationVar(&netcheckArgs.every, "every", 0, "if non-zero, do an incremental report with the given frequency")
 		fs.BoolVar(&netcheckArgs.verbose, "verbose", false, "verbose logs")
+		fs.BoolVar(&netcheckArgs.history, "history", false, "summarize the reports recently made by tailscaled, rather than making a new one")
 		return fs
 	})(),
 }
@@ -44,9 +49,13 @@
 	format  string
 	every   time.Duration
 	verbose bool
+	history bool
 }
 
 func runNetcheck(ctx context.Context, args []string) error {
+	if netcheckArgs.history {
+		return runNetcheckHistory(ctx)
+	}
 	logf := logger.WithPrefix(log.Printf, "portmap: ")
 	netMon, err := netmon.New(logf)
 	if err != nil {
@@ -142,6 +151,8 @@ func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	}
 	printf("\t* MappingVariesByDestIP: %v\n", report.MappingVariesByDestIP)
 	printf("\t* HairPinning: %v\n", report.HairPinning)
+	printf("\t* NATMapping: %v\n", natBehavior(report.NATMapping))
+	printf("\t* NATFiltering: %v\n", natBehavior(report.NATFiltering))
 	printf("\t* PortMapping: %v\n", portMapping(report))
 	if report.CaptivePortal != "" {
 		printf("\t* CaptivePortal: %v\n", report.CaptivePortal)
@@ -204,6 +215,130 @@ func portMapping(r *netcheck.Report) string {
 	return strings.Join(got, ", ")
 }
 
+// runNetcheckHistory prints a summary of tailscaled's recent netcheck
+// reports: when the network changed or UDP failed, and percentiles of the
+// latency to each DERP region.
+func runNetcheckHistory(ctx context.Context) error {
+	hist, err := localClient.NetcheckHistory(ctx)
+	if err != nil {
+		return err
+	}
+	switch netcheckArgs.format {
+	case "":
+	case "json":
+		j, err := json.MarshalIndent(hist, "", "\t")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	case "json-line":
+		for _, e := range hist {
+			j, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			outln(string(j))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", netcheckArgs.format)
+	}
+	if len(hist) == 0 {
+		outln("No netcheck reports yet.")
+		return nil
+	}
+	dm, err := localClient.CurrentDERPMap(ctx)
+	if err != nil {
+		return err
+	}
+
+	first, last := hist[0].Time, hist[len(hist)-1].Time
+	printf("History of %d reports, %v to %v (%v):\n", len(hist),
+		first.Local().Format(time.DateTime), last.Local().Format(time.DateTime), last.Sub(first).Round(time.Second))
+
+	var linkChanges, udpFailures []string
+	var derpChanges int
+	latencies := map[int][]time.Duration{} // by region ID
+	for i, e := range hist {
+		when := e.Time.Local().Format(time.TimeOnly)
+		if e.LinkChange {
+			linkChanges = append(linkChanges, when)
+		}
+		if !e.UDP {
+			udpFailures = append(udpFailures, when)
+		}
+		if i > 0 && e.PreferredDERP != hist[i-1].PreferredDERP {
+			derpChanges++
+		}
+		for rid, d := range e.RegionLatency {
+			latencies[rid] = append(latencies[rid], d)
+		}
+	}
+	printf("\t* Link changes: %v\n", timesSummary(linkChanges))
+	printf("\t* UDP failures: %v\n", timesSummary(udpFailures))
+	printf("\t* Nearest DERP changes: %d\n", derpChanges)
+	if len(latencies) == 0 {
+		printf("\t* DERP latency: unknown (no response to latency probes)\n")
+		return nil
+	}
+	printf("\t* DERP latency:\n")
+
+	rids := xmaps.Keys(latencies)
+	for _, ds := range latencies {
+		slices.Sort(ds)
+	}
+	slices.SortFunc(rids, func(a, b int) int {
+		return cmp.Compare(latencyPercentile(latencies[a], 50), latencyPercentile(latencies[b], 50))
+	})
+	w := tabwriter.NewWriter(Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "\t\tREGION\tREPORTS\tP50\tP90\tP99\tMAX\n")
+	for _, rid := range rids {
+		ds := latencies[rid]
+		name := fmt.Sprint(rid)
+		if r := dm.Regions[rid]; r != nil {
+			name = fmt.Sprintf("%s (%s)", r.RegionCode, r.RegionName)
+		}
+		fmt.Fprintf(w, "\t\t%s\t%d\t%v\t%v\t%v\t%v\n", name, len(ds),
+			latencyPercentile(ds, 50).Round(time.Millisecond/10),
+			latencyPercentile(ds, 90).Round(time.Millisecond/10),
+			latencyPercentile(ds, 99).Round(time.Millisecond/10),
+			ds[len(ds)-1].Round(time.Millisecond/10))
+	}
+	return w.Flush()
+}
+
+// timesSummary returns a summary of the times when some event happened.
+func timesSummary(times []string) string {
+	const maxShown = 5
+	switch {
+	case len(times) == 0:
+		return "none"
+	case len(times) > maxShown:
+		return fmt.Sprintf("%d, most recently at %s", len(times), strings.Join(times[len(times)-maxShown:], ", "))
+	}
+	return fmt.Sprintf("%d, at %s", len(times), strings.Join(times, ", "))
+}
+
+// latencyPercentile returns the pth percentile of the sorted latencies
+// ds, using the nearest-rank method.
+func latencyPercentile(ds []time.Duration, p int) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	i := (len(ds)*p+99)/100 - 1
+	return ds[max(i, 0)]
+}
+
+// natBehavior returns a description of b, a NAT behavior as classified by
+// netcheck.
+func natBehavior(b netcheck.NATBehavior) string {
+	if b == "" {
+		return "unknown"
+	}
+	return string(b)
+}
+
 func prodDERPMap(ctx context.Context, httpc *http.Client) (*tailcfg.DERPMap, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", ipn.DefaultControlURL+"/derpmap/default", nil)
 	if err != nil {
@@ -11,7 +11,9 @@
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -22,6 +24,7 @@
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
@@ -40,10 +43,11 @@ func newServeCommand(e *serveEnv) *ffcli.Command {
 		Name:      "serve",
 		ShortHelp: "Serve content and local servers",
 		ShortUsage: strings.Join([]string{
-			"serve http:<port> <mount-point> <source> [off]",
-			"serve https:<port> <mount-point> <source> [off]",
+			"serve [flags] http:<port> <mount-point> <source> [off]",
+			"serve [flags] https:<port> <mount-point> <source> [off]",
 			"serve tcp:<port> tcp://localhost:<local-port> [off]",
 			"serve tls-terminated-tcp:<port> tcp://localhost:<local-port> [off]",
+			"serve [flags] udp:<port> udp://localhost:<local-port> [off]",
 			"serve status [--json]",
 			"serve reset",
 		}, "\n  "),
@@ -73,6 +77,14 @@ func newServeCommand(e *serveEnv) *ffcli.Command {
   - To serve simple static text:
     $ tailscale serve https:8080 / text:"Hello, world!"
 
+  - To redirect requests elsewhere, optionally keeping the request URI:
+    $ tailscale serve --redirect-code=301 https /old/ redirect:'https://${HOST}/new${REQUEST_URI}'
+
+  - To only allow some users, groups, or tagged nodes, and set a header on
+    every response:
+    $ tailscale serve --allow=alice@example.com,group:eng,tag:ci \
+        --set-header="Cache-Control: no-store" https / http://127.0.0.1:3000
+
   - To serve over HTTP (tailnet only):
     $ tailscale serve http:80 / http://127.0.0.1:3000
 
@@ -86,9 +98,22 @@ func newServeCommand(e *serveEnv) *ffcli.Command {
   - To accept TCP TLS connections (terminated within tailscaled) proxied to a
     local plaintext server on port 80:
     $ tailscale serve tls-terminated-tcp:443 tcp://localhost:80
+
+  - To forward incoming UDP datagrams on port 53 to a local DNS server on
+    port 5353:
+    $ tailscale serve udp:53 udp://localhost:5353
 `),
 		Exec:      e.runServe,
 		UsageFunc: usageFunc,
+		FlagSet: e.newFlags("serve", func(fs *flag.FlagSet) {
+			fs.Var(&e.headers, "set-header", `static response header "Name: value" to set on web handlers; may be repeated`)
+			fs.IntVar(&e.redirectCode, "redirect-code", 0, "HTTP status code for redirect: sources; 301, 302, 303, 307 or 308, or 0 for 302")
+			fs.BoolVar(&e.noListing, "no-listing", false, "don't list the contents of directories without an index.html when serving a path")
+			fs.BoolVar(&e.noStripPrefix, "no-strip-prefix", false, "don't trim the mount point from request paths when proxying")
+			fs.StringVar(&e.allowFrom, "allow", "", "comma-separated login names, group:s or tag:s to restrict web handlers to; other requests get a 403")
+			fs.DurationVar(&e.udpIdleTimeout, "idle-timeout", 0, "how long a UDP flow may be idle before it's closed, or 0 for 2m")
+			fs.BoolVar(&e.bindSourcePort, "bind-source-port", false, "bind each UDP flow's local socket to the same port number as the client's source port, if free; the backend still sees a local source address")
+		}),
 		Subcommands: []*ffcli.Command{
 			{
 				Name:      "status",
@@ -146,7 +171,15 @@ type localServeClient interface {
 // It also contains the flags, as registered with newServeCommand.
 type serveEnv struct {
 	// flags
-	json bool // output JSON (status only for now)
+	json          bool        // output JSON (status only for now)
+	headers       headerFlags // static response headers (web only)
+	redirectCode  int         // status code for redirects (web only)
+	noListing     bool        // disable directory listings (web only)
+	noStripPrefix bool        // keep the mount point when proxying (web only)
+	allowFrom     string      // comma-separated identities to allow (web only)
+
+	udpIdleTimeout time.Duration // idle timeout for UDP flows (udp only)
+	bindSourcePort bool          // bind to the client's source port number (udp only)
 
 	lc localServeClient // localClient interface, specific to serve
 
@@ -188,6 +221,28 @@ func (e *serveEnv) getLocalClientStatusWithoutPeers(ctx context.Context) (*ipnst
 	return st, nil
 }
 
+// headerFlags is a flag.Value that collects repeated "Name: value" headers.
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	var ss []string
+	for k, v := range h {
+		ss = append(ss, k+": "+v)
+	}
+	sort.Strings(ss)
+	return strings.Join(ss, ", ")
+}
+
+func (h *headerFlags) Set(s string) error {
+	k, v, ok := strings.Cut(s, ":")
+	k = strings.TrimSpace(k)
+	if !ok || k == "" || strings.ContainsAny(k, " \t") {
+		return fmt.Errorf("invalid header %q; want \"Name: value\"", s)
+	}
+	mak.Set((*map[string]string)(h), http.CanonicalHeaderKey(k), strings.TrimSpace(v))
+	return nil
+}
+
 // runServe is the entry point for the "serve" subcommand, managing Web
 // serve config types like proxy, path, and text.
 //
@@ -196,8 +251,10 @@ func (e *serveEnv) getLocalClientStatusWithoutPeers(ctx context.Context) (*ipnst
 // - tailscale serve https / http://localhost:3000
 // - tailscale serve https /images/ /var/www/images/
 // - tailscale serve https:10000 /motd.txt text:"Hello, world!"
+// - tailscale serve https /old/ redirect:https://example.com/
 // - tailscale serve tcp:2222 tcp://localhost:22
 // - tailscale serve tls-terminated-tcp:443 tcp://localhost:80
+// - tailscale serve udp:53 udp://localhost:5353
 func (e *serveEnv) runServe(ctx context.Context, args []string) error {
 	if len(args) == 0 {
 		return flag.ErrHelp
@@ -273,9 +330,14 @@ func (e *serveEnv) runServe(ctx context.Context, args []string) error {
 			return e.handleTCPServeRemove(ctx, srcPort)
 		}
 		return e.handleTCPServe(ctx, srcType, srcPort, args[1])
+	case "udp":
+		if turnOff {
+			return e.handleUDPServeRemove(ctx, srcPort)
+		}
+		return e.handleUDPServe(ctx, srcPort, args[1])
 	default:
 		fmt.Fprintf(os.Stderr, "error: invalid serve type %q\n", srcType)
-		fmt.Fprint(os.Stderr, "must be one of: http:<port>, https:<port>, tcp:<port> or tls-terminated-tcp:<port>\n\n", srcType)
+		fmt.Fprint(os.Stderr, "must be one of: http:<port>, https:<port>, tcp:<port>, tls-terminated-tcp:<port> or udp:<port>\n\n", srcType)
 		return flag.ErrHelp
 	}
 }
@@ -288,6 +350,7 @@ func (e *serveEnv) runServe(ctx context.Context, args []string) error {
 //   - tailscale serve https / http://localhost:3000
 //   - tailscale serve https:8443 /files/ /home/alice/shared-files/
 //   - tailscale serve https:10000 /motd.txt text:"Hello, world!"
+//   - tailscale serve https /old/ redirect:https://example.com/
 func (e *serveEnv) handleWebServe(ctx context.Context, srvPort uint16, useTLS bool, mount, source string) error {
 	h := new(ipn.HTTPHandler)
 
@@ -299,6 +362,21 @@ func (e *serveEnv) handleWebServe(ctx context.Context, srvPort uint16, useTLS bo
 			return errors.New("unable to serve; text cannot be an empty string")
 		}
 		h.Text = text
+	case ts == "redirect":
+		target := strings.TrimPrefix(source, "redirect:")
+		if target == "" {
+			return errors.New("unable to serve; redirect target cannot be empty")
+		}
+		// Check the target as it'll be after the placeholders that
+		// the server substitutes per request are expanded.
+		example := strings.NewReplacer(
+			"${HOST}", "example.com",
+			"${REQUEST_URI}", "/",
+		).Replace(target)
+		if _, err := url.Parse(example); err != nil {
+			return fmt.Errorf("invalid redirect target: %w", err)
+		}
+		h.Redirect = target
 	case isProxyTarget(source):
 		t, err := expandProxyTarget(source)
 		if err != nil {
@@ -327,6 +405,9 @@ func (e *serveEnv) handleWebServe(ctx context.Context, srvPort uint16, useTLS bo
 		}
 		h.Path = source
 	}
+	if err := e.applyWebHandlerFlags(h); err != nil {
+		return err
+	}
 
 	cursc, err := e.lc.GetServeConfig(ctx)
 	if err != nil {
@@ -379,6 +460,48 @@ func (e *serveEnv) handleWebServe(ctx context.Context, srvPort uint16, useTLS bo
 	return nil
 }
 
+// applyWebHandlerFlags sets the per-handler options given as flags on h,
+// whose source must already be set.
+func (e *serveEnv) applyWebHandlerFlags(h *ipn.HTTPHandler) error {
+	if e.redirectCode != 0 {
+		if h.Redirect == "" {
+			return errors.New("--redirect-code is only valid with a redirect: source")
+		}
+		if !ipn.ValidRedirectCode(e.redirectCode) {
+			return fmt.Errorf("invalid --redirect-code %d; must be one of 301, 302, 303, 307 or 308", e.redirectCode)
+		}
+		h.RedirectCode = e.redirectCode
+	}
+	if e.noListing {
+		if h.Path == "" {
+			return errors.New("--no-listing is only valid when serving a path")
+		}
+		h.NoListing = true
+	}
+	if e.noStripPrefix {
+		if h.Proxy == "" {
+			return errors.New("--no-strip-prefix is only valid when serving a proxy")
+		}
+		h.NoStripPrefix = true
+	}
+	if len(e.headers) > 0 {
+		h.Headers = maps.Clone(e.headers)
+	}
+	if e.allowFrom != "" {
+		for _, id := range strings.Split(e.allowFrom, ",") {
+			id = strings.TrimSpace(id)
+			if id == "" {
+				continue
+			}
+			if !strings.HasPrefix(id, "group:") && !strings.HasPrefix(id, "tag:") && !strings.Contains(id, "@") {
+				return fmt.Errorf("invalid --allow entry %q; must be a login name, group:name or tag:name", id)
+			}
+			h.AllowFrom = append(h.AllowFrom, id)
+		}
+	}
+	return nil
+}
+
 // isProxyTarget reports whether source is a valid proxy target.
 func isProxyTarget(source string) bool {
 	if strings.HasPrefix(source, "http://") ||
@@ -619,6 +742,83 @@ func (e *serveEnv) handleTCPServeRemove(ctx context.Context, src uint16) error {
 	return errors.New("error: serve config does not exist")
 }
 
+// handleUDPServe handles the "tailscale serve udp:..." subcommand. It
+// configures the serve config to forward UDP datagrams to the given
+// local port.
+//
+// Examples:
+//   - tailscale serve udp:53 udp://localhost:5353
+//   - tailscale serve --idle-timeout=30s udp:514 localhost:514
+func (e *serveEnv) handleUDPServe(ctx context.Context, srcPort uint16, dest string) error {
+	if !strings.Contains(dest, "://") {
+		if allNumeric(dest) {
+			dest = "localhost:" + dest
+		}
+		dest = "udp://" + dest
+	}
+	dstURL, err := url.Parse(dest)
+	if err != nil || dstURL.Scheme != "udp" {
+		fmt.Fprintf(os.Stderr, "error: invalid UDP target %q\n\n", dest)
+		return flag.ErrHelp
+	}
+	switch dstURL.Hostname() {
+	case "localhost", "127.0.0.1":
+		// ok
+	default:
+		fmt.Fprintf(os.Stderr, "error: invalid UDP target %q\n", dest)
+		fmt.Fprint(os.Stderr, "must be one of: localhost or 127.0.0.1\n\n")
+		return flag.ErrHelp
+	}
+	dstPortStr := dstURL.Port()
+	if p, err := strconv.ParseUint(dstPortStr, 10, 16); p == 0 || err != nil {
+		fmt.Fprintf(os.Stderr, "error: invalid port %q\n\n", dstPortStr)
+		return flag.ErrHelp
+	}
+	if e.udpIdleTimeout < 0 || (e.udpIdleTimeout > 0 && e.udpIdleTimeout < time.Second) {
+		return fmt.Errorf("invalid --idle-timeout %v; must be at least 1s", e.udpIdleTimeout)
+	}
+
+	cursc, err := e.lc.GetServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sc := cursc.Clone() // nil if no config
+	if sc == nil {
+		sc = new(ipn.ServeConfig)
+	}
+	mak.Set(&sc.UDP, srcPort, &ipn.UDPPortHandler{
+		Forward:        "127.0.0.1:" + dstPortStr,
+		IdleTimeoutSec: int(e.udpIdleTimeout / time.Second),
+		BindSourcePort: e.bindSourcePort,
+	})
+
+	if !reflect.DeepEqual(cursc, sc) {
+		if err := e.lc.SetServeConfig(ctx, sc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleUDPServeRemove removes the UDP forwarding configuration for the
+// given serving port.
+func (e *serveEnv) handleUDPServeRemove(ctx context.Context, src uint16) error {
+	cursc, err := e.lc.GetServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sc := cursc.Clone() // nil if no config
+	if sc.GetUDPPortHandler(src) == nil {
+		return errors.New("error: serve config does not exist")
+	}
+	delete(sc.UDP, src)
+	// clear map mostly for testing
+	if len(sc.UDP) == 0 {
+		sc.UDP = nil
+	}
+	return e.lc.SetServeConfig(ctx, sc)
+}
+
 // runServeStatus is the entry point for the "serve status"
 // subcommand and prints the current serve config.
 //
@@ -640,7 +840,7 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 		return nil
 	}
 	printFunnelStatus(ctx)
-	if sc == nil || (len(sc.TCP) == 0 && len(sc.Web) == 0 && len(sc.AllowFunnel) == 0) {
+	if sc == nil || (len(sc.TCP) == 0 && len(sc.UDP) == 0 && len(sc.Web) == 0 && len(sc.AllowFunnel) == 0) {
 		printf("No serve config\n")
 		return nil
 	}
@@ -654,6 +854,10 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 		}
 		printf("\n")
 	}
+	if len(sc.UDP) > 0 {
+		printUDPStatusTree(sc, st)
+		printf("\n")
+	}
 	for hp := range sc.Web {
 		err := e.printWebStatusTree(sc, hp)
 		if err != nil {
@@ -697,6 +901,23 @@ func printTCPStatusTree(ctx context.Context, sc *ipn.ServeConfig, st *ipnstate.S
 	return nil
 }
 
+func printUDPStatusTree(sc *ipn.ServeConfig, st *ipnstate.Status) {
+	dnsName := strings.TrimSuffix(st.Self.DNSName, ".")
+	ports := make([]uint16, 0, len(sc.UDP))
+	for p := range sc.UDP {
+		ports = append(ports, p)
+	}
+	slices.Sort(ports)
+	for _, p := range ports {
+		h := sc.UDP[p]
+		printf("|-- udp://%s (tailnet only, idle timeout %v)\n", net.JoinHostPort(dnsName, strconv.Itoa(int(p))), h.IdleTimeout())
+		for _, a := range st.TailscaleIPs {
+			printf("|-- udp://%s\n", net.JoinHostPort(a.String(), strconv.Itoa(int(p))))
+		}
+		printf("|--> udp://%s\n", h.Forward)
+	}
+}
+
 func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) error {
 	// No-op if no serve config
 	if sc == nil {
@@ -736,6 +957,8 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 			return "proxy", h.Proxy
 		case h.Text != "":
 			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
+		case h.Redirect != "":
+			return "redir", h.Redirect
 		}
 		return "", ""
 	}
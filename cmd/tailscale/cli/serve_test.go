@@ -684,6 +684,112 @@ type step struct {
 		wantErr: anyErr(),
 	})
 
+	// per-handler options
+	add(step{reset: true})
+	add(step{
+		command: cmd("--redirect-code=301 https /old/ redirect:https://${HOST}/new${REQUEST_URI}"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/old/": {Redirect: "https://${HOST}/new${REQUEST_URI}", RedirectCode: 301},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--set-header=x-frame-options:DENY --allow=alice@example.com,group:eng,tag:ci --no-strip-prefix https /app http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/old/": {Redirect: "https://${HOST}/new${REQUEST_URI}", RedirectCode: 301},
+					"/app": {
+						Proxy:         "http://127.0.0.1:3000",
+						Headers:       map[string]string{"X-Frame-Options": "DENY"},
+						NoStripPrefix: true,
+						AllowFrom:     []string{"alice@example.com", "group:eng", "tag:ci"},
+					},
+				}},
+			},
+		},
+	})
+	add(step{ // redirect code without a redirect
+		command: cmd("--redirect-code=301 https / text:hi"),
+		wantErr: anyErr(),
+	})
+	add(step{ // invalid redirect code
+		command: cmd("--redirect-code=200 https / redirect:https://example.com/"),
+		wantErr: anyErr(),
+	})
+	add(step{ // listing option on a proxy
+		command: cmd("--no-listing https / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // bad identity
+		command: cmd("--allow=alice https / text:hi"),
+		wantErr: anyErr(),
+	})
+	add(step{ // bad header
+		command: cmd("--set-header=no-colon https / text:hi"),
+		wantErr: anyErr(),
+	})
+
+	// udp
+	add(step{reset: true})
+	add(step{
+		command: cmd("udp:53 udp://localhost:5353"),
+		want: &ipn.ServeConfig{
+			UDP: map[uint16]*ipn.UDPPortHandler{53: {Forward: "127.0.0.1:5353"}},
+		},
+	})
+	add(step{
+		command: cmd("--idle-timeout=30s --bind-source-port udp:514 514"),
+		want: &ipn.ServeConfig{
+			UDP: map[uint16]*ipn.UDPPortHandler{
+				53:  {Forward: "127.0.0.1:5353"},
+				514: {Forward: "127.0.0.1:514", IdleTimeoutSec: 30, BindSourcePort: true},
+			},
+		},
+	})
+	add(step{ // UDP and TCP ports are independent
+		command: cmd("tcp:53 tcp://localhost:5353"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{53: {TCPForward: "127.0.0.1:5353"}},
+			UDP: map[uint16]*ipn.UDPPortHandler{
+				53:  {Forward: "127.0.0.1:5353"},
+				514: {Forward: "127.0.0.1:514", IdleTimeoutSec: 30, BindSourcePort: true},
+			},
+		},
+	})
+	add(step{
+		command: cmd("udp:514 off"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{53: {TCPForward: "127.0.0.1:5353"}},
+			UDP: map[uint16]*ipn.UDPPortHandler{53: {Forward: "127.0.0.1:5353"}},
+		},
+	})
+	add(step{ // not served
+		command: cmd("udp:514 off"),
+		wantErr: anyErr(),
+	})
+	add(step{ // non-local target
+		command: cmd("udp:53 udp://somehost:53"),
+		wantErr: anyErr(),
+	})
+	add(step{ // invalid target port
+		command: cmd("udp:53 udp://localhost:0"),
+		wantErr: anyErr(),
+	})
+	add(step{ // wrong scheme
+		command: cmd("udp:53 tcp://localhost:53"),
+		wantErr: anyErr(),
+	})
+	add(step{ // idle timeout too small
+		command: cmd("--idle-timeout=10ms udp:53 53"),
+		wantErr: anyErr(),
+	})
+
 	lc := &fakeLocalServeClient{}
 	// And now run the steps above.
 	for i, st := range steps {
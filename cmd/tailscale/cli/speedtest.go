@@ -0,0 +1,188 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/speedtest"
+	"tailscale.com/tailcfg"
+)
+
+var speedtestCmd = &ffcli.Command{
+	Name:       "speedtest",
+	ShortUsage: "speedtest [flags] <hostname-or-IP>",
+	ShortHelp:  "Measure throughput to a peer over the tailnet",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale speedtest' command measures the upload and download
+throughput between this node and a peer, through WireGuard, and reports
+whether the traffic went over a direct path or DERP.
+
+The peer must be owned by the same user, or grant this node the
+"https://tailscale.com/cap/speedtest" peer capability in the tailnet
+policy file. A peer runs one test at a time.
+
+`),
+	Exec: runSpeedtest,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("speedtest")
+		fs.StringVar(&speedtestArgs.direction, "direction", "both", "direction to test: upload, download or both")
+		fs.DurationVar(&speedtestArgs.duration, "duration", speedtest.DefaultDuration, fmt.Sprintf("duration of each test, between %v and %v", speedtest.MinDuration, speedtest.MaxDuration))
+		fs.BoolVar(&speedtestArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var speedtestArgs struct {
+	direction string
+	duration  time.Duration
+	json      bool
+}
+
+// speedtestOutput is the JSON output of 'tailscale speedtest --json'.
+type speedtestOutput struct {
+	Peer     string
+	IP       netip.Addr
+	Path     string               // "direct" or "DERP"
+	Endpoint string               `json:",omitempty"` // for direct paths
+	DERP     string               `json:",omitempty"` // region code, for DERP paths
+	Download []speedtest.Result   `json:",omitempty"`
+	Upload   []speedtest.Result   `json:",omitempty"`
+	Ping     *ipnstate.PingResult `json:",omitempty"`
+}
+
+func runSpeedtest(ctx context.Context, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return errors.New("usage: speedtest [flags] <hostname-or-IP>")
+	}
+	var dirs []speedtest.Direction
+	switch speedtestArgs.direction {
+	case "both":
+		dirs = []speedtest.Direction{speedtest.Download, speedtest.Upload}
+	case "download":
+		dirs = []speedtest.Direction{speedtest.Download}
+	case "upload":
+		dirs = []speedtest.Direction{speedtest.Upload}
+	default:
+		return fmt.Errorf("invalid --direction %q; want upload, download or both", speedtestArgs.direction)
+	}
+	if d := speedtestArgs.duration; d < speedtest.MinDuration || d > speedtest.MaxDuration {
+		return fmt.Errorf("--duration must be within %v and %v", speedtest.MinDuration, speedtest.MaxDuration)
+	}
+
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	description, ok := isRunningOrStarting(st)
+	if !ok {
+		printf("%s\n", description)
+		os.Exit(1)
+	}
+
+	ipStr, self, err := tailscaleIPFromArg(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if self {
+		return fmt.Errorf("%v is a local Tailscale IP", ipStr)
+	}
+	ip, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		return err
+	}
+
+	out := speedtestOutput{IP: ip, Peer: args[0]}
+
+	// A disco ping both finds out the path to the peer and gives NAT
+	// traversal a head start before the test.
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	pr, err := localClient.Ping(pingCtx, ip, tailcfg.PingDisco)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("ping %v: %w", ip, err)
+	}
+	if pr.Err != "" {
+		return errors.New(pr.Err)
+	}
+	out.Ping = pr
+	if pr.NodeName != "" {
+		out.Peer = pr.NodeName
+	}
+	if pr.DERPRegionID != 0 {
+		out.Path = "DERP"
+		out.DERP = pr.DERPRegionCode
+	} else {
+		out.Path = "direct"
+		out.Endpoint = pr.Endpoint
+	}
+
+	if !speedtestArgs.json {
+		printf("Testing throughput to %s (%v) via %s\n", out.Peer, ip, speedtestPath(out))
+	}
+	for _, dir := range dirs {
+		if !speedtestArgs.json {
+			printf("\nStarting a %v %s test...\n", speedtestArgs.duration, dir)
+		}
+		res, err := localClient.Speedtest(ctx, ip, dir, speedtestArgs.duration)
+		if err != nil {
+			return fmt.Errorf("%s test: %w", dir, err)
+		}
+		if dir == speedtest.Download {
+			out.Download = res
+		} else {
+			out.Upload = res
+		}
+		if !speedtestArgs.json {
+			printSpeedtestResults(res)
+		}
+	}
+
+	if speedtestArgs.json {
+		j, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+	}
+	return nil
+}
+
+func speedtestPath(o speedtestOutput) string {
+	if o.Path == "DERP" {
+		return fmt.Sprintf("DERP(%s)", o.DERP)
+	}
+	return fmt.Sprintf("direct (%s)", o.Endpoint)
+}
+
+// printSpeedtestResults prints the per-interval results of a test, followed
+// by the total.
+func printSpeedtestResults(results []speedtest.Result) {
+	if len(results) == 0 {
+		outln("No results.")
+		return
+	}
+	w := tabwriter.NewWriter(Stdout, 12, 0, 0, ' ', tabwriter.TabIndent)
+	fmt.Fprintln(w, "Interval\t\tTransfer\t\tBandwidth\t\t")
+	startTime := results[0].IntervalStart
+	for _, r := range results {
+		if r.Total {
+			fmt.Fprintln(w, "-------------------------------------------------------------------------")
+		}
+		fmt.Fprintf(w, "%.2f-%.2f\tsec\t%.4f\tMBits\t%.4f\tMbits/sec\t\n", r.IntervalStart.Sub(startTime).Seconds(), r.IntervalEnd.Sub(startTime).Seconds(), r.MegaBits(), r.MBitsPerSecond())
+	}
+	w.Flush()
+}
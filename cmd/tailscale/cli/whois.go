@@ -0,0 +1,93 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/exp/maps"
+)
+
+var whoisCmd = &ffcli.Command{
+	Name:       "whois",
+	ShortUsage: "whois [--json] ip[:port]",
+	ShortHelp:  "Show the machine and user associated with a Tailscale IP (v4 or v6)",
+	LongHelp: strings.TrimSpace(`
+'tailscale whois' shows the machine and user associated with a Tailscale IP
+address, along with the capabilities that machine has been granted.
+`),
+	Exec: runWhoIs,
+	FlagSet: func() *flag.FlagSet {
+		fs := newFlagSet("whois")
+		fs.BoolVar(&whoIsArgs.json, "json", false, "output in JSON format")
+		return fs
+	}(),
+}
+
+var whoIsArgs struct {
+	json bool // output in JSON format
+}
+
+func runWhoIs(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errors.New("too many arguments, expected at most one peer")
+	} else if len(args) == 0 {
+		return errors.New("missing argument, expected one peer")
+	}
+	who, err := localClient.WhoIs(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if whoIsArgs.json {
+		ec := json.NewEncoder(Stdout)
+		ec.SetIndent("", "  ")
+		ec.Encode(who)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(Stdout, 10, 5, 5, ' ', 0)
+	fmt.Fprintf(w, "Machine:\n")
+	fmt.Fprintf(w, "  Name:\t%s\n", strings.TrimSuffix(who.Node.Name, "."))
+	fmt.Fprintf(w, "  ID:\t%s\n", who.Node.StableID)
+	for i, addr := range who.Node.Addresses {
+		if i == 0 {
+			fmt.Fprintf(w, "  Addresses:\t%s\n", addr.Addr())
+			continue
+		}
+		fmt.Fprintf(w, "\t%s\n", addr.Addr())
+	}
+	if len(who.Node.Tags) > 0 {
+		fmt.Fprintf(w, "  Tags:\t%s\n", strings.Join(who.Node.Tags, ", "))
+	}
+	if !who.Node.IsTagged() {
+		fmt.Fprintf(w, "User:\n")
+		fmt.Fprintf(w, "  Name:\t%s\n", who.UserProfile.LoginName)
+		fmt.Fprintf(w, "  ID:\t%d\n", who.UserProfile.ID)
+	}
+	w.Flush()
+
+	if len(who.CapMap) > 0 {
+		printf("Capabilities:\n")
+		caps := maps.Keys(who.CapMap)
+		slices.Sort(caps)
+		for _, cap := range caps {
+			// JSON encode the values to make them more readable.
+			b, err := json.Marshal(who.CapMap[cap])
+			if err != nil {
+				fmt.Fprintf(Stderr, "  - %s: %v\n", cap, err)
+				continue
+			}
+			printf("  - %s: %s\n", cap, b)
+		}
+	}
+	return nil
+}
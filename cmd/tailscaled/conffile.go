@@ -0,0 +1,80 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"tailscale.com/ipn/conffile"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/types/logger"
+)
+
+// confFilePollInterval is how often watchConfigFile checks whether the
+// config file has changed on disk.
+const confFilePollInterval = 5 * time.Second
+
+// watchConfigFile re-reads the config file that c was loaded from and
+// re-applies it to lb whenever tailscaled gets SIGHUP or the file changes
+// on disk, until ctx is done. If the new file is invalid, the previous
+// config stays in effect.
+func watchConfigFile(ctx context.Context, logf logger.Logf, lb *ipnlocal.LocalBackend, c *conffile.Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(confFilePollInterval)
+	defer ticker.Stop()
+
+	lastStat := statConfFile(c.Path)
+	for {
+		forced := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			forced = true
+		case <-ticker.C:
+		}
+		st := statConfFile(c.Path)
+		if !forced && st == lastStat {
+			continue
+		}
+		lastStat = st
+
+		nc, err := conffile.Load(c.Path)
+		if err != nil {
+			logf("config file reload failed, keeping previous config: %v", err)
+			continue
+		}
+		if !forced && nc.Equal(c) {
+			continue
+		}
+		if err := lb.SetConfigFile(nc); err != nil {
+			logf("config file reload failed: %v", err)
+			continue
+		}
+		c = nc
+		logf("config file %s reloaded", c.Path)
+	}
+}
+
+// confFileStat is the subset of a config file's metadata used to detect
+// changes.
+type confFileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+func statConfFile(path string) confFileStat {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return confFileStat{}
+	}
+	return confFileStat{modTime: fi.ModTime(), size: fi.Size()}
+}
@@ -32,6 +32,7 @@
 	"tailscale.com/cmd/tailscaled/childproc"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/envknob"
+	"tailscale.com/ipn/conffile"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/ipn/store"
@@ -136,6 +137,7 @@ func defaultPort() uint16 {
 	socksAddr      string // listen address for SOCKS5 server
 	httpProxyAddr  string // listen address for HTTP proxy server
 	disableLogs    bool
+	confFile       string // path to declarative config file; empty means none
 }
 
 var (
@@ -171,6 +173,7 @@ func main() {
 	flag.StringVar(&args.birdSocketPath, "bird-socket", "", "path of the bird unix socket")
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 	flag.BoolVar(&args.disableLogs, "no-logs-no-support", false, "disable log uploads; this also disables any technical support")
+	flag.StringVar(&args.confFile, "config", "", "path to a HuJSON config file declaring this node's preferences; fields it sets can't be changed with the CLI. Re-read on SIGHUP or when the file changes.")
 
 	if len(os.Args) > 0 && filepath.Base(os.Args[0]) == "tailscale" && beCLI != nil {
 		beCLI()
@@ -230,6 +233,15 @@ func main() {
 		envknob.SetNoLogsNoSupport()
 	}
 
+	if args.confFile != "" {
+		var err error
+		nodeConf, err = conffile.Load(args.confFile)
+		if err != nil {
+			log.SetFlags(0)
+			log.Fatalf("--config: %v", err)
+		}
+	}
+
 	if beWindowsSubprocess() {
 		return
 	}
@@ -328,6 +340,7 @@ func ipnServerOpts() (o serverOptions) {
 
 var logPol *logpolicy.Policy
 var debugMux *http.ServeMux
+var nodeConf *conffile.Config // or nil if --config wasn't provided
 
 func run() error {
 	var logf logger.Logf = log.Printf
@@ -503,6 +516,9 @@ func getLocalBackend(ctx context.Context, logf logger.Logf, logID logid.PublicID
 		dialer.NetstackDialTCP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
 			return ns.DialContextTCP(ctx, dst)
 		}
+		dialer.NetstackDialUDP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
+			return ns.DialContextUDP(ctx, dst)
+		}
 	}
 	if socksListener != nil || httpProxyListener != nil {
 		var addrs []string
@@ -552,6 +568,12 @@ func getLocalBackend(ctx context.Context, logf logger.Logf, logID logid.PublicID
 	if err := ns.Start(lb); err != nil {
 		log.Fatalf("failed to start netstack: %v", err)
 	}
+	if nodeConf != nil {
+		if err := lb.SetConfigFile(nodeConf); err != nil {
+			return nil, err
+		}
+		go watchConfigFile(ctx, logf, lb, nodeConf)
+	}
 	return lb, nil
 }
 
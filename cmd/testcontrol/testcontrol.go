@@ -8,6 +8,7 @@
 	"flag"
 	"log"
 	"net/http"
+	"os"
 	"testing"
 
 	"tailscale.com/tstest/integration"
@@ -16,7 +17,8 @@
 )
 
 var (
-	flagNFake = flag.Int("nfake", 0, "number of fake nodes to add to network")
+	flagNFake  = flag.Int("nfake", 0, "number of fake nodes to add to network")
+	flagPolicy = flag.String("policy", "", "optional path to a HuJSON tailnet policy file; if empty, all traffic is allowed")
 )
 
 func main() {
@@ -29,6 +31,17 @@ func main() {
 		DERPMap:         derpMap,
 		ExplicitBaseURL: "http://127.0.0.1:9911",
 	}
+	if *flagPolicy != "" {
+		b, err := os.ReadFile(*flagPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p, err := testcontrol.ParsePolicy(b)
+		if err != nil {
+			log.Fatalf("parsing %s: %v", *flagPolicy, err)
+		}
+		control.SetPolicy(p)
+	}
 	for i := 0; i < *flagNFake; i++ {
 		control.AddFakeNode()
 	}
@@ -0,0 +1,360 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/set"
+)
+
+// castHeader is the header line of an asciinema recording as written by
+// ssh/tailssh. It mirrors tailssh.CastHeader.
+type castHeader struct {
+	Version       int                  `json:"version"`
+	Width         int                  `json:"width"`
+	Height        int                  `json:"height"`
+	Timestamp     int64                `json:"timestamp"`
+	Env           map[string]string    `json:"env"`
+	Command       string               `json:"command,omitempty"`
+	SrcNode       string               `json:"srcNode"`
+	SrcNodeID     tailcfg.StableNodeID `json:"srcNodeID"`
+	SrcNodeTags   []string             `json:"srcNodeTags,omitempty"`
+	SrcNodeUserID tailcfg.UserID       `json:"srcNodeUserID,omitempty"`
+	SrcNodeUser   string               `json:"srcNodeUser,omitempty"`
+	SSHUser       string               `json:"sshUser"`
+	LocalUser     string               `json:"localUser"`
+	ConnectionID  string               `json:"connectionID"`
+}
+
+// maxHeaderSize is the maximum size of a recording's header line.
+const maxHeaderSize = 64 << 10
+
+// readCastHeader reads and parses the header line of a recording from br.
+// It returns the raw line, including its trailing newline.
+func readCastHeader(br *bufio.Reader) (line []byte, h castHeader, err error) {
+	for {
+		frag, err := br.ReadSlice('\n')
+		line = append(line, frag...)
+		if len(line) > maxHeaderSize {
+			return nil, h, errors.New("header too long")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, h, fmt.Errorf("reading header: %w", err)
+		}
+		break
+	}
+	if err := json.Unmarshal(line, &h); err != nil {
+		return nil, h, fmt.Errorf("parsing header: %w", err)
+	}
+	if h.Version != 2 {
+		return nil, h, fmt.Errorf("unsupported asciinema version %d", h.Version)
+	}
+	return line, h, nil
+}
+
+// Session is an entry in the recorder's index.
+type Session struct {
+	// ID is the name of the recording in the BlobStore.
+	ID string
+
+	// Start is when the session started.
+	Start time.Time
+
+	// Node and NodeID identify the node that the SSH connection came
+	// from. User is its owner's login name; it's empty if the node is
+	// tagged, in which case Tags is set. These are as reported by the
+	// SSH server in the recording's header.
+	Node   string
+	NodeID tailcfg.StableNodeID
+	User   string   `json:",omitempty"`
+	Tags   []string `json:",omitempty"`
+
+	// SSHUser is the username requested by the SSH client and LocalUser
+	// is the user the session ran as on the server.
+	SSHUser   string
+	LocalUser string
+	Command   string `json:",omitempty"`
+
+	// ServerID is the stable ID of the SSH server that uploaded the
+	// recording, as determined by the recorder, if known. Server is its
+	// name; it's only populated for recordings received since the
+	// recorder started.
+	ServerID tailcfg.StableNodeID `json:",omitempty"`
+	Server   string               `json:",omitempty"`
+
+	// Active is whether the recording is still being uploaded.
+	Active bool `json:",omitempty"`
+	// Size is the recording's size in bytes, if known.
+	Size int64 `json:",omitempty"`
+}
+
+func sessionFromHeader(id string, h castHeader) *Session {
+	return &Session{
+		ID:        id,
+		Start:     time.Unix(h.Timestamp, 0).UTC(),
+		Node:      h.SrcNode,
+		NodeID:    h.SrcNodeID,
+		User:      h.SrcNodeUser,
+		Tags:      h.SrcNodeTags,
+		SSHUser:   h.SSHUser,
+		LocalUser: h.LocalUser,
+		Command:   h.Command,
+	}
+}
+
+// recorder accepts SSH session recordings from ssh/tailssh, stores them in
+// a BlobStore, and indexes them.
+type recorder struct {
+	store BlobStore
+	logf  logger.Logf
+
+	// whoIs, if non-nil, is used to identify the node uploading a
+	// recording and peers using the web UI.
+	whoIs func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+	// uiAllow is the set of login names and tags of peers allowed to
+	// use the web UI.
+	uiAllow set.Set[string]
+
+	mu       sync.Mutex
+	sessions map[string]*Session // keyed by Session.ID
+}
+
+func newRecorder(store BlobStore, logf logger.Logf) *recorder {
+	return &recorder{
+		store:    store,
+		logf:     logf,
+		sessions: make(map[string]*Session),
+	}
+}
+
+// loadIndex populates the index from the recordings in the store.
+func (rec *recorder) loadIndex(ctx context.Context) error {
+	names, err := rec.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".cast") {
+			continue
+		}
+		s, err := rec.loadSession(ctx, name)
+		if err != nil {
+			rec.logf("skipping recording %q: %v", name, err)
+			continue
+		}
+		rec.mu.Lock()
+		if _, ok := rec.sessions[name]; !ok {
+			rec.sessions[name] = s
+		}
+		rec.mu.Unlock()
+	}
+	return nil
+}
+
+func (rec *recorder) loadSession(ctx context.Context, name string) (*Session, error) {
+	rc, err := rec.store.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	_, h, err := readCastHeader(bufio.NewReader(rc))
+	if err != nil {
+		return nil, err
+	}
+	s := sessionFromHeader(name, h)
+	if dir := path.Dir(name); dir != unknownServer && dir != "." {
+		s.ServerID = tailcfg.StableNodeID(dir)
+	}
+	if f, ok := rc.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if fi, err := f.Stat(); err == nil {
+			s.Size = fi.Size()
+		}
+	}
+	return s, nil
+}
+
+// Filter selects sessions from the index. Zero fields match everything.
+type Filter struct {
+	Node  string // node name or stable ID
+	User  string // login name of the node's owner, or a tag
+	Since time.Time
+	Until time.Time
+}
+
+func (f Filter) match(s *Session) bool {
+	if f.Node != "" && f.Node != s.Node && f.Node != string(s.NodeID) &&
+		!strings.HasPrefix(s.Node, f.Node+".") {
+		return false
+	}
+	if f.User != "" && f.User != s.User && !slices.Contains(s.Tags, f.User) {
+		return false
+	}
+	if !f.Since.IsZero() && s.Start.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !s.Start.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Sessions returns the indexed sessions matching f, newest first.
+func (rec *recorder) Sessions(f Filter) []*Session {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var ret []*Session
+	for _, s := range rec.sessions {
+		if f.match(s) {
+			c := *s
+			ret = append(ret, &c)
+		}
+	}
+	slices.SortFunc(ret, func(a, b *Session) int {
+		if c := b.Start.Compare(a.Start); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return ret
+}
+
+func (rec *recorder) session(id string) (Session, bool) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	s, ok := rec.sessions[id]
+	if !ok {
+		return Session{}, false
+	}
+	return *s, true
+}
+
+// unknownServer is the directory that recordings from an unidentified
+// server are stored in.
+const unknownServer = "unknown"
+
+// blobName returns the name to store a recording from the SSH server with
+// the given stable ID under. The server's ID is used, rather than the
+// client's from the recording's header, so that a server can't place its
+// recordings among another node's.
+func blobName(server tailcfg.StableNodeID, start time.Time) string {
+	dir := unknownServer
+	if server != "" {
+		dir = safeName(string(server))
+	}
+	var rnd [4]byte
+	rand.Read(rnd[:])
+	return fmt.Sprintf("%s/%s-%s.cast",
+		dir, start.UTC().Format("20060102T150405Z"), hex.EncodeToString(rnd[:]))
+}
+
+// safeName returns s with any characters unsuitable for a blob name path
+// element replaced by underscores.
+func safeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// serveRecord handles recording uploads from ssh/tailssh. The request body
+// is an asciinema cast that's streamed for the duration of the session.
+func (rec *recorder) serveRecord(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	var server *tailcfg.Node
+	if rec.whoIs != nil {
+		who, err := rec.whoIs(ctx, r.RemoteAddr)
+		if err != nil {
+			rec.logf("upload from %v: %v", r.RemoteAddr, err)
+			http.Error(w, "unknown peer", http.StatusForbidden)
+			return
+		}
+		server = who.Node
+	}
+	br := bufio.NewReader(r.Body)
+	line, h, err := readCastHeader(br)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start := time.Unix(h.Timestamp, 0)
+	if h.Timestamp == 0 {
+		start = time.Now()
+	}
+	var serverID tailcfg.StableNodeID
+	if server != nil {
+		serverID = server.StableID
+	}
+	name := blobName(serverID, start)
+	s := sessionFromHeader(name, h)
+	s.Start = start.UTC()
+	s.Active = true
+	if server != nil {
+		s.ServerID = server.StableID
+		s.Server = strings.TrimSuffix(server.Name, ".")
+	}
+
+	rec.mu.Lock()
+	rec.sessions[name] = s
+	rec.mu.Unlock()
+	rec.logf("recording %s: started; node=%q user=%q ssh-user=%q server=%q", name, s.Node, s.User, s.SSHUser, s.Server)
+
+	cr := &countingReader{r: br}
+	err = rec.store.Put(ctx, name, io.MultiReader(bytes.NewReader(line), cr))
+	size := int64(len(line)) + cr.n.Load()
+
+	rec.mu.Lock()
+	s.Active = false
+	s.Size = size
+	rec.mu.Unlock()
+
+	if err != nil {
+		rec.logf("recording %s: ended with error after %d bytes: %v", name, size, err)
+		http.Error(w, "error storing recording", http.StatusInternalServerError)
+		return
+	}
+	rec.logf("recording %s: done, %d bytes", name, size)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,264 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/set"
+)
+
+const testCast = `{"version":2,"width":80,"height":24,"timestamp":1672531200,"env":{"TERM":"xterm"},"srcNode":"laptop.tail-scale.ts.net","srcNodeID":"nLAPTOP","srcNodeUserID":1,"srcNodeUser":"alice@example.com","sshUser":"root","localUser":"root","connectionID":"c1"}
+[0.5,"o","hello\r\n"]
+[1.25,"o","world\r\n"]
+`
+
+func newTestRecorder(t *testing.T, dir string) *recorder {
+	t.Helper()
+	store, err := newDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRecorder(store, t.Logf)
+}
+
+// fakeWhoIs returns a whoIs func that identifies every peer as a node with
+// the given stable ID, owned by login or, if login has a "tag:" prefix,
+// tagged with it.
+func fakeWhoIs(id tailcfg.StableNodeID, login string) func(context.Context, string) (*apitype.WhoIsResponse, error) {
+	return func(context.Context, string) (*apitype.WhoIsResponse, error) {
+		res := &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{StableID: id, Name: strings.ToLower(string(id)) + ".tail-scale.ts.net."},
+			UserProfile: &tailcfg.UserProfile{LoginName: login},
+		}
+		if strings.HasPrefix(login, "tag:") {
+			res.Node.Tags = []string{login}
+			res.UserProfile.LoginName = "tagged-devices"
+		}
+		return res, nil
+	}
+}
+
+func TestRecord(t *testing.T) {
+	dir := t.TempDir()
+	rec := newTestRecorder(t, dir)
+	rec.whoIs = fakeWhoIs("nSERVER", "alice@example.com")
+	rec.uiAllow = set.Set[string]{"alice@example.com": {}}
+	ts := httptest.NewServer(rec.handler())
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/record", "application/octet-stream", strings.NewReader(testCast))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("upload status = %v", res.Status)
+	}
+
+	sessions := rec.Sessions(Filter{})
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions; want 1", len(sessions))
+	}
+	s := sessions[0]
+	if !strings.HasPrefix(s.ID, "nSERVER/20230101T000000Z-") {
+		t.Errorf("ID = %q", s.ID)
+	}
+	if s.Node != "laptop.tail-scale.ts.net" || s.User != "alice@example.com" || s.LocalUser != "root" {
+		t.Errorf("unexpected session: %+v", s)
+	}
+	if s.ServerID != "nSERVER" || s.Server != "nserver.tail-scale.ts.net" {
+		t.Errorf("ServerID, Server = %q, %q; want from WhoIs", s.ServerID, s.Server)
+	}
+	if s.Active || s.Size != int64(len(testCast)) {
+		t.Errorf("Active = %v, Size = %v; want false, %v", s.Active, s.Size, len(testCast))
+	}
+
+	res, err = http.Get(ts.URL + "/recordings/" + s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != testCast {
+		t.Errorf("downloaded recording = %q; want %q", got, testCast)
+	}
+
+	// A new recorder indexes what's on disk. Only the server's name is
+	// lost.
+	rec2 := newTestRecorder(t, dir)
+	if err := rec2.loadIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.Server = ""
+	sessions2 := rec2.Sessions(Filter{})
+	if len(sessions2) != 1 || !reflect.DeepEqual(sessions2[0], s) {
+		t.Errorf("reloaded sessions = %+v; want %+v", sessions2, s)
+	}
+}
+
+func TestRecordBadHeader(t *testing.T) {
+	rec := newTestRecorder(t, t.TempDir())
+	ts := httptest.NewServer(rec.handler())
+	defer ts.Close()
+
+	for _, body := range []string{
+		"not json\n",
+		`{"version":1}` + "\n",
+		`{"version":2}`, // no newline
+	} {
+		res, err := http.Post(ts.URL+"/record", "application/octet-stream", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("upload of %q: status = %v; want 400", body, res.Status)
+		}
+	}
+	if n := len(rec.Sessions(Filter{})); n != 0 {
+		t.Errorf("got %d sessions; want 0", n)
+	}
+}
+
+func TestRecordUnknownPeer(t *testing.T) {
+	rec := newTestRecorder(t, t.TempDir())
+	rec.whoIs = func(context.Context, string) (*apitype.WhoIsResponse, error) {
+		return nil, errors.New("no match for IP:port")
+	}
+	ts := httptest.NewServer(rec.handler())
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/record", "application/octet-stream", strings.NewReader(testCast))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("upload status = %v; want 403", res.Status)
+	}
+	if n := len(rec.Sessions(Filter{})); n != 0 {
+		t.Errorf("got %d sessions; want 0", n)
+	}
+}
+
+func TestUIAccess(t *testing.T) {
+	allow := set.Set[string]{"alice@example.com": {}, "tag:audit": {}}
+	tests := []struct {
+		name  string
+		login string // or tag; empty means no whoIs
+		allow set.Set[string]
+		want  int
+	}{
+		{"allowed-user", "alice@example.com", allow, http.StatusOK},
+		{"allowed-tag", "tag:audit", allow, http.StatusOK},
+		{"other-user", "bob@example.com", allow, http.StatusForbidden},
+		{"other-tag", "tag:web", allow, http.StatusForbidden},
+		{"no-allowlist", "alice@example.com", nil, http.StatusForbidden},
+		{"no-whois", "", allow, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := newTestRecorder(t, t.TempDir())
+			rec.uiAllow = tt.allow
+			if tt.login != "" {
+				rec.whoIs = fakeWhoIs("nPEER", tt.login)
+			}
+			h := rec.handler()
+			for _, path := range []string{"/", "/api/sessions", "/recordings/x.cast", "/play/x.cast"} {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+				got := w.Code
+				if got == http.StatusNotFound {
+					got = http.StatusOK // allowed, but no such recording
+				}
+				if got != tt.want {
+					t.Errorf("GET %s: status = %v; want %v", path, w.Code, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	rec := newTestRecorder(t, t.TempDir())
+	day := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, s := range []*Session{
+		{ID: "a", Start: day, Node: "laptop.example.ts.net", NodeID: "n1", User: "alice@example.com"},
+		{ID: "b", Start: day.Add(time.Hour), Node: "ci.example.ts.net", NodeID: "n2", Tags: []string{"tag:ci"}},
+		{ID: "c", Start: day.AddDate(0, 0, 2), Node: "laptop.example.ts.net", NodeID: "n1", User: "alice@example.com"},
+	} {
+		rec.sessions[s.ID] = s
+	}
+
+	ids := func(ss []*Session) string {
+		var ret []string
+		for _, s := range ss {
+			ret = append(ret, s.ID)
+		}
+		return strings.Join(ret, ",")
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"all", "", "c,b,a"},
+		{"node-short", "node=laptop", "c,a"},
+		{"node-id", "node=n2", "b"},
+		{"user", "user=alice@example.com", "c,a"},
+		{"tag", "user=tag:ci", "b"},
+		{"since", "since=2023-01-02", "c"},
+		{"until-date", "until=2023-01-01", "b,a"},
+		{"until-time", "until=2023-01-01T00:30:00Z", "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseFilter(httptest.NewRequest("GET", "/?"+tt.query, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(rec.Sessions(f)); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The JSON API uses the same filters.
+	w := httptest.NewRecorder()
+	rec.serveSessionsJSON(w, httptest.NewRequest("GET", "/api/sessions?user=tag:ci", nil))
+	var got []*Session
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if ids(got) != "b" {
+		t.Errorf("JSON API returned %q; want %q", ids(got), "b")
+	}
+}
+
+func TestDirStoreInvalidName(t *testing.T) {
+	store, err := newDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", ".", "../x.cast", "/abs.cast", `a\b.cast`} {
+		if err := store.Put(context.Background(), name, strings.NewReader("x")); err != errInvalidName {
+			t.Errorf("Put(%q) = %v; want errInvalidName", name, err)
+		}
+	}
+}
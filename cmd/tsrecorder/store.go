@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore is where recordings are stored.
+//
+// Blob names are slash-separated paths such as "nodeid/20230102T150405Z-x.cast".
+// Implementations for object stores (S3, GCS, etc) can be plugged in by
+// implementing this interface.
+type BlobStore interface {
+	// Put stores the contents of r as the blob named name, reading until
+	// r returns io.EOF or another error. Recordings are streamed for the
+	// duration of an SSH session, so Put may run for a long time.
+	//
+	// If r returns an error other than io.EOF, whatever was read so far
+	// should still be kept, and the error returned.
+	Put(ctx context.Context, name string, r io.Reader) error
+
+	// Get returns the contents of the named blob. It returns an error
+	// satisfying errors.Is(err, fs.ErrNotExist) if it doesn't exist.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// List returns the names of all stored blobs, in no particular order.
+	List(ctx context.Context) ([]string, error)
+}
+
+// dirStore is a BlobStore backed by a local directory.
+type dirStore struct {
+	dir string
+}
+
+// newDirStore returns a BlobStore that stores blobs as files under dir,
+// creating it if needed.
+func newDirStore(dir string) (*dirStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &dirStore{dir: dir}, nil
+}
+
+var errInvalidName = errors.New("invalid blob name")
+
+func (s *dirStore) path(name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." || strings.Contains(name, `\`) {
+		return "", errInvalidName
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+func (s *dirStore) Put(ctx context.Context, name string, r io.Reader) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *dirStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *dirStore) List(ctx context.Context) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	return names, err
+}
@@ -0,0 +1,80 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// The tsrecorder command is a Tailscale SSH session recorder. It joins the
+// tailnet with tsnet and accepts the asciinema recordings that Tailscale SSH
+// servers upload when an SSH policy rule lists it in "recorder". Recordings
+// are written to a local directory and can be listed and replayed in a
+// small web UI served on the same port to the users and tags given in
+// --ui-allow.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"tailscale.com/hostinfo"
+	"tailscale.com/tsnet"
+	"tailscale.com/util/mak"
+)
+
+var (
+	hostname = flag.String("hostname", "recorder", "Tailscale hostname to use")
+	stateDir = flag.String("state-dir", "", "directory to store tsnet state in; empty means a default directory under the user config directory")
+	dir      = flag.String("dir", "", "directory to store recordings in; empty means a \"recordings\" directory in --state-dir")
+	port     = flag.Int("port", 80, "port to accept recordings and serve the web UI on; SSH policy recorder addresses must use this port")
+	uiAllow  = flag.String("ui-allow", "", "comma-separated login names and tags (tag:foo) of tailnet users and nodes allowed to list and replay recordings in the web UI; if empty, the web UI is disabled")
+)
+
+func main() {
+	flag.Parse()
+	hostinfo.SetApp("tsrecorder")
+
+	recDir := *dir
+	if recDir == "" {
+		if *stateDir == "" {
+			log.Fatal("--dir is required when --state-dir is not set")
+		}
+		recDir = filepath.Join(*stateDir, "recordings")
+	}
+	store, err := newDirStore(recDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := &tsnet.Server{
+		Hostname: *hostname,
+		Dir:      *stateDir,
+	}
+	defer s.Close()
+
+	lc, err := s.LocalClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	rec := newRecorder(store, log.Printf)
+	rec.whoIs = lc.WhoIs
+	for _, v := range strings.Split(*uiAllow, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			mak.Set(&rec.uiAllow, v, struct{}{})
+		}
+	}
+	if err := rec.loadIndex(context.Background()); err != nil {
+		log.Fatalf("indexing recordings in %s: %v", recDir, err)
+	}
+
+	ln, err := s.Listen("tcp", fmt.Sprintf(":%d", *port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("accepting recordings on port %d, storing in %s", *port, recDir)
+	if len(rec.uiAllow) == 0 {
+		log.Printf("web UI disabled; use --ui-allow to enable it")
+	}
+	log.Fatal(http.Serve(ln, rec.handler()))
+}
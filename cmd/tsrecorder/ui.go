@@ -0,0 +1,204 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//go:embed index.tmpl.html
+var indexHTML string
+
+//go:embed play.tmpl.html
+var playHTML string
+
+var (
+	indexTmpl = template.Must(template.New("index").Parse(indexHTML))
+	playTmpl  = template.Must(template.New("play").Parse(playHTML))
+)
+
+// handler returns the recorder's HTTP handler. The web UI is only served
+// to peers in rec.uiAllow; see uiAllowed.
+func (rec *recorder) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/record", rec.serveRecord)
+	mux.Handle("/", rec.requireUIAccess(rec.serveIndex))
+	mux.Handle("/api/sessions", rec.requireUIAccess(rec.serveSessionsJSON))
+	mux.Handle("/recordings/", rec.requireUIAccess(rec.serveRecording))
+	mux.Handle("/play/", rec.requireUIAccess(rec.servePlay))
+	return mux
+}
+
+// requireUIAccess wraps h to reject requests from peers not allowed to use
+// the web UI.
+func (rec *recorder) requireUIAccess(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rec.uiAllowed(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// uiAllowed reports whether the peer that sent r may list and download
+// recordings. It must be a node owned by a user in rec.uiAllow or have a
+// tag in it. Without a whoIs func, nobody is allowed.
+func (rec *recorder) uiAllowed(r *http.Request) bool {
+	if len(rec.uiAllow) == 0 || rec.whoIs == nil {
+		return false
+	}
+	who, err := rec.whoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		rec.logf("UI request from %v: %v", r.RemoteAddr, err)
+		return false
+	}
+	if who.Node == nil {
+		return false
+	}
+	if who.Node.IsTagged() {
+		for _, tag := range who.Node.Tags {
+			if rec.uiAllow.Contains(tag) {
+				return true
+			}
+		}
+		return false
+	}
+	return who.UserProfile != nil && rec.uiAllow.Contains(who.UserProfile.LoginName)
+}
+
+// parseTime parses a filter time, either in RFC 3339 format or as a
+// YYYY-MM-DD date in UTC.
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// parseFilter returns the Filter described by r's "node", "user", "since"
+// and "until" query parameters.
+func parseFilter(r *http.Request) (Filter, error) {
+	f := Filter{
+		Node: r.FormValue("node"),
+		User: r.FormValue("user"),
+	}
+	var err error
+	if v := r.FormValue("since"); v != "" {
+		if f.Since, err = parseTime(v); err != nil {
+			return f, fmt.Errorf("invalid 'since': %w", err)
+		}
+	}
+	if v := r.FormValue("until"); v != "" {
+		if f.Until, err = parseTime(v); err != nil {
+			return f, fmt.Errorf("invalid 'until': %w", err)
+		}
+		if !strings.Contains(v, "T") {
+			// Make a date-only bound include that whole day.
+			f.Until = f.Until.AddDate(0, 0, 1)
+		}
+	}
+	return f, nil
+}
+
+func (rec *recorder) serveSessionsJSON(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sessions := rec.Sessions(f)
+	if sessions == nil {
+		sessions = []*Session{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(sessions)
+}
+
+func (rec *recorder) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := parseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data := struct {
+		Filter   Filter
+		Since    string
+		Until    string
+		Sessions []*Session
+	}{
+		Filter:   f,
+		Since:    r.FormValue("since"),
+		Until:    r.FormValue("until"),
+		Sessions: rec.Sessions(f),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTmpl.Execute(w, data); err != nil {
+		rec.logf("index template: %v", err)
+	}
+}
+
+// sessionFromPath returns the indexed session whose ID is the remainder
+// of r's path after prefix.
+func (rec *recorder) sessionFromPath(r *http.Request, prefix string) (Session, bool) {
+	id, ok := strings.CutPrefix(r.URL.Path, prefix)
+	if !ok {
+		return Session{}, false
+	}
+	return rec.session(id)
+}
+
+func (rec *recorder) serveRecording(w http.ResponseWriter, r *http.Request) {
+	s, ok := rec.sessionFromPath(r, "/recordings/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	rc, err := rec.store.Get(r.Context(), s.ID)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	io.Copy(w, rc)
+}
+
+func (rec *recorder) servePlay(w http.ResponseWriter, r *http.Request) {
+	s, ok := rec.sessionFromPath(r, "/play/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data := struct {
+		Session Session
+		CastURL string
+	}{
+		Session: s,
+		CastURL: "/recordings/" + s.ID,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := playTmpl.Execute(w, data); err != nil {
+		rec.logf("play template: %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go4.org/mem"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/set"
+)
+
+// maxAllowlistSize is the largest allowlist that Allowlist loads.
+const maxAllowlistSize = 16 << 20
+
+// Allowlist is a ClientVerifier that permits the node keys listed in a file
+// or at an HTTP(S) URL, which it reloads periodically.
+//
+// The list has one node key per line, either as "nodekey:<hex>" or bare
+// hex. A key prefixed with "!" is denied, even if also listed as allowed.
+// A line of "*" allows all keys that aren't denied, making the list a deny
+// list. Blank lines and "#" comments are ignored.
+type Allowlist struct {
+	source string
+	logf   logger.Logf
+
+	cur atomic.Pointer[allowlistEntries]
+
+	mu       sync.Mutex
+	onChange func() // or nil; called after each successful reload
+
+	ctx       context.Context // canceled by Close
+	ctxCancel context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// allowlistEntries is a parsed allowlist.
+type allowlistEntries struct {
+	allowAll bool
+	allow    set.Set[key.NodePublic]
+	deny     set.Set[key.NodePublic]
+}
+
+// NewAllowlist returns an Allowlist loaded from source, a file path or an
+// http:// or https:// URL. If refresh is positive, the list is reloaded at
+// that interval until Close is called; if reloading fails, the last list
+// loaded is kept.
+func NewAllowlist(source string, refresh time.Duration, logf logger.Logf) (*Allowlist, error) {
+	a := &Allowlist{
+		source: source,
+		logf:   logger.WithPrefix(logf, "derp allowlist: "),
+	}
+	a.ctx, a.ctxCancel = context.WithCancel(context.Background())
+	if err := a.reload(); err != nil {
+		a.ctxCancel()
+		return nil, err
+	}
+	if refresh > 0 {
+		a.wg.Add(1)
+		go a.reloadLoop(refresh)
+	}
+	return a, nil
+}
+
+// VerifyClient implements ClientVerifier.
+func (a *Allowlist) VerifyClient(clientKey key.NodePublic) error {
+	e := a.cur.Load()
+	switch {
+	case e.deny.Contains(clientKey):
+		return fmt.Errorf("client %v is denied", clientKey)
+	case e.allowAll, e.allow.Contains(clientKey):
+		return nil
+	}
+	return fmt.Errorf("client %v not in allowlist", clientKey)
+}
+
+// Close stops reloading the list.
+func (a *Allowlist) Close() error {
+	a.ctxCancel()
+	a.wg.Wait()
+	return nil
+}
+
+// OnChange sets f to be called after each successful reload of the list.
+// It implements the optional ClientVerifier method that a Server uses to
+// disconnect clients the list no longer permits.
+func (a *Allowlist) OnChange(f func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.onChange = f
+}
+
+func (a *Allowlist) reloadLoop(refresh time.Duration) {
+	defer a.wg.Done()
+	t := time.NewTicker(refresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := a.reload(); err != nil {
+			a.logf("reloading %s: %v; keeping previous list", a.source, err)
+		}
+	}
+}
+
+// reload loads and parses the list from its source, replacing the current
+// one if successful.
+func (a *Allowlist) reload() error {
+	b, err := a.fetch()
+	if err != nil {
+		return err
+	}
+	e, err := parseAllowlist(b)
+	if err != nil {
+		return err
+	}
+	if old := a.cur.Swap(e); old == nil || len(old.allow) != len(e.allow) || len(old.deny) != len(e.deny) || old.allowAll != e.allowAll {
+		a.logf("loaded %d allowed and %d denied keys from %s (allow all: %v)", len(e.allow), len(e.deny), a.source, e.allowAll)
+	}
+	a.mu.Lock()
+	f := a.onChange
+	a.mu.Unlock()
+	if f != nil {
+		f()
+	}
+	return nil
+}
+
+// fetch returns the contents of the list's source.
+func (a *Allowlist) fetch() ([]byte, error) {
+	if !strings.HasPrefix(a.source, "http://") && !strings.HasPrefix(a.source, "https://") {
+		return os.ReadFile(a.source)
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", a.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", res.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxAllowlistSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxAllowlistSize {
+		return nil, fmt.Errorf("allowlist larger than %d bytes", maxAllowlistSize)
+	}
+	return b, nil
+}
+
+// parseAllowlist parses an allowlist in the format described on Allowlist.
+func parseAllowlist(b []byte) (*allowlistEntries, error) {
+	e := &allowlistEntries{
+		allow: set.Set[key.NodePublic]{},
+		deny:  set.Set[key.NodePublic]{},
+	}
+	bs := bufio.NewScanner(bytes.NewReader(b))
+	for lineNum := 1; bs.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(bs.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line == "*" {
+			e.allowAll = true
+			continue
+		}
+		entries := e.allow
+		if rest, ok := strings.CutPrefix(line, "!"); ok {
+			entries, line = e.deny, strings.TrimSpace(rest)
+		}
+		var k key.NodePublic
+		var err error
+		if strings.HasPrefix(line, "nodekey:") {
+			err = k.UnmarshalText([]byte(line))
+		} else {
+			k, err = key.ParseNodePublicUntyped(mem.S(line))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid node key %q: %w", lineNum, line, err)
+		}
+		entries.Add(k)
+	}
+	if err := bs.Err(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -35,6 +35,7 @@
 
 	"go4.org/mem"
 	"golang.org/x/sync/errgroup"
+	xrate "golang.org/x/time/rate"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/disco"
 	"tailscale.com/envknob"
@@ -44,6 +45,7 @@
 	"tailscale.com/tstime/rate"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/mak"
 	"tailscale.com/util/set"
 	"tailscale.com/version"
 )
@@ -144,10 +146,22 @@ type Server struct {
 	avgQueueDuration             *uint64          // In milliseconds; accessed atomically
 	tcpRtt                       metrics.LabelMap // histogram
 
+	// Per-key traffic accounting; disabled unless SetTrafficTopK is called.
+	topClients trafficTopK // by client key
+	topPeers   trafficTopK // by mesh peer server key
+
+	// clientRateLimit limits the packets accepted from each client;
+	// see SetClientRateLimit.
+	clientRateLimit ClientRateLimit
+
 	// verifyClients only accepts client connections to the DERP server if the clientKey is a
 	// known peer in the network, as specified by a running tailscaled's client's LocalAPI.
 	verifyClients bool
 
+	// clientVerifier, if non-nil, also decides which clients may connect;
+	// see SetClientVerifier.
+	clientVerifier ClientVerifier
+
 	mu       sync.Mutex
 	closed   bool
 	netConns map[Conn]chan struct{} // chan is closed when conn closes
@@ -323,6 +337,8 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		tcpRtt:               metrics.LabelMap{Label: "le"},
 		keyOfAddr:            map[netip.AddrPort]key.NodePublic{},
 		clock:                tstime.StdClock{},
+		topClients:           trafficTopK{label: "client"},
+		topPeers:             trafficTopK{label: "peer"},
 	}
 	s.initMetacert()
 	s.packetsRecvDisco = s.packetsRecvByKind.Get("disco")
@@ -331,10 +347,11 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		s.packetsDroppedReason.Get("unknown_dest"),
 		s.packetsDroppedReason.Get("unknown_dest_on_fwd"),
 		s.packetsDroppedReason.Get("gone_disconnected"),
-		s.packetsDroppedReason.Get("gone_not_here"),
 		s.packetsDroppedReason.Get("queue_head"),
 		s.packetsDroppedReason.Get("queue_tail"),
 		s.packetsDroppedReason.Get("write_error"),
+		s.packetsDroppedReason.Get("dup_client"),
+		s.packetsDroppedReason.Get("rate_limited"),
 	}
 	s.packetsDroppedTypeDisco = s.packetsDroppedType.Get("disco")
 	s.packetsDroppedTypeOther = s.packetsDroppedType.Get("other")
@@ -356,6 +373,118 @@ func (s *Server) SetVerifyClient(v bool) {
 	s.verifyClients = v
 }
 
+// ClientVerifier decides whether clients may connect to a DERP server.
+//
+// A ClientVerifier whose decisions can change may also implement
+// OnChange(f func()), calling f after they change, to have the Server check
+// its connected clients again.
+type ClientVerifier interface {
+	// VerifyClient returns an error if the client with the node key
+	// clientKey may not connect.
+	VerifyClient(clientKey key.NodePublic) error
+}
+
+// SetClientVerifier sets v to verify clients connecting to this DERP
+// server, in addition to tailscaled if SetVerifyClient is also set. Mesh
+// peers, which present the mesh key, aren't checked by v.
+//
+// If v implements OnChange, such as an *Allowlist, connected clients are
+// checked again each time v changes, and those it no longer permits are
+// disconnected.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientVerifier(v ClientVerifier) {
+	s.clientVerifier = v
+	if cv, ok := v.(interface{ OnChange(func()) }); ok {
+		cv.OnChange(s.closeUnverifiedClients)
+	}
+}
+
+// closeUnverifiedClients disconnects the connected clients, other than
+// mesh peers, that s.clientVerifier no longer permits.
+func (s *Server) closeUnverifiedClients() {
+	// Verify a snapshot of the keys without holding s.mu, as verifiers
+	// may be slow.
+	s.mu.Lock()
+	keys := make([]key.NodePublic, 0, len(s.clients))
+	for k := range s.clients {
+		keys = append(keys, k)
+	}
+	s.mu.Unlock()
+	var denied map[key.NodePublic]error
+	for _, k := range keys {
+		if err := s.clientVerifier.VerifyClient(k); err != nil {
+			mak.Set(&denied, k, err)
+		}
+	}
+	if len(denied) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, err := range denied {
+		set, ok := s.clients[k]
+		if !ok {
+			continue
+		}
+		set.ForeachClient(func(c *sclient) {
+			if c.canMesh {
+				return
+			}
+			c.logf("closing connection: %v", err)
+			go c.nc.Close()
+		})
+	}
+}
+
+// ClientRateLimit is a token bucket limit on the packets that a DERP server
+// accepts from each client to relay. Packets over the limit are dropped.
+//
+// Clients are told the byte limit when they connect, so that well-behaved
+// ones pace themselves rather than have packets dropped by the server.
+type ClientRateLimit struct {
+	// BytesPerSecond is the sustained rate of packet bytes a client may
+	// send, or zero for no limit.
+	BytesPerSecond int
+
+	// BytesBurst is how many bytes a client may send at once. If
+	// BytesPerSecond is non-zero, it's at least MaxPacketSize; zero means
+	// one second's worth.
+	BytesBurst int
+
+	// PacketsPerSecond is the sustained rate of packets a client may send,
+	// or zero for no limit.
+	PacketsPerSecond int
+
+	// PacketsBurst is how many packets a client may send at once. Zero
+	// means one second's worth.
+	PacketsBurst int
+}
+
+// SetClientRateLimit sets the limit on the packets accepted from each
+// client. Mesh peers aren't limited.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientRateLimit(l ClientRateLimit) {
+	if l.BytesPerSecond > 0 {
+		if l.BytesBurst <= 0 {
+			l.BytesBurst = l.BytesPerSecond
+		}
+		l.BytesBurst = max(l.BytesBurst, MaxPacketSize)
+	} else {
+		l.BytesPerSecond, l.BytesBurst = 0, 0
+	}
+	if l.PacketsPerSecond > 0 {
+		if l.PacketsBurst <= 0 {
+			l.PacketsBurst = l.PacketsPerSecond
+		}
+	} else {
+		l.PacketsPerSecond, l.PacketsBurst = 0, 0
+	}
+	s.clientRateLimit = l
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -715,7 +844,7 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 		remoteAddr:     remoteAddr,
 		remoteIPPort:   remoteIPPort,
 		connectedAt:    s.clock.Now(),
-		sendQueue:      make(chan pkt, perClientSendQueueDepth),
+		sendQueue:      newFairQueue(perClientSendQueueDepth),
 		discoSendQueue: make(chan pkt, perClientSendQueueDepth),
 		sendPongCh:     make(chan [8]byte, 1),
 		peerGone:       make(chan peerGoneMsg),
@@ -725,6 +854,14 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{})
+	} else {
+		l := s.clientRateLimit
+		if l.BytesPerSecond > 0 {
+			c.recvBytesLim = xrate.NewLimiter(xrate.Limit(l.BytesPerSecond), l.BytesBurst)
+		}
+		if l.PacketsPerSecond > 0 {
+			c.recvPacketsLim = xrate.NewLimiter(xrate.Limit(l.PacketsPerSecond), l.PacketsBurst)
+		}
 	}
 	if clientInfo != nil {
 		c.info = *clientInfo
@@ -861,11 +998,14 @@ func (c *sclient) handleFramePing(ft frameType, fl uint32) error {
 	if extra := int64(fl) - int64(len(m)); extra > 0 {
 		_, err = io.CopyN(io.Discard, c.br, extra)
 	}
+	if !c.allowRecv(0) {
+		// They're over their packet rate limit. Ignore.
+		return err
+	}
 	select {
 	case c.sendPongCh <- [8]byte(m):
 	default:
 		// They're pinging too fast. Ignore.
-		// TODO(bradfitz): add a rate limiter too.
 	}
 	return err
 }
@@ -915,6 +1055,7 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 		return fmt.Errorf("client %x: recvForwardPacket: %v", c.key, err)
 	}
 	s.packetsForwardedIn.Add(1)
+	s.topPeers.add(c.key, trafficReceived, len(contents))
 
 	var dstLen int
 	var dst *sclient
@@ -969,6 +1110,13 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
+	s.topClients.add(c.key, trafficReceived, len(contents))
+
+	if !c.allowRecv(len(contents)) {
+		s.recordDrop(contents, c.key, dstKey, dropReasonRateLimited)
+		c.debugLogf("SendPacket for %s, dropping with reason=%s", dstKey.ShortString(), dropReasonRateLimited)
+		return nil
+	}
 
 	var fwd PacketForwarder
 	var dstLen int
@@ -991,6 +1139,13 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 			s.packetsForwardedOut.Add(1)
 			err := fwd.ForwardPacket(c.key, dstKey, contents)
 			c.debugLogf("SendPacket for %s, forwarding via %s: %v", dstKey.ShortString(), fwd, err)
+			if s.topPeers.enabled() {
+				kind := trafficSent
+				if err != nil {
+					kind = trafficDropped
+				}
+				s.topPeers.add(forwarderKey(fwd), kind, len(contents))
+			}
 			if err != nil {
 				// TODO:
 				return nil
@@ -1023,6 +1178,22 @@ func (c *sclient) debugLogf(format string, v ...any) {
 	}
 }
 
+// allowRecv reports whether the client is within its rate limit to send a
+// packet of n bytes, consuming tokens from its buckets if so.
+func (c *sclient) allowRecv(n int) bool {
+	if c.recvBytesLim == nil && c.recvPacketsLim == nil {
+		return true
+	}
+	now := c.s.clock.Now()
+	if c.recvBytesLim != nil && !c.recvBytesLim.AllowN(now, n) {
+		return false
+	}
+	if c.recvPacketsLim != nil && !c.recvPacketsLim.AllowN(now, 1) {
+		return false
+	}
+	return true
+}
+
 // dropReason is why we dropped a DERP frame.
 type dropReason int
 
@@ -1036,6 +1207,7 @@ func (c *sclient) debugLogf(format string, v ...any) {
 	dropReasonQueueTail                          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError                         // OS write() failed
 	dropReasonDupClient                          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonRateLimited                        // the source client exceeded its rate limit
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
@@ -1055,6 +1227,15 @@ func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, r
 		msg := fmt.Sprintf("drop (%s) %s -> %s", srcKey.ShortString(), reason, dstKey.ShortString())
 		s.limitedLogf(msg)
 	}
+	switch reason {
+	case dropReasonUnknownDest, dropReasonRateLimited:
+		// Blame the sender.
+		s.topClients.add(srcKey, trafficDropped, len(packetBytes))
+	case dropReasonUnknownDestOnFwd:
+		// Neither key is ours.
+	default:
+		s.topClients.add(dstKey, trafficDropped, len(packetBytes))
+	}
 	s.debugLogf("dropping packet reason=%s dst=%s disco=%v", reason, dstKey, looksDisco)
 }
 
@@ -1062,13 +1243,28 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 	s := c.s
 	dstKey := dst.key
 
+	if !disco.LooksLikeDiscoWrapper(p.bs) {
+		select {
+		case <-dst.done:
+			s.recordDrop(p.bs, c.key, dstKey, dropReasonGoneDisconnected)
+			dst.debugLogf("sendPkt dropped, dst gone")
+			return nil
+		default:
+		}
+		// The fair queue always has room for the packet, making it by
+		// dropping the oldest packet of the heaviest sender if needed.
+		if old, ok := dst.sendQueue.enqueue(p); ok {
+			s.recordDrop(old.bs, old.src, dstKey, dropReasonQueueHead)
+			c.recordQueueTime(old.enqueuedAt)
+		}
+		dst.debugLogf("sendPkt enqueued")
+		return nil
+	}
+
 	// Attempt to queue for sending up to 3 times. On each attempt, if
 	// the queue is full, try to drop from queue head to prioritize
 	// fresher packets.
-	sendQueue := dst.sendQueue
-	if disco.LooksLikeDiscoWrapper(p.bs) {
-		sendQueue = dst.discoSendQueue
-	}
+	sendQueue := dst.discoSendQueue
 	for attempt := 0; attempt < 3; attempt++ {
 		select {
 		case <-dst.done:
@@ -1124,6 +1320,12 @@ func (c *sclient) requestMeshUpdate() {
 }
 
 func (s *Server) verifyClient(clientKey key.NodePublic, info *clientInfo) error {
+	isMeshPeer := info != nil && s.meshKey != "" && info.MeshKey == s.meshKey
+	if s.clientVerifier != nil && !isMeshPeer {
+		if err := s.clientVerifier.VerifyClient(clientKey); err != nil {
+			return err
+		}
+	}
 	if !s.verifyClients {
 		return nil
 	}
@@ -1209,7 +1411,11 @@ type serverInfo struct {
 }
 
 func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.NodePublic) error {
-	msg, err := json.Marshal(serverInfo{Version: ProtocolVersion})
+	msg, err := json.Marshal(serverInfo{
+		Version:                   ProtocolVersion,
+		TokenBucketBytesPerSecond: s.clientRateLimit.BytesPerSecond,
+		TokenBucketBytesBurst:     s.clientRateLimit.BytesBurst,
+	})
 	if err != nil {
 		return err
 	}
@@ -1325,7 +1531,7 @@ type sclient struct {
 	done           <-chan struct{}  // closed when connection closes
 	remoteAddr     string           // usually ip:port from net.Conn.RemoteAddr().String()
 	remoteIPPort   netip.AddrPort   // zero if remoteAddr is not ip:port.
-	sendQueue      chan pkt         // packets queued to this client; never closed
+	sendQueue      *fairQueue       // packets queued to this client
 	discoSendQueue chan pkt         // important packets queued to this client; never closed
 	sendPongCh     chan [8]byte     // pong replies to send to the client; never closed
 	peerGone       chan peerGoneMsg // write request that a peer is not at this server (not used by mesh peers)
@@ -1355,6 +1561,11 @@ type sclient struct {
 	// client that it's trying to establish a direct connection
 	// through us with a peer we have no record of.
 	peerGoneLim *rate.Limiter
+
+	// recvBytesLim and recvPacketsLim, if non-nil, limit the rate of
+	// packets the client sends us to relay; see Server.SetClientRateLimit.
+	recvBytesLim   *xrate.Limiter
+	recvPacketsLim *xrate.Limiter
 }
 
 // peerConnState represents whether a peer is connected to the server
@@ -1435,11 +1646,12 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		// that the receive loop unblocks and cleans up the rest.
 		c.nc.Close()
 
-		// Drain the send queue to count dropped packets
+		// Drain the send queues to count dropped packets
+		for _, pkt := range c.sendQueue.drain() {
+			c.s.recordDrop(pkt.bs, pkt.src, c.key, dropReasonGoneDisconnected)
+		}
 		for {
 			select {
-			case pkt := <-c.sendQueue:
-				c.s.recordDrop(pkt.bs, pkt.src, c.key, dropReasonGoneDisconnected)
 			case pkt := <-c.discoSendQueue:
 				c.s.recordDrop(pkt.bs, pkt.src, c.key, dropReasonGoneDisconnected)
 			default:
@@ -1468,9 +1680,8 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
-		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+		case <-c.sendQueue.ready:
+			werr = c.sendQueuedPacket()
 			continue
 		case msg := <-c.discoSendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
@@ -1499,9 +1710,8 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
-		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+		case <-c.sendQueue.ready:
+			werr = c.sendQueuedPacket()
 		case msg := <-c.discoSendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
 			c.recordQueueTime(msg.enqueuedAt)
@@ -1514,6 +1724,18 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 	}
 }
 
+// sendQueuedPacket sends the next packet from the send queue, if any,
+// without flushing.
+func (c *sclient) sendQueuedPacket() error {
+	msg, ok := c.sendQueue.dequeue()
+	if !ok {
+		return nil
+	}
+	err := c.sendPacket(msg.src, msg.bs)
+	c.recordQueueTime(msg.enqueuedAt)
+	return err
+}
+
 func (c *sclient) setWriteDeadline() {
 	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
 }
@@ -1627,6 +1849,7 @@ func (c *sclient) sendPacket(srcKey key.NodePublic, contents []byte) (err error)
 		} else {
 			c.s.packetsSent.Add(1)
 			c.s.bytesSent.Add(int64(len(contents)))
+			c.s.topClients.add(c.key, trafficSent, len(contents))
 		}
 		c.debugLogf("sendPacket from %s: %v", srcKey.ShortString(), err)
 	}()
@@ -1840,6 +2063,8 @@ func (s *Server) ExpVar() expvar.Var {
 		return math.Float64frombits(atomic.LoadUint64(s.avgQueueDuration))
 	}))
 	m.Set("counter_tcp_rtt", &s.tcpRtt)
+	m.Set("top_clients", &s.topClients)
+	m.Set("top_peers", &s.topPeers)
 	var expvarVersion expvar.String
 	expvarVersion.Set(version.Long())
 	m.Set("version", &expvarVersion)
@@ -16,9 +16,13 @@
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -1516,3 +1520,301 @@ func TestServerRepliesToPing(t *testing.T) {
 		}
 	}
 }
+
+func TestTrafficTopK(t *testing.T) {
+	k := pubAll
+	tk := &trafficTopK{label: "client"}
+	tk.add(k(1), trafficSent, 100) // disabled; ignored
+	if got := tk.snapshot(); len(got) != 0 {
+		t.Fatalf("disabled table has %d entries", len(got))
+	}
+
+	tk.max = 2
+	tk.add(k(1), trafficReceived, 1000)
+	tk.add(k(1), trafficSent, 500)
+	tk.add(k(2), trafficReceived, 10)
+	tk.add(k(2), trafficDropped, 5)
+	tk.snapshot() // merge the pending counts, so k(3) arrives to a full table
+	// k(3) replaces k(2), the lightest, inheriting its weight.
+	tk.add(k(3), trafficSent, 20)
+
+	got := tk.snapshot()
+	want := []topKEntry{
+		{Key: k(1), BytesReceived: 1000, BytesSent: 500, PacketsReceived: 1, PacketsSent: 1, Weight: 1500},
+		{Key: k(3), BytesSent: 20, PacketsSent: 1, Weight: 35, Error: 15},
+	}
+	for i := range got {
+		got[i].index = 0
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("snapshot:\n got %+v\nwant %+v", got, want)
+	}
+
+	var buf bytes.Buffer
+	tk.WritePrometheus(&buf, "derp_top_clients")
+	if !strings.Contains(buf.String(), fmt.Sprintf("derp_top_clients_bytes_sent{client=%q} 20\n", k(3))) {
+		t.Errorf("missing bytes_sent metric in:\n%s", buf.String())
+	}
+	var ents []topKEntry
+	if err := json.Unmarshal([]byte(tk.String()), &ents); err != nil || len(ents) != 2 {
+		t.Errorf("String() = %s, %v; want JSON array of 2 entries", tk.String(), err)
+	}
+}
+
+func BenchmarkTrafficTopK(b *testing.B) {
+	tk := &trafficTopK{label: "client", max: 100}
+	keys := make([]key.NodePublic, 1000)
+	for i := range keys {
+		keys[i] = key.NewNode().Public()
+	}
+	var mu sync.Mutex
+	var goroutines int
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		mu.Lock()
+		i := goroutines * 97 // start each goroutine at different keys
+		goroutines++
+		mu.Unlock()
+		for pb.Next() {
+			tk.add(keys[i%len(keys)], trafficSent, 1000)
+			i++
+		}
+	})
+}
+
+type testMeshForwarder struct{ k key.NodePublic }
+
+func (f testMeshForwarder) ForwardPacket(src, dst key.NodePublic, payload []byte) error { return nil }
+func (f testMeshForwarder) String() string                                              { return "test" }
+func (f testMeshForwarder) ServerPublicKey() key.NodePublic                             { return f.k }
+
+func TestForwarderKey(t *testing.T) {
+	k := key.NewNode().Public()
+	if got := forwarderKey(testMeshForwarder{k}); got != k {
+		t.Errorf("forwarderKey = %v; want %v", got, k)
+	}
+	if got := forwarderKey(newMultiForwarder(testMeshForwarder{k}, testFwd(1))); got != k {
+		t.Errorf("forwarderKey(multiForwarder) = %v; want %v", got, k)
+	}
+	if got := forwarderKey(testFwd(1)); !got.IsZero() {
+		t.Errorf("forwarderKey(testFwd) = %v; want zero", got)
+	}
+}
+
+func TestServeDebugTop(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+
+	rec := httptest.NewRecorder()
+	s.ServeDebugTop(rec, httptest.NewRequest("GET", "/debug/derp/top", nil))
+	if !strings.Contains(rec.Body.String(), "disabled") {
+		t.Errorf("disabled page = %q", rec.Body.String())
+	}
+
+	s.SetTrafficTopK(10)
+	c := key.NewNode().Public()
+	s.topClients.add(c, trafficReceived, 123)
+	rec = httptest.NewRecorder()
+	s.ServeDebugTop(rec, httptest.NewRequest("GET", "/debug/derp/top", nil))
+	if body := rec.Body.String(); !strings.Contains(body, c.ShortString()) || !strings.Contains(body, "<td>123</td>") {
+		t.Errorf("page missing client traffic:\n%s", body)
+	}
+}
+
+func TestFairQueue(t *testing.T) {
+	k := pubAll
+	q := newFairQueue(4)
+	enqueue := func(src byte, b byte) (dropped []byte) {
+		t.Helper()
+		old, ok := q.enqueue(pkt{src: k(src), bs: []byte{b}})
+		if ok {
+			return old.bs
+		}
+		return nil
+	}
+	// A heavy sender fills the queue.
+	for i := byte(0); i < 4; i++ {
+		if d := enqueue(1, 10+i); d != nil {
+			t.Fatalf("enqueue %d dropped %v", i, d)
+		}
+	}
+	// A light sender's packet makes room by dropping the heavy sender's
+	// oldest packet.
+	if d := enqueue(2, 20); !bytes.Equal(d, []byte{10}) {
+		t.Fatalf("dropped %v; want [10]", d)
+	}
+	if d := enqueue(3, 30); !bytes.Equal(d, []byte{11}) {
+		t.Fatalf("dropped %v; want [11]", d)
+	}
+
+	select {
+	case <-q.ready:
+	default:
+		t.Fatal("ready not signaled")
+	}
+	// Senders are dequeued round-robin.
+	var got []byte
+	for {
+		p, ok := q.dequeue()
+		if !ok {
+			break
+		}
+		got = append(got, p.bs[0])
+	}
+	if want := []byte{12, 20, 30, 13}; !bytes.Equal(got, want) {
+		t.Errorf("dequeued %v; want %v", got, want)
+	}
+
+	enqueue(1, 1)
+	enqueue(2, 2)
+	if ps := q.drain(); len(ps) != 2 || q.n != 0 || len(q.bySrc) != 0 || len(q.order) != 0 {
+		t.Errorf("drain = %d packets, leaving %d; want 2, leaving 0", len(ps), q.n)
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	s.clock = clock
+
+	s.SetClientRateLimit(ClientRateLimit{BytesPerSecond: 1000, PacketsPerSecond: 10, PacketsBurst: 2})
+	if l := s.clientRateLimit; l.BytesBurst != MaxPacketSize {
+		t.Errorf("BytesBurst = %d; want %d", l.BytesBurst, MaxPacketSize)
+	}
+	l := s.clientRateLimit
+	c := &sclient{
+		s:              s,
+		recvBytesLim:   rate.NewLimiter(rate.Limit(l.BytesPerSecond), l.BytesBurst),
+		recvPacketsLim: rate.NewLimiter(rate.Limit(l.PacketsPerSecond), l.PacketsBurst),
+	}
+	if !c.allowRecv(100) || !c.allowRecv(100) {
+		t.Fatal("packets within burst not allowed")
+	}
+	if c.allowRecv(100) {
+		t.Fatal("packet over packet burst allowed")
+	}
+	clock.Advance(time.Second)
+	if !c.allowRecv(MaxPacketSize - 200) {
+		t.Fatal("packet within byte burst not allowed")
+	}
+	if c.allowRecv(1000) {
+		t.Fatal("packet over byte burst allowed")
+	}
+
+	before := s.packetsDroppedReasonCounters[dropReasonRateLimited].Value()
+	s.recordDrop([]byte{1}, c.key, key.NodePublic{}, dropReasonRateLimited)
+	if got := s.packetsDroppedReasonCounters[dropReasonRateLimited].Value(); got != before+1 {
+		t.Errorf("rate_limited drops = %d; want %d", got, before+1)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	k1, k2, k3 := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+	raw := func(k key.NodePublic) string { return strings.TrimPrefix(k.String(), "nodekey:") }
+
+	path := filepath.Join(t.TempDir(), "allowlist")
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(fmt.Sprintf("# allowed\n%s\n%s # bare hex\n!%s\n", k1, raw(k2), k2))
+	a, err := NewAllowlist(path, 0, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	check := func(k key.NodePublic, wantOK bool) {
+		t.Helper()
+		if err := a.VerifyClient(k); (err == nil) != wantOK {
+			t.Errorf("VerifyClient(%v) = %v; want ok=%v", k.ShortString(), err, wantOK)
+		}
+	}
+	check(k1, true)
+	check(k2, false) // denied wins
+	check(k3, false)
+
+	write(fmt.Sprintf("*\n!%s\n", k1))
+	if err := a.reload(); err != nil {
+		t.Fatal(err)
+	}
+	check(k1, false)
+	check(k3, true)
+
+	// A bad list keeps the previous one.
+	write("not-a-key\n")
+	if err := a.reload(); err == nil {
+		t.Error("reload of invalid list succeeded")
+	}
+	check(k3, true)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, k3)
+	}))
+	defer ts.Close()
+	ha, err := NewAllowlist(ts.URL, 0, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ha.Close()
+	if err := ha.VerifyClient(k3); err != nil {
+		t.Errorf("VerifyClient from URL list: %v", err)
+	}
+
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetMeshKey("mesh-key")
+	s.SetClientVerifier(a)
+	if err := s.verifyClient(k1, &clientInfo{}); err == nil {
+		t.Error("denied client verified")
+	}
+	if err := s.verifyClient(k1, &clientInfo{MeshKey: "mesh-key"}); err != nil {
+		t.Errorf("mesh peer not verified: %v", err)
+	}
+}
+
+func TestAllowlistReloadDisconnects(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "allowlist")
+	if err := os.WriteFile(path, []byte("*\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAllowlist(path, 0, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	ts.s.SetClientVerifier(a)
+
+	w1 := newTestWatcher(t, ts, "w1")
+	w1.wantPresent(t, w1.pub)
+	c1 := newRegularClient(t, ts, "c1")
+	w1.wantPresent(t, c1.pub)
+	c2 := newRegularClient(t, ts, "c2")
+	w1.wantPresent(t, c2.pub)
+
+	// The mesh peer is exempt even when denied.
+	list := fmt.Sprintf("*\n!%s\n!%s\n", c1.pub, w1.pub)
+	if err := os.WriteFile(path, []byte(list), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.reload(); err != nil {
+		t.Fatal(err)
+	}
+	w1.wantGone(t, c1.pub)
+
+	ts.s.mu.Lock()
+	defer ts.s.mu.Unlock()
+	for _, k := range []key.NodePublic{w1.pub, c2.pub} {
+		if _, ok := ts.s.clients[k]; !ok {
+			t.Errorf("client %q disconnected; want still connected", ts.keyName(k))
+		}
+	}
+}
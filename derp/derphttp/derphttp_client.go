@@ -183,6 +183,13 @@ func (c *Client) ServerPublicKey() key.NodePublic {
 	return c.serverPubKey
 }
 
+// IsConnected reports whether c currently has a connection to its server.
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client != nil
+}
+
 // SelfPublicKey returns our own public key.
 func (c *Client) SelfPublicKey() key.NodePublic {
 	return c.privateKey.Public()
@@ -0,0 +1,123 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"slices"
+	"sync"
+
+	"tailscale.com/types/key"
+)
+
+// fairQueue is a bounded queue of packets to write to a client that
+// schedules their senders fairly, so one sender can't starve the others:
+// packets are dequeued round-robin by sender, and when the queue is full,
+// the packet dropped is the oldest one of the sender with the most packets
+// queued.
+type fairQueue struct {
+	// ready receives a value when the queue becomes non-empty, and again
+	// after each dequeue that leaves packets behind. It has a buffer of 1
+	// and is never closed.
+	ready chan struct{}
+
+	depth int // max packets queued
+
+	mu    sync.Mutex
+	n     int                      // packets queued, across all senders
+	bySrc map[key.NodePublic][]pkt // non-empty queues, by sender
+	order []key.NodePublic         // senders in bySrc, in dequeue order
+}
+
+func newFairQueue(depth int) *fairQueue {
+	return &fairQueue{
+		ready: make(chan struct{}, 1),
+		depth: depth,
+		bySrc: make(map[key.NodePublic][]pkt),
+	}
+}
+
+// enqueue adds p to the queue. If the queue was full, it makes room by
+// removing the oldest packet of the sender with the most packets queued,
+// preferring p's sender in a tie, and returns that packet and true.
+func (q *fairQueue) enqueue(p pkt) (dropped pkt, ok bool) {
+	q.mu.Lock()
+	if q.n >= q.depth {
+		victim, most := p.src, len(q.bySrc[p.src])
+		for src, ps := range q.bySrc {
+			if len(ps) > most {
+				victim, most = src, len(ps)
+			}
+		}
+		dropped, ok = q.popLocked(victim)
+	}
+	if len(q.bySrc[p.src]) == 0 {
+		q.order = append(q.order, p.src)
+	}
+	q.bySrc[p.src] = append(q.bySrc[p.src], p)
+	q.n++
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return dropped, ok
+}
+
+// dequeue removes and returns the oldest packet of the next sender in
+// round-robin order, reporting whether there was one.
+func (q *fairQueue) dequeue() (p pkt, ok bool) {
+	q.mu.Lock()
+	if len(q.order) > 0 {
+		src := q.order[0]
+		p, ok = q.popLocked(src)
+		if len(q.bySrc[src]) > 0 {
+			// Move the sender to the back of the line.
+			q.order = append(slices.Delete(q.order, 0, 1), src)
+		}
+	}
+	more := q.n > 0
+	q.mu.Unlock()
+
+	if more {
+		select {
+		case q.ready <- struct{}{}:
+		default:
+		}
+	}
+	return p, ok
+}
+
+// popLocked removes and returns the oldest packet queued by src, reporting
+// whether there was one. q.mu must be held.
+func (q *fairQueue) popLocked(src key.NodePublic) (p pkt, ok bool) {
+	ps := q.bySrc[src]
+	if len(ps) == 0 {
+		return p, false
+	}
+	p = ps[0]
+	ps[0] = pkt{} // don't retain the packet bytes
+	q.n--
+	if len(ps) == 1 {
+		delete(q.bySrc, src)
+		q.order = slices.DeleteFunc(q.order, func(k key.NodePublic) bool { return k == src })
+	} else {
+		q.bySrc[src] = ps[1:]
+	}
+	return p, true
+}
+
+// drain removes and returns all queued packets.
+func (q *fairQueue) drain() []pkt {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ps []pkt
+	for _, src := range q.order {
+		ps = append(ps, q.bySrc[src]...)
+	}
+	clear(q.bySrc)
+	q.order = nil
+	q.n = 0
+	return ps
+}
@@ -0,0 +1,291 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"tailscale.com/types/key"
+	"tailscale.com/util/mak"
+)
+
+// trafficKind is the kind of traffic accounted by a trafficTopK.
+type trafficKind int
+
+const (
+	trafficReceived trafficKind = iota // received by the server from the key
+	trafficSent                        // sent by the server to the key
+	trafficDropped                     // dropped by the server on the way to (or from) the key
+)
+
+// trafficTopK tracks the heaviest users of a DERP server, by key, with
+// bounded memory and metric cardinality.
+//
+// It implements the Space-Saving algorithm: at most max keys are tracked,
+// and when a new key shows up while the table is full, it replaces the key
+// with the least traffic, inheriting that key's weight. That keeps the true
+// heavy hitters in the table regardless of arrival order, at the cost of
+// overestimating the weight of new entries by at most their Error.
+//
+// Packets are first counted in one of several shards, by key, and only
+// merged into the table in batches, so that accounting a packet doesn't
+// contend on a single lock or reorder the heap.
+//
+// It implements expvar.Var and varz.PrometheusWriter.
+type trafficTopK struct {
+	label string // Prometheus label for the key ("client" or "peer")
+	max   int    // max entries; zero means disabled. Set before use.
+
+	shards [topKShards]topKShard
+
+	mu      sync.Mutex // guards entries and heap; acquired after a shard's mu
+	entries map[key.NodePublic]*topKEntry
+	heap    topKHeap // min-heap of entries by weight
+}
+
+const (
+	// topKShards is the number of shards a trafficTopK counts packets in
+	// before merging them into its table.
+	topKShards = 16
+
+	// topKMaxPending is the number of keys a shard counts packets for
+	// before merging them into the table. Shards are also merged when
+	// the table is read.
+	topKMaxPending = 64
+)
+
+// topKShard is a batch of per-key counts not yet merged into a
+// trafficTopK's table.
+type topKShard struct {
+	mu      sync.Mutex
+	pending map[key.NodePublic]topKCounts
+}
+
+// topKCounts is the traffic counted for a key in a topKShard.
+type topKCounts struct {
+	bytesReceived, bytesSent                     int64
+	packetsReceived, packetsSent, packetsDropped int64
+	weight                                       int64
+}
+
+// topKEntry is the accounting for a single key in a trafficTopK.
+type topKEntry struct {
+	Key             key.NodePublic `json:"key"`
+	BytesReceived   int64          `json:"bytesReceived"`
+	BytesSent       int64          `json:"bytesSent"`
+	PacketsReceived int64          `json:"packetsReceived"`
+	PacketsSent     int64          `json:"packetsSent"`
+	PacketsDropped  int64          `json:"packetsDropped"`
+
+	// Weight is the number of bytes received, sent and dropped for the
+	// key, plus Error. Entries are ranked by weight.
+	Weight int64 `json:"weight"`
+
+	// Error is the upper bound by which Weight overestimates the key's
+	// traffic. It's non-zero for keys that replaced another key in a full
+	// table.
+	Error int64 `json:"error,omitempty"`
+
+	index int // in trafficTopK.heap
+}
+
+func (t *trafficTopK) enabled() bool { return t.max > 0 }
+
+// add accounts a packet of n bytes of the given kind to k.
+func (t *trafficTopK) add(k key.NodePublic, kind trafficKind, n int) {
+	if !t.enabled() || k.IsZero() {
+		return
+	}
+	sh := &t.shards[k.Raw32()[0]%topKShards]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	c := sh.pending[k]
+	switch kind {
+	case trafficReceived:
+		c.bytesReceived += int64(n)
+		c.packetsReceived++
+	case trafficSent:
+		c.bytesSent += int64(n)
+		c.packetsSent++
+	case trafficDropped:
+		c.packetsDropped++
+	}
+	c.weight += int64(n)
+	mak.Set(&sh.pending, k, c)
+	if len(sh.pending) >= topKMaxPending {
+		t.mergeShardLocked(sh)
+	}
+}
+
+// mergeShardLocked merges the counts pending in sh into the table.
+// sh.mu must be held.
+func (t *trafficTopK) mergeShardLocked(sh *topKShard) {
+	if len(sh.pending) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, c := range sh.pending {
+		e, ok := t.entries[k]
+		if !ok {
+			if len(t.heap) < t.max {
+				e = &topKEntry{Key: k}
+				heap.Push(&t.heap, e)
+			} else {
+				e = t.heap[0]
+				delete(t.entries, e.Key)
+				*e = topKEntry{Key: k, Weight: e.Weight, Error: e.Weight, index: e.index}
+			}
+			mak.Set(&t.entries, k, e)
+		}
+		e.BytesReceived += c.bytesReceived
+		e.BytesSent += c.bytesSent
+		e.PacketsReceived += c.packetsReceived
+		e.PacketsSent += c.packetsSent
+		e.PacketsDropped += c.packetsDropped
+		e.Weight += c.weight
+		heap.Fix(&t.heap, e.index)
+	}
+	clear(sh.pending)
+}
+
+// snapshot returns a copy of the tracked entries, heaviest first.
+func (t *trafficTopK) snapshot() []topKEntry {
+	for i := range t.shards {
+		sh := &t.shards[i]
+		sh.mu.Lock()
+		t.mergeShardLocked(sh)
+		sh.mu.Unlock()
+	}
+	t.mu.Lock()
+	ret := make([]topKEntry, 0, len(t.heap))
+	for _, e := range t.heap {
+		ret = append(ret, *e)
+	}
+	t.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Weight != ret[j].Weight {
+			return ret[i].Weight > ret[j].Weight
+		}
+		return ret[i].Key.Less(ret[j].Key)
+	})
+	return ret
+}
+
+// String implements expvar.Var, returning the entries as JSON.
+func (t *trafficTopK) String() string {
+	j, err := json.Marshal(t.snapshot())
+	if err != nil {
+		return "null"
+	}
+	return string(j)
+}
+
+// WritePrometheus implements varz.PrometheusWriter.
+func (t *trafficTopK) WritePrometheus(w io.Writer, name string) {
+	if !t.enabled() {
+		return
+	}
+	ents := t.snapshot()
+	for _, m := range []struct {
+		name string
+		val  func(*topKEntry) int64
+	}{
+		{"bytes_received", func(e *topKEntry) int64 { return e.BytesReceived }},
+		{"bytes_sent", func(e *topKEntry) int64 { return e.BytesSent }},
+		{"packets_received", func(e *topKEntry) int64 { return e.PacketsReceived }},
+		{"packets_sent", func(e *topKEntry) int64 { return e.PacketsSent }},
+		{"packets_dropped", func(e *topKEntry) int64 { return e.PacketsDropped }},
+	} {
+		mname := name + "_" + m.name
+		fmt.Fprintf(w, "# TYPE %s counter\n", mname)
+		for i := range ents {
+			fmt.Fprintf(w, "%s{%s=%q} %d\n", mname, t.label, ents[i].Key.String(), m.val(&ents[i]))
+		}
+	}
+}
+
+// topKHeap is a container/heap.Interface min-heap of entries by weight.
+type topKHeap []*topKEntry
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].Weight < h[j].Weight }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topKHeap) Push(x any) {
+	e := x.(*topKEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *topKHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// SetTrafficTopK enables per-client and per-mesh-peer traffic accounting
+// for the n heaviest clients and mesh peers, by bytes. Zero, the default,
+// disables it.
+//
+// The accounting is exported in the Server's ExpVar and on the page
+// served by ServeDebugTop.
+//
+// It must be called before the Server accepts connections.
+func (s *Server) SetTrafficTopK(n int) {
+	s.topClients.max = n
+	s.topPeers.max = n
+}
+
+// forwarderKey returns the public key of the mesh peer that fwd forwards
+// packets to, if known.
+func forwarderKey(fwd PacketForwarder) key.NodePublic {
+	if mf, ok := fwd.(*multiForwarder); ok {
+		fwd = mf.fwd.Load()
+	}
+	if sk, ok := fwd.(interface{ ServerPublicKey() key.NodePublic }); ok {
+		return sk.ServerPublicKey()
+	}
+	return key.NodePublic{}
+}
+
+// ServeDebugTop serves an HTML page of the clients and mesh peers with the
+// most traffic, as tracked when SetTrafficTopK is enabled.
+func (s *Server) ServeDebugTop(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, "<html><head><title>DERP top traffic</title></head><body>\n")
+	if !s.topClients.enabled() {
+		io.WriteString(w, "<p>Traffic accounting is disabled.</p></body></html>\n")
+		return
+	}
+	writeTopKTable(w, "Clients", s.topClients.snapshot())
+	writeTopKTable(w, "Mesh peers", s.topPeers.snapshot())
+	io.WriteString(w, "</body></html>\n")
+}
+
+func writeTopKTable(w io.Writer, title string, ents []topKEntry) {
+	fmt.Fprintf(w, "<h2>%s</h2>\n", html.EscapeString(title))
+	if len(ents) == 0 {
+		io.WriteString(w, "<p>None.</p>\n")
+		return
+	}
+	io.WriteString(w, "<table border=1 cellpadding=3><tr><th>Key</th><th>Bytes recv</th><th>Bytes sent</th><th>Packets recv</th><th>Packets sent</th><th>Packets dropped</th><th>Weight</th><th>Error</th></tr>\n")
+	for _, e := range ents {
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td></tr>\n",
+			html.EscapeString(e.Key.ShortString()), e.BytesReceived, e.BytesSent, e.PacketsReceived, e.PacketsSent, e.PacketsDropped, e.Weight, e.Error)
+	}
+	io.WriteString(w, "</table>\n")
+}
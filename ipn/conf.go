@@ -0,0 +1,147 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
+	"tailscale.com/types/preftype"
+)
+
+// ConfigVAlpha is the config file format for the "alpha0" version.
+//
+// Every field is optional. Fields left unset in the file are not
+// managed by the file and may be changed with the CLI as usual.
+type ConfigVAlpha struct {
+	Version string   // "alpha0" for now
+	Locked  opt.Bool `json:",omitempty"` // whether the fields set in the config are locked from being changed by 'tailscale set' or 'up'; it defaults to true
+
+	ServerURL *string  `json:",omitempty"` // if non-nil, used; else, default
+	AuthKey   *string  `json:",omitempty"` // as a string literal or "file:/path/to/file"
+	Enabled   opt.Bool `json:",omitempty"` // wantRunning; if empty, left to 'tailscale up' and 'down'
+
+	OperatorUser *string `json:",omitempty"` // local user name who is allowed to operate tailscaled without being root or using sudo
+	Hostname     *string `json:",omitempty"`
+
+	AcceptDNS    opt.Bool `json:",omitempty"` // --accept-dns
+	AcceptRoutes opt.Bool `json:",omitempty"`
+
+	ExitNode                   *string  `json:",omitempty"` // IP or StableNodeID
+	AllowLANWhileUsingExitNode opt.Bool `json:",omitempty"`
+
+	AdvertiseRoutes   []netip.Prefix `json:",omitempty"`
+	AdvertiseExitNode opt.Bool       `json:",omitempty"`
+	AdvertiseTags     []string       `json:",omitempty"`
+	DisableSNAT       opt.Bool       `json:",omitempty"`
+
+	NetfilterMode *string `json:",omitempty"` // "on", "off", "nodivert"
+
+	RunSSHServer opt.Bool `json:",omitempty"` // Tailscale SSH
+	ShieldsUp    opt.Bool `json:",omitempty"`
+
+	// ServeConfig, if non-nil, is the ServeConfig to use, replacing
+	// any set with 'tailscale serve'.
+	ServeConfig *ServeConfig `json:",omitempty"`
+}
+
+// IsLocked reports whether the fields set in c may not be changed
+// through the LocalAPI (e.g. by 'tailscale set').
+func (c *ConfigVAlpha) IsLocked() bool {
+	v, ok := c.Locked.Get()
+	return !ok || v
+}
+
+// ToPrefs returns a MaskedPrefs with the fields set in c applied.
+// Only the fields that c sets have their corresponding Set bit set.
+func (c *ConfigVAlpha) ToPrefs() (MaskedPrefs, error) {
+	var mp MaskedPrefs
+	if c == nil {
+		return mp, nil
+	}
+	if c.Enabled != "" {
+		mp.WantRunning = c.Enabled.EqualBool(true)
+		mp.WantRunningSet = true
+	}
+	if c.ServerURL != nil {
+		mp.ControlURL = *c.ServerURL
+		mp.ControlURLSet = true
+	}
+	if c.OperatorUser != nil {
+		mp.OperatorUser = *c.OperatorUser
+		mp.OperatorUserSet = true
+	}
+	if c.Hostname != nil {
+		mp.Hostname = *c.Hostname
+		mp.HostnameSet = true
+	}
+	if c.AcceptDNS != "" {
+		mp.CorpDNS = c.AcceptDNS.EqualBool(true)
+		mp.CorpDNSSet = true
+	}
+	if c.AcceptRoutes != "" {
+		mp.RouteAll = c.AcceptRoutes.EqualBool(true)
+		mp.RouteAllSet = true
+	}
+	if c.ExitNode != nil {
+		// Set both so that a previous exit node of the other kind is
+		// cleared.
+		mp.ExitNodeIDSet = true
+		mp.ExitNodeIPSet = true
+		if *c.ExitNode != "" {
+			if ip, err := netip.ParseAddr(*c.ExitNode); err == nil {
+				mp.ExitNodeIP = ip
+			} else {
+				mp.ExitNodeID = tailcfg.StableNodeID(*c.ExitNode)
+			}
+		}
+	}
+	if c.AllowLANWhileUsingExitNode != "" {
+		mp.ExitNodeAllowLANAccess = c.AllowLANWhileUsingExitNode.EqualBool(true)
+		mp.ExitNodeAllowLANAccessSet = true
+	}
+	if c.AdvertiseRoutes != nil || c.AdvertiseExitNode != "" {
+		for _, r := range c.AdvertiseRoutes {
+			if r.Bits() == 0 {
+				return mp, errors.New("AdvertiseRoutes must not contain default routes; use AdvertiseExitNode instead")
+			}
+		}
+		mp.AdvertiseRoutes = append([]netip.Prefix(nil), c.AdvertiseRoutes...)
+		mp.SetAdvertiseExitNode(c.AdvertiseExitNode.EqualBool(true))
+		mp.AdvertiseRoutesSet = true
+	}
+	if c.AdvertiseTags != nil {
+		mp.AdvertiseTags = append([]string(nil), c.AdvertiseTags...)
+		mp.AdvertiseTagsSet = true
+	}
+	if c.DisableSNAT != "" {
+		mp.NoSNAT = c.DisableSNAT.EqualBool(true)
+		mp.NoSNATSet = true
+	}
+	if c.NetfilterMode != nil {
+		switch *c.NetfilterMode {
+		case "on":
+			mp.NetfilterMode = preftype.NetfilterOn
+		case "nodivert":
+			mp.NetfilterMode = preftype.NetfilterNoDivert
+		case "off":
+			mp.NetfilterMode = preftype.NetfilterOff
+		default:
+			return mp, fmt.Errorf("invalid NetfilterMode %q; must be one of on, nodivert, off", *c.NetfilterMode)
+		}
+		mp.NetfilterModeSet = true
+	}
+	if c.RunSSHServer != "" {
+		mp.RunSSH = c.RunSSHServer.EqualBool(true)
+		mp.RunSSHSet = true
+	}
+	if c.ShieldsUp != "" {
+		mp.ShieldsUp = c.ShieldsUp.EqualBool(true)
+		mp.ShieldsUpSet = true
+	}
+	return mp, nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package conffile contains code to load, manipulate, and access config file
+// settings for tailscaled.
+package conffile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tailscale/hujson"
+	"tailscale.com/ipn"
+)
+
+// Config describes a config file.
+type Config struct {
+	Path    string // disk path of HuJSON
+	Raw     []byte // raw bytes from disk, in HuJSON form
+	Std     []byte // standardized JSON form
+	Version string // "alpha0" for now
+
+	// Parsed is the parsed config, converted from its on-disk version to the
+	// latest known format.
+	//
+	// There is currently exactly one format ("alpha0") so this is both
+	// the on-disk format and the in-memory upgraded format.
+	Parsed ipn.ConfigVAlpha
+}
+
+// Equal reports whether c and c2 were loaded from identical file contents.
+func (c *Config) Equal(c2 *Config) bool {
+	if c == nil || c2 == nil {
+		return c == c2
+	}
+	return c.Path == c2.Path && bytes.Equal(c.Raw, c2.Raw)
+}
+
+// AuthKey returns the auth key named by the config, if any.
+//
+// The config's AuthKey may be either a literal key or a reference of the
+// form "file:/path/to/file", in which case the key is read from that file
+// with surrounding whitespace removed.
+func (c *Config) AuthKey() (string, error) {
+	if c == nil || c.Parsed.AuthKey == nil {
+		return "", nil
+	}
+	v := *c.Parsed.AuthKey
+	if path, ok := strings.CutPrefix(v, "file:"); ok {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading AuthKey file: %w", err)
+		}
+		v = strings.TrimSpace(string(b))
+		if v == "" {
+			return "", fmt.Errorf("AuthKey file %q is empty", path)
+		}
+	}
+	return v, nil
+}
+
+// Load reads and parses the config file at the provided path on disk.
+func Load(path string) (*Config, error) {
+	var c Config
+	c.Path = path
+
+	var err error
+	c.Raw, err = os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c.Std, err = hujson.Standardize(c.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s HuJSON/JSON: %w", path, err)
+	}
+	var ver struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(c.Std, &ver); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	switch ver.Version {
+	case "":
+		return nil, fmt.Errorf("error parsing config file %s: no \"version\" field defined", path)
+	case "alpha0":
+	default:
+		return nil, fmt.Errorf("error parsing config file %s: unsupported \"version\" value %q; want \"alpha0\" for now", path, ver.Version)
+	}
+	c.Version = ver.Version
+
+	dec := json.NewDecoder(bytes.NewReader(c.Std))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c.Parsed); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("error parsing config file %s: trailing data after JSON object", path)
+	}
+	if _, err := c.Parsed.ToPrefs(); err != nil {
+		return nil, fmt.Errorf("error in config file %s: %w", path, err)
+	}
+	if c.Parsed.ServeConfig != nil && c.Parsed.ServeConfig.IsFunnelOn() && c.Parsed.ShieldsUp.EqualBool(true) {
+		return nil, fmt.Errorf("error in config file %s: Funnel cannot be enabled with ShieldsUp", path)
+	}
+	return &c, nil
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package conffile
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func writeConf(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "node.hujson")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConf(t, `{
+		// A comment, which plain JSON wouldn't allow.
+		"version": "alpha0",
+		"hostname": "web-1",
+		"advertiseRoutes": ["10.0.0.0/24"],
+		"advertiseExitNode": true,
+		"advertiseTags": ["tag:web"],
+		"exitNode": "stable-node-id",
+		"shieldsUp": false,
+		"serveConfig": {"TCP": {"443": {"HTTPS": true}}},
+	}`)
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version != "alpha0" {
+		t.Errorf("Version = %q", c.Version)
+	}
+	mp, err := c.Parsed.ToPrefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mp.HostnameSet || mp.Hostname != "web-1" {
+		t.Errorf("Hostname = %q, set=%v", mp.Hostname, mp.HostnameSet)
+	}
+	wantRoutes := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+	}
+	if !mp.AdvertiseRoutesSet || !reflect.DeepEqual(mp.AdvertiseRoutes, wantRoutes) {
+		t.Errorf("AdvertiseRoutes = %v; want %v", mp.AdvertiseRoutes, wantRoutes)
+	}
+	if !mp.ExitNodeIDSet || !mp.ExitNodeIPSet || mp.ExitNodeID != tailcfg.StableNodeID("stable-node-id") {
+		t.Errorf("ExitNodeID = %q", mp.ExitNodeID)
+	}
+	if !mp.ShieldsUpSet || mp.ShieldsUp {
+		t.Errorf("ShieldsUp = %v, set=%v", mp.ShieldsUp, mp.ShieldsUpSet)
+	}
+	if mp.RunSSHSet || mp.CorpDNSSet || mp.RouteAllSet || mp.WantRunningSet {
+		t.Errorf("unexpected fields set: %v", mp.Pretty())
+	}
+	if sc := c.Parsed.ServeConfig; sc == nil || !sc.TCP[443].HTTPS {
+		t.Errorf("ServeConfig = %+v", sc)
+	}
+	if !c.Parsed.IsLocked() {
+		t.Errorf("IsLocked = false; want true by default")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr string
+	}{
+		{"no-version", `{"hostname": "x"}`, `no "version"`},
+		{"bad-version", `{"version": "beta9"}`, `unsupported "version"`},
+		{"unknown-field", `{"version": "alpha0", "hostnme": "x"}`, `unknown field`},
+		{"default-route", `{"version": "alpha0", "advertiseRoutes": ["0.0.0.0/0"]}`, `AdvertiseExitNode`},
+		{"netfilter", `{"version": "alpha0", "netfilterMode": "sometimes"}`, `invalid NetfilterMode`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConf(t, tt.conf))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load error = %v; want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "authkey")
+	if err := os.WriteFile(keyFile, []byte("tskey-from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		ref  string
+		want string
+	}{
+		{"tskey-literal", "tskey-literal"},
+		{"file:" + keyFile, "tskey-from-file"},
+	} {
+		c := &Config{}
+		c.Parsed.AuthKey = &tt.ref
+		got, err := c.AuthKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("AuthKey(%q) = %q; want %q", tt.ref, got, tt.want)
+		}
+	}
+}
@@ -68,6 +68,12 @@ func (src *ServeConfig) Clone() *ServeConfig {
 			dst.TCP[k] = v.Clone()
 		}
 	}
+	if dst.UDP != nil {
+		dst.UDP = map[uint16]*UDPPortHandler{}
+		for k, v := range src.UDP {
+			dst.UDP[k] = v.Clone()
+		}
+	}
 	if dst.Web != nil {
 		dst.Web = map[HostPort]*WebServerConfig{}
 		for k, v := range src.Web {
@@ -81,6 +87,7 @@ func (src *ServeConfig) Clone() *ServeConfig {
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ServeConfigCloneNeedsRegeneration = ServeConfig(struct {
 	TCP         map[uint16]*TCPPortHandler
+	UDP         map[uint16]*UDPPortHandler
 	Web         map[HostPort]*WebServerConfig
 	AllowFunnel map[HostPort]bool
 }{})
@@ -104,6 +111,24 @@ func (src *TCPPortHandler) Clone() *TCPPortHandler {
 	TerminateTLS string
 }{})
 
+// Clone makes a deep copy of UDPPortHandler.
+// The result aliases no memory with the original.
+func (src *UDPPortHandler) Clone() *UDPPortHandler {
+	if src == nil {
+		return nil
+	}
+	dst := new(UDPPortHandler)
+	*dst = *src
+	return dst
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _UDPPortHandlerCloneNeedsRegeneration = UDPPortHandler(struct {
+	Forward        string
+	IdleTimeoutSec int
+	BindSourcePort bool
+}{})
+
 // Clone makes a deep copy of HTTPHandler.
 // The result aliases no memory with the original.
 func (src *HTTPHandler) Clone() *HTTPHandler {
@@ -112,14 +137,22 @@ func (src *HTTPHandler) Clone() *HTTPHandler {
 	}
 	dst := new(HTTPHandler)
 	*dst = *src
+	dst.Headers = maps.Clone(src.Headers)
+	dst.AllowFrom = append(src.AllowFrom[:0:0], src.AllowFrom...)
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerCloneNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path          string
+	Proxy         string
+	Text          string
+	Redirect      string
+	RedirectCode  int
+	Headers       map[string]string
+	NoListing     bool
+	NoStripPrefix bool
+	AllowFrom     []string
 }{})
 
 // Clone makes a deep copy of WebServerConfig.
@@ -16,7 +16,7 @@
 	"tailscale.com/types/views"
 )
 
-//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,HTTPHandler,WebServerConfig
+//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,UDPPortHandler,HTTPHandler,WebServerConfig
 
 // View returns a readonly view of Prefs.
 func (p *Prefs) View() PrefsView {
@@ -165,6 +165,12 @@ func (v ServeConfigView) TCP() views.MapFn[uint16, *TCPPortHandler, TCPPortHandl
 	})
 }
 
+func (v ServeConfigView) UDP() views.MapFn[uint16, *UDPPortHandler, UDPPortHandlerView] {
+	return views.MapFnOf(v.ж.UDP, func(t *UDPPortHandler) UDPPortHandlerView {
+		return t.View()
+	})
+}
+
 func (v ServeConfigView) Web() views.MapFn[HostPort, *WebServerConfig, WebServerConfigView] {
 	return views.MapFnOf(v.ж.Web, func(t *WebServerConfig) WebServerConfigView {
 		return t.View()
@@ -178,6 +184,7 @@ func (v ServeConfigView) AllowFunnel() views.Map[HostPort, bool] {
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ServeConfigViewNeedsRegeneration = ServeConfig(struct {
 	TCP         map[uint16]*TCPPortHandler
+	UDP         map[uint16]*UDPPortHandler
 	Web         map[HostPort]*WebServerConfig
 	AllowFunnel map[HostPort]bool
 }{})
@@ -240,6 +247,62 @@ func (v TCPPortHandlerView) TerminateTLS() string { return v.ж.TerminateTLS }
 	TerminateTLS string
 }{})
 
+// View returns a readonly view of UDPPortHandler.
+func (p *UDPPortHandler) View() UDPPortHandlerView {
+	return UDPPortHandlerView{ж: p}
+}
+
+// UDPPortHandlerView provides a read-only view over UDPPortHandler.
+//
+// Its methods should only be called if `Valid()` returns true.
+type UDPPortHandlerView struct {
+	// ж is the underlying mutable value, named with a hard-to-type
+	// character that looks pointy like a pointer.
+	// It is named distinctively to make you think of how dangerous it is to escape
+	// to callers. You must not let callers be able to mutate it.
+	ж *UDPPortHandler
+}
+
+// Valid reports whether underlying value is non-nil.
+func (v UDPPortHandlerView) Valid() bool { return v.ж != nil }
+
+// AsStruct returns a clone of the underlying value which aliases no memory with
+// the original.
+func (v UDPPortHandlerView) AsStruct() *UDPPortHandler {
+	if v.ж == nil {
+		return nil
+	}
+	return v.ж.Clone()
+}
+
+func (v UDPPortHandlerView) MarshalJSON() ([]byte, error) { return json.Marshal(v.ж) }
+
+func (v *UDPPortHandlerView) UnmarshalJSON(b []byte) error {
+	if v.ж != nil {
+		return errors.New("already initialized")
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var x UDPPortHandler
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	v.ж = &x
+	return nil
+}
+
+func (v UDPPortHandlerView) Forward() string      { return v.ж.Forward }
+func (v UDPPortHandlerView) IdleTimeoutSec() int  { return v.ж.IdleTimeoutSec }
+func (v UDPPortHandlerView) BindSourcePort() bool { return v.ж.BindSourcePort }
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _UDPPortHandlerViewNeedsRegeneration = UDPPortHandler(struct {
+	Forward        string
+	IdleTimeoutSec int
+	BindSourcePort bool
+}{})
+
 // View returns a readonly view of HTTPHandler.
 func (p *HTTPHandler) View() HTTPHandlerView {
 	return HTTPHandlerView{ж: p}
@@ -285,15 +348,27 @@ func (v *HTTPHandlerView) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (v HTTPHandlerView) Path() string  { return v.ж.Path }
-func (v HTTPHandlerView) Proxy() string { return v.ж.Proxy }
-func (v HTTPHandlerView) Text() string  { return v.ж.Text }
+func (v HTTPHandlerView) Path() string                       { return v.ж.Path }
+func (v HTTPHandlerView) Proxy() string                      { return v.ж.Proxy }
+func (v HTTPHandlerView) Text() string                       { return v.ж.Text }
+func (v HTTPHandlerView) Redirect() string                   { return v.ж.Redirect }
+func (v HTTPHandlerView) RedirectCode() int                  { return v.ж.RedirectCode }
+func (v HTTPHandlerView) Headers() views.Map[string, string] { return views.MapOf(v.ж.Headers) }
+func (v HTTPHandlerView) NoListing() bool                    { return v.ж.NoListing }
+func (v HTTPHandlerView) NoStripPrefix() bool                { return v.ж.NoStripPrefix }
+func (v HTTPHandlerView) AllowFrom() views.Slice[string]     { return views.SliceOf(v.ж.AllowFrom) }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerViewNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path          string
+	Proxy         string
+	Text          string
+	Redirect      string
+	RedirectCode  int
+	Headers       map[string]string
+	NoListing     bool
+	NoStripPrefix bool
+	AllowFrom     []string
 }{})
 
 // View returns a readonly view of WebServerConfig.
@@ -0,0 +1,108 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/conffile"
+)
+
+// SetConfigFile sets the declarative config file that tailscaled was
+// started with and applies the prefs and ServeConfig it declares. It's
+// called at startup and again whenever the file changes.
+//
+// Fields set in c take precedence over what's in the state store. Unless
+// c is explicitly unlocked, they can't subsequently be changed via
+// EditPrefs, Start or SetServeConfig; only by editing the file.
+//
+// A nil c releases ownership of all fields, leaving their current values
+// in place.
+func (b *LocalBackend) SetConfigFile(c *conffile.Config) error {
+	var mp ipn.MaskedPrefs
+	if c != nil {
+		var err error
+		mp, err = c.Parsed.ToPrefs()
+		if err != nil {
+			return fmt.Errorf("config file %s: %w", c.Path, err)
+		}
+	}
+
+	b.mu.Lock()
+	b.conf = c
+	b.mu.Unlock()
+
+	if !mp.IsEmpty() {
+		if _, err := b.editPrefs(&mp, false); err != nil {
+			return fmt.Errorf("applying config file %s: %w", c.Path, err)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.setTCPPortsInterceptedFromNetmapAndPrefsLocked(b.pm.CurrentPrefs())
+	return nil
+}
+
+// configFileServeConfigLocked returns the ServeConfig declared in the
+// config file, or nil if there's no config file or it doesn't declare one.
+//
+// b.mu must be held.
+func (b *LocalBackend) configFileServeConfigLocked() *ipn.ServeConfig {
+	if b.conf == nil {
+		return nil
+	}
+	return b.conf.Parsed.ServeConfig
+}
+
+// checkConfigFileEditLocked returns an error if changing the prefs from
+// oldp to newp would modify any pref owned by a locked config file.
+//
+// b.mu must be held.
+func (b *LocalBackend) checkConfigFileEditLocked(oldp ipn.PrefsView, newp *ipn.Prefs) error {
+	if b.conf == nil || !b.conf.Parsed.IsLocked() || !oldp.Valid() {
+		return nil
+	}
+	owned, err := b.conf.Parsed.ToPrefs()
+	if err != nil {
+		return err
+	}
+	ov := reflect.ValueOf(&owned).Elem()
+	oldv := reflect.ValueOf(oldp.AsStruct()).Elem()
+	newv := reflect.ValueOf(newp).Elem()
+	var changed []string
+	for i := 0; i < ov.NumField(); i++ {
+		sf := ov.Type().Field(i)
+		name, ok := strings.CutSuffix(sf.Name, "Set")
+		if !ok || sf.Type.Kind() != reflect.Bool || !ov.Field(i).Bool() {
+			continue
+		}
+		// Look up the Prefs field by name rather than by position so
+		// that this doesn't silently check the wrong field if the
+		// layouts of MaskedPrefs and Prefs drift apart.
+		oldf, newf := oldv.FieldByName(name), newv.FieldByName(name)
+		if !oldf.IsValid() || !newf.IsValid() {
+			return fmt.Errorf("config file owns unknown pref %q", name)
+		}
+		if !prefFieldEqual(oldf, newf) {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("cannot change %s: managed by config file %s", strings.Join(changed, ", "), b.conf.Path)
+	}
+	return nil
+}
+
+// prefFieldEqual reports whether the two values of the same Prefs
+// field are equal, treating nil and empty slices as equal.
+func prefFieldEqual(a, b reflect.Value) bool {
+	if a.Kind() == reflect.Slice && a.Len() == 0 && b.Len() == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
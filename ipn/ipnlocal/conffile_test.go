@@ -0,0 +1,182 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"strings"
+	"testing"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/conffile"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tsd"
+	"tailscale.com/tstest"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logid"
+	"tailscale.com/types/persist"
+	"tailscale.com/types/ptr"
+	"tailscale.com/wgengine"
+)
+
+func TestConfigFileOwnsPrefs(t *testing.T) {
+	logf := tstest.WhileTestRunningLogger(t)
+	sys := new(tsd.System)
+	sys.Set(new(mem.Store))
+	e, err := wgengine.NewFakeUserspaceEngine(logf, sys.Set)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(e.Close)
+	sys.Set(e)
+
+	b, err := NewLocalBackend(logf, logid.PublicID{}, sys, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	b.pm.SetPrefs(ipn.NewPrefs().View())
+
+	conf := &conffile.Config{Path: "/etc/tailscale.conf"}
+	conf.Parsed = ipn.ConfigVAlpha{
+		Version:   "alpha0",
+		Hostname:  ptr.To("from-file"),
+		ShieldsUp: "true",
+	}
+	if err := b.SetConfigFile(conf); err != nil {
+		t.Fatalf("SetConfigFile: %v", err)
+	}
+	if p := b.pm.CurrentPrefs(); p.Hostname() != "from-file" || !p.ShieldsUp() {
+		t.Fatalf("after SetConfigFile: Hostname=%q ShieldsUp=%v", p.Hostname(), p.ShieldsUp())
+	}
+
+	for _, tt := range []struct {
+		name    string
+		mp      *ipn.MaskedPrefs
+		wantErr string // or empty for success
+	}{
+		{
+			name: "hostname",
+			mp: &ipn.MaskedPrefs{
+				Prefs:       ipn.Prefs{Hostname: "from-cli"},
+				HostnameSet: true,
+			},
+			wantErr: "cannot change Hostname",
+		},
+		{
+			name: "shields-up",
+			mp: &ipn.MaskedPrefs{
+				Prefs:        ipn.Prefs{ShieldsUp: false},
+				ShieldsUpSet: true,
+			},
+			wantErr: "cannot change ShieldsUp",
+		},
+		{
+			name: "same-value",
+			mp: &ipn.MaskedPrefs{
+				Prefs:       ipn.Prefs{Hostname: "from-file"},
+				HostnameSet: true,
+			},
+		},
+		{
+			name: "not-owned",
+			mp: &ipn.MaskedPrefs{
+				Prefs:       ipn.Prefs{RouteAll: true},
+				RouteAllSet: true,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := b.EditPrefs(tt.mp)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("EditPrefs: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("EditPrefs error = %v; want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+	if p := b.pm.CurrentPrefs(); p.Hostname() != "from-file" || !p.ShieldsUp() || !p.RouteAll() {
+		t.Errorf("after edits: Hostname=%q ShieldsUp=%v RouteAll=%v", p.Hostname(), p.ShieldsUp(), p.RouteAll())
+	}
+
+	// The file doesn't set Enabled, so 'tailscale up' and 'down' still
+	// own WantRunning.
+	b.mu.Lock()
+	p1 := b.pm.CurrentPrefs().AsStruct()
+	p1.WantRunning = !p1.WantRunning
+	err = b.checkConfigFileEditLocked(b.pm.CurrentPrefs(), p1)
+	b.mu.Unlock()
+	if err != nil {
+		t.Errorf("changing WantRunning: %v", err)
+	}
+
+	// Once unlocked, the file's fields can be changed.
+	conf.Parsed.Locked = "false"
+	if err := b.SetConfigFile(conf); err != nil {
+		t.Fatalf("SetConfigFile: %v", err)
+	}
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:       ipn.Prefs{Hostname: "from-cli"},
+		HostnameSet: true,
+	}); err != nil {
+		t.Errorf("EditPrefs with unlocked config: %v", err)
+	}
+}
+
+func TestConfigFileAuthKey(t *testing.T) {
+	logf := tstest.WhileTestRunningLogger(t)
+	sys := new(tsd.System)
+	sys.Set(new(mem.Store))
+	e, err := wgengine.NewFakeUserspaceEngine(logf, sys.Set)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(e.Close)
+	sys.Set(e)
+
+	b, err := NewLocalBackend(logf, logid.PublicID{}, sys, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	var cc *mockControl
+	b.SetControlClientGetterForTesting(func(opts controlclient.Options) (controlclient.Client, error) {
+		cc = newClient(t, opts)
+		return cc, nil
+	})
+
+	conf := &conffile.Config{Path: "/etc/tailscale.conf"}
+	conf.Parsed = ipn.ConfigVAlpha{
+		Version: "alpha0",
+		AuthKey: ptr.To("tskey-from-file"),
+	}
+	if err := b.SetConfigFile(conf); err != nil {
+		t.Fatalf("SetConfigFile: %v", err)
+	}
+
+	// Without a node key, the config file's AuthKey is used to log in
+	// without user interaction.
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if cc.opts.AuthKey != "tskey-from-file" {
+		t.Errorf("AuthKey = %q; want the config file's", cc.opts.AuthKey)
+	}
+	cc.assertCalls("Login")
+
+	// Once the node has a node key, restarts don't send it again.
+	p := b.pm.CurrentPrefs().AsStruct()
+	p.Persist = &persist.Persist{PrivateNodeKey: key.NewNode()}
+	if err := b.pm.SetPrefs(p.View()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if cc.opts.AuthKey != "" {
+		t.Errorf("AuthKey = %q after login; want none", cc.opts.AuthKey)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/dns/resolver"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+var errNoDNSManager = errors.New("DNS manager not available")
+
+// DNSStatus returns the DNS configuration that was most recently applied
+// to the system.
+func (b *LocalBackend) DNSStatus() (*apitype.DNSStatus, error) {
+	dm, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return nil, errNoDNSManager
+	}
+	st := dm.Status()
+	ret := &apitype.DNSStatus{
+		OSConfigurator:   st.OSConfigurator,
+		SupportsSplitDNS: st.SupportsSplitDNS,
+		DefaultResolvers: st.Config.DefaultResolvers,
+		Routes:           routesByName(st.Config.Routes),
+		NumHosts:         len(st.Config.Hosts),
+		ResolverRoutes:   routesByName(st.ResolverConfig.Routes),
+		OSNameservers:    st.OSConfig.Nameservers,
+	}
+	for _, d := range st.Config.SearchDomains {
+		ret.SearchDomains = append(ret.SearchDomains, d.WithoutTrailingDot())
+	}
+	for _, d := range st.OSConfig.SearchDomains {
+		ret.OSSearchDomains = append(ret.OSSearchDomains, d.WithoutTrailingDot())
+	}
+	for _, d := range st.OSConfig.MatchDomains {
+		ret.OSMatchDomains = append(ret.OSMatchDomains, d.WithoutTrailingDot())
+	}
+	return ret, nil
+}
+
+func routesByName(routes map[dnsname.FQDN][]*dnstype.Resolver) map[string][]*dnstype.Resolver {
+	if len(routes) == 0 {
+		return nil
+	}
+	ret := make(map[string][]*dnstype.Resolver, len(routes))
+	for suffix, rs := range routes {
+		ret[string(suffix)] = rs
+	}
+	return ret
+}
+
+// QueryDNS looks up name with the given query type using the resolver
+// at 100.100.100.100, as a local client of it would. It returns the raw
+// DNS response along with the upstream resolvers that the query would be
+// forwarded to if it's not answered by MagicDNS.
+func (b *LocalBackend) QueryDNS(ctx context.Context, name string, queryType dnsmessage.Type) (res []byte, resolvers []*dnstype.Resolver, err error) {
+	dm, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return nil, nil, errNoDNSManager
+	}
+	fqdn, err := dnsname.ToFQDN(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	q, err := dnsQueryMessage(fqdn, queryType)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := dm.Resolver()
+	res, err = r.Query(ctx, q, netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+	if err != nil {
+		return nil, nil, fmt.Errorf("querying %q: %w", fqdn.WithoutTrailingDot(), err)
+	}
+	return res, r.GetUpstreamResolvers(fqdn), nil
+}
+
+// WatchDNSQueryLog calls fn with the queries recently logged by the resolver
+// at 100.100.100.100, and then with each new query until ctx is done.
+// Queries are only logged while they're being watched.
+func (b *LocalBackend) WatchDNSQueryLog(ctx context.Context, fn func(*apitype.DNSQueryLogEntry)) error {
+	dm, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return errNoDNSManager
+	}
+	dm.Resolver().WatchQueryLog(ctx, func(e resolver.QueryLogEntry) {
+		ent := &apitype.DNSQueryLogEntry{
+			Time:     e.Time,
+			Source:   e.Source,
+			Name:     e.Name,
+			Type:     e.Type,
+			RCode:    e.RCode,
+			Upstream: e.Upstream,
+			Local:    e.Local,
+			Cached:   e.Cached,
+			ExitNode: e.ExitNode,
+			Latency:  e.Latency,
+			Err:      e.Err,
+		}
+		if e.Source.Addr().IsValid() && !e.Source.Addr().IsUnspecified() {
+			if n, _, ok := b.WhoIs(e.Source); ok {
+				ent.SourceNode = strings.TrimSuffix(n.Name(), ".")
+			}
+		}
+		fn(ent)
+	})
+	return nil
+}
+
+// DNSUpstreamStats returns the stats of the upstream resolvers that the
+// resolver at 100.100.100.100 has forwarded queries to.
+func (b *LocalBackend) DNSUpstreamStats() ([]apitype.DNSUpstreamStats, error) {
+	dm, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return nil, errNoDNSManager
+	}
+	stats := dm.Resolver().UpstreamStats()
+	ret := make([]apitype.DNSUpstreamStats, len(stats))
+	for i, st := range stats {
+		ret[i] = apitype.DNSUpstreamStats{
+			Upstream:     st.Upstream,
+			Queries:      st.Queries,
+			Errors:       st.Errors,
+			Answered:     st.Answered,
+			TotalLatency: st.TotalLatency,
+			MaxLatency:   st.MaxLatency,
+		}
+	}
+	return ret, nil
+}
+
+// dnsQueryMessage returns a DNS query message asking for records of type
+// typ for name.
+func dnsQueryMessage(name dnsname.FQDN, typ dnsmessage.Type) ([]byte, error) {
+	qname, err := dnsmessage.NewName(name.WithTrailingDot())
+	if err != nil {
+		return nil, err
+	}
+	bld := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               uint16(rand.Intn(1 << 16)),
+		RecursionDesired: true,
+	})
+	if err := bld.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := bld.Question(dnsmessage.Question{
+		Name:  qname,
+		Type:  typ,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, err
+	}
+	return bld.Finish()
+}
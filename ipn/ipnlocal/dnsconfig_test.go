@@ -9,8 +9,10 @@
 	"reflect"
 	"testing"
 
+	"golang.org/x/net/dns/dnsmessage"
 	"tailscale.com/ipn"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/types/dnstype"
@@ -154,6 +156,34 @@ func TestDNSConfigForNetmap(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "extra_records_typed",
+			nm: &netmap.NetworkMap{
+				Name:      "myname.net",
+				Addresses: ipps("100.101.101.101"),
+				DNS: tailcfg.DNSConfig{
+					ExtraRecords: []tailcfg.DNSRecord{
+						{Name: "www.myname.net", Type: "CNAME", Value: "myname.net"},
+						{Name: "_http._tcp.myname.net", Type: "SRV", Value: "10 5 80 myname.net"},
+						{Name: "myname.net", Type: "TXT", Value: "hello"},
+						{Name: "myname.net", Type: "MX", Value: "bogus"},
+					},
+				},
+			},
+			prefs: &ipn.Prefs{},
+			want: &dns.Config{
+				Routes: map[dnsname.FQDN][]*dnstype.Resolver{},
+				Hosts: map[dnsname.FQDN][]netip.Addr{
+					"myname.net.": ips("100.101.101.101"),
+				},
+				Records: map[dnsname.FQDN][]resolver.Record{
+					"www.myname.net.":        {{Type: dnsmessage.TypeCNAME, Target: "myname.net."}},
+					"_http._tcp.myname.net.": {{Type: dnsmessage.TypeSRV, Priority: 10, Weight: 5, Port: 80, Target: "myname.net."}},
+					"myname.net.":            {{Type: dnsmessage.TypeTXT, TXT: []string{"hello"}}},
+				},
+			},
+			wantLog: "[unexpected] ignoring DNS extra record \"myname.net\": invalid MX record \"bogus\"; want \"preference exchange\"\n",
+		},
 		{
 			name: "corp_dns_misc",
 			nm: &netmap.NetworkMap{
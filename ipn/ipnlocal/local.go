@@ -4,6 +4,8 @@
 package ipnlocal
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -11,6 +13,7 @@
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -41,18 +44,21 @@
 	"tailscale.com/health/healthmsg"
 	"tailscale.com/hostinfo"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/conffile"
 	"tailscale.com/ipn/ipnauth"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/policy"
 	"tailscale.com/log/sockstatlog"
 	"tailscale.com/logpolicy"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/dnsfallback"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/netutil"
+	"tailscale.com/net/speedtest"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/paths"
@@ -64,10 +70,12 @@
 	"tailscale.com/tstime"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/empty"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/nettype"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
 	"tailscale.com/types/ptr"
@@ -159,6 +167,8 @@ type LocalBackend struct {
 	sshAtomicBool         atomic.Bool
 	shutdownCalled        bool // if Shutdown has been called
 	debugSink             *capture.Sink
+	debugRing             *capture.Ring // or nil if no capture ring is running
+	debugRingUnregister   func()        // unregisters debugRing from debugSink
 	sockstatLogger        *sockstatlog.Logger
 
 	// getTCPHandlerForFunnelFlow returns a handler for an incoming TCP flow for
@@ -184,6 +194,7 @@ type LocalBackend struct {
 	filterAtomic                 atomic.Pointer[filter.Filter]
 	containsViaIPFuncAtomic      syncs.AtomicValue[func(netip.Addr) bool]
 	shouldInterceptTCPPortAtomic syncs.AtomicValue[func(uint16) bool]
+	shouldInterceptUDPPortAtomic syncs.AtomicValue[func(uint16) bool]
 	numClientStatusCalls         atomic.Uint32
 
 	// The mutex protects the following elements.
@@ -239,12 +250,18 @@ type LocalBackend struct {
 	directFileDoFinalRename bool // false on macOS, true on several NAS platforms
 	componentLogUntil       map[string]componentLogState
 
+	// conf is the declarative config file that tailscaled was started
+	// with (via --config), or nil if none. Prefs and the ServeConfig
+	// that it sets take precedence over what's in the state store.
+	conf *conffile.Config
+
 	// ServeConfig fields. (also guarded by mu)
 	lastServeConfJSON mem.RO              // last JSON that was parsed into serveConfig
 	serveConfig       ipn.ServeConfigView // or !Valid if none
 
 	serveListeners     map[netip.AddrPort]*serveListener // addrPort => serveListener
 	serveProxyHandlers sync.Map                          // string (HTTPHandler.Proxy) => *httputil.ReverseProxy
+	serveUDPFlows      map[uint16]int                    // serve port => number of active UDP flows
 	// serveStreamers is a map for those running Funnel in the foreground
 	// and streaming incoming requests.
 	serveStreamers map[uint16]map[uint32]func(ipn.FunnelRequestLog) // serve port => map of stream loggers (key is UUID)
@@ -336,6 +353,7 @@ func NewLocalBackend(logf logger.Logf, logID logid.PublicID, sys *tsd.System, lo
 	b.setFilter(filter.NewAllowNone(logf, &netipx.IPSet{}))
 
 	b.setTCPPortsIntercepted(nil)
+	b.setUDPPortsIntercepted(nil)
 
 	b.statusChanged = sync.NewCond(&b.statusLock)
 	b.e.SetStatusCallback(b.setWgengineStatus)
@@ -578,6 +596,8 @@ func (b *LocalBackend) Shutdown() {
 		b.e.InstallCaptureHook(nil)
 		b.debugSink.Close()
 		b.debugSink = nil
+		b.debugRing = nil
+		b.debugRingUnregister = nil
 	}
 	b.mu.Unlock()
 
@@ -1309,6 +1329,10 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 
 	b.mu.Lock()
 	if opts.UpdatePrefs != nil {
+		if err := b.checkConfigFileEditLocked(b.pm.CurrentPrefs(), opts.UpdatePrefs); err != nil {
+			b.mu.Unlock()
+			return err
+		}
 		if err := b.checkPrefsLocked(opts.UpdatePrefs); err != nil {
 			b.mu.Unlock()
 			return err
@@ -1321,6 +1345,19 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	}
 	profileID := b.pm.CurrentProfile().ID
 
+	// A config file's AuthKey is only used to log in a node that doesn't
+	// have a node key yet, not sent to control on every restart.
+	authKeyFromConfigFile := false
+	if opts.AuthKey == "" && b.conf != nil && !b.hasNodeKeyLocked() {
+		authKey, err := b.conf.AuthKey()
+		if err != nil {
+			b.mu.Unlock()
+			return err
+		}
+		opts.AuthKey = authKey
+		authKeyFromConfigFile = authKey != ""
+	}
+
 	// The iOS client sends a "Start" whenever its UI screen comes
 	// up, just because it wants a netmap. That should be fixed,
 	// but meanwhile we can make Start cheaper here for such a
@@ -1500,10 +1537,13 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	b.send(ipn.Notify{BackendLogID: &blid})
 	b.send(ipn.Notify{Prefs: &prefs})
 
-	if !loggedOut && b.hasNodeKey() {
+	if !loggedOut && (b.hasNodeKey() || authKeyFromConfigFile) {
 		// Even if !WantRunning, we should verify our key, if there
 		// is one. If you want tailscaled to be completely idle,
 		// use logout instead.
+		//
+		// With an AuthKey from the config file, this logs in
+		// without any user interaction.
 		cc.Login(nil, controlclient.LoginDefault)
 	}
 	b.stateMachine()
@@ -2286,6 +2326,19 @@ func (b *LocalBackend) migrateStateLocked(prefs *ipn.Prefs) (err error) {
 // efficient func for ShouldInterceptTCPPort to use, which is called on every
 // incoming packet.
 func (b *LocalBackend) setTCPPortsIntercepted(ports []uint16) {
+	b.shouldInterceptTCPPortAtomic.Store(portMatcher(ports))
+}
+
+// setUDPPortsIntercepted populates b.shouldInterceptUDPPortAtomic with an
+// efficient func for ShouldInterceptUDPPort to use, which is called on every
+// incoming packet.
+func (b *LocalBackend) setUDPPortsIntercepted(ports []uint16) {
+	b.shouldInterceptUDPPortAtomic.Store(portMatcher(ports))
+}
+
+// portMatcher returns an efficient func that reports whether a port is
+// in ports.
+func portMatcher(ports []uint16) func(uint16) bool {
 	slices.Sort(ports)
 	uniq.ModifySlice(&ports)
 	var f func(uint16) bool
@@ -2316,7 +2369,7 @@ func (b *LocalBackend) setTCPPortsIntercepted(ports []uint16) {
 			}
 		}
 	}
-	b.shouldInterceptTCPPortAtomic.Store(f)
+	return f
 }
 
 // setAtomicValuesFromPrefsLocked populates sshAtomicBool, containsViaIPFuncAtomic
@@ -2327,6 +2380,7 @@ func (b *LocalBackend) setAtomicValuesFromPrefsLocked(p ipn.PrefsView) {
 	if !p.Valid() {
 		b.containsViaIPFuncAtomic.Store(tsaddr.NewContainsIPFunc(nil))
 		b.setTCPPortsIntercepted(nil)
+		b.setUDPPortsIntercepted(nil)
 		b.lastServeConfJSON = mem.B(nil)
 		b.serveConfig = ipn.ServeConfigView{}
 	} else {
@@ -2502,6 +2556,82 @@ func (b *LocalBackend) pingPeerAPI(ctx context.Context, ip netip.Addr) (peer tai
 	return peer, base, nil
 }
 
+// Speedtest runs a throughput test in direction dir for duration d
+// against the peer with Tailscale IP ip, over the peer's peerAPI. The peer
+// must grant this node tailcfg.PeerCapabilitySpeedtest, unless it's owned
+// by the same user.
+func (b *LocalBackend) Speedtest(ctx context.Context, ip netip.Addr, dir speedtest.Direction, d time.Duration) ([]speedtest.Result, error) {
+	if d < speedtest.MinDuration || d > speedtest.MaxDuration {
+		return nil, fmt.Errorf("test duration must be within %v and %v", speedtest.MinDuration, speedtest.MaxDuration)
+	}
+	nm := b.NetMap()
+	if nm == nil {
+		return nil, errors.New("no netmap")
+	}
+	peer, ok := nm.PeerByTailscaleIP(ip)
+	if !ok {
+		return nil, fmt.Errorf("no peer found with Tailscale IP %v", ip)
+	}
+	base := peerAPIBase(nm, peer)
+	if base == "" {
+		return nil, fmt.Errorf("no PeerAPI base found for peer %v (%v)", peer.ID(), ip)
+	}
+	conn, err := b.dialPeerSpeedtest(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	res, err := speedtest.RunClientConn(conn, dir, d)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return res, err
+}
+
+// dialPeerSpeedtest dials the peerAPI at base (as returned by peerAPIBase)
+// and upgrades the connection to the speedtest protocol.
+func (b *LocalBackend) dialPeerSpeedtest(ctx context.Context, base string) (net.Conn, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", base+"/v0/speedtest", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", speedtestUpgradeProto)
+
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	conn, err := b.Dialer().PeerAPITransport().DialContext(dialCtx, "tcp", req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if dl, ok := dialCtx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		res.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("peer speedtest: %v: %s", res.Status, bytes.TrimSpace(body))
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, errors.New("peer speedtest: unexpected data after upgrade")
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
 // parseWgStatusLocked returns an EngineStatus based on s.
 //
 // b.mu must be held; mostly because the caller is about to anyway, and doing so
@@ -2693,6 +2823,12 @@ func (b *LocalBackend) checkFunnelEnabledLocked(p *ipn.Prefs) error {
 }
 
 func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (ipn.PrefsView, error) {
+	return b.editPrefs(mp, true)
+}
+
+// editPrefs implements EditPrefs. If enforceConfigFile is true, edits
+// that would change prefs owned by a locked config file are rejected.
+func (b *LocalBackend) editPrefs(mp *ipn.MaskedPrefs, enforceConfigFile bool) (ipn.PrefsView, error) {
 	b.mu.Lock()
 	if mp.EggSet {
 		mp.EggSet = false
@@ -2702,6 +2838,13 @@ func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (ipn.PrefsView, error) {
 	p0 := b.pm.CurrentPrefs()
 	p1 := b.pm.CurrentPrefs().AsStruct()
 	p1.ApplyEdits(mp)
+	if enforceConfigFile {
+		if err := b.checkConfigFileEditLocked(p0, p1); err != nil {
+			b.mu.Unlock()
+			b.logf("EditPrefs config file error: %v", err)
+			return ipn.PrefsView{}, err
+		}
+	}
 	if err := b.checkPrefsLocked(p1); err != nil {
 		b.mu.Unlock()
 		b.logf("EditPrefs check error: %v", err)
@@ -2785,10 +2928,15 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) ipn
 	setExitNodeID(newp, netMap)
 	// We do this to avoid holding the lock while doing everything else.
 
+	// Before Start, such as when tailscaled applies its config file,
+	// there's no Hostinfo yet; Start applies the prefs to the one it
+	// creates.
 	oldHi := b.hostinfo
 	newHi := oldHi.Clone()
-	b.applyPrefsToHostinfoLocked(newHi, newp.View())
-	b.hostinfo = newHi
+	if newHi != nil {
+		b.applyPrefsToHostinfoLocked(newHi, newp.View())
+		b.hostinfo = newHi
+	}
 	hostInfoChanged := !oldHi.Equal(newHi)
 	cc := b.cc
 
@@ -2826,7 +2974,7 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) ipn
 	b.lastProfileID = b.pm.CurrentProfile().ID
 	b.mu.Unlock()
 
-	if oldp.ShieldsUp() != newp.ShieldsUp || hostInfoChanged {
+	if newHi != nil && (oldp.ShieldsUp() != newp.ShieldsUp || hostInfoChanged) {
 		b.doSetHostinfoFilterServices(newHi)
 	}
 
@@ -2834,7 +2982,7 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) ipn
 		b.e.SetDERPMap(netMap.DERPMap)
 	}
 
-	if !oldp.WantRunning() && newp.WantRunning {
+	if !oldp.WantRunning() && newp.WantRunning && cc != nil {
 		b.logf("transitioning to running; doing Login...")
 		cc.Login(nil, controlclient.LoginDefault)
 	}
@@ -2925,6 +3073,15 @@ func (b *LocalBackend) TCPHandlerForDst(src, dst netip.AddrPort) (handler func(c
 	return nil, nil
 }
 
+// UDPHandlerForDst returns a handler for the UDP flow from src to dst, or
+// nil if tailscaled doesn't handle it.
+func (b *LocalBackend) UDPHandlerForDst(src, dst netip.AddrPort) (handler func(nettype.ConnPacketConn)) {
+	if !b.isLocalIP(dst.Addr()) {
+		return nil
+	}
+	return b.udpHandlerForServe(dst.Port(), src)
+}
+
 func (b *LocalBackend) peerAPIServicesLocked() (ret []tailcfg.Service) {
 	for _, pln := range b.peerAPIListeners {
 		proto := tailcfg.PeerAPI4
@@ -3172,23 +3329,29 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, prefs ipn.PrefsView, logf logger.
 		set(peer.Name(), peer.Addresses())
 	}
 	for _, rec := range nm.DNS.ExtraRecords {
+		fqdn, err := dnsname.ToFQDN(rec.Name)
+		if err != nil {
+			continue
+		}
 		switch rec.Type {
 		case "", "A", "AAAA":
 			// Treat these all the same for now: infer from the value
+			ip, err := netip.ParseAddr(rec.Value)
+			if err != nil {
+				// Ignore.
+				continue
+			}
+			dcfg.Hosts[fqdn] = append(dcfg.Hosts[fqdn], ip)
+		case "CNAME", "TXT", "SRV", "MX":
+			r, err := resolver.ParseRecord(rec.Type, rec.Value)
+			if err != nil {
+				logf("[unexpected] ignoring DNS extra record %q: %v", rec.Name, err)
+				continue
+			}
+			mak.Set(&dcfg.Records, fqdn, append(dcfg.Records[fqdn], r))
 		default:
 			// TODO: more
-			continue
 		}
-		ip, err := netip.ParseAddr(rec.Value)
-		if err != nil {
-			// Ignore.
-			continue
-		}
-		fqdn, err := dnsname.ToFQDN(rec.Name)
-		if err != nil {
-			continue
-		}
-		dcfg.Hosts[fqdn] = append(dcfg.Hosts[fqdn], ip)
 	}
 
 	if !prefs.CorpDNS() {
@@ -3718,9 +3881,14 @@ func (b *LocalBackend) enterStateLockedOnEntry(newState ipn.State) {
 }
 
 func (b *LocalBackend) hasNodeKey() bool {
-	// we can't use b.Prefs(), because it strips the keys, oops!
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	return b.hasNodeKeyLocked()
+}
+
+// hasNodeKeyLocked is like hasNodeKey but requires b.mu be held.
+func (b *LocalBackend) hasNodeKeyLocked() bool {
+	// we can't use b.Prefs(), because it strips the keys, oops!
 	p := b.pm.CurrentPrefs()
 	return p.Valid() && p.Persist().Valid() && !p.Persist().PrivateNodeKey().IsZero()
 }
@@ -4076,13 +4244,26 @@ func (b *LocalBackend) reloadServeConfigLocked(prefs ipn.PrefsView) {
 		return
 	}
 	confKey := ipn.ServeConfigKey(b.pm.CurrentProfile().ID)
-	// TODO(maisem,bradfitz): prevent reading the config from disk
-	// if the profile has not changed.
-	confj, err := b.store.ReadState(confKey)
-	if err != nil {
-		b.lastServeConfJSON = mem.B(nil)
-		b.serveConfig = ipn.ServeConfigView{}
-		return
+	var confj []byte
+	if sc := b.configFileServeConfigLocked(); sc != nil {
+		j, err := json.Marshal(sc)
+		if err != nil {
+			b.logf("invalid ServeConfig in config file: %v", err)
+			b.lastServeConfJSON = mem.B(nil)
+			b.serveConfig = ipn.ServeConfigView{}
+			return
+		}
+		confj = j
+	} else {
+		// TODO(maisem,bradfitz): prevent reading the config from disk
+		// if the profile has not changed.
+		j, err := b.store.ReadState(confKey)
+		if err != nil {
+			b.lastServeConfJSON = mem.B(nil)
+			b.serveConfig = ipn.ServeConfigView{}
+			return
+		}
+		confj = j
 	}
 	if b.lastServeConfJSON.Equal(mem.B(confj)) {
 		return
@@ -4103,6 +4284,7 @@ func (b *LocalBackend) reloadServeConfigLocked(prefs ipn.PrefsView) {
 // b.mu must be held.
 func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.PrefsView) {
 	handlePorts := make([]uint16, 0, 4)
+	var udpPorts []uint16
 
 	if prefs.Valid() && prefs.RunSSH() && envknob.CanSSHD() {
 		handlePorts = append(handlePorts, 22)
@@ -4118,6 +4300,12 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 			return true
 		})
 		handlePorts = append(handlePorts, servePorts...)
+		b.serveConfig.UDP().Range(func(port uint16, _ ipn.UDPPortHandlerView) bool {
+			if port > 0 {
+				udpPorts = append(udpPorts, port)
+			}
+			return true
+		})
 
 		b.setServeProxyHandlersLocked()
 
@@ -4134,6 +4322,7 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 	}
 
 	b.setTCPPortsIntercepted(handlePorts)
+	b.setUDPPortsIntercepted(udpPorts)
 }
 
 // setServeProxyHandlersLocked ensures there is an http proxy handler for each
@@ -4617,6 +4806,34 @@ func (b *LocalBackend) DebugReSTUN() error {
 	return nil
 }
 
+// NetcheckHistory returns magicsock's recent netcheck reports, oldest
+// first.
+func (b *LocalBackend) NetcheckHistory() ([]apitype.NetcheckHistoryEntry, error) {
+	mc, err := b.magicConn()
+	if err != nil {
+		return nil, err
+	}
+	h := mc.NetcheckHistory()
+	ret := make([]apitype.NetcheckHistoryEntry, 0, len(h))
+	for _, e := range h {
+		r := e.Report
+		ret = append(ret, apitype.NetcheckHistoryEntry{
+			Time:          e.Time,
+			Full:          e.Full,
+			LinkChange:    e.LinkChange,
+			UDP:           r.UDP,
+			IPv4:          r.IPv4,
+			IPv6:          r.IPv6,
+			GlobalV4:      r.GlobalV4,
+			GlobalV6:      r.GlobalV6,
+			CaptivePortal: r.CaptivePortal,
+			PreferredDERP: r.PreferredDERP,
+			RegionLatency: maps.Clone(r.RegionLatency),
+		})
+	}
+	return ret, nil
+}
+
 func (b *LocalBackend) magicConn() (*magicsock.Conn, error) {
 	mc, ok := b.sys.MagicSock.GetOK()
 	if !ok {
@@ -4865,6 +5082,13 @@ func (b *LocalBackend) ShouldInterceptTCPPort(port uint16) bool {
 	return b.shouldInterceptTCPPortAtomic.Load()(port)
 }
 
+// ShouldInterceptUDPPort reports whether the given UDP port number to a
+// Tailscale IP (not a subnet router, service IP, etc) should be intercepted by
+// Tailscaled and handled in-process.
+func (b *LocalBackend) ShouldInterceptUDPPort(port uint16) bool {
+	return b.shouldInterceptUDPPortAtomic.Load()(port)
+}
+
 // SwitchProfile switches to the profile with the given id.
 // It will restart the backend on success.
 // If the profile is not known, it returns an errProfileNotFound.
@@ -5003,16 +5227,8 @@ func (b *LocalBackend) ResetAuth() error {
 // StreamDebugCapture writes a pcap stream of packets traversing
 // tailscaled to the provided response writer.
 func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) error {
-	var s *capture.Sink
-
 	b.mu.Lock()
-	if b.debugSink == nil {
-		s = capture.New()
-		b.debugSink = s
-		b.e.InstallCaptureHook(s.LogPacket)
-	} else {
-		s = b.debugSink
-	}
+	s := b.debugSinkLocked()
 	b.mu.Unlock()
 
 	unregister := s.RegisterOutput(w)
@@ -5023,11 +5239,24 @@ func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) erro
 	}
 	unregister()
 
-	// Shut down & uninstall the sink if there are no longer
-	// any outputs on it.
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	return b.maybeCloseDebugSinkLocked()
+}
+
+// debugSinkLocked returns the debug capture sink, creating and installing
+// it if needed. b.mu must be held.
+func (b *LocalBackend) debugSinkLocked() *capture.Sink {
+	if b.debugSink == nil {
+		b.debugSink = capture.New()
+		b.e.InstallCaptureHook(b.debugSink.LogPacket)
+	}
+	return b.debugSink
+}
 
+// maybeCloseDebugSinkLocked shuts down & uninstalls the debug capture sink
+// if there are no longer any outputs on it. b.mu must be held.
+func (b *LocalBackend) maybeCloseDebugSinkLocked() error {
 	select {
 	case <-b.ctx.Done():
 		return nil
@@ -5042,6 +5271,150 @@ func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) erro
 	return nil
 }
 
+// StartDebugCaptureRing starts writing the packets traversing tailscaled
+// that match filter to a ring of pcapng files in the "captures" directory
+// of the var root, replacing any capture ring already running. If fileSize
+// or files are zero, the capture package's defaults are used.
+func (b *LocalBackend) StartDebugCaptureRing(filter *capture.Filter, fileSize int64, files int) error {
+	root := b.TailscaleVarRoot()
+	if root == "" {
+		return errors.New("no var root for capture files")
+	}
+	r, err := capture.NewRing(capture.RingOptions{
+		Dir:      filepath.Join(root, "captures"),
+		FileSize: fileSize,
+		Files:    files,
+		Filter:   filter,
+	})
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopDebugCaptureRingLocked()
+	b.debugRing = r
+	b.debugRingUnregister = b.debugSinkLocked().RegisterRing(r)
+	return nil
+}
+
+// StopDebugCaptureRing stops the capture ring started by
+// StartDebugCaptureRing, if any. Its files are kept.
+func (b *LocalBackend) StopDebugCaptureRing() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.stopDebugCaptureRingLocked()
+	if cerr := b.maybeCloseDebugSinkLocked(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (b *LocalBackend) stopDebugCaptureRingLocked() error {
+	if b.debugRing == nil {
+		return nil
+	}
+	b.debugRingUnregister()
+	err := b.debugRing.Close()
+	b.debugRing = nil
+	b.debugRingUnregister = nil
+	return err
+}
+
+// DebugCaptureRingStatus returns the status of the capture ring, or of the
+// last one if none is running.
+func (b *LocalBackend) DebugCaptureRingStatus() *apitype.DebugCaptureRingStatus {
+	b.mu.Lock()
+	r := b.debugRing
+	b.mu.Unlock()
+
+	st := &apitype.DebugCaptureRingStatus{}
+	if r == nil {
+		if root := b.TailscaleVarRoot(); root != "" {
+			st.Dir = filepath.Join(root, "captures")
+			st.Files, _ = capture.RingFiles(st.Dir)
+		}
+		return st
+	}
+	opts := r.Options()
+	st.Running = true
+	st.Dir = opts.Dir
+	st.Filter = opts.Filter.String()
+	st.FileSize = opts.FileSize
+	st.MaxFiles = opts.Files
+	st.Files = r.Files()
+	if err := r.Err(); err != nil {
+		st.Err = err.Error()
+	}
+	return st
+}
+
+// DebugConntrack returns the flows tracked by the packet filter, with the
+// names of the nodes involved, and the hits of the filter's rules.
+func (b *LocalBackend) DebugConntrack() (*apitype.DebugConntrack, error) {
+	f := b.e.GetFilter()
+	if f == nil {
+		return nil, errors.New("no packet filter")
+	}
+	nodeName := func(ipp netip.AddrPort) string {
+		if n, _, ok := b.WhoIs(netip.AddrPortFrom(ipp.Addr(), 0)); ok {
+			return strings.TrimSuffix(n.Name(), ".")
+		}
+		return ""
+	}
+	ret := &apitype.DebugConntrack{
+		Flows: []apitype.DebugConntrackFlow{},
+		Rules: []apitype.DebugFilterRule{},
+	}
+	for _, fl := range f.Flows() {
+		cf := apitype.DebugConntrackFlow{
+			Proto:     fl.Proto.String(),
+			Src:       fl.Src,
+			Dst:       fl.Dst,
+			SrcNode:   nodeName(fl.Src),
+			DstNode:   nodeName(fl.Dst),
+			Outgoing:  fl.Outgoing,
+			Created:   fl.Created,
+			LastSeen:  fl.LastSeen,
+			RuleIndex: fl.RuleIndex,
+		}
+		if fl.RuleIndex >= 0 {
+			cf.Rule = fl.Rule.String()
+		}
+		ret.Flows = append(ret.Flows, cf)
+	}
+	for i, rh := range f.RuleHits() {
+		ret.Rules = append(ret.Rules, apitype.DebugFilterRule{
+			Index: i,
+			Rule:  rh.Match.String(),
+			Hits:  rh.Hits,
+		})
+	}
+	return ret, nil
+}
+
+// DebugFilterCheck reports how the packet filter would handle a packet of
+// proto from src to dst: one received from a peer, or if outgoing is true,
+// one sent to a peer.
+func (b *LocalBackend) DebugFilterCheck(proto ipproto.Proto, src, dst netip.AddrPort, outgoing bool) (*apitype.DebugFilterCheck, error) {
+	f := b.e.GetFilter()
+	if f == nil {
+		return nil, errors.New("no packet filter")
+	}
+	res := f.Check(proto, src, dst, outgoing)
+	ret := &apitype.DebugFilterCheck{
+		Response:  res.Response.String(),
+		Why:       res.Why,
+		ShieldsUp: f.ShieldsUp(),
+		RuleIndex: res.RuleIndex,
+		Caps:      res.Caps,
+	}
+	if res.RuleIndex >= 0 {
+		ret.Rule = res.Rule.String()
+	}
+	return ret, nil
+}
+
 func (b *LocalBackend) GetPeerEndpointChanges(ctx context.Context, ip netip.Addr) ([]magicsock.EndpointChange, error) {
 	pip, ok := b.e.PeerForIP(ip)
 	if !ok {
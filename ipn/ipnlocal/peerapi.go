@@ -5,10 +5,13 @@
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"hash/adler32"
 	"hash/crc32"
 	"html"
@@ -46,9 +49,13 @@
 	"tailscale.com/net/netaddr"
 	"tailscale.com/net/netutil"
 	"tailscale.com/net/sockstats"
+	"tailscale.com/net/speedtest"
+	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
 	"tailscale.com/types/views"
 	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/mak"
 	"tailscale.com/util/multierr"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine/filter"
@@ -84,9 +91,13 @@ type peerAPIServer struct {
 
 const (
 	// partialSuffix is the suffix appended to files while they're
-	// still in the process of being transferred.
+	// still in the process of being transferred. See partialPath.
 	partialSuffix = ".partial"
 
+	// maxPartialAge is how long a partial file may go unmodified before
+	// it's considered abandoned and removed.
+	maxPartialAge = 24 * time.Hour
+
 	// deletedSuffix is the suffix for a deleted marker file
 	// that's placed next to a file (without the suffix) that we
 	// tried to delete, but Windows wouldn't let us. These are
@@ -113,30 +124,52 @@ func validFilenameRune(r rune) bool {
 	return unicode.IsPrint(r)
 }
 
-func (s *peerAPIServer) diskPath(baseName string) (fullPath string, ok bool) {
-	if !utf8.ValidString(baseName) {
-		return "", false
+// maxPathDepth is the maximum number of elements in the relative path of a
+// received file.
+const maxPathDepth = 32
+
+// validBaseName reports whether name is acceptable as the name of a
+// received file or of one of its parent directories.
+func validBaseName(name string) bool {
+	if !utf8.ValidString(name) {
+		return false
 	}
-	if strings.TrimSpace(baseName) != baseName {
-		return "", false
+	if strings.TrimSpace(name) != name {
+		return false
 	}
-	if len(baseName) > 255 {
-		return "", false
+	if len(name) > 255 {
+		return false
 	}
 	// TODO: validate unicode normalization form too? Varies by platform.
-	clean := path.Clean(baseName)
-	if clean != baseName ||
+	clean := path.Clean(name)
+	if clean != name ||
 		clean == "." || clean == ".." ||
 		strings.HasSuffix(clean, deletedSuffix) ||
 		strings.HasSuffix(clean, partialSuffix) {
-		return "", false
+		return false
 	}
-	for _, r := range baseName {
+	for _, r := range name {
 		if !validFilenameRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// diskPath returns the path on disk of the received file named relPath.
+// relPath is either a base name ("foo.jpg") or, for files received as part
+// of a directory, a slash-separated path of base names ("dir/foo.jpg").
+func (s *peerAPIServer) diskPath(relPath string) (fullPath string, ok bool) {
+	elems := strings.Split(relPath, "/")
+	if len(elems) > maxPathDepth {
+		return "", false
+	}
+	for _, e := range elems {
+		if !validBaseName(e) {
 			return "", false
 		}
 	}
-	return filepath.Join(s.rootDir, baseName), true
+	return filepath.Join(s.rootDir, filepath.FromSlash(relPath)), true
 }
 
 // hasFilesWaiting reports whether any files are buffered in the
@@ -153,9 +186,19 @@ func (s *peerAPIServer) hasFilesWaiting() bool {
 		// keep this negative cache.
 		return false
 	}
-	f, err := os.Open(s.rootDir)
+	has, err := s.hasFilesWaitingIn(s.rootDir)
+	if !has && err == nil {
+		s.knownEmpty.Store(true)
+	}
+	return has
+}
+
+// hasFilesWaitingIn reports whether dir or any of its subdirectories
+// contain received files.
+func (s *peerAPIServer) hasFilesWaitingIn(dir string) (bool, error) {
+	f, err := os.Open(dir)
 	if err != nil {
-		return false
+		return false, err
 	}
 	defer f.Close()
 	for {
@@ -171,28 +214,33 @@ func (s *peerAPIServer) hasFilesWaiting() bool {
 				// as the OS may return "foo.jpg.deleted" before "foo.jpg"
 				// and we don't want to delete the ".deleted" file before
 				// enumerating to the "foo.jpg" file.
-				defer tryDeleteAgain(filepath.Join(s.rootDir, name))
+				defer tryDeleteAgain(filepath.Join(dir, name))
+				continue
+			}
+			if de.IsDir() {
+				if has, _ := s.hasFilesWaitingIn(filepath.Join(dir, name)); has {
+					return true, nil
+				}
 				continue
 			}
 			if de.Type().IsRegular() {
-				_, err := os.Stat(filepath.Join(s.rootDir, name+deletedSuffix))
+				_, err := os.Stat(filepath.Join(dir, name+deletedSuffix))
 				if os.IsNotExist(err) {
-					return true
+					return true, nil
 				}
 				if err == nil {
-					tryDeleteAgain(filepath.Join(s.rootDir, name))
+					tryDeleteAgain(filepath.Join(dir, name))
 					continue
 				}
 			}
 		}
 		if err == io.EOF {
-			s.knownEmpty.Store(true)
+			return false, nil
 		}
 		if err != nil {
-			break
+			return false, err
 		}
 	}
-	return false
 }
 
 // WaitingFiles returns the list of files that have been sent by a
@@ -211,43 +259,40 @@ func (s *peerAPIServer) WaitingFiles() (ret []apitype.WaitingFile, err error) {
 	if s.directFileMode {
 		return nil, nil
 	}
-	f, err := os.Open(s.rootDir)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
 	var deleted map[string]bool // "foo.jpg" => true (if "foo.jpg.deleted" exists)
-	for {
-		des, err := f.ReadDir(10)
-		for _, de := range des {
-			name := de.Name()
-			if strings.HasSuffix(name, partialSuffix) {
-				continue
-			}
-			if name, ok := strings.CutSuffix(name, deletedSuffix); ok { // for Windows + tests
-				if deleted == nil {
-					deleted = map[string]bool{}
-				}
-				deleted[name] = true
-				continue
-			}
-			if de.Type().IsRegular() {
-				fi, err := de.Info()
-				if err != nil {
-					continue
-				}
-				ret = append(ret, apitype.WaitingFile{
-					Name: filepath.Base(name),
-					Size: fi.Size(),
-				})
-			}
+	err = filepath.WalkDir(s.rootDir, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
 		}
-		if err == io.EOF {
-			break
+		if de.IsDir() {
+			return nil
 		}
+		rel, err := filepath.Rel(s.rootDir, p)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasSuffix(name, partialSuffix) {
+			return nil
+		}
+		if name, ok := strings.CutSuffix(name, deletedSuffix); ok { // for Windows + tests
+			mak.Set(&deleted, name, true)
+			return nil
+		}
+		if de.Type().IsRegular() {
+			fi, err := de.Info()
+			if err != nil {
+				return nil
+			}
+			ret = append(ret, apitype.WaitingFile{
+				Name: name,
+				Size: fi.Size(),
+			})
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	if len(deleted) > 0 {
 		// Filter out any return values "foo.jpg" where a
@@ -263,7 +308,7 @@ func (s *peerAPIServer) WaitingFiles() (ret []apitype.WaitingFile, err error) {
 		// Maybe Windows is done virus scanning the file we tried
 		// to delete a long time ago and will let us delete it now.
 		for name := range deleted {
-			tryDeleteAgain(filepath.Join(s.rootDir, name))
+			tryDeleteAgain(filepath.Join(s.rootDir, filepath.FromSlash(name)))
 		}
 	}
 	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
@@ -335,10 +380,21 @@ func (s *peerAPIServer) DeleteFile(baseName string) error {
 			logf("peerapi: failed to DeleteFile: %v", err)
 			return err
 		}
+		s.removeEmptyParents(path)
 		return nil
 	}
 }
 
+// removeEmptyParents removes the directories containing the received file
+// at fullPath, up to but not including s.rootDir, as long as they're empty.
+func (s *peerAPIServer) removeEmptyParents(fullPath string) {
+	for dir := filepath.Dir(fullPath); dir != s.rootDir && strings.HasPrefix(dir, s.rootDir); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
 // redacted is a fake path name we use in errors, to avoid
 // accidentally logging actual filenames anywhere.
 const redacted = "redacted"
@@ -727,6 +783,10 @@ func (h *peerAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		metricIngressCalls.Add(1)
 		h.handleServeIngress(w, r)
 		return
+	case "/v0/speedtest":
+		metricSpeedtestCalls.Add(1)
+		h.handleServeSpeedtest(w, r)
+		return
 	}
 	who := h.peerUser.DisplayName
 	fmt.Fprintf(w, `<html>
@@ -1054,6 +1114,14 @@ func (h *peerAPIHandler) canWakeOnLAN() bool {
 	return h.isSelf || h.peerHasCap(tailcfg.PeerCapabilityWakeOnLAN)
 }
 
+// canSpeedtest reports whether h can run a speedtest against this node.
+func (h *peerAPIHandler) canSpeedtest() bool {
+	if h.peerNode.UnsignedPeerAPIOnly() {
+		return false
+	}
+	return h.isSelf || h.peerHasCap(tailcfg.PeerCapabilitySpeedtest)
+}
+
 var allowSelfIngress = envknob.RegisterBool("TS_ALLOW_SELF_INGRESS")
 
 // canIngress reports whether h can send ingress requests to this node.
@@ -1078,8 +1146,8 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "file sharing not enabled by Tailscale admin", http.StatusForbidden)
 		return
 	}
-	if r.Method != "PUT" {
-		http.Error(w, "expected method PUT", http.StatusMethodNotAllowed)
+	if r.Method != "PUT" && r.Method != "GET" {
+		http.Error(w, "expected method GET or PUT", http.StatusMethodNotAllowed)
 		return
 	}
 	if h.ps.rootDir == "" {
@@ -1100,44 +1168,88 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "empty filename", 400)
 		return
 	}
-	if strings.Contains(suffix, "/") {
-		http.Error(w, "directories not supported", 400)
-		return
-	}
-	baseName, err := url.PathUnescape(suffix)
+	relPath, err := unescapePutPath(suffix)
 	if err != nil {
 		http.Error(w, "bad path encoding", 400)
 		return
 	}
-	dstFile, ok := h.ps.diskPath(baseName)
+	dstFile, ok := h.ps.diskPath(relPath)
 	if !ok {
 		http.Error(w, "bad filename", 400)
 		return
 	}
+	// Partial files are per sender, so a peer can only see and resume
+	// its own transfers.
+	partialFile := partialPath(dstFile, h.peerNode.StableID())
+	if r.Method == "GET" {
+		st, err := partialFileState(partialFile)
+		if err != nil {
+			err = redactErr(err)
+			h.logf("put GET error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+		return
+	}
+	var offset int64
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "bad offset", 400)
+			return
+		}
+	}
+	wantSum := strings.ToLower(r.Header.Get(apitype.TaildropSHA256Header))
+
 	t0 := h.ps.b.clock.Now()
-	// TODO(bradfitz): prevent same filename being sent by two peers at once
-	partialFile := dstFile + partialSuffix
-	f, err := os.Create(partialFile)
+	if dir := filepath.Dir(dstFile); dir != h.ps.rootDir {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			err = redactErr(err)
+			h.logf("put MkdirAll error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !h.ps.directFileMode || h.ps.directFileDoFinalRename {
+		// Otherwise, the frontend renames the partial files itself,
+		// so ones that are old may be complete.
+		removeStalePartials(filepath.Dir(dstFile), t0.Add(-maxPartialAge), h.logf)
+	}
+	f, sum, err := openPartialFile(partialFile, offset)
+	if err == errPartialTooShort {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
-		h.logf("put Create error: %v", redactErr(err))
+		err = redactErr(err)
+		h.logf("put Create error: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	var success bool
+	// keepPartial is whether to leave the partial file on failure, so the
+	// sender can resume the transfer.
+	var success, keepPartial bool
 	defer func() {
-		if !success {
+		if !success && !keepPartial {
 			os.Remove(partialFile)
 		}
 	}()
-	var finalSize int64
+	finalSize := offset
 	var inFile *incomingFile
 	if r.ContentLength != 0 {
+		size := r.ContentLength
+		if size > 0 {
+			size += offset
+		}
 		inFile = &incomingFile{
-			name:    baseName,
+			name:    relPath,
 			started: h.ps.b.clock.Now(),
-			size:    r.ContentLength,
-			w:       f,
+			size:    size,
+			w:       io.MultiWriter(f, sum),
 			ph:      h,
+			copied:  offset,
 		}
 		if h.ps.directFileMode {
 			inFile.partialPath = partialFile
@@ -1149,16 +1261,22 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 			err = redactErr(err)
 			f.Close()
 			h.logf("put Copy error: %v", err)
+			keepPartial = true
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		finalSize = n
+		finalSize += n
 	}
 	if err := redactErr(f.Close()); err != nil {
 		h.logf("put Close error: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if wantSum != "" && hex.EncodeToString(sum.Sum(nil)) != wantSum {
+		h.logf("put of %s from %v/%v failed SHA-256 check", approxSize(finalSize), h.remoteAddr.Addr(), h.peerNode.ComputedName)
+		http.Error(w, "SHA-256 mismatch; file discarded", http.StatusBadRequest)
+		return
+	}
 	if h.ps.directFileMode && !h.ps.directFileDoFinalRename {
 		if inFile != nil { // non-zero length; TODO: notify even for zero length
 			inFile.markAndNotifyDone()
@@ -1173,7 +1291,11 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 	}
 
 	d := h.ps.b.clock.Since(t0).Round(time.Second / 10)
-	h.logf("got put of %s in %v from %v/%v", approxSize(finalSize), d, h.remoteAddr.Addr(), h.peerNode.ComputedName)
+	var resumed string
+	if offset > 0 {
+		resumed = " (resumed at " + approxSize(offset) + ")"
+	}
+	h.logf("got put of %s%s in %v from %v/%v", approxSize(finalSize), resumed, d, h.remoteAddr.Addr(), h.peerNode.ComputedName)
 
 	// TODO: set modtime
 	// TODO: some real response
@@ -1183,6 +1305,116 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 	h.ps.b.sendFileNotify()
 }
 
+// partialPath returns the path of the partial file for dstFile while it's
+// being received from the peer with the given stable node ID.
+func partialPath(dstFile string, peer tailcfg.StableNodeID) string {
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return -1
+	}, string(peer))
+	return dstFile + "." + id + partialSuffix
+}
+
+// removeStalePartials removes the partial files in dir that haven't been
+// modified since before. They're left behind by interrupted transfers, so
+// the sender can resume them, but not forever.
+func removeStalePartials(dir string, before time.Time, logf logger.Logf) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, de := range des {
+		if !strings.HasSuffix(de.Name(), partialSuffix) || !de.Type().IsRegular() {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil || !fi.ModTime().Before(before) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, de.Name())); err != nil && !os.IsNotExist(err) {
+			logf("removing stale partial file: %v", redactErr(err))
+		}
+	}
+}
+
+// unescapePutPath unescapes the escaped path of a /v0/put/ request (without
+// the prefix), which is one or more "/"-separated, path-escaped elements.
+// Escaped slashes within an element are preserved so that diskPath rejects
+// them.
+func unescapePutPath(escaped string) (string, error) {
+	elems := strings.Split(escaped, "/")
+	for i, e := range elems {
+		v, err := url.PathUnescape(e)
+		if err != nil {
+			return "", err
+		}
+		elems[i] = v
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+// errPartialTooShort is returned by openPartialFile when the sender asks to
+// resume at an offset beyond what was received.
+var errPartialTooShort = errors.New("partial file is shorter than offset; restart the transfer")
+
+// openPartialFile opens the partial file at path for writing at offset. If
+// offset is zero, the file is created or truncated. Otherwise, the file
+// must already have at least offset bytes, and anything after offset is
+// discarded.
+//
+// It also returns a SHA-256 hash of the file's first offset bytes, for the
+// caller to continue with the rest of the file.
+func openPartialFile(path string, offset int64) (*os.File, hash.Hash, error) {
+	sum := sha256.New()
+	if offset == 0 {
+		f, err := os.Create(path)
+		return f, sum, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if os.IsNotExist(err) {
+		return nil, nil, errPartialTooShort
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.CopyN(sum, f, offset); err != nil {
+		f.Close()
+		if err == io.EOF {
+			return nil, nil, errPartialTooShort
+		}
+		return nil, nil, err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, sum, nil
+}
+
+// partialFileState returns the resume state of the partial file at path.
+func partialFileState(path string) (apitype.TaildropPartial, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return apitype.TaildropPartial{}, nil
+	}
+	if err != nil {
+		return apitype.TaildropPartial{}, err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	n, err := io.Copy(sum, f)
+	if err != nil || n == 0 {
+		return apitype.TaildropPartial{}, err
+	}
+	return apitype.TaildropPartial{
+		Offset: n,
+		SHA256: hex.EncodeToString(sum.Sum(nil)),
+	}, nil
+}
+
 func approxSize(n int64) string {
 	if n <= 1<<10 {
 		return "<=1KB"
@@ -1318,6 +1550,65 @@ func (h *peerAPIHandler) handleWakeOnLAN(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(res)
 }
 
+// speedtestUpgradeProto is the HTTP Upgrade protocol that switches a
+// peerAPI connection to the net/speedtest protocol.
+const speedtestUpgradeProto = "tailscale-speedtest"
+
+// speedtestMaxConnTime bounds how long a speedtest connection may last,
+// including the setup exchange.
+const speedtestMaxConnTime = speedtest.MaxDuration + 30*time.Second
+
+// speedtestSem limits the node to serving one speedtest at a time, so
+// concurrent tests don't skew each other's results.
+var speedtestSem = syncs.NewSemaphore(1)
+
+// handleServeSpeedtest serves the server side of a speedtest with the peer.
+// The peer sends a POST with an "Upgrade: tailscale-speedtest" header and,
+// once it gets a 101 response, speaks the net/speedtest protocol over the
+// connection.
+func (h *peerAPIHandler) handleServeSpeedtest(w http.ResponseWriter, r *http.Request) {
+	if !h.canSpeedtest() {
+		http.Error(w, "denied; no speedtest access", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), speedtestUpgradeProto) {
+		http.Error(w, "missing Upgrade: "+speedtestUpgradeProto+" header", http.StatusBadRequest)
+		return
+	}
+	if !speedtestSem.TryAcquire() {
+		http.Error(w, "speedtest already in progress", http.StatusServiceUnavailable)
+		return
+	}
+	defer speedtestSem.Release()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't hijack connection", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		h.logf("speedtest: hijack: %v", err)
+		return
+	}
+	if brw.Reader.Buffered() > 0 {
+		// The client must wait for our 101 before starting the test.
+		h.logf("speedtest: unexpected early data from %v", h.remoteAddr)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Now().Add(speedtestMaxConnTime))
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", speedtestUpgradeProto)
+	h.logf("speedtest: starting for %v", h.remoteAddr)
+	if err := speedtest.ServeConn(conn); err != nil {
+		h.logf("speedtest: %v", err)
+	}
+}
+
 func (h *peerAPIHandler) replyToDNSQueries() bool {
 	if h.isSelf {
 		// If the peer is owned by the same user, just allow it
@@ -1587,4 +1878,5 @@ func (fl *fakePeerAPIListener) Addr() net.Addr { return fl.addr }
 	metricDNSCalls       = clientmetric.NewCounter("peerapi_dns")
 	metricWakeOnLANCalls = clientmetric.NewCounter("peerapi_wol")
 	metricIngressCalls   = clientmetric.NewCounter("peerapi_ingress")
+	metricSpeedtestCalls = clientmetric.NewCounter("peerapi_speedtest")
 )
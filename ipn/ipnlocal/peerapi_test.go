@@ -5,6 +5,9 @@
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -18,8 +21,10 @@
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"go4.org/netipx"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/tailcfg"
@@ -100,6 +105,24 @@ func fileHasContents(name string, want string) check {
 	}
 }
 
+func fileMissing(name string) check {
+	return func(t *testing.T, e *peerAPITestEnv) {
+		if _, err := os.Stat(filepath.Join(e.ph.ps.rootDir, name)); !os.IsNotExist(err) {
+			t.Errorf("file %q exists (err=%v); want missing", name, err)
+		}
+	}
+}
+
+func withHeader(r *http.Request, k, v string) *http.Request {
+	r.Header.Set(k, v)
+	return r
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
 func hexAll(v string) string {
 	var sb strings.Builder
 	for i := 0; i < len(v); i++ {
@@ -165,6 +188,30 @@ func TestHandlePeerAPI(t *testing.T) {
 				bodyContains("ServeHTTP"),
 			),
 		},
+		{
+			name:   "speedtest/deny-nonself",
+			isSelf: false,
+			req:    httptest.NewRequest("POST", "/v0/speedtest", nil),
+			checks: checks(
+				httpStatus(http.StatusForbidden),
+				bodyContains("no speedtest access"),
+			),
+		},
+		{
+			name:   "speedtest/self-bad-method",
+			isSelf: true,
+			req:    httptest.NewRequest("GET", "/v0/speedtest", nil),
+			checks: checks(httpStatus(http.StatusMethodNotAllowed)),
+		},
+		{
+			name:   "speedtest/self-no-upgrade",
+			isSelf: true,
+			req:    httptest.NewRequest("POST", "/v0/speedtest", nil),
+			checks: checks(
+				httpStatus(http.StatusBadRequest),
+				bodyContains("missing Upgrade"),
+			),
+		},
 		{
 			name:       "reject_non_owner_put",
 			isSelf:     false,
@@ -203,7 +250,7 @@ func TestHandlePeerAPI(t *testing.T) {
 			req:        httptest.NewRequest("POST", "/v0/put/foo", nil),
 			checks: checks(
 				httpStatus(405),
-				bodyContains("expected method PUT"),
+				bodyContains("expected method GET or PUT"),
 			),
 		},
 		{
@@ -283,13 +330,97 @@ func TestHandlePeerAPI(t *testing.T) {
 			),
 		},
 		{
-			name:       "bad_filename_slash",
+			name:       "put_subdir",
 			isSelf:     true,
 			capSharing: true,
-			req:        httptest.NewRequest("PUT", "/v0/put/foo/bar", nil),
+			req:        httptest.NewRequest("PUT", "/v0/put/foo/"+hexAll("bar baz")+"/qux", strings.NewReader("in a dir")),
+			checks: checks(
+				httpStatus(200),
+				bodyContains("{}"),
+				fileHasContents("foo/bar baz/qux", "in a dir"),
+			),
+		},
+		{
+			name:       "bad_filename_dotdot_elem",
+			isSelf:     true,
+			capSharing: true,
+			req:        httptest.NewRequest("PUT", "/v0/put/foo/../bar", nil),
+			checks: checks(
+				httpStatus(400),
+				bodyContains("bad filename"),
+			),
+		},
+		{
+			name:       "bad_filename_empty_elem",
+			isSelf:     true,
+			capSharing: true,
+			req:        httptest.NewRequest("PUT", "/v0/put/foo//bar", nil),
 			checks: checks(
 				httpStatus(400),
-				bodyContains("directories not supported"),
+				bodyContains("bad filename"),
+			),
+		},
+		{
+			name:       "bad_filename_partial_dir",
+			isSelf:     true,
+			capSharing: true,
+			req:        httptest.NewRequest("PUT", "/v0/put/foo.partial/bar", nil),
+			checks: checks(
+				httpStatus(400),
+				bodyContains("bad filename"),
+			),
+		},
+		{
+			name:       "put_sha256",
+			isSelf:     true,
+			capSharing: true,
+			req: withHeader(httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents")),
+				apitype.TaildropSHA256Header, sha256Hex("contents")),
+			checks: checks(
+				httpStatus(200),
+				fileHasContents("foo", "contents"),
+			),
+		},
+		{
+			name:       "put_sha256_mismatch",
+			isSelf:     true,
+			capSharing: true,
+			req: withHeader(httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents")),
+				apitype.TaildropSHA256Header, sha256Hex("other")),
+			checks: checks(
+				httpStatus(400),
+				bodyContains("SHA-256 mismatch"),
+				fileMissing("foo"),
+				fileMissing("foo.nPEER.partial"),
+			),
+		},
+		{
+			name:       "get_partial_none",
+			isSelf:     true,
+			capSharing: true,
+			req:        httptest.NewRequest("GET", "/v0/put/foo", nil),
+			checks: checks(
+				httpStatus(200),
+				bodyContains(`{"Offset":0}`),
+			),
+		},
+		{
+			name:       "put_resume_missing_partial",
+			isSelf:     true,
+			capSharing: true,
+			req:        httptest.NewRequest("PUT", "/v0/put/foo?offset=3", strings.NewReader("tents")),
+			checks: checks(
+				httpStatus(409),
+			),
+		},
+		{
+			name:       "put_bad_offset",
+			isSelf:     true,
+			capSharing: true,
+			req:        httptest.NewRequest("PUT", "/v0/put/foo?offset=-1", strings.NewReader("x")),
+			checks: checks(
+				httpStatus(400),
+				bodyContains("bad offset"),
 			),
 		},
 		{
@@ -463,6 +594,7 @@ func TestHandlePeerAPI(t *testing.T) {
 				isSelf:   tt.isSelf,
 				selfNode: selfNode.View(),
 				peerNode: (&tailcfg.Node{
+					StableID:     "nPEER",
 					ComputedName: "some-peer-name",
 				}).View(),
 				ps: &peerAPIServer{
@@ -514,6 +646,7 @@ func TestFileDeleteRace(t *testing.T) {
 	ph := &peerAPIHandler{
 		isSelf: true,
 		peerNode: (&tailcfg.Node{
+			StableID:     "nPEER",
 			ComputedName: "some-peer-name",
 		}).View(),
 		selfNode: (&tailcfg.Node{
@@ -549,6 +682,159 @@ func TestFileDeleteRace(t *testing.T) {
 	}
 }
 
+func TestPeerPutResume(t *testing.T) {
+	dir := t.TempDir()
+	ps := &peerAPIServer{
+		b: &LocalBackend{
+			logf:           t.Logf,
+			capFileSharing: true,
+			clock:          &tstest.Clock{},
+		},
+		rootDir: dir,
+	}
+	ph := &peerAPIHandler{
+		isSelf: true,
+		peerNode: (&tailcfg.Node{
+			StableID:     "nPEER",
+			ComputedName: "some-peer-name",
+		}).View(),
+		selfNode: (&tailcfg.Node{
+			Addresses: []netip.Prefix{netip.MustParsePrefix("100.100.100.101/32")},
+		}).View(),
+		ps: ps,
+	}
+	do := func(method, path, body, sum string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, "http://100.100.100.101:123"+path, strings.NewReader(body))
+		if sum != "" {
+			req.Header.Set(apitype.TaildropSHA256Header, sum)
+		}
+		rr := httptest.NewRecorder()
+		ph.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// An interrupted transfer left "contXYZ" behind, of which the
+	// sender agrees with the first 4 bytes.
+	if err := os.MkdirAll(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "d", "f.txt.nPEER.partial"), []byte("contXYZ"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	rr := do("GET", "/v0/put/d/f.txt", "", "")
+	var got apitype.TaildropPartial
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("GET: %v; body %q", err, rr.Body.String())
+	}
+	if want := (apitype.TaildropPartial{Offset: 7, SHA256: sha256Hex("contXYZ")}); got != want {
+		t.Fatalf("GET = %+v; want %+v", got, want)
+	}
+
+	rr = do("PUT", "/v0/put/d/f.txt?offset=4", "ents", sha256Hex("contents"))
+	if rr.Code != 200 {
+		t.Fatalf("resumed PUT: %v, %s", rr.Code, rr.Body.String())
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "d", "f.txt")); err != nil || string(b) != "contents" {
+		t.Fatalf("received file = %q, %v; want %q", b, err, "contents")
+	}
+
+	// The received file is listed with its relative path, and deleting it
+	// cleans up its now-empty directory.
+	wfs, err := ps.WaitingFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wfs) != 1 || wfs[0].Name != "d/f.txt" || wfs[0].Size != 8 {
+		t.Fatalf("WaitingFiles = %+v; want d/f.txt of size 8", wfs)
+	}
+	if !ps.hasFilesWaiting() {
+		t.Error("hasFilesWaiting = false; want true")
+	}
+	if err := ps.DeleteFile("d/f.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d")); !os.IsNotExist(err) {
+		t.Errorf("directory d still exists after delete (err=%v)", err)
+	}
+	if ps.hasFilesWaiting() {
+		t.Error("hasFilesWaiting = true after delete; want false")
+	}
+}
+
+func TestPeerPutPartialsPerSender(t *testing.T) {
+	dir := t.TempDir()
+	ps := &peerAPIServer{
+		b: &LocalBackend{
+			logf:           t.Logf,
+			capFileSharing: true,
+			clock:          &tstest.Clock{},
+		},
+		rootDir: dir,
+	}
+	do := func(peer tailcfg.StableNodeID, method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		ph := &peerAPIHandler{
+			isSelf: true,
+			peerNode: (&tailcfg.Node{
+				StableID:     peer,
+				ComputedName: "peer-" + string(peer),
+			}).View(),
+			selfNode: (&tailcfg.Node{
+				Addresses: []netip.Prefix{netip.MustParsePrefix("100.100.100.101/32")},
+			}).View(),
+			ps: ps,
+		}
+		rr := httptest.NewRecorder()
+		ph.ServeHTTP(rr, httptest.NewRequest(method, "http://100.100.100.101:123"+path, strings.NewReader(body)))
+		return rr
+	}
+
+	// Peer A's transfer of f.txt was interrupted. Another, abandoned
+	// long ago, is left over from peer C.
+	partialA := filepath.Join(dir, "f.txt.nA.partial")
+	if err := os.WriteFile(partialA, []byte("from A"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	partialC := filepath.Join(dir, "g.txt.nC.partial")
+	if err := os.WriteFile(partialC, []byte("from C"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	old := ps.b.clock.Now().Add(-maxPartialAge - time.Minute)
+	if err := os.Chtimes(partialC, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// Peer B can neither see nor resume A's partial file.
+	if rr := do("nB", "GET", "/v0/put/f.txt", ""); !strings.Contains(rr.Body.String(), `{"Offset":0}`) {
+		t.Errorf("B's GET = %q; want offset 0", rr.Body.String())
+	}
+	if rr := do("nB", "PUT", "/v0/put/f.txt?offset=4", " B"); rr.Code != http.StatusConflict {
+		t.Errorf("B's resumed PUT = %v; want 409", rr.Code)
+	}
+	if rr := do("nB", "PUT", "/v0/put/f.txt", "from B"); rr.Code != 200 {
+		t.Fatalf("B's PUT = %v, %s", rr.Code, rr.Body.String())
+	}
+	if b, err := os.ReadFile(partialA); err != nil || string(b) != "from A" {
+		t.Errorf("A's partial file = %q, %v; want unchanged", b, err)
+	}
+
+	// A can still resume its own.
+	rr := do("nA", "GET", "/v0/put/f.txt", "")
+	var got apitype.TaildropPartial
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("A's GET: %v; body %q", err, rr.Body.String())
+	}
+	if want := (apitype.TaildropPartial{Offset: 6, SHA256: sha256Hex("from A")}); got != want {
+		t.Errorf("A's GET = %+v; want %+v", got, want)
+	}
+
+	// The abandoned partial file was cleaned up.
+	if _, err := os.Stat(partialC); !os.IsNotExist(err) {
+		t.Errorf("stale partial file still exists (err=%v)", err)
+	}
+}
+
 // Tests "foo.jpg.deleted" marks (for Windows).
 func TestDeletedMarkers(t *testing.T) {
 	dir := t.TempDir()
@@ -26,10 +26,13 @@
 	"github.com/google/uuid"
 	"tailscale.com/ipn"
 	"tailscale.com/logtail/backoff"
+	"tailscale.com/net/netaddr"
 	"tailscale.com/net/netutil"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/nettype"
+	"tailscale.com/types/views"
 	"tailscale.com/util/mak"
 	"tailscale.com/version"
 )
@@ -219,6 +222,10 @@ func (b *LocalBackend) SetServeConfig(config *ipn.ServeConfig) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	if b.conf != nil && b.conf.Parsed.ServeConfig != nil && b.conf.Parsed.IsLocked() {
+		return fmt.Errorf("serve config is managed by config file %s", b.conf.Path)
+	}
+
 	prefs := b.pm.CurrentPrefs()
 	if config.IsFunnelOn() && prefs.ShieldsUp() {
 		return errors.New("Unable to turn on Funnel while shields-up is enabled")
@@ -564,6 +571,112 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort)
 	return nil
 }
 
+// udpHandlerForServe returns a handler for a UDP flow to be served via the
+// ipn.ServeConfig, or nil if dport isn't served.
+func (b *LocalBackend) udpHandlerForServe(dport uint16, srcAddr netip.AddrPort) (handler func(nettype.ConnPacketConn)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sc := b.serveConfig
+	if !sc.Valid() {
+		return nil
+	}
+	udph, ok := sc.UDP().GetOk(dport)
+	if !ok || udph.Forward() == "" {
+		return nil
+	}
+	if b.serveUDPFlows[dport] >= ipn.MaxUDPFlowsPerPort {
+		b.logf("localbackend: dropping UDP flow to port %v from %v: too many flows", dport, srcAddr)
+		return func(c nettype.ConnPacketConn) { c.Close() }
+	}
+	mak.Set(&b.serveUDPFlows, dport, b.serveUDPFlows[dport]+1)
+
+	backDst := udph.Forward()
+	idleTimeout := udph.IdleTimeout()
+	bindSourcePort := udph.BindSourcePort()
+	return func(c nettype.ConnPacketConn) {
+		defer c.Close()
+		defer b.endServeUDPFlow(dport)
+		backConn, err := dialServeUDP(backDst, srcAddr, bindSourcePort)
+		if err != nil {
+			b.logf("localbackend: failed to UDP forward port %v (from %v) to %s: %v", dport, srcAddr, backDst, err)
+			return
+		}
+		defer backConn.Close()
+		if ipp := netaddr.Unmap(backConn.LocalAddr().(*net.UDPAddr).AddrPort()); ipp.IsValid() {
+			b.e.RegisterIPPortIdentity(ipp, srcAddr.Addr())
+			defer b.e.UnregisterIPPortIdentity(ipp)
+		}
+		proxyUDPFlow(c, backConn, idleTimeout)
+	}
+}
+
+// endServeUDPFlow records the end of a UDP flow to dport started by
+// udpHandlerForServe.
+func (b *LocalBackend) endServeUDPFlow(dport uint16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n := b.serveUDPFlows[dport] - 1; n > 0 {
+		b.serveUDPFlows[dport] = n
+	} else {
+		delete(b.serveUDPFlows, dport)
+	}
+}
+
+// dialServeUDP returns a UDP socket connected to dst for forwarding the flow
+// from src. If bindSourcePort is set, it tries to bind to the same port
+// number as src's first.
+func dialServeUDP(dst string, src netip.AddrPort, bindSourcePort bool) (*net.UDPConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", dst)
+	if err != nil {
+		return nil, err
+	}
+	if bindSourcePort {
+		c, err := net.DialUDP("udp", &net.UDPAddr{Port: int(src.Port())}, raddr)
+		if err == nil {
+			return c, nil
+		}
+		// Port is likely in use; fall back to a random one.
+	}
+	return net.DialUDP("udp", nil, raddr)
+}
+
+// maxServeUDPPacketSize is the largest datagram proxyUDPFlow forwards
+// without truncation.
+const maxServeUDPPacketSize = 64 << 10
+
+// proxyUDPFlow copies datagrams between client and backend until either
+// fails or no datagram has been forwarded in either direction for
+// idleTimeout. It closes both before returning.
+func proxyUDPFlow(client, backend net.Conn, idleTimeout time.Duration) {
+	closeBoth := func() {
+		client.Close()
+		backend.Close()
+	}
+	timer := time.AfterFunc(idleTimeout, closeBoth)
+	defer timer.Stop()
+	defer closeBoth()
+
+	errc := make(chan error, 2)
+	copyPackets := func(dst, src net.Conn) {
+		buf := make([]byte, maxServeUDPPacketSize)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				errc <- err
+				return
+			}
+			timer.Reset(idleTimeout)
+			if _, err := dst.Write(buf[:n]); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}
+	go copyPackets(backend, client)
+	go copyPackets(client, backend)
+	<-errc
+}
+
 func getServeHTTPContext(r *http.Request) (c *serveHTTPContext, ok bool) {
 	c, ok = r.Context().Value(serveHTTPContextKey{}).(*serveHTTPContext)
 	return c, ok
@@ -687,16 +800,32 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	if c, ok := getServeHTTPContext(r); ok {
+	c, ok := getServeHTTPContext(r)
+	if ok {
 		b.maybeLogServeConnection(c.DestPort, c.SrcAddr)
 	}
+	if h.AllowFrom().Len() > 0 && !b.serveAllowed(h, c) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if h.Headers().Len() > 0 {
+		w = &setHeadersResponseWriter{ResponseWriter: w, headers: h.Headers()}
+	}
 	if s := h.Text(); s != "" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		io.WriteString(w, s)
 		return
 	}
+	if v := h.Redirect(); v != "" {
+		code := h.RedirectCode()
+		if code == 0 {
+			code = http.StatusFound
+		}
+		http.Redirect(w, r, expandRedirect(v, r), code)
+		return
+	}
 	if v := h.Path(); v != "" {
-		b.serveFileOrDirectory(w, r, v, mountPoint)
+		b.serveFileOrDirectory(w, r, v, mountPoint, h.NoListing())
 		return
 	}
 	if v := h.Proxy(); v != "" {
@@ -705,19 +834,97 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "unknown proxy destination", http.StatusInternalServerError)
 			return
 		}
-		h := p.(http.Handler)
+		h2 := p.(http.Handler)
 		// Trim the mount point from the URL path before proxying. (#6571)
-		if r.URL.Path != "/" {
-			h = http.StripPrefix(strings.TrimSuffix(mountPoint, "/"), h)
+		if r.URL.Path != "/" && !h.NoStripPrefix() {
+			h2 = http.StripPrefix(strings.TrimSuffix(mountPoint, "/"), h2)
 		}
-		h.ServeHTTP(w, r)
+		h2.ServeHTTP(w, r)
 		return
 	}
 
 	http.Error(w, "empty handler", 500)
 }
 
-func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Request, fileOrDir, mountPoint string) {
+// serveAllowed reports whether the source of the request described by c
+// matches one of h's AllowFrom identities.
+func (b *LocalBackend) serveAllowed(h ipn.HTTPHandlerView, c *serveHTTPContext) bool {
+	if c == nil {
+		return false
+	}
+	node, user, ok := b.WhoIs(c.SrcAddr)
+	if !ok {
+		return false // traffic from outside of Tailnet (funneled)
+	}
+	return identityAllowed(h.AllowFrom(), node, user)
+}
+
+// identityAllowed reports whether the node and its owner match any of the
+// entries in allow. Entries are login names, "group:" names, or "tag:"
+// names. Tagged nodes only match by tag.
+func identityAllowed(allow views.Slice[string], node tailcfg.NodeView, user tailcfg.UserProfile) bool {
+	for i := 0; i < allow.Len(); i++ {
+		id := allow.At(i)
+		switch {
+		case strings.HasPrefix(id, "tag:"):
+			if views.SliceContains(node.Tags(), id) {
+				return true
+			}
+		case node.IsTagged():
+			// Tagged nodes aren't owned by the user in user.
+		case strings.HasPrefix(id, "group:"):
+			if slices.Contains(user.Groups, id) {
+				return true
+			}
+		case strings.EqualFold(id, user.LoginName):
+			return true
+		}
+	}
+	return false
+}
+
+// expandRedirect returns the redirect target for r, replacing "${HOST}"
+// and "${REQUEST_URI}" in target.
+func expandRedirect(target string, r *http.Request) string {
+	return strings.NewReplacer(
+		"${HOST}", r.Host,
+		"${REQUEST_URI}", r.URL.RequestURI(),
+	).Replace(target)
+}
+
+// setHeadersResponseWriter is an http.ResponseWriter wrapper that, upon
+// flushing HTTP headers, sets the configured static headers.
+type setHeadersResponseWriter struct {
+	http.ResponseWriter
+	headers views.Map[string, string]
+	setOnce sync.Once // guards call to set
+}
+
+func (w *setHeadersResponseWriter) set() {
+	h := w.ResponseWriter.Header()
+	w.headers.Range(func(k, v string) bool {
+		h.Set(k, v)
+		return true
+	})
+}
+
+func (w *setHeadersResponseWriter) WriteHeader(code int) {
+	w.setOnce.Do(w.set)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *setHeadersResponseWriter) Write(p []byte) (int, error) {
+	w.setOnce.Do(w.set)
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the underlying ResponseWriter, for use by
+// http.ResponseController.
+func (w *setHeadersResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Request, fileOrDir, mountPoint string, noListing bool) {
 	fi, err := os.Stat(fileOrDir)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -750,7 +957,11 @@ func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	var fs http.Handler = http.FileServer(http.Dir(fileOrDir))
+	var dir http.FileSystem = http.Dir(fileOrDir)
+	if noListing {
+		dir = noListingFS{dir}
+	}
+	var fs http.Handler = http.FileServer(dir)
 	if mountPoint != "/" {
 		fs = http.StripPrefix(strings.TrimSuffix(mountPoint, "/"), fs)
 	}
@@ -760,6 +971,30 @@ func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Reque
 	}, r)
 }
 
+// noListingFS is an http.FileSystem that hides directories without an
+// index.html, so that http.FileServer doesn't list their contents.
+type noListingFS struct {
+	http.FileSystem
+}
+
+func (fs noListingFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.IsDir() {
+		return f, err
+	}
+	index, err := fs.FileSystem.Open(path.Join(name, "index.html"))
+	if err != nil {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	index.Close()
+	return f, nil
+}
+
 // fixLocationHeaderResponseWriter is an http.ResponseWriter wrapper that, upon
 // flushing HTTP headers, prefixes any Location header with the mount point.
 type fixLocationHeaderResponseWriter struct {
@@ -7,7 +7,9 @@
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
@@ -16,6 +18,7 @@
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/store/mem"
@@ -388,7 +391,7 @@ func TestServeFileOrDirectory(t *testing.T) {
 	for _, tt := range tests {
 		rec := httptest.NewRecorder()
 		req := httptest.NewRequest("GET", tt.req, nil)
-		b.serveFileOrDirectory(rec, req, td, tt.mount)
+		b.serveFileOrDirectory(rec, req, td, tt.mount, false)
 		if tt.want == nil {
 			t.Errorf("no want for path %q", tt.req)
 			return
@@ -398,3 +401,224 @@ func TestServeFileOrDirectory(t *testing.T) {
 		}
 	}
 }
+
+func TestServeFileOrDirectoryNoListing(t *testing.T) {
+	td := t.TempDir()
+	os.MkdirAll(filepath.Join(td, "site"), 0700)
+	if err := os.WriteFile(filepath.Join(td, "site", "index.html"), []byte("welcome"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(td, "foo"), []byte("this is foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &LocalBackend{}
+	tests := []struct {
+		req      string
+		wantCode int
+		wantBody string
+	}{
+		{"/", 404, ""},
+		{"/foo", 200, "this is foo"},
+		{"/site/", 200, "welcome"},
+		{"/site", 301, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		b.serveFileOrDirectory(rec, httptest.NewRequest("GET", tt.req, nil), td, "/", true)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: status = %d; want %d", tt.req, rec.Code, tt.wantCode)
+		}
+		if tt.wantBody != "" && !strings.Contains(rec.Body.String(), tt.wantBody) {
+			t.Errorf("%s: body = %q; want %q", tt.req, rec.Body.String(), tt.wantBody)
+		}
+	}
+}
+
+func TestServeHandlerOptions(t *testing.T) {
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {
+					Text:    "hi",
+					Headers: map[string]string{"Cache-Control": "no-store"},
+				},
+				"/old/": {
+					Redirect:     "https://${HOST}/new${REQUEST_URI}",
+					RedirectCode: http.StatusMovedPermanently,
+				},
+				"/private/": {
+					Text:      "secret",
+					AllowFrom: []string{"alice@example.com", "group:admins", "tag:ci"},
+				},
+			}},
+		},
+	}
+	b := &LocalBackend{
+		serveConfig: conf.View(),
+		netMap: &netmap.NetworkMap{
+			UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+				1: {LoginName: "alice@example.com"},
+				2: {LoginName: "bob@example.com"},
+				3: {LoginName: "carol@example.com", Groups: []string{"group:admins"}},
+			},
+		},
+		nodeByAddr: map[netip.Addr]tailcfg.NodeView{
+			netip.MustParseAddr("100.64.0.1"): (&tailcfg.Node{User: 1}).View(),
+			netip.MustParseAddr("100.64.0.2"): (&tailcfg.Node{User: 2}).View(),
+			netip.MustParseAddr("100.64.0.3"): (&tailcfg.Node{User: 3}).View(),
+			netip.MustParseAddr("100.64.0.4"): (&tailcfg.Node{User: 2, Tags: []string{"tag:ci"}}).View(),
+			netip.MustParseAddr("100.64.0.5"): (&tailcfg.Node{User: 1, Tags: []string{"tag:other"}}).View(),
+		},
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		src      string
+		wantCode int
+		wantBody string
+		wantHdr  map[string]string
+	}{
+		{"headers", "/", "100.64.0.2", 200, "hi", map[string]string{"Cache-Control": "no-store"}},
+		{"redirect", "/old/x?y=1", "100.64.0.2", 301, "", map[string]string{"Location": "https://example.ts.net/new/old/x?y=1"}},
+		{"allow-user", "/private/", "100.64.0.1", 200, "secret", nil},
+		{"allow-group", "/private/", "100.64.0.3", 200, "secret", nil},
+		{"allow-tag", "/private/", "100.64.0.4", 200, "secret", nil},
+		{"deny-user", "/private/", "100.64.0.2", 403, "", nil},
+		{"deny-tagged-owner", "/private/", "100.64.0.5", 403, "", nil},
+		{"deny-funnel", "/private/", "203.0.113.1", 403, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "https://example.ts.net"+tt.path, nil)
+			req.TLS = &tls.ConnectionState{ServerName: "example.ts.net"}
+			req = req.WithContext(context.WithValue(req.Context(), serveHTTPContextKey{}, &serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.AddrPortFrom(netip.MustParseAddr(tt.src), 0),
+			}))
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d; want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q; want %q", w.Body.String(), tt.wantBody)
+			}
+			for k, v := range tt.wantHdr {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("header %s = %q; want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyUDPFlow(t *testing.T) {
+	// backend echoes datagrams back to their sender.
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	// peer stands in for the remote tailnet node, and flow for netstack's
+	// connected socket for its flow.
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	flow, err := net.DialUDP("udp", nil, peer.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := netip.MustParseAddrPort("100.64.0.1:5353")
+	backConn, err := dialServeUDP(backend.LocalAddr().String(), src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxyUDPFlow(flow, backConn, 500*time.Millisecond)
+	}()
+
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := peer.WriteTo([]byte(msg), flow.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := peer.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != msg {
+			t.Errorf("got %q; want %q", got, msg)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow didn't time out")
+	}
+}
+
+func TestServeUDPFlowLimit(t *testing.T) {
+	sc := &ipn.ServeConfig{
+		UDP: map[uint16]*ipn.UDPPortHandler{
+			53: {Forward: "127.0.0.1:5353"},
+		},
+	}
+	b := &LocalBackend{logf: t.Logf, serveConfig: sc.View()}
+	src := func(i int) netip.AddrPort {
+		return netip.AddrPortFrom(netip.MustParseAddr("100.64.0.1"), uint16(1024+i))
+	}
+	for i := 0; i < ipn.MaxUDPFlowsPerPort; i++ {
+		if h := b.udpHandlerForServe(53, src(i)); h == nil {
+			t.Fatalf("flow %d: no handler", i)
+		}
+	}
+	if got := b.serveUDPFlows[53]; got != ipn.MaxUDPFlowsPerPort {
+		t.Fatalf("serveUDPFlows[53] = %d; want %d", got, ipn.MaxUDPFlowsPerPort)
+	}
+
+	// The next flow is dropped: its handler just closes the conn.
+	h := b.udpHandlerForServe(53, src(ipn.MaxUDPFlowsPerPort))
+	if h == nil {
+		t.Fatal("no handler for flow over the limit")
+	}
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h(c)
+	if _, err := c.WriteTo([]byte("x"), c.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after dropped flow: %v; want net.ErrClosed", err)
+	}
+	if got := b.serveUDPFlows[53]; got != ipn.MaxUDPFlowsPerPort {
+		t.Errorf("serveUDPFlows[53] = %d after dropped flow; want %d", got, ipn.MaxUDPFlowsPerPort)
+	}
+
+	// Once a flow ends, there's room for another.
+	b.endServeUDPFlow(53)
+	if h := b.udpHandlerForServe(53, src(ipn.MaxUDPFlowsPerPort)); h == nil {
+		t.Fatal("no handler after a flow ended")
+	}
+	if got := b.serveUDPFlows[53]; got != ipn.MaxUDPFlowsPerPort {
+		t.Errorf("serveUDPFlows[53] = %d; want %d", got, ipn.MaxUDPFlowsPerPort)
+	}
+}
@@ -25,6 +25,7 @@
 	"sync"
 	"time"
 
+	"golang.org/x/net/dns/dnsmessage"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/envknob"
 	"tailscale.com/health"
@@ -36,10 +37,12 @@
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/netutil"
 	"tailscale.com/net/portmapper"
+	"tailscale.com/net/speedtest"
 	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tka"
 	"tailscale.com/tstime"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
@@ -50,6 +53,7 @@
 	"tailscale.com/util/mak"
 	"tailscale.com/util/osdiag"
 	"tailscale.com/version"
+	"tailscale.com/wgengine/capture"
 )
 
 type localAPIHandler func(*Handler, http.ResponseWriter, *http.Request)
@@ -77,11 +81,18 @@
 	"debug-portmap":               (*Handler).serveDebugPortmap,
 	"debug-peer-endpoint-changes": (*Handler).serveDebugPeerEndpointChanges,
 	"debug-capture":               (*Handler).serveDebugCapture,
+	"debug-capture-ring":          (*Handler).serveDebugCaptureRing,
+	"debug-conntrack":             (*Handler).serveDebugConntrack,
+	"debug-filter-check":          (*Handler).serveDebugFilterCheck,
 	"debug-log":                   (*Handler).serveDebugLog,
 	"derpmap":                     (*Handler).serveDERPMap,
 	"dev-set-state-store":         (*Handler).serveDevSetStateStore,
 	"set-push-device-token":       (*Handler).serveSetPushDeviceToken,
 	"dial":                        (*Handler).serveDial,
+	"dns-query":                   (*Handler).serveDNSQuery,
+	"dns-query-log":               (*Handler).serveDNSQueryLog,
+	"dns-status":                  (*Handler).serveDNSStatus,
+	"dns-upstream-stats":          (*Handler).serveDNSUpstreamStats,
 	"file-targets":                (*Handler).serveFileTargets,
 	"goroutines":                  (*Handler).serveGoroutines,
 	"id-token":                    (*Handler).serveIDToken,
@@ -89,6 +100,7 @@
 	"logout":                      (*Handler).serveLogout,
 	"logtap":                      (*Handler).serveLogTap,
 	"metrics":                     (*Handler).serveMetrics,
+	"netcheck-history":            (*Handler).serveNetcheckHistory,
 	"ping":                        (*Handler).servePing,
 	"prefs":                       (*Handler).servePrefs,
 	"pprof":                       (*Handler).servePprof,
@@ -96,6 +108,7 @@
 	"serve-config":                (*Handler).serveServeConfig,
 	"set-dns":                     (*Handler).serveSetDNS,
 	"set-expiry-sooner":           (*Handler).serveSetExpirySooner,
+	"speedtest":                   (*Handler).serveSpeedtest,
 	"start":                       (*Handler).serveStart,
 	"status":                      (*Handler).serveStatus,
 	"stream-serve":                (*Handler).serveStreamServe,
@@ -424,8 +437,13 @@ func (h *Handler) serveWhoIs(w http.ResponseWriter, r *http.Request) {
 		var err error
 		ipp, err = netip.ParseAddrPort(v)
 		if err != nil {
-			http.Error(w, "invalid 'addr' parameter", 400)
-			return
+			// Also accept a bare IP address.
+			ip, err := netip.ParseAddr(v)
+			if err != nil {
+				http.Error(w, "invalid 'addr' parameter", 400)
+				return
+			}
+			ipp = netip.AddrPortFrom(ip, 0)
 		}
 	} else {
 		http.Error(w, "missing 'addr' parameter", 400)
@@ -1234,6 +1252,12 @@ func (h *Handler) serveFileTargets(w http.ResponseWriter, r *http.Request) {
 // URL format:
 //
 //   - PUT /localapi/v0/file-put/:stableID/:escaped-filename
+//   - GET /localapi/v0/file-put/:stableID/:escaped-filename, to get the
+//     peer's apitype.TaildropPartial for resuming a transfer
+//
+// The filename may contain unescaped slashes to put a file in a directory.
+// The "offset" query parameter and apitype.TaildropSHA256Header header are
+// passed on to the peer.
 func (h *Handler) serveFilePut(w http.ResponseWriter, r *http.Request) {
 	metricFilePutCalls.Add(1)
 
@@ -1241,7 +1265,7 @@ func (h *Handler) serveFilePut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "file access denied", http.StatusForbidden)
 		return
 	}
-	if r.Method != "PUT" {
+	if r.Method != "PUT" && r.Method != "GET" {
 		http.Error(w, "want PUT to put file", 400)
 		return
 	}
@@ -1279,12 +1303,22 @@ func (h *Handler) serveFilePut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bogus peer URL", 500)
 		return
 	}
-	outReq, err := http.NewRequestWithContext(r.Context(), "PUT", "http://peer/v0/put/"+filenameEscaped, r.Body)
+	var body io.Reader
+	if r.Method == "PUT" {
+		body = r.Body
+	}
+	outReq, err := http.NewRequestWithContext(r.Context(), r.Method, "http://peer/v0/put/"+filenameEscaped, body)
 	if err != nil {
 		http.Error(w, "bogus outreq", 500)
 		return
 	}
 	outReq.ContentLength = r.ContentLength
+	if offset := r.URL.Query().Get("offset"); offset != "" {
+		outReq.URL.RawQuery = url.Values{"offset": {offset}}.Encode()
+	}
+	if sum := r.Header.Get(apitype.TaildropSHA256Header); sum != "" {
+		outReq.Header.Set(apitype.TaildropSHA256Header, sum)
+	}
 
 	rp := httputil.NewSingleHostReverseProxy(dstURL)
 	rp.Transport = h.b.Dialer().PeerAPITransport()
@@ -1310,6 +1344,129 @@ func (h *Handler) serveSetDNS(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(struct{}{})
 }
 
+func (h *Handler) serveDNSStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	st, err := h.b.DNSStatus()
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(st)
+}
+
+// dnsQueryTypes maps the query type names accepted by serveDNSQuery to
+// their DNS types.
+var dnsQueryTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"ANY":   dnsmessage.TypeALL,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+// serveDNSQuery resolves the "name" query parameter using tailscaled's
+// internal resolver. The optional "type" parameter is the record type to
+// query for, defaulting to "A".
+func (h *Handler) serveDNSQuery(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "missing 'name' parameter", 400)
+		return
+	}
+	typ := dnsmessage.TypeA
+	if v := r.FormValue("type"); v != "" {
+		var ok bool
+		typ, ok = dnsQueryTypes[strings.ToUpper(v)]
+		if !ok {
+			http.Error(w, "unsupported 'type' parameter", 400)
+			return
+		}
+	}
+	res, resolvers, err := h.b.QueryDNS(r.Context(), name, typ)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&apitype.DNSQueryResponse{
+		Bytes:     res,
+		Resolvers: resolvers,
+	})
+}
+
+// serveDNSQueryLog streams the DNS queries handled by tailscaled's internal
+// resolver as JSON apitype.DNSQueryLogEntry values, starting with those
+// recently logged. Queries are only logged while a client is watching.
+func (h *Handler) serveDNSQueryLog(w http.ResponseWriter, r *http.Request) {
+	// Require write access, as the queried names of other clients may
+	// be sensitive.
+	if !h.PermitWrite {
+		http.Error(w, "dns query log access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err := h.b.WatchDNSQueryLog(r.Context(), func(e *apitype.DNSQueryLogEntry) {
+		enc.Encode(e)
+		f.Flush()
+	})
+	if err != nil {
+		writeErrorJSON(w, err)
+	}
+}
+
+func (h *Handler) serveDNSUpstreamStats(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	stats, err := h.b.DNSUpstreamStats()
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(stats)
+}
+
 func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "want GET", 400)
@@ -1321,6 +1478,26 @@ func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
 	e.Encode(h.b.DERPMap())
 }
 
+// serveNetcheckHistory serves the netcheck reports recently made by
+// tailscaled, oldest first.
+func (h *Handler) serveNetcheckHistory(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "netcheck-history access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	res, err := h.b.NetcheckHistory()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
 // serveSetExpirySooner sets the expiry date on the current machine, specified
 // by an `expiry` unix timestamp as POST or query param.
 func (h *Handler) serveSetExpirySooner(w http.ResponseWriter, r *http.Request) {
@@ -1401,6 +1578,49 @@ func (h *Handler) servePing(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
+// serveSpeedtest runs a throughput test against a peer and returns the
+// []speedtest.Result as JSON.
+func (h *Handler) serveSpeedtest(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "speedtest access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", http.StatusMethodNotAllowed)
+		return
+	}
+	ip, err := netip.ParseAddr(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid or missing 'ip' parameter", http.StatusBadRequest)
+		return
+	}
+	var dir speedtest.Direction
+	switch r.FormValue("direction") {
+	case "download", "":
+		dir = speedtest.Download
+	case "upload":
+		dir = speedtest.Upload
+	default:
+		http.Error(w, "invalid 'direction' parameter; want upload or download", http.StatusBadRequest)
+		return
+	}
+	dur := speedtest.DefaultDuration
+	if v := r.FormValue("duration"); v != "" {
+		dur, err = time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "invalid 'duration' parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := h.b.Speedtest(r.Context(), ip, dir, dur)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
 func (h *Handler) serveDial(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "POST required", http.StatusMethodNotAllowed)
@@ -2068,6 +2288,123 @@ func (h *Handler) serveDebugCapture(w http.ResponseWriter, r *http.Request) {
 	h.b.StreamDebugCapture(r.Context(), w)
 }
 
+// serveDebugCaptureRing reports the status of the on-disk capture ring on
+// GET, and starts or stops it on POST with action=start or action=stop.
+// Starting takes the optional parameters filter (see capture.ParseFilter),
+// size (bytes per file) and files (number of files kept).
+func (h *Handler) serveDebugCaptureRing(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		switch action := r.FormValue("action"); action {
+		case "start":
+			filter, err := capture.ParseFilter(r.FormValue("filter"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var size int64
+			if v := r.FormValue("size"); v != "" {
+				if size, err = strconv.ParseInt(v, 10, 64); err != nil {
+					http.Error(w, "invalid size", http.StatusBadRequest)
+					return
+				}
+			}
+			var files int
+			if v := r.FormValue("files"); v != "" {
+				if files, err = strconv.Atoi(v); err != nil {
+					http.Error(w, "invalid files", http.StatusBadRequest)
+					return
+				}
+			}
+			if err := h.b.StartDebugCaptureRing(filter, size, files); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "stop":
+			if err := h.b.StopDebugCaptureRing(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, fmt.Sprintf("unknown action %q", action), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.b.DebugCaptureRingStatus())
+}
+
+func (h *Handler) serveDebugConntrack(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	res, err := h.b.DebugConntrack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// serveDebugFilterCheck reports how the packet filter would handle a packet
+// with the IP protocol number proto from src to dst (both "ip:port"), in the
+// direction dir: "in" (the default) for one received from a peer, or "out".
+func (h *Handler) serveDebugFilterCheck(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	proto, err := strconv.ParseUint(r.FormValue("proto"), 10, 8)
+	if err != nil {
+		http.Error(w, "invalid proto", http.StatusBadRequest)
+		return
+	}
+	src, err := netip.ParseAddrPort(r.FormValue("src"))
+	if err != nil {
+		http.Error(w, "invalid src: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	dst, err := netip.ParseAddrPort(r.FormValue("dst"))
+	if err != nil {
+		http.Error(w, "invalid dst: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var outgoing bool
+	switch dir := r.FormValue("dir"); dir {
+	case "", "in":
+	case "out":
+		outgoing = true
+	default:
+		http.Error(w, fmt.Sprintf("invalid dir %q", dir), http.StatusBadRequest)
+		return
+	}
+	res, err := h.b.DebugFilterCheck(ipproto.Proto(proto), src, dst, outgoing)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
 func (h *Handler) serveDebugLog(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitRead {
 		http.Error(w, "debug-log access denied", http.StatusForbidden)
@@ -30,6 +30,10 @@ type ServeConfig struct {
 	// the Tailscale IP addresses. (not subnet routers, etc)
 	TCP map[uint16]*TCPPortHandler `json:",omitempty"`
 
+	// UDP are the UDP port numbers that tailscaled should handle for the
+	// Tailscale IP addresses, and how to handle them.
+	UDP map[uint16]*UDPPortHandler `json:",omitempty"`
+
 	// Web maps from "$SNI_NAME:$PORT" to a set of HTTP handlers
 	// keyed by mount point ("/", "/foo", etc)
 	Web map[HostPort]*WebServerConfig `json:",omitempty"`
@@ -157,8 +161,45 @@ type HTTPHandler struct {
 
 	Text string `json:",omitempty"` // plaintext to serve (primarily for testing)
 
-	// TODO(bradfitz): bool to not enumerate directories? TTL on mapping for
-	// temporary ones? Error codes? Redirects?
+	// Redirect is a URL to redirect requests to. The strings "${HOST}" and
+	// "${REQUEST_URI}" in it are replaced by the request's host and URI.
+	Redirect string `json:",omitempty"`
+
+	// The following options modify how the handler above serves requests.
+
+	// RedirectCode is the HTTP status code used for Redirect.
+	// Zero means http.StatusFound.
+	RedirectCode int `json:",omitempty"`
+
+	// Headers are static headers to set on every response, replacing
+	// any of the same name set by the handler.
+	Headers map[string]string `json:",omitempty"`
+
+	// NoListing, if set, disables directory listings when serving a Path.
+	// Directories without an index.html then respond with 404.
+	NoListing bool `json:",omitempty"`
+
+	// NoStripPrefix, if set, keeps the mount point in the URL path of
+	// requests sent to a Proxy. By default, it's trimmed.
+	NoStripPrefix bool `json:",omitempty"`
+
+	// AllowFrom, if non-empty, restricts the handler to requests from
+	// tailnet nodes whose identity matches one of its entries: a user's
+	// login name, a "group:" the user is a member of, or a "tag:" of the
+	// node. Other requests, including all Funnel traffic, get a 403.
+	AllowFrom []string `json:",omitempty"`
+
+	// TODO(bradfitz): TTL on mapping for temporary ones? Error codes?
+}
+
+// ValidRedirectCode reports whether code is acceptable as an
+// HTTPHandler.RedirectCode.
+func ValidRedirectCode(code int) bool {
+	switch code {
+	case 0, 301, 302, 303, 307, 308:
+		return true
+	}
+	return false
 }
 
 // WebHandlerExists reports whether if the ServeConfig Web handler exists for
@@ -177,6 +218,58 @@ func (sc *ServeConfig) GetWebHandler(hp HostPort, mount string) *HTTPHandler {
 	return sc.Web[hp].Handlers[mount]
 }
 
+// UDPPortHandler describes what to do when handling datagrams sent to a
+// UDP port.
+type UDPPortHandler struct {
+	// Forward is the IP:port to forward datagrams to. Each flow (distinct
+	// source IP:port) gets its own backend socket, up to
+	// MaxUDPFlowsPerPort at a time; datagrams starting further flows are
+	// dropped.
+	Forward string `json:",omitempty"`
+
+	// IdleTimeoutSec is how many seconds a flow may be idle before its
+	// backend socket is closed. Zero means DefaultUDPIdleTimeout.
+	IdleTimeoutSec int `json:",omitempty"`
+
+	// BindSourcePort, if true, binds each flow's backend socket to the
+	// same port number as the client's source port, if that port is free
+	// locally. The backend still sees datagrams coming from a local
+	// address, not the client's; in either case, the backend socket's
+	// address is registered for WhoIs lookups so the backend can find the
+	// client's Tailscale IP.
+	BindSourcePort bool `json:",omitempty"`
+}
+
+// MaxUDPFlowsPerPort is the maximum number of concurrent flows forwarded
+// for each UDPPortHandler.
+const MaxUDPFlowsPerPort = 1024
+
+// DefaultUDPIdleTimeout is the idle timeout for UDP flows when
+// UDPPortHandler.IdleTimeoutSec is zero.
+const DefaultUDPIdleTimeout = 2 * time.Minute
+
+// IdleTimeout returns the idle timeout for flows handled by h.
+func (h *UDPPortHandler) IdleTimeout() time.Duration {
+	if h.IdleTimeoutSec <= 0 {
+		return DefaultUDPIdleTimeout
+	}
+	return time.Duration(h.IdleTimeoutSec) * time.Second
+}
+
+// IdleTimeout returns the idle timeout for flows handled by h.
+//
+// View version of UDPPortHandler.IdleTimeout.
+func (v UDPPortHandlerView) IdleTimeout() time.Duration { return v.ж.IdleTimeout() }
+
+// GetUDPPortHandler returns the UDPPortHandler for the given port.
+// If the port is not configured, nil is returned.
+func (sc *ServeConfig) GetUDPPortHandler(port uint16) *UDPPortHandler {
+	if sc == nil {
+		return nil
+	}
+	return sc.UDP[port]
+}
+
 // GetTCPPortHandler returns the TCPPortHandler for the given port.
 // If the port is not configured, nil is returned.
 func (sc *ServeConfig) GetTCPPortHandler(port uint16) *TCPPortHandler {
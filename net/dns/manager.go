@@ -8,12 +8,14 @@
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/netip"
 	"runtime"
 	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -62,6 +64,11 @@ type Manager struct {
 
 	resolver *resolver.Resolver
 	os       OSConfigurator
+
+	mu   sync.Mutex // guards following
+	cfg  Config     // last Config passed to Set
+	rcfg resolver.Config
+	ocfg OSConfig
 }
 
 // NewManagers created a new manager from the given config.
@@ -108,9 +115,45 @@ func (m *Manager) Set(cfg Config) error {
 	}
 	health.SetDNSOSHealth(nil)
 
+	m.mu.Lock()
+	m.cfg, m.rcfg, m.ocfg = cfg, rcfg, ocfg
+	m.mu.Unlock()
 	return nil
 }
 
+// Status describes the DNS configuration most recently applied by a
+// Manager.
+type Status struct {
+	// Config is the Config that was passed to Set.
+	Config Config
+	// ResolverConfig is the configuration of the in-process resolver
+	// that Config compiled to.
+	ResolverConfig resolver.Config
+	// OSConfig is the configuration installed in the OS.
+	OSConfig OSConfig
+
+	// OSConfigurator is the type of the OSConfigurator in use.
+	OSConfigurator string
+	// SupportsSplitDNS is whether the OSConfigurator supports
+	// split DNS.
+	SupportsSplitDNS bool
+}
+
+// Status returns the configuration most recently applied by Set.
+//
+// The returned value's maps and slices must not be modified.
+func (m *Manager) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return Status{
+		Config:           m.cfg,
+		ResolverConfig:   m.rcfg,
+		OSConfig:         m.ocfg,
+		OSConfigurator:   strings.TrimPrefix(fmt.Sprintf("%T", m.os), "*dns."),
+		SupportsSplitDNS: m.os.SupportsSplitDNS(),
+	}
+}
+
 // compileHostEntries creates a list of single-label resolutions possible
 // from the configured hosts and search domains.
 // The entries are compiled in the order of the search domains, then the hosts.
@@ -160,6 +203,7 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// authoritative suffixes, even if we don't propagate MagicDNS to
 	// the OS.
 	rcfg.Hosts = cfg.Hosts
+	rcfg.Records = cfg.Records
 	routes := map[dnsname.FQDN][]*dnstype.Resolver{} // assigned conditionally to rcfg.Routes below.
 	for suffix, resolvers := range cfg.Routes {
 		if len(resolvers) == 0 {
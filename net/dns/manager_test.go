@@ -625,6 +625,17 @@ func TestManager(t *testing.T) {
 			if diff := cmp.Diff(f.ResolverConfig, test.rs, trIP, trIPPort, cmpopts.EquateEmpty()); diff != "" {
 				t.Errorf("wrong resolver.Config (-got+want)\n%s", diff)
 			}
+
+			st := m.Status()
+			if diff := cmp.Diff(st.OSConfig, f.OSConfig, trIP, trIPPort, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("wrong Status.OSConfig (-got+want)\n%s", diff)
+			}
+			if diff := cmp.Diff(st.ResolverConfig, f.ResolverConfig, trIP, trIPPort, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("wrong Status.ResolverConfig (-got+want)\n%s", diff)
+			}
+			if st.OSConfigurator != "fakeOSConfigurator" || st.SupportsSplitDNS != test.split {
+				t.Errorf("Status = %q, split %v; want %q, split %v", st.OSConfigurator, st.SupportsSplitDNS, "fakeOSConfigurator", test.split)
+			}
 		})
 	}
 }
@@ -0,0 +1,272 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/envknob"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/util/lru"
+)
+
+const (
+	// maxCacheEntries is the maximum number of responses the forwarder
+	// caches.
+	maxCacheEntries = 4096
+
+	// maxCacheTTL caps how long a positive response is cached,
+	// regardless of its TTL.
+	maxCacheTTL = time.Hour
+
+	// maxNegativeCacheTTL caps how long a negative (NXDOMAIN or NODATA)
+	// response is cached. RFC 2308 section 5 suggests one to three hours;
+	// we use less, as names in split DNS domains tend to come and go.
+	maxNegativeCacheTTL = 5 * time.Minute
+)
+
+// disableDNSCache disables the forwarder's response cache.
+var disableDNSCache = envknob.RegisterBool("TS_DEBUG_DNS_FORWARD_NO_CACHE")
+
+// cacheKey is the key for a cached response: the query's question, and
+// the UDP payload size the query advertised in an EDNS OPT record, as that
+// limits how large a response the upstream may send. A response to a
+// query advertising a larger size could overflow the client's buffer.
+type cacheKey struct {
+	name     dnsname.FQDN // lowercase
+	qtype    dns.Type
+	class    dns.Class
+	ednsSize uint16 // 0 without EDNS; else clamped to [512, maxResponseBytes]
+}
+
+// cacheEntry is a cached upstream response.
+type cacheEntry struct {
+	msg     []byte    // the response as received; its ID is rewritten on use
+	stored  time.Time // when msg was received
+	expires time.Time
+}
+
+// responseCache is a size-bounded cache of upstream DNS responses.
+//
+// Entries are kept for the smallest TTL among the response's records, or
+// for negative responses, per RFC 2308, the smaller of the SOA record's TTL
+// and its MINIMUM field. Responses served from the cache have their TTLs
+// decremented by the time spent in the cache.
+//
+// The zero value is ready to use.
+type responseCache struct {
+	now func() time.Time // or nil for time.Now; for tests
+
+	mu      sync.Mutex
+	entries lru.Cache[cacheKey, *cacheEntry]
+}
+
+func (c *responseCache) timeNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// get returns the cached response for the query with key k, with its ID
+// and question set from query, and reports whether there was one.
+func (c *responseCache) get(k cacheKey, query []byte) ([]byte, bool) {
+	now := c.timeNow()
+	c.mu.Lock()
+	e, ok := c.entries.GetOk(k)
+	if ok && !now.Before(e.expires) {
+		c.entries.Delete(k)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	res, err := rewriteCachedResponse(e.msg, query, now.Sub(e.stored))
+	if err != nil {
+		return nil, false
+	}
+	return res, true
+}
+
+// put caches res, the upstream response to the query with key k, if it's
+// cacheable.
+func (c *responseCache) put(k cacheKey, res []byte) {
+	ttl, ok := cacheTTL(k, res)
+	if !ok {
+		return
+	}
+	now := c.timeNow()
+	e := &cacheEntry{
+		msg:     bytes.Clone(res),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.MaxEntries = maxCacheEntries
+	c.entries.Set(k, e)
+}
+
+// flush removes all entries from the cache.
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.entries.Len() > 0 {
+		c.entries.DeleteOldest()
+	}
+}
+
+// len returns the number of entries in the cache, including expired ones
+// that haven't been removed yet.
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Len()
+}
+
+// parseCacheKey returns the cache key for the DNS query in bs and reports
+// whether the query is cacheable: a standard query with a single question.
+func parseCacheKey(bs []byte) (k cacheKey, ok bool) {
+	var p dns.Parser
+	h, err := p.Start(bs)
+	if err != nil || h.Response || h.OpCode != 0 {
+		return k, false
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) != 1 {
+		return k, false
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return k, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return k, false
+	}
+	for {
+		rh, err := p.AdditionalHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return k, false
+		}
+		if rh.Type == dns.TypeOPT {
+			// The OPT record's class is the UDP payload size. Per
+			// RFC 6891 section 6.2.5, values below 512 are treated
+			// as 512, and we never relay responses larger than
+			// maxResponseBytes.
+			k.ednsSize = min(max(uint16(rh.Class), 512), maxResponseBytes)
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return k, false
+		}
+	}
+	q := qs[0]
+	name, err := dnsname.ToFQDN(rawNameToLower(q.Name.Data[:q.Name.Length]))
+	if err != nil {
+		return k, false
+	}
+	k.name, k.qtype, k.class = name, q.Type, q.Class
+	return k, true
+}
+
+// cacheTTL reports for how long res, the upstream response to the query
+// with key k, may be cached, and whether it may be cached at all.
+func cacheTTL(k cacheKey, res []byte) (ttl time.Duration, ok bool) {
+	var m dns.Message
+	if err := m.Unpack(res); err != nil {
+		return 0, false
+	}
+	if !m.Response || m.Truncated || len(m.Questions) != 1 {
+		return 0, false
+	}
+	q := m.Questions[0]
+	name, err := dnsname.ToFQDN(rawNameToLower(q.Name.Data[:q.Name.Length]))
+	if err != nil || name != k.name || q.Type != k.qtype || q.Class != k.class {
+		return 0, false
+	}
+
+	switch {
+	case m.RCode == dns.RCodeSuccess && len(m.Answers) > 0:
+		secs, ok := minTTL(m.Answers, m.Authorities, m.Additionals)
+		if !ok || secs == 0 {
+			return 0, false
+		}
+		return min(time.Duration(secs)*time.Second, maxCacheTTL), true
+	case m.RCode == dns.RCodeSuccess, m.RCode == dns.RCodeNameError:
+		// A negative response: NODATA or NXDOMAIN. Per RFC 2308 section 5,
+		// it's cached for the smaller of the SOA record's TTL and its
+		// MINIMUM field, and not at all if there's no SOA record.
+		for _, rr := range m.Authorities {
+			soa, ok := rr.Body.(*dns.SOAResource)
+			if !ok {
+				continue
+			}
+			secs := min(rr.Header.TTL, soa.MinTTL)
+			if secs == 0 {
+				return 0, false
+			}
+			return min(time.Duration(secs)*time.Second, maxNegativeCacheTTL), true
+		}
+	}
+	return 0, false
+}
+
+// minTTL returns the smallest TTL among the resource records in sections,
+// ignoring EDNS OPT records, and whether there were any records.
+func minTTL(sections ...[]dns.Resource) (ttl uint32, ok bool) {
+	for _, rrs := range sections {
+		for _, rr := range rrs {
+			if rr.Header.Type == dns.TypeOPT {
+				continue
+			}
+			if !ok || rr.Header.TTL < ttl {
+				ttl = rr.Header.TTL
+			}
+			ok = true
+		}
+	}
+	return ttl, ok
+}
+
+// rewriteCachedResponse returns a copy of the cached response msg that
+// answers query: with query's ID and question, and with the TTLs of its
+// records decremented by age.
+func rewriteCachedResponse(msg, query []byte, age time.Duration) ([]byte, error) {
+	var p dns.Parser
+	qh, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	var m dns.Message
+	if err := m.Unpack(msg); err != nil {
+		return nil, err
+	}
+	m.ID = qh.ID
+	m.Questions = []dns.Question{q}
+	secs := uint32(age / time.Second)
+	for _, rrs := range [][]dns.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range rrs {
+			h := &rrs[i].Header
+			if h.Type == dns.TypeOPT {
+				continue
+			}
+			if h.TTL > secs {
+				h.TTL -= secs
+			} else {
+				h.TTL = 0
+			}
+		}
+	}
+	return m.Pack()
+}
@@ -0,0 +1,317 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+// cacheTestResponse returns a response to query with the given rcode,
+// answers and authorities.
+func cacheTestResponse(t testing.TB, query []byte, rcode dns.RCode, answers, authorities []dns.Resource) []byte {
+	t.Helper()
+	var p dns.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := p.Question()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := dns.Message{
+		Header:      dns.Header{ID: h.ID, Response: true, RCode: rcode},
+		Questions:   []dns.Question{q},
+		Answers:     answers,
+		Authorities: authorities,
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func aRecord(name string, ttl uint32, ip netip.Addr) dns.Resource {
+	return dns.Resource{
+		Header: dns.ResourceHeader{Name: dns.MustNewName(name), Type: dns.TypeA, Class: dns.ClassINET, TTL: ttl},
+		Body:   &dns.AResource{A: ip.As4()},
+	}
+}
+
+func soaRecord(name string, ttl, minTTL uint32) dns.Resource {
+	return dns.Resource{
+		Header: dns.ResourceHeader{Name: dns.MustNewName(name), Type: dns.TypeSOA, Class: dns.ClassINET, TTL: ttl},
+		Body: &dns.SOAResource{
+			NS:     dns.MustNewName("ns." + name),
+			MBox:   dns.MustNewName("hostmaster." + name),
+			MinTTL: minTTL,
+		},
+	}
+}
+
+func TestParseCacheKey(t *testing.T) {
+	k, ok := parseCacheKey(dnspacket("Test.Example.", dns.TypeA, noEdns))
+	if !ok {
+		t.Fatal("query not cacheable")
+	}
+	want := cacheKey{name: "test.example.", qtype: dns.TypeA, class: dns.ClassINET}
+	if k != want {
+		t.Errorf("key = %+v; want %+v", k, want)
+	}
+
+	k, ok = parseCacheKey(dnspacket("test.example.", dns.TypeAAAA, 1232))
+	if !ok || k.ednsSize != 1232 || k.qtype != dns.TypeAAAA {
+		t.Errorf("EDNS query key = %+v, %v; want EDNS AAAA key", k, ok)
+	}
+
+	// Queries advertising different payload sizes don't share responses,
+	// except that sizes beyond what's ever relayed are equivalent.
+	for _, tt := range []struct {
+		size uint16
+		want uint16
+	}{
+		{100, 512},
+		{512, 512},
+		{4096, maxResponseBytes},
+		{65535, maxResponseBytes},
+	} {
+		k, _ := parseCacheKey(dnspacket("test.example.", dns.TypeA, tt.size))
+		if k.ednsSize != tt.want {
+			t.Errorf("EDNS size %d: key size = %d; want %d", tt.size, k.ednsSize, tt.want)
+		}
+	}
+
+	q := dnspacket("test.example.", dns.TypeA, noEdns)
+	res := cacheTestResponse(t, q, dns.RCodeSuccess, nil, nil)
+	if _, ok := parseCacheKey(res); ok {
+		t.Error("response unexpectedly cacheable as a query")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	q := dnspacket("test.example.", dns.TypeA, noEdns)
+	k, _ := parseCacheKey(q)
+	ip := netip.MustParseAddr("1.2.3.4")
+
+	tests := []struct {
+		name   string
+		res    []byte
+		want   time.Duration
+		wantOK bool
+	}{
+		{
+			name:   "min-answer-ttl",
+			res:    cacheTestResponse(t, q, dns.RCodeSuccess, []dns.Resource{aRecord("test.example.", 300, ip), aRecord("test.example.", 60, ip)}, nil),
+			want:   60 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:   "capped",
+			res:    cacheTestResponse(t, q, dns.RCodeSuccess, []dns.Resource{aRecord("test.example.", 86400, ip)}, nil),
+			want:   maxCacheTTL,
+			wantOK: true,
+		},
+		{
+			name: "zero-ttl",
+			res:  cacheTestResponse(t, q, dns.RCodeSuccess, []dns.Resource{aRecord("test.example.", 0, ip)}, nil),
+		},
+		{
+			name:   "nxdomain-soa-minimum",
+			res:    cacheTestResponse(t, q, dns.RCodeNameError, nil, []dns.Resource{soaRecord("example.", 3600, 30)}),
+			want:   30 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:   "nodata-soa-ttl",
+			res:    cacheTestResponse(t, q, dns.RCodeSuccess, nil, []dns.Resource{soaRecord("example.", 20, 3600)}),
+			want:   20 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:   "negative-capped",
+			res:    cacheTestResponse(t, q, dns.RCodeNameError, nil, []dns.Resource{soaRecord("example.", 86400, 86400)}),
+			want:   maxNegativeCacheTTL,
+			wantOK: true,
+		},
+		{
+			name: "nxdomain-no-soa",
+			res:  cacheTestResponse(t, q, dns.RCodeNameError, nil, nil),
+		},
+		{
+			name: "servfail",
+			res:  cacheTestResponse(t, q, dns.RCodeServerFailure, nil, []dns.Resource{soaRecord("example.", 60, 60)}),
+		},
+		{
+			name: "other-question",
+			res:  cacheTestResponse(t, dnspacket("other.example.", dns.TypeA, noEdns), dns.RCodeSuccess, []dns.Resource{aRecord("other.example.", 60, ip)}, nil),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := cacheTTL(k, tt.res)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("cacheTTL = %v, %v; want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := &responseCache{now: func() time.Time { return now }}
+
+	q := dnspacket("test.example.", dns.TypeA, noEdns)
+	k, _ := parseCacheKey(q)
+	ip := netip.MustParseAddr("1.2.3.4")
+	c.put(k, cacheTestResponse(t, q, dns.RCodeSuccess, []dns.Resource{aRecord("test.example.", 60, ip)}, nil))
+
+	// A later query, with a different ID and name case, gets the cached
+	// response with its own ID and question, and a decremented TTL.
+	now = now.Add(25 * time.Second)
+	q2 := dnspacket("TEST.example.", dns.TypeA, noEdns)
+	q2[0], q2[1] = 0x12, 0x34
+	k2, _ := parseCacheKey(q2)
+	res, ok := c.get(k2, q2)
+	if !ok {
+		t.Fatal("cache miss")
+	}
+	var m dns.Message
+	if err := m.Unpack(res); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 0x1234 {
+		t.Errorf("ID = %#x; want 0x1234", m.ID)
+	}
+	if got := m.Questions[0].Name.String(); got != "TEST.example." {
+		t.Errorf("question = %q; want TEST.example.", got)
+	}
+	if len(m.Answers) != 1 || m.Answers[0].Header.TTL != 35 {
+		t.Errorf("answers = %+v; want one with TTL 35", m.Answers)
+	}
+
+	now = now.Add(35 * time.Second)
+	if _, ok := c.get(k, q); ok {
+		t.Error("expired entry returned")
+	}
+	if n := c.len(); n != 0 {
+		t.Errorf("len after expiry = %d; want 0", n)
+	}
+
+	c.put(k, cacheTestResponse(t, q, dns.RCodeSuccess, []dns.Resource{aRecord("test.example.", 60, ip)}, nil))
+	c.flush()
+	if _, ok := c.get(k, q); ok {
+		t.Error("entry returned after flush")
+	}
+}
+
+func TestResponseCacheBounded(t *testing.T) {
+	var c responseCache
+	ip := netip.MustParseAddr("1.2.3.4")
+	for i := 0; i < maxCacheEntries+10; i++ {
+		name := dnsname.FQDN(fmt.Sprintf("host%d.example.", i))
+		q := dnspacket(name, dns.TypeA, noEdns)
+		k, ok := parseCacheKey(q)
+		if !ok {
+			t.Fatalf("query %d not cacheable", i)
+		}
+		c.put(k, cacheTestResponse(t, q, dns.RCodeSuccess, []dns.Resource{aRecord(name.WithTrailingDot(), 60, ip)}, nil))
+	}
+	if n := c.len(); n != maxCacheEntries {
+		t.Errorf("len = %d; want %d", n, maxCacheEntries)
+	}
+}
+
+func TestSetRoutesFlushesCache(t *testing.T) {
+	f := newForwarder(t.Logf, nil, nil, new(tsdial.Dialer))
+	defer f.Close()
+
+	routes := func(addr string) map[dnsname.FQDN][]*dnstype.Resolver {
+		return map[dnsname.FQDN][]*dnstype.Resolver{
+			".":             {{Addr: "8.8.8.8"}},
+			"corp.example.": {{Addr: addr}},
+			"lab.example.":  {{Addr: "10.0.0.2"}},
+		}
+	}
+	f.setRoutes(routes("10.0.0.1"))
+
+	q := dnspacket("test.example.", dns.TypeA, noEdns)
+	k, _ := parseCacheKey(q)
+	res := cacheTestResponse(t, q, dns.RCodeSuccess, []dns.Resource{aRecord("test.example.", 60, netip.MustParseAddr("1.2.3.4"))}, nil)
+
+	f.cache.put(k, res)
+	f.setRoutes(routes("10.0.0.1"))
+	if f.cache.len() != 1 {
+		t.Error("cache flushed by unchanged routes")
+	}
+	f.setRoutes(routes("10.0.0.3"))
+	if f.cache.len() != 0 {
+		t.Error("cache not flushed by changed routes")
+	}
+}
+
+func TestForwarderCache(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			var m dns.Message
+			if err := m.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			m.Response = true
+			m.Additionals = nil
+			m.Answers = []dns.Resource{aRecord("test.example.", 60, netip.MustParseAddr("1.2.3.4"))}
+			res, err := m.Pack()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(res, addr)
+		}
+	}()
+
+	f := newForwarder(t.Logf, nil, nil, new(tsdial.Dialer))
+	defer f.Close()
+	f.setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: pc.LocalAddr().String()}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		resc := make(chan packet, 1)
+		q := dnspacket("test.example.", dns.TypeA, noEdns)
+		q[1] = byte(i)
+		if err := f.forwardWithDestChan(ctx, packet{q, netip.AddrPort{}}, resc); err != nil {
+			t.Fatal(err)
+		}
+		if id := getTxID((<-resc).bs); id != getTxID(q) {
+			t.Errorf("query %d: response txid = %v; want %v", i, id, getTxID(q))
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("upstream got %d queries; want 1", n)
+	}
+}
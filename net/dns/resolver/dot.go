@@ -0,0 +1,233 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"tailscale.com/net/dnscache"
+	"tailscale.com/net/sockstats"
+	"tailscale.com/types/dnstype"
+)
+
+const (
+	// dotDefaultPort is the DNS-over-TLS port, per RFC 7858.
+	dotDefaultPort = "853"
+
+	// dotDialTimeout is how long to wait for a DoT connection, including
+	// the TLS handshake.
+	dotDialTimeout = 5 * time.Second
+
+	// dotIdleTimeout is how long to keep idle DoT connections for reuse.
+	dotIdleTimeout = dohTransportTimeout
+
+	// dotMaxIdleConns is the maximum number of idle connections kept per
+	// DoT resolver.
+	dotMaxIdleConns = 4
+)
+
+// dotClient sends DNS-over-TLS (RFC 7858) queries to a single resolver,
+// reusing connections between queries.
+//
+// Each connection carries one query at a time; concurrent queries use
+// separate connections.
+type dotClient struct {
+	hostPort  string // to dial
+	tlsConfig *tls.Config
+	dial      dnscache.DialContextFunc
+
+	mu     sync.Mutex
+	idle   []*dotConn // most recently used last
+	closed bool
+}
+
+// dotConn is a connection to a DoT resolver.
+type dotConn struct {
+	*tls.Conn
+	idleSince time.Time
+}
+
+// parseDoTAddr parses a "tls://host[:port]" resolver address, returning the
+// host and port to dial.
+func parseDoTAddr(addr string) (host, port string, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "tls" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return "", "", fmt.Errorf("invalid DNS-over-TLS resolver %q; want tls://host[:port]", addr)
+	}
+	host, port = u.Hostname(), u.Port()
+	if port == "" {
+		port = dotDefaultPort
+	}
+	return host, port, nil
+}
+
+// getDoTClient returns the client for the DoT resolver r, creating it if
+// needed.
+func (f *forwarder) getDoTClient(r *dnstype.Resolver) (*dotClient, error) {
+	key := encryptedResolverKey(r)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.dotClient[key]; ok {
+		return c, nil
+	}
+	host, port, err := parseDoTAddr(r.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &dotClient{
+		hostPort:  net.JoinHostPort(host, port),
+		tlsConfig: tlsConfig(host, nil),
+		dial:      f.dialerForHost(host, r.BootstrapResolution),
+	}
+	if f.dotClient == nil {
+		f.dotClient = map[string]*dotClient{}
+	}
+	f.dotClient[key] = c
+	return c, nil
+}
+
+// sendDoT sends fq to the DoT resolver r and returns its response.
+func (f *forwarder) sendDoT(ctx context.Context, fq *forwardQuery, r *dnstype.Resolver) ([]byte, error) {
+	metricDNSFwdDoT.Add(1)
+	c, err := f.getDoTClient(r)
+	if err != nil {
+		metricDNSFwdErrorType.Add(1)
+		return nil, err
+	}
+	ctx = sockstats.WithSockStats(ctx, sockstats.LabelDNSForwarderDoT, f.logf)
+	res, err := c.exchange(ctx, fq)
+	if err != nil {
+		metricDNSFwdDoTErrorTransport.Add(1)
+		return nil, err
+	}
+	return res, nil
+}
+
+// exchange sends fq and returns the response.
+//
+// If a reused connection fails before any response bytes are read, as
+// happens when the server closed it while idle, the query is retried once
+// on a new connection.
+func (c *dotClient) exchange(ctx context.Context, fq *forwardQuery) ([]byte, error) {
+	for {
+		conn, reused, err := c.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res, started, err := c.roundTrip(ctx, conn, fq)
+		if err == nil {
+			c.putConn(conn)
+			return res, nil
+		}
+		conn.Close()
+		if !reused || started || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// roundTrip writes fq to conn and reads the response. It reports whether
+// any response bytes were read.
+func (c *dotClient) roundTrip(ctx context.Context, conn *dotConn, fq *forwardQuery) (res []byte, started bool, err error) {
+	fq.closeOnCtxDone.Add(conn)
+	defer fq.closeOnCtxDone.Remove(conn)
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dnsQueryTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	// RFC 7858 section 3.3: messages are prefixed with a two-byte length,
+	// as in DNS over TCP (RFC 1035 section 4.2.2).
+	msg := make([]byte, 2+len(fq.packet))
+	binary.BigEndian.PutUint16(msg, uint16(len(fq.packet)))
+	copy(msg[2:], fq.packet)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, false, err
+	}
+
+	var lenBuf [2]byte
+	n, err := io.ReadFull(conn, lenBuf[:])
+	if err != nil {
+		return nil, n > 0, err
+	}
+	res = make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, res); err != nil {
+		return nil, true, err
+	}
+	if len(res) < headerBytes || getTxID(res) != fq.txid {
+		return nil, true, errors.New("txid doesn't match")
+	}
+	conn.SetDeadline(time.Time{})
+	return res, true, nil
+}
+
+// getConn returns an idle connection, or dials a new one.
+func (c *dotClient) getConn(ctx context.Context) (conn *dotConn, reused bool, err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, false, net.ErrClosed
+	}
+	for len(c.idle) > 0 {
+		conn = c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+		if time.Since(conn.idleSince) < dotIdleTimeout {
+			c.mu.Unlock()
+			return conn, true, nil
+		}
+		conn.Close()
+	}
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, dotDialTimeout)
+	defer cancel()
+	nc, err := c.dial(ctx, "tcp", c.hostPort)
+	if err != nil {
+		return nil, false, err
+	}
+	tc := tls.Client(nc, c.tlsConfig)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		nc.Close()
+		return nil, false, err
+	}
+	return &dotConn{Conn: tc}, false, nil
+}
+
+// putConn returns conn to the idle pool.
+func (c *dotClient) putConn(conn *dotConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= dotMaxIdleConns {
+		conn.Close()
+		return
+	}
+	conn.idleSince = time.Now()
+	c.idle = append(c.idle, conn)
+}
+
+// close closes the client's idle connections and stops it from making
+// new ones. Queries in flight are unaffected.
+func (c *dotClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+}
@@ -0,0 +1,311 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/tstest"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+var encryptedTestIP = netip.MustParseAddr("1.2.3.4")
+
+// answerEncryptedTest returns a response to query with rcode and, for
+// successful responses, an A record for encryptedTestIP.
+func answerEncryptedTest(query []byte, rcode dns.RCode) ([]byte, error) {
+	var m dns.Message
+	if err := m.Unpack(query); err != nil {
+		return nil, err
+	}
+	m.Response = true
+	m.RCode = rcode
+	m.Additionals = nil
+	if rcode == dns.RCodeSuccess {
+		m.Answers = []dns.Resource{aRecord(m.Questions[0].Name.String(), 60, encryptedTestIP)}
+	}
+	return m.Pack()
+}
+
+// useTestTLSConfig makes the forwarder trust ts's certificate, which is
+// valid for example.com and 127.0.0.1.
+func useTestTLSConfig(t *testing.T, ts *httptest.Server) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	tstest.Replace(t, &tlsConfig, func(host string, base *tls.Config) *tls.Config {
+		return &tls.Config{ServerName: host, RootCAs: roots}
+	})
+}
+
+func testForwardQuery(name string) *forwardQuery {
+	q := dnspacket(dnsname.FQDN(name), dns.TypeA, noEdns)
+	return &forwardQuery{txid: getTxID(q), packet: q, closeOnCtxDone: new(closePool)}
+}
+
+func checkEncryptedTestResponse(t *testing.T, res []byte, fq *forwardQuery) {
+	t.Helper()
+	if getTxID(res) != fq.txid {
+		t.Errorf("txid = %v; want %v", getTxID(res), fq.txid)
+	}
+	r, err := unpackResponse(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ip != encryptedTestIP {
+		t.Errorf("ip = %v; want %v", r.ip, encryptedTestIP)
+	}
+}
+
+func TestParseDoTAddr(t *testing.T) {
+	tests := []struct {
+		addr     string
+		wantHost string
+		wantPort string
+		wantErr  bool
+	}{
+		{addr: "tls://dns.example.com", wantHost: "dns.example.com", wantPort: "853"},
+		{addr: "tls://dns.example.com:8853", wantHost: "dns.example.com", wantPort: "8853"},
+		{addr: "tls://1.1.1.1", wantHost: "1.1.1.1", wantPort: "853"},
+		{addr: "tls://[2606:4700:4700::1111]:853", wantHost: "2606:4700:4700::1111", wantPort: "853"},
+		{addr: "tls://", wantErr: true},
+		{addr: "tls://dns.example.com/path", wantErr: true},
+		{addr: "https://dns.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		host, port, err := parseDoTAddr(tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDoTAddr(%q) error = %v; want error: %v", tt.addr, err, tt.wantErr)
+			continue
+		}
+		if host != tt.wantHost || port != tt.wantPort {
+			t.Errorf("parseDoTAddr(%q) = %q, %q; want %q, %q", tt.addr, host, port, tt.wantHost, tt.wantPort)
+		}
+	}
+}
+
+// serveDoT serves DNS-over-TLS on ln until it's closed, answering queries
+// for names starting with "servfail." with SERVFAIL. It closes connections
+// after closeAfter queries, if non-zero.
+func serveDoT(ln net.Listener, conns *atomic.Int32, closeAfter int) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conns.Add(1)
+		go func() {
+			defer c.Close()
+			for n := 0; closeAfter == 0 || n < closeAfter; n++ {
+				var lenBuf [2]byte
+				if _, err := io.ReadFull(c, lenBuf[:]); err != nil {
+					return
+				}
+				q := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+				if _, err := io.ReadFull(c, q); err != nil {
+					return
+				}
+				rcode := dns.RCodeSuccess
+				if name, _ := nameFromQuery(q); strings.HasPrefix(string(name), "servfail.") {
+					rcode = dns.RCodeServerFailure
+				}
+				res, err := answerEncryptedTest(q, rcode)
+				if err != nil {
+					return
+				}
+				binary.BigEndian.PutUint16(lenBuf[:], uint16(len(res)))
+				if _, err := c.Write(append(lenBuf[:], res...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestDoT(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	useTestTLSConfig(t, ts)
+
+	for _, closeAfter := range []int{0, 1} {
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", ts.TLS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		var conns atomic.Int32
+		go serveDoT(ln, &conns, closeAfter)
+
+		f := newForwarder(t.Logf, nil, nil, new(tsdial.Dialer))
+		defer f.Close()
+		rr := resolverAndDelay{name: &dnstype.Resolver{Addr: "tls://" + ln.Addr().String()}}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		const numQueries = 3
+		for i := 0; i < numQueries; i++ {
+			fq := testForwardQuery("test.example.")
+			res, err := f.send(ctx, fq, rr)
+			if err != nil {
+				t.Fatalf("closeAfter=%d: query %d: %v", closeAfter, i, err)
+			}
+			checkEncryptedTestResponse(t, res, fq)
+			// Give the server time to close the connection, if it's going to.
+			time.Sleep(10 * time.Millisecond)
+		}
+		wantConns := int32(1)
+		if closeAfter != 0 {
+			wantConns = numQueries
+		}
+		if got := conns.Load(); got != wantConns {
+			t.Errorf("closeAfter=%d: server got %d connections; want %d", closeAfter, got, wantConns)
+		}
+
+		_, err = f.send(ctx, testForwardQuery("servfail.example."), rr)
+		if !errors.Is(err, errServerFailure) {
+			t.Errorf("closeAfter=%d: SERVFAIL query error = %v; want errServerFailure", closeAfter, err)
+		}
+	}
+}
+
+func TestDoHCustomProvider(t *testing.T) {
+	var queries atomic.Int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		if r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != dohType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		q, _ := io.ReadAll(r.Body)
+		res, err := answerEncryptedTest(q, dns.RCodeSuccess)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dohType)
+		w.Write(res)
+	}))
+	defer ts.Close()
+	useTestTLSConfig(t, ts)
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+
+	f := newForwarder(t.Logf, nil, nil, new(tsdial.Dialer))
+	defer f.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, r := range []*dnstype.Resolver{
+		{Addr: ts.URL + "/dns-query"},
+		{
+			Addr:                fmt.Sprintf("https://example.com:%d/dns-query", port),
+			BootstrapResolution: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+		},
+	} {
+		fq := testForwardQuery("test.example.")
+		res, err := f.send(ctx, fq, resolverAndDelay{name: r})
+		if err != nil {
+			t.Fatalf("%v: %v", r.Addr, err)
+		}
+		checkEncryptedTestResponse(t, res, fq)
+	}
+	if got := queries.Load(); got != 2 {
+		t.Errorf("server got %d queries; want 2", got)
+	}
+}
+
+func TestPruneEncryptedClients(t *testing.T) {
+	f := newForwarder(t.Logf, nil, nil, new(tsdial.Dialer))
+	defer f.Close()
+
+	dot := &dnstype.Resolver{Addr: "tls://dns.example.com"}
+	doh := &dnstype.Resolver{Addr: "https://dns.example.com/dns-query"}
+	f.setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{"example.com.": {dot, doh}})
+	if _, err := f.getDoTClient(dot); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.getDoHClient(doh); err != nil {
+		t.Fatal(err)
+	}
+
+	f.setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{"example.com.": {dot}})
+	if len(f.dotClient) != 1 || len(f.dohClient) != 0 {
+		t.Errorf("after removing DoH resolver: %d DoT, %d DoH clients; want 1, 0", len(f.dotClient), len(f.dohClient))
+	}
+	f.setRoutes(nil)
+	if len(f.dotClient) != 0 {
+		t.Errorf("after removing all resolvers: %d DoT clients; want 0", len(f.dotClient))
+	}
+}
+
+func TestDefaultRouteNeedsBootstrap(t *testing.T) {
+	var ignoredLogs int
+	logf := func(format string, args ...any) {
+		if strings.Contains(format, "ignoring default resolvers") {
+			ignoredLogs++
+		}
+		t.Logf(format, args...)
+	}
+	f := newForwarder(logf, nil, nil, new(tsdial.Dialer))
+	defer f.Close()
+
+	bootstrap := []netip.Addr{netip.MustParseAddr("192.0.2.53")}
+	var (
+		dotName      = &dnstype.Resolver{Addr: "tls://dns.example.com"}
+		dohName      = &dnstype.Resolver{Addr: "https://dns.example.com/dns-query"}
+		dotIP        = &dnstype.Resolver{Addr: "tls://192.0.2.53"}
+		dohBootstrap = &dnstype.Resolver{Addr: "https://dns.example.com/dns-query", BootstrapResolution: bootstrap}
+		dohKnown     = &dnstype.Resolver{Addr: "https://dns.google/dns-query"}
+		udp          = &dnstype.Resolver{Addr: "192.0.2.1"}
+	)
+	all := []*dnstype.Resolver{dotName, dohName, dotIP, dohBootstrap, dohKnown, udp}
+	routes := map[dnsname.FQDN][]*dnstype.Resolver{
+		".":            all,
+		"example.com.": all,
+	}
+	f.setRoutes(routes)
+
+	addrs := func(domain dnsname.FQDN) string {
+		var ret []string
+		for _, r := range f.resolvers(domain) {
+			ret = append(ret, encryptedResolverKey(r.name))
+		}
+		return strings.Join(ret, ", ")
+	}
+	// The host names of dotName and dohName can't be resolved without
+	// asking the forwarder itself, so they're dropped from the default
+	// route.
+	want := "tls://192.0.2.53, https://dns.example.com/dns-query [192.0.2.53], https://dns.google/dns-query, 192.0.2.1"
+	if got := addrs("foo.test."); got != want {
+		t.Errorf("default resolvers = %q; want %q", got, want)
+	}
+	// Other routes can still use them.
+	if got := addrs("foo.example.com."); !strings.Contains(got, "tls://dns.example.com") || !strings.Contains(got, "https://dns.example.com/dns-query,") {
+		t.Errorf("example.com resolvers = %q; want to include all", got)
+	}
+	// Dropping the same resolvers again isn't logged again.
+	f.setRoutes(routes)
+	if ignoredLogs != 1 {
+		t.Errorf("logged dropped resolvers %d times; want 1", ignoredLogs)
+	}
+	f.setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{".": {dotName, udp}})
+	if ignoredLogs != 2 {
+		t.Errorf("logged dropped resolvers %d times after they changed; want 2", ignoredLogs)
+	}
+}
@@ -15,6 +15,7 @@
 	"net/http"
 	"net/netip"
 	"net/url"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -28,12 +29,14 @@
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/sockstats"
+	"tailscale.com/net/tlsdial"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/nettype"
 	"tailscale.com/util/cloudenv"
 	"tailscale.com/util/dnsname"
+	"tailscale.com/util/mak"
 	"tailscale.com/version"
 )
 
@@ -183,9 +186,19 @@ type forwarder struct {
 	ctx       context.Context    // good until Close
 	ctxCancel context.CancelFunc // closes ctx
 
+	netMonUnregister func() // or nil
+
+	// cache caches responses to queries forwarded using routes. It's
+	// flushed when the routes or the network change.
+	cache responseCache
+
+	// stats are the stats of queries sent to each upstream resolver.
+	stats upstreamStatsSet
+
 	mu sync.Mutex // guards following
 
-	dohClient map[string]*http.Client // urlBase -> client
+	dohClient map[string]*http.Client // encryptedResolverKey -> client
+	dotClient map[string]*dotClient   // encryptedResolverKey -> client
 
 	// routes are per-suffix resolvers to use, with
 	// the most specific routes first.
@@ -200,6 +213,11 @@ type forwarder struct {
 	// /etc/resolv.conf is missing/corrupt, and the peerapi ExitDNS stub
 	// resolver lookup.
 	cloudHostFallback []resolverAndDelay
+
+	// droppedDefaults are the addresses of the default resolvers that
+	// withoutUnresolvableDefaults last dropped, so that it only logs
+	// when they change.
+	droppedDefaults []string
 }
 
 func init() {
@@ -214,14 +232,40 @@ func newForwarder(logf logger.Logf, netMon *netmon.Monitor, linkSel ForwardLinkS
 		dialer:  dialer,
 	}
 	f.ctx, f.ctxCancel = context.WithCancel(context.Background())
+	if netMon != nil {
+		f.netMonUnregister = netMon.RegisterChangeCallback(f.linkChanged)
+	}
 	return f
 }
 
 func (f *forwarder) Close() error {
 	f.ctxCancel()
+	if f.netMonUnregister != nil {
+		f.netMonUnregister()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.dohClient {
+		c.CloseIdleConnections()
+	}
+	for _, c := range f.dotClient {
+		c.close()
+	}
 	return nil
 }
 
+// linkChanged flushes the response cache on major network changes, as
+// upstream resolvers (notably the OS ones) may now answer differently.
+func (f *forwarder) linkChanged(delta *netmon.ChangeDelta) {
+	if !delta.Major {
+		return
+	}
+	if f.cache.len() > 0 {
+		metricDNSFwdCacheFlush.Add(1)
+	}
+	f.cache.flush()
+}
+
 // resolversWithDelays maps from a set of DNS server names to a slice of a type
 // that included a startDelay, upgrading any well-known DoH (DNS-over-HTTP)
 // servers in the process, insert a DoH lookup first before UDP fallbacks.
@@ -311,6 +355,9 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]*dnstype.Resolve
 
 	cloudHostFallback := cloudResolvers()
 	for suffix, rs := range routesBySuffix {
+		if suffix == "." {
+			rs = f.withoutUnresolvableDefaults(rs)
+		}
 		if suffix == "." && len(rs) == 0 && len(cloudHostFallback) > 0 {
 			routes = append(routes, route{
 				Suffix:    suffix,
@@ -333,15 +380,130 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]*dnstype.Resolve
 		}
 	}
 
-	// Sort from longest prefix to shortest.
+	// Sort from longest prefix to shortest. Ties are broken by name so the
+	// order is deterministic, for routesEqual.
 	sort.Slice(routes, func(i, j int) bool {
-		return routes[i].Suffix.NumLabels() > routes[j].Suffix.NumLabels()
+		ni, nj := routes[i].Suffix.NumLabels(), routes[j].Suffix.NumLabels()
+		if ni != nj {
+			return ni > nj
+		}
+		return routes[i].Suffix < routes[j].Suffix
 	})
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if !routesEqual(f.routes, routes) {
+		if f.cache.len() > 0 {
+			metricDNSFwdCacheFlush.Add(1)
+		}
+		f.cache.flush()
+	}
 	f.routes = routes
 	f.cloudHostFallback = cloudHostFallback
+	f.pruneEncryptedClientsLocked()
+}
+
+// withoutUnresolvableDefaults returns the resolvers in rs, the resolvers
+// for the default route, except for the DoH and DoT ones that
+// needsBootstrap. Their host names would be resolved with the system
+// resolver, which is typically 100.100.100.100 when there's a default
+// route, so looking them up would loop back into the forwarder.
+func (f *forwarder) withoutUnresolvableDefaults(rs []*dnstype.Resolver) []*dnstype.Resolver {
+	var ret []*dnstype.Resolver
+	var dropped []string
+	for _, r := range rs {
+		if needsBootstrap(r) {
+			dropped = append(dropped, r.Addr)
+			continue
+		}
+		ret = append(ret, r)
+	}
+
+	f.mu.Lock()
+	changed := !slices.Equal(f.droppedDefaults, dropped)
+	f.droppedDefaults = dropped
+	f.mu.Unlock()
+	if changed && len(dropped) > 0 {
+		f.logf("dns: ignoring default resolvers %q: DoH and DoT resolvers for all domains need an IP address or BootstrapResolution", dropped)
+	}
+	return ret
+}
+
+// needsBootstrap reports whether r is a DoH or DoT resolver whose host can
+// only be resolved with the system resolver: it's not an IP address, it's
+// not a provider known to the publicdns package, and r has no
+// BootstrapResolution.
+func needsBootstrap(r *dnstype.Resolver) bool {
+	if len(r.BootstrapResolution) > 0 {
+		return false
+	}
+	var host string
+	switch {
+	case strings.HasPrefix(r.Addr, "https://"):
+		if len(publicdns.DoHIPsOfBase(r.Addr)) > 0 {
+			return false
+		}
+		u, err := url.Parse(r.Addr)
+		if err != nil {
+			return false // rejected when used
+		}
+		host = u.Hostname()
+	case strings.HasPrefix(r.Addr, "tls://"):
+		h, _, err := parseDoTAddr(r.Addr)
+		if err != nil {
+			return false // rejected when used
+		}
+		host = h
+	default:
+		return false
+	}
+	_, err := netip.ParseAddr(host)
+	return err != nil
+}
+
+// pruneEncryptedClientsLocked closes and forgets the DoH and DoT clients
+// for resolvers that are no longer in f.routes.
+//
+// f.mu must be held.
+func (f *forwarder) pruneEncryptedClientsLocked() {
+	inUse := map[string]bool{}
+	for _, r := range f.routes {
+		for _, rr := range r.Resolvers {
+			inUse[encryptedResolverKey(rr.name)] = true
+		}
+	}
+	for k, c := range f.dohClient {
+		if !inUse[k] {
+			c.CloseIdleConnections()
+			delete(f.dohClient, k)
+		}
+	}
+	for k, c := range f.dotClient {
+		if !inUse[k] {
+			c.close()
+			delete(f.dotClient, k)
+		}
+	}
+}
+
+// routesEqual reports whether a and b are the same routes, in the same
+// order.
+func routesEqual(a, b []route) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Suffix != b[i].Suffix || len(a[i].Resolvers) != len(b[i].Resolvers) {
+			return false
+		}
+		for j, ra := range a[i].Resolvers {
+			rb := b[i].Resolvers[j]
+			if ra.startDelay != rb.startDelay || !ra.name.Equal(rb.name) {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 var stdNetPacketListener nettype.PacketListenerWithNetIP = nettype.MakePacketListenerWithNetIP(new(net.ListenConfig))
@@ -361,6 +523,86 @@ func (f *forwarder) packetListener(ip netip.Addr) (nettype.PacketListenerWithNet
 	return nettype.MakePacketListenerWithNetIP(lc), nil
 }
 
+// tlsConfig returns the TLS config for connecting to the DoH or DoT server
+// host. It's a variable for tests.
+var tlsConfig = tlsdial.Config
+
+// encryptedResolverKey returns the key for r in the forwarder's DoH and DoT
+// client maps.
+func encryptedResolverKey(r *dnstype.Resolver) string {
+	if len(r.BootstrapResolution) == 0 {
+		return r.Addr
+	}
+	return fmt.Sprintf("%s %v", r.Addr, r.BootstrapResolution)
+}
+
+// dialerForHost returns a func to dial host, the host name or IP of a DoH
+// or DoT resolver. If bootstrap is non-empty, it's used as host's IPs
+// instead of resolving it with the system resolver. That's only safe for
+// resolvers that aren't on the default route; see needsBootstrap.
+func (f *forwarder) dialerForHost(host string, bootstrap []netip.Addr) dnscache.DialContextFunc {
+	res := &dnscache.Resolver{
+		Logf:        f.logf,
+		NetMon:      f.netMon,
+		UseLastGood: true,
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		bootstrap = []netip.Addr{ip}
+	}
+	if len(bootstrap) > 0 {
+		res.SingleHost = host
+		res.SingleHostStaticResult = bootstrap
+	}
+	nsDialer := netns.NewDialer(f.logf, f.netMon)
+	return dnscache.Dialer(nsDialer.DialContext, res)
+}
+
+// getDoHClient returns an HTTP client for the DoH resolver r.
+//
+// For providers known to the publicdns package, it's the client from
+// getKnownDoHClientForProvider. Other providers are dialed at the IPs in
+// r.BootstrapResolution if set, and otherwise at the IPs the system
+// resolver returns for the URL's host.
+func (f *forwarder) getDoHClient(r *dnstype.Resolver) (*http.Client, error) {
+	if len(r.BootstrapResolution) == 0 {
+		if c, ok := f.getKnownDoHClientForProvider(r.Addr); ok {
+			return c, nil
+		}
+	}
+	u, err := url.Parse(r.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid DNS-over-HTTPS resolver %q", r.Addr)
+	}
+
+	key := encryptedResolverKey(r)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.dohClient[key]; ok {
+		return c, nil
+	}
+	dialer := f.dialerForHost(u.Hostname(), r.BootstrapResolution)
+	c := &http.Client{
+		Timeout: dnsQueryTimeout,
+		Transport: &http.Transport{
+			ForceAttemptHTTP2:   true,
+			IdleConnTimeout:     dohTransportTimeout,
+			TLSHandshakeTimeout: dotDialTimeout,
+			TLSClientConfig:     tlsConfig(u.Hostname(), nil),
+			DialContext: func(ctx context.Context, netw, addr string) (net.Conn, error) {
+				if !strings.HasPrefix(netw, "tcp") {
+					return nil, fmt.Errorf("unexpected network %q", netw)
+				}
+				return dialer(ctx, netw, addr)
+			},
+		},
+	}
+	mak.Set(&f.dohClient, key, c)
+	return c, nil
+}
+
 // getKnownDoHClientForProvider returns an HTTP client for a specific DoH
 // provider named by its DoH base URL (like "https://dns.google/dns-query").
 //
@@ -433,7 +675,7 @@ func (f *forwarder) sendDoH(ctx context.Context, urlBase string, c *http.Client,
 		metricDNSFwdDoHErrorCT.Add(1)
 		return nil, fmt.Errorf("unexpected response Content-Type %q", ct)
 	}
-	res, err := io.ReadAll(hres.Body)
+	res, err := io.ReadAll(io.LimitReader(hres.Body, maxDoHResponseBytes))
 	if err != nil {
 		metricDNSFwdDoHErrorBody.Add(1)
 	}
@@ -443,6 +685,35 @@ func (f *forwarder) sendDoH(ctx context.Context, urlBase string, c *http.Client,
 	return res, err
 }
 
+// maxDoHResponseBytes is the largest DoH response read. It's the largest
+// DNS message there can be.
+const maxDoHResponseBytes = 1<<16 - 1
+
+// checkEncryptedResponse applies to res, a response from a DoH or DoT
+// resolver, the same handling sendUDP applies to UDP responses: a
+// SERVFAIL is returned as errServerFailure so other resolvers are given a
+// chance, and responses too large to relay are truncated.
+func (f *forwarder) checkEncryptedResponse(res []byte) ([]byte, error) {
+	if len(res) < headerBytes {
+		return nil, errors.New("response too short")
+	}
+	if rcode := getRCode(res); rcode == dns.RCodeServerFailure {
+		f.logf("recv: response code indicating server failure: %d", rcode)
+		metricDNSFwdEncryptedErrorServer.Add(1)
+		return nil, errServerFailure
+	}
+	if len(res) > maxResponseBytes {
+		// As with UDP, this drops the end of the response; see the TODO
+		// in sendUDP.
+		res = res[:maxResponseBytes]
+		flags := binary.BigEndian.Uint16(res[2:4])
+		binary.BigEndian.PutUint16(res[2:4], flags|dnsFlagTruncated)
+		metricDNSFwdTruncated.Add(1)
+	}
+	clampEDNSSize(res, maxResponseBytes)
+	return res, nil
+}
+
 var verboseDNSForward = envknob.RegisterBool("TS_DEBUG_DNS_FORWARD_SEND")
 
 // send sends packet to dst. It is best effort.
@@ -459,22 +730,23 @@ func (f *forwarder) send(ctx context.Context, fq *forwardQuery, rr resolverAndDe
 		return f.sendDoH(ctx, rr.name.Addr, f.dialer.PeerAPIHTTPClient(), fq.packet)
 	}
 	if strings.HasPrefix(rr.name.Addr, "https://") {
-		// Only known DoH providers are supported currently. Specifically, we
-		// only support DoH providers where we can TCP connect to them on port
-		// 443 at the same IP address they serve normal UDP DNS from (1.1.1.1,
-		// 8.8.8.8, 9.9.9.9, etc.) That's why OpenDNS and custom DoH providers
-		// aren't currently supported. There's no backup DNS resolution path for
-		// them.
-		urlBase := rr.name.Addr
-		if hc, ok := f.getKnownDoHClientForProvider(urlBase); ok {
-			return f.sendDoH(ctx, urlBase, hc, fq.packet)
+		hc, err := f.getDoHClient(rr.name)
+		if err != nil {
+			metricDNSFwdErrorType.Add(1)
+			return nil, err
 		}
-		metricDNSFwdErrorType.Add(1)
-		return nil, fmt.Errorf("arbitrary https:// resolvers not supported yet")
+		res, err := f.sendDoH(ctx, rr.name.Addr, hc, fq.packet)
+		if err != nil {
+			return nil, err
+		}
+		return f.checkEncryptedResponse(res)
 	}
 	if strings.HasPrefix(rr.name.Addr, "tls://") {
-		metricDNSFwdErrorType.Add(1)
-		return nil, fmt.Errorf("tls:// resolvers not supported yet")
+		res, err := f.sendDoT(ctx, fq, rr.name)
+		if err != nil {
+			return nil, err
+		}
+		return f.checkEncryptedResponse(res)
 	}
 
 	return f.sendUDP(ctx, fq, rr)
@@ -662,6 +934,35 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 
 	clampEDNSSize(query.bs, maxResponseBytes)
 
+	// Responses to queries forwarded using the routes are cached. Those
+	// to explicit resolvers (for exit node DNS) aren't, as the routes
+	// don't apply to them.
+	qi := queryInfoFromContext(ctx)
+	if qi != nil {
+		qi.forwarded = true
+	}
+
+	var ck cacheKey
+	useCache := len(resolvers) == 0 && !disableDNSCache()
+	if useCache {
+		ck, useCache = parseCacheKey(query.bs)
+	}
+	if useCache {
+		if res, ok := f.cache.get(ck, query.bs); ok {
+			metricDNSFwdCacheHit.Add(1)
+			if qi != nil {
+				qi.cached = true
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case responseChan <- packet{res, query.addr}:
+				return nil
+			}
+		}
+		metricDNSFwdCacheMiss.Add(1)
+	}
+
 	if len(resolvers) == 0 {
 		resolvers = f.resolvers(domain)
 		if len(resolvers) == 0 {
@@ -690,8 +991,12 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 	}
 	defer fq.closeOnCtxDone.Close()
 
-	resc := make(chan []byte, 1) // it's fine buffered or not
-	errc := make(chan error, 1)  // it's fine buffered or not too
+	type upstreamResponse struct {
+		res      []byte
+		upstream string // resolver Addr
+	}
+	resc := make(chan upstreamResponse, 1) // it's fine buffered or not
+	errc := make(chan error, 1)            // it's fine buffered or not too
 	for i := range resolvers {
 		go func(rr *resolverAndDelay) {
 			if rr.startDelay > 0 {
@@ -703,7 +1008,13 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 					return
 				}
 			}
+			start := time.Now()
 			resb, err := f.send(ctx, fq, *rr)
+			if err == nil || ctx.Err() == nil {
+				// Don't count queries canceled because another
+				// resolver answered first.
+				f.stats.recordQuery(rr.name.Addr, time.Since(start), err)
+			}
 			if err != nil {
 				select {
 				case errc <- err:
@@ -712,7 +1023,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 				return
 			}
 			select {
-			case resc <- resb:
+			case resc <- upstreamResponse{resb, rr.name.Addr}:
 			case <-ctx.Done():
 			}
 		}(&resolvers[i])
@@ -723,12 +1034,19 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 	for {
 		select {
 		case v := <-resc:
+			if useCache {
+				f.cache.put(ck, v.res)
+			}
 			select {
 			case <-ctx.Done():
 				metricDNSFwdErrorContext.Add(1)
 				return ctx.Err()
-			case responseChan <- packet{v, query.addr}:
+			case responseChan <- packet{v.res, query.addr}:
 				metricDNSFwdSuccess.Add(1)
+				f.stats.recordAnswered(v.upstream)
+				if qi != nil {
+					qi.upstream = v.upstream
+				}
 				return nil
 			}
 		case err := <-errc:
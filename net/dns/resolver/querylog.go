@@ -0,0 +1,275 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/envknob"
+	"tailscale.com/util/set"
+)
+
+const (
+	// queryLogSize is the number of recent queries kept in the query log.
+	queryLogSize = 1000
+
+	// queryLogWatcherBuffer is the number of entries buffered for each
+	// query log watcher; entries are dropped for watchers that fall
+	// further behind.
+	queryLogWatcherBuffer = 256
+
+	// maxUpstreamStats is the maximum number of upstream resolvers for
+	// which stats are kept.
+	maxUpstreamStats = 64
+)
+
+// alwaysLogQueries makes the query log record queries even when nobody is
+// watching it.
+var alwaysLogQueries = envknob.RegisterBool("TS_DEBUG_DNS_QUERY_LOG")
+
+// QueryLogEntry describes a DNS query handled by a Resolver, from
+// Resolver.Query or Resolver.HandleExitNodeDNSQuery.
+type QueryLogEntry struct {
+	Time     time.Time      // when the query arrived
+	Source   netip.AddrPort // the client that sent the query
+	Name     string         // the queried name
+	Type     string         // the query type, such as "A" or "AAAA"
+	RCode    string         // the response code, such as "NOERROR"; empty on error
+	Upstream string         // the resolver that answered, if forwarded
+	Local    bool           // answered by MagicDNS without forwarding
+	Cached   bool           // answered from the forwarder's cache
+	ExitNode bool           // arrived via the exit node DoH server
+	Latency  time.Duration  // how long it took to answer
+	Err      string         // error, if the query failed without a response
+}
+
+// UpstreamStats are the aggregate stats of the queries forwarded to an
+// upstream resolver.
+type UpstreamStats struct {
+	Upstream     string        // the resolver's address
+	Queries      int64         // queries sent, excluding those canceled
+	Errors       int64         // queries that failed, including with SERVFAIL
+	Answered     int64         // responses used, being the first to arrive
+	TotalLatency time.Duration // total latency of successful queries
+	MaxLatency   time.Duration // largest latency of a successful query
+}
+
+// queryInfo is filled in by the forwarder with how a query was answered.
+// It's passed in a context so that only logged queries pay for it.
+type queryInfo struct {
+	forwarded bool   // not answered by MagicDNS
+	cached    bool   // answered from the cache
+	upstream  string // Addr of the resolver that answered
+}
+
+type queryInfoKey struct{}
+
+func withQueryInfo(ctx context.Context, qi *queryInfo) context.Context {
+	return context.WithValue(ctx, queryInfoKey{}, qi)
+}
+
+// queryInfoFromContext returns the queryInfo in ctx, or nil if the query
+// isn't being logged.
+func queryInfoFromContext(ctx context.Context) *queryInfo {
+	qi, _ := ctx.Value(queryInfoKey{}).(*queryInfo)
+	return qi
+}
+
+// queryLog is a ring buffer of recent queries, which records queries only
+// while it's being watched, or if alwaysLogQueries is set.
+type queryLog struct {
+	numWatchers atomic.Int32
+
+	mu       sync.Mutex
+	ent      []QueryLogEntry // ring buffer; ent[pos] is next when full
+	pos      int
+	watchers set.HandleSet[chan QueryLogEntry]
+}
+
+// enabled reports whether queries should be logged.
+func (l *queryLog) enabled() bool {
+	return l.numWatchers.Load() > 0 || alwaysLogQueries()
+}
+
+func (l *queryLog) add(e QueryLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.ent) < queryLogSize {
+		l.ent = append(l.ent, e)
+	} else {
+		l.ent[l.pos] = e
+		l.pos = (l.pos + 1) % queryLogSize
+	}
+	for _, ch := range l.watchers {
+		select {
+		case ch <- e:
+		default:
+			metricDNSQueryLogDropped.Add(1)
+		}
+	}
+}
+
+// watch calls fn with the log's recent entries, oldest first, and then
+// with each new entry until ctx is done. Queries are logged while any
+// watch is running.
+func (l *queryLog) watch(ctx context.Context, fn func(QueryLogEntry)) {
+	ch := make(chan QueryLogEntry, queryLogWatcherBuffer)
+	l.mu.Lock()
+	backlog := make([]QueryLogEntry, 0, len(l.ent))
+	backlog = append(backlog, l.ent[l.pos:]...)
+	backlog = append(backlog, l.ent[:l.pos]...)
+	h := l.watchers.Add(ch)
+	l.numWatchers.Add(1)
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		delete(l.watchers, h)
+		l.numWatchers.Add(-1)
+		l.mu.Unlock()
+	}()
+
+	for _, e := range backlog {
+		fn(e)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-ch:
+			fn(e)
+		}
+	}
+}
+
+// WatchQueryLog calls fn with the recently logged queries, oldest first,
+// and then with each new query until ctx is done. Queries are only logged
+// while there's a watcher, unless the TS_DEBUG_DNS_QUERY_LOG envknob is
+// set, so the initial entries are those from earlier watches.
+//
+// If fn falls too far behind, entries are dropped.
+func (r *Resolver) WatchQueryLog(ctx context.Context, fn func(QueryLogEntry)) {
+	r.queryLog.watch(ctx, fn)
+}
+
+// UpstreamStats returns the stats of the upstream resolvers that queries
+// have been forwarded to, sorted by address.
+func (r *Resolver) UpstreamStats() []UpstreamStats {
+	return r.forwarder.stats.snapshot()
+}
+
+// logQuery adds an entry for query to the query log, given its response
+// and the queryInfo the forwarder filled in.
+func (r *Resolver) logQuery(start time.Time, from netip.AddrPort, query, res []byte, err error, qi *queryInfo, exitNode bool) {
+	e := QueryLogEntry{
+		Time:     start,
+		Source:   from,
+		Upstream: qi.upstream,
+		Local:    !qi.forwarded && err == nil,
+		Cached:   qi.cached,
+		ExitNode: exitNode,
+		Latency:  time.Since(start),
+	}
+	var p dns.Parser
+	if _, perr := p.Start(query); perr == nil {
+		if q, perr := p.Question(); perr == nil {
+			e.Name = q.Name.String()
+			e.Type = strings.TrimPrefix(q.Type.String(), "Type")
+		}
+	}
+	if err != nil {
+		e.Err = err.Error()
+	}
+	if len(res) >= headerBytes {
+		e.RCode = rcodeName(dns.RCode(res[3] & 0x0f))
+	}
+	r.queryLog.add(e)
+}
+
+// rcodeName returns the conventional name of rcode, as used by dig.
+func rcodeName(rcode dns.RCode) string {
+	switch rcode {
+	case dns.RCodeSuccess:
+		return "NOERROR"
+	case dns.RCodeFormatError:
+		return "FORMERR"
+	case dns.RCodeServerFailure:
+		return "SERVFAIL"
+	case dns.RCodeNameError:
+		return "NXDOMAIN"
+	case dns.RCodeNotImplemented:
+		return "NOTIMP"
+	case dns.RCodeRefused:
+		return "REFUSED"
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// upstreamStatsSet tracks UpstreamStats by resolver address.
+type upstreamStatsSet struct {
+	mu sync.Mutex
+	m  map[string]*UpstreamStats
+}
+
+// getLocked returns the stats for upstream, or nil if there are too many
+// upstreams already. s.mu must be held.
+func (s *upstreamStatsSet) getLocked(upstream string) *UpstreamStats {
+	st, ok := s.m[upstream]
+	if !ok {
+		if len(s.m) >= maxUpstreamStats {
+			return nil
+		}
+		if s.m == nil {
+			s.m = map[string]*UpstreamStats{}
+		}
+		st = &UpstreamStats{Upstream: upstream}
+		s.m[upstream] = st
+	}
+	return st
+}
+
+// recordQuery records a query to upstream that took d and failed with err,
+// if non-nil.
+func (s *upstreamStatsSet) recordQuery(upstream string, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.getLocked(upstream)
+	if st == nil {
+		return
+	}
+	st.Queries++
+	if err != nil {
+		st.Errors++
+		return
+	}
+	st.TotalLatency += d
+	st.MaxLatency = max(st.MaxLatency, d)
+}
+
+// recordAnswered records that upstream's response was used.
+func (s *upstreamStatsSet) recordAnswered(upstream string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.getLocked(upstream); st != nil {
+		st.Answered++
+	}
+}
+
+func (s *upstreamStatsSet) snapshot() []UpstreamStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]UpstreamStats, 0, len(s.m))
+	for _, st := range s.m {
+		ret = append(ret, *st)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Upstream < ret[j].Upstream })
+	return ret
+}
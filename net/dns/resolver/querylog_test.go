@@ -0,0 +1,132 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+// serveTestUDP answers A queries on pc with testipv4 until pc is closed.
+func serveTestUDP(pc net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		res, err := answerEncryptedTest(buf[:n], dns.RCodeSuccess)
+		if err != nil {
+			continue
+		}
+		pc.WriteTo(res, addr)
+	}
+}
+
+func TestQueryLog(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go serveTestUDP(pc)
+	upstream := pc.LocalAddr().String()
+
+	r := newResolver(t)
+	defer r.Close()
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: upstream}},
+	}
+	r.SetConfig(cfg)
+
+	// Not logged: nobody's watching.
+	if _, err := syncRespond(r, dnspacket("test1.ipn.dev.", dns.TypeA, noEdns)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	entc := make(chan QueryLogEntry, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.WatchQueryLog(ctx, func(e QueryLogEntry) { entc <- e })
+	}()
+	for r.queryLog.numWatchers.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	src := netip.MustParseAddrPort("100.64.0.1:1234")
+	for _, name := range []dnsname.FQDN{"test1.ipn.dev.", "nxdomain.ipn.dev.", "example.com.", "example.com."} {
+		if _, err := r.Query(ctx, dnspacket(name, dns.TypeA, noEdns), src); err != nil {
+			t.Fatalf("query %v: %v", name, err)
+		}
+	}
+
+	want := []QueryLogEntry{
+		{Name: "test1.ipn.dev.", Type: "A", RCode: "NOERROR", Local: true},
+		{Name: "nxdomain.ipn.dev.", Type: "A", RCode: "NXDOMAIN", Local: true},
+		{Name: "example.com.", Type: "A", RCode: "NOERROR", Upstream: upstream},
+		{Name: "example.com.", Type: "A", RCode: "NOERROR", Cached: true},
+	}
+	for i, w := range want {
+		var got QueryLogEntry
+		select {
+		case got = <-entc:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for entry %d", i)
+		}
+		if got.Source != src || got.Time.IsZero() {
+			t.Errorf("entry %d: Source, Time = %v, %v; want %v, non-zero", i, got.Source, got.Time, src)
+		}
+		got.Source, got.Time, got.Latency = netip.AddrPort{}, time.Time{}, 0
+		if got != w {
+			t.Errorf("entry %d = %+v; want %+v", i, got, w)
+		}
+	}
+	cancel()
+	<-done
+
+	// A new watcher gets the earlier entries first.
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	var backlog []QueryLogEntry
+	cancel2()
+	r.WatchQueryLog(ctx2, func(e QueryLogEntry) { backlog = append(backlog, e) })
+	if len(backlog) != len(want) {
+		t.Errorf("backlog has %d entries; want %d", len(backlog), len(want))
+	}
+
+	stats := r.UpstreamStats()
+	if len(stats) != 1 {
+		t.Fatalf("UpstreamStats = %+v; want 1 upstream", stats)
+	}
+	if st := stats[0]; st.Upstream != upstream || st.Queries != 1 || st.Answered != 1 || st.Errors != 0 || st.MaxLatency <= 0 {
+		t.Errorf("UpstreamStats = %+v; want 1 query, answered, for %v", st, upstream)
+	}
+}
+
+func TestQueryLogRing(t *testing.T) {
+	var l queryLog
+	for i := 0; i < queryLogSize+10; i++ {
+		l.add(QueryLogEntry{Latency: time.Duration(i)})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var got []QueryLogEntry
+	l.watch(ctx, func(e QueryLogEntry) { got = append(got, e) })
+	if len(got) != queryLogSize {
+		t.Fatalf("got %d entries; want %d", len(got), queryLogSize)
+	}
+	if got[0].Latency != 10 || got[len(got)-1].Latency != queryLogSize+9 {
+		t.Errorf("entries range from %d to %d; want 10 to %d", got[0].Latency, got[len(got)-1].Latency, queryLogSize+9)
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+// maxCNAMEChain is the maximum number of CNAME records followed within the
+// local zone when answering a query.
+const maxCNAMEChain = 8
+
+// maxTXTStringLen is the maximum length of a character-string in a TXT
+// record (RFC 1035 section 3.3).
+const maxTXTStringLen = 255
+
+// Record is a non-address DNS record in the local zone: a CNAME, TXT, SRV
+// or MX record.
+//
+// A name with a CNAME record shouldn't have any other records (RFC 1034
+// section 3.6.2); if it does, the CNAME takes precedence.
+type Record struct {
+	// Type is the record type: dns.TypeCNAME, TypeTXT, TypeSRV or TypeMX.
+	Type dns.Type
+
+	// Target is the target of a CNAME or SRV record, or the exchange of an
+	// MX record.
+	Target dnsname.FQDN
+
+	// TXT is the text of a TXT record, as character-strings of at most
+	// 255 bytes each.
+	TXT []string
+
+	// Priority is the priority of an SRV record, or the preference of an
+	// MX record.
+	Priority uint16
+
+	// Weight and Port are the weight and port of an SRV record.
+	Weight uint16
+	Port   uint16
+}
+
+// ParseRecord parses a record of type typ ("CNAME", "TXT", "SRV" or "MX",
+// case insensitively) from value, which is in the record's zone file
+// presentation format, without the owner name, TTL, class or type:
+//
+//	CNAME: target.example.com
+//	TXT:   any text, which may be longer than 255 bytes
+//	SRV:   priority weight port target.example.com
+//	MX:    preference mail.example.com
+func ParseRecord(typ, value string) (Record, error) {
+	var rec Record
+	switch strings.ToUpper(typ) {
+	case "CNAME":
+		if value == "" {
+			return rec, errors.New("empty CNAME target")
+		}
+		target, err := dnsname.ToFQDN(value)
+		if err != nil {
+			return rec, fmt.Errorf("invalid CNAME target: %w", err)
+		}
+		rec.Type, rec.Target = dns.TypeCNAME, target
+	case "TXT":
+		rec.Type = dns.TypeTXT
+		for len(value) > maxTXTStringLen {
+			rec.TXT = append(rec.TXT, value[:maxTXTStringLen])
+			value = value[maxTXTStringLen:]
+		}
+		rec.TXT = append(rec.TXT, value)
+	case "SRV":
+		f := strings.Fields(value)
+		if len(f) != 4 {
+			return rec, fmt.Errorf("invalid SRV record %q; want \"priority weight port target\"", value)
+		}
+		nums, err := parseUint16s(f[:3])
+		if err != nil {
+			return rec, fmt.Errorf("invalid SRV record %q: %w", value, err)
+		}
+		target, err := dnsname.ToFQDN(f[3])
+		if err != nil {
+			return rec, fmt.Errorf("invalid SRV target: %w", err)
+		}
+		rec.Type, rec.Priority, rec.Weight, rec.Port, rec.Target = dns.TypeSRV, nums[0], nums[1], nums[2], target
+	case "MX":
+		f := strings.Fields(value)
+		if len(f) != 2 {
+			return rec, fmt.Errorf("invalid MX record %q; want \"preference exchange\"", value)
+		}
+		nums, err := parseUint16s(f[:1])
+		if err != nil {
+			return rec, fmt.Errorf("invalid MX record %q: %w", value, err)
+		}
+		target, err := dnsname.ToFQDN(f[1])
+		if err != nil {
+			return rec, fmt.Errorf("invalid MX exchange: %w", err)
+		}
+		rec.Type, rec.Priority, rec.Target = dns.TypeMX, nums[0], target
+	default:
+		return rec, fmt.Errorf("unsupported record type %q", typ)
+	}
+	return rec, nil
+}
+
+func parseUint16s(ss []string) ([]uint16, error) {
+	ret := make([]uint16, len(ss))
+	for i, s := range ss {
+		n, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = uint16(n)
+	}
+	return ret, nil
+}
+
+// resource returns rec as a resource record for owner.
+func (rec Record) resource(owner dnsname.FQDN) (dns.Resource, error) {
+	name, err := dns.NewName(owner.WithTrailingDot())
+	if err != nil {
+		return dns.Resource{}, err
+	}
+	rr := dns.Resource{
+		Header: dns.ResourceHeader{
+			Name:  name,
+			Type:  rec.Type,
+			Class: dns.ClassINET,
+			TTL:   uint32(defaultTTL / time.Second),
+		},
+	}
+	var target dns.Name
+	if rec.Target != "" {
+		target, err = dns.NewName(rec.Target.WithTrailingDot())
+		if err != nil {
+			return dns.Resource{}, err
+		}
+	}
+	switch rec.Type {
+	case dns.TypeCNAME:
+		rr.Body = &dns.CNAMEResource{CNAME: target}
+	case dns.TypeTXT:
+		rr.Body = &dns.TXTResource{TXT: rec.TXT}
+	case dns.TypeSRV:
+		rr.Body = &dns.SRVResource{Priority: rec.Priority, Weight: rec.Weight, Port: rec.Port, Target: target}
+	case dns.TypeMX:
+		rr.Body = &dns.MXResource{Pref: rec.Priority, MX: target}
+	default:
+		return dns.Resource{}, fmt.Errorf("unsupported record type %v", rec.Type)
+	}
+	return rr, nil
+}
+
+// cnameTarget returns the target of the CNAME record in recs, or the empty
+// string if there isn't one.
+func cnameTarget(recs []Record) dnsname.FQDN {
+	for _, rec := range recs {
+		if rec.Type == dns.TypeCNAME {
+			return rec.Target
+		}
+	}
+	return ""
+}
+
+func isAddrType(typ dns.Type) bool {
+	return typ == dns.TypeA || typ == dns.TypeAAAA || typ == dns.TypeALL
+}
+
+// addrResources returns A and AAAA records for owner's IPs that answer a
+// query of type typ.
+func addrResources(owner dnsname.FQDN, ips []netip.Addr, typ dns.Type) ([]dns.Resource, error) {
+	var ret []dns.Resource
+	for _, ip := range ips {
+		if (typ == dns.TypeA && !ip.Is4()) || (typ == dns.TypeAAAA && !ip.Is6()) {
+			continue
+		}
+		name, err := dns.NewName(owner.WithTrailingDot())
+		if err != nil {
+			return nil, err
+		}
+		h := dns.ResourceHeader{Name: name, Class: dns.ClassINET, TTL: uint32(defaultTTL / time.Second)}
+		if ip.Is4() {
+			h.Type = dns.TypeA
+			ret = append(ret, dns.Resource{Header: h, Body: &dns.AResource{A: ip.As4()}})
+		} else {
+			h.Type = dns.TypeAAAA
+			ret = append(ret, dns.Resource{Header: h, Body: &dns.AAAAResource{AAAA: ip.As16()}})
+		}
+	}
+	return ret, nil
+}
+
+// resolveLocalRecords answers a query of type typ for name from the local
+// zone's CNAME, TXT, SRV and MX records. CNAMEs are followed while their
+// targets are names in the local zone; the addresses of in-zone SRV and MX
+// targets are returned as additional records.
+//
+// It reports false if the query is to be answered by resolveLocal instead:
+// if name has no such records, or if the query is for addresses and name
+// isn't a CNAME.
+func (r *Resolver) resolveLocalRecords(name dnsname.FQDN, typ dns.Type) (answers, additionals []dns.Resource, ok bool, err error) {
+	r.mu.Lock()
+	records := r.records
+	hosts := r.hostToIP
+	r.mu.Unlock()
+
+	recs, found := records[name]
+	if !found || (isAddrType(typ) && cnameTarget(recs) == "") {
+		return nil, nil, false, nil
+	}
+	metricDNSResolveLocalRecords.Add(1)
+
+	seen := map[dnsname.FQDN]bool{}
+	for typ != dns.TypeCNAME {
+		target := cnameTarget(records[name])
+		if target == "" {
+			break
+		}
+		seen[name] = true
+		rr, err := Record{Type: dns.TypeCNAME, Target: target}.resource(name)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		answers = append(answers, rr)
+		_, inZone := records[target]
+		if _, ok := hosts[target]; ok {
+			inZone = true
+		}
+		if !inZone {
+			// Leave it to the client to resolve the target.
+			return answers, nil, true, nil
+		}
+		if seen[target] || len(seen) >= maxCNAMEChain {
+			metricDNSResolveLocalCNAMELoop.Add(1)
+			return answers, nil, true, nil
+		}
+		name = target
+	}
+
+	if isAddrType(typ) {
+		rrs, err := addrResources(name, hosts[name], typ)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		return append(answers, rrs...), nil, true, nil
+	}
+	for _, rec := range records[name] {
+		if rec.Type != typ {
+			continue
+		}
+		rr, err := rec.resource(name)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		answers = append(answers, rr)
+		if typ == dns.TypeSRV || typ == dns.TypeMX {
+			rrs, err := addrResources(rec.Target, hosts[rec.Target], dns.TypeALL)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			additionals = append(additionals, rrs...)
+		}
+	}
+	return answers, additionals, true, nil
+}
+
+// marshalResource serializes rr, which must be of a type returned by
+// Record.resource or addrResources, into an active builder.
+func marshalResource(rr dns.Resource, builder *dns.Builder) error {
+	switch body := rr.Body.(type) {
+	case *dns.AResource:
+		return builder.AResource(rr.Header, *body)
+	case *dns.AAAAResource:
+		return builder.AAAAResource(rr.Header, *body)
+	case *dns.CNAMEResource:
+		return builder.CNAMEResource(rr.Header, *body)
+	case *dns.TXTResource:
+		return builder.TXTResource(rr.Header, *body)
+	case *dns.SRVResource:
+		return builder.SRVResource(rr.Header, *body)
+	case *dns.MXResource:
+		return builder.MXResource(rr.Header, *body)
+	}
+	return fmt.Errorf("unsupported resource type %T", rr.Body)
+}
@@ -0,0 +1,203 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+func mustParseRecord(t *testing.T, typ, value string) Record {
+	t.Helper()
+	rec, err := ParseRecord(typ, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestParseRecord(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		typ, value string
+		want       Record
+		wantErr    bool
+	}{
+		{typ: "CNAME", value: "target.ipn.dev", want: Record{Type: dns.TypeCNAME, Target: "target.ipn.dev."}},
+		{typ: "cname", value: "target.ipn.dev.", want: Record{Type: dns.TypeCNAME, Target: "target.ipn.dev."}},
+		{typ: "TXT", value: "v=spf1 -all", want: Record{Type: dns.TypeTXT, TXT: []string{"v=spf1 -all"}}},
+		{typ: "TXT", value: long, want: Record{Type: dns.TypeTXT, TXT: []string{long[:255], long[255:]}}},
+		{typ: "SRV", value: "10 5 8080 web.ipn.dev", want: Record{Type: dns.TypeSRV, Priority: 10, Weight: 5, Port: 8080, Target: "web.ipn.dev."}},
+		{typ: "MX", value: "10 mail.ipn.dev.", want: Record{Type: dns.TypeMX, Priority: 10, Target: "mail.ipn.dev."}},
+		{typ: "SRV", value: "10 5 web.ipn.dev", wantErr: true},
+		{typ: "SRV", value: "10 5 70000 web.ipn.dev", wantErr: true},
+		{typ: "MX", value: "mail.ipn.dev", wantErr: true},
+		{typ: "CNAME", value: "", wantErr: true},
+		{typ: "NS", value: "ns.ipn.dev", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRecord(tt.typ, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRecord(%q, %q) error = %v; want error: %v", tt.typ, tt.value, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRecord(%q, %q) = %+v; want %+v", tt.typ, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestResolveLocalRecords(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+
+	cfg := dnsCfg
+	cfg.Records = map[dnsname.FQDN][]Record{
+		"_http._tcp.svc.ipn.dev.": {mustParseRecord(t, "SRV", "10 5 8080 test1.ipn.dev")},
+		"svc.ipn.dev.": {
+			mustParseRecord(t, "TXT", "hello"),
+			mustParseRecord(t, "MX", "10 test2.ipn.dev"),
+		},
+		"alias.ipn.dev.":  {mustParseRecord(t, "CNAME", "test1.ipn.dev")},
+		"alias2.ipn.dev.": {mustParseRecord(t, "CNAME", "alias.ipn.dev")},
+		"ext.ipn.dev.":    {mustParseRecord(t, "CNAME", "example.com")},
+		"loop1.ipn.dev.":  {mustParseRecord(t, "CNAME", "loop2.ipn.dev")},
+		"loop2.ipn.dev.":  {mustParseRecord(t, "CNAME", "loop1.ipn.dev")},
+	}
+	r.SetConfig(cfg)
+
+	tests := []struct {
+		name            string
+		qname           dnsname.FQDN
+		qtype           dns.Type
+		wantCode        dns.RCode
+		wantAnswers     []string
+		wantAdditionals []string
+	}{
+		{
+			name:            "srv",
+			qname:           "_http._tcp.svc.ipn.dev.",
+			qtype:           dns.TypeSRV,
+			wantAnswers:     []string{"_http._tcp.svc.ipn.dev. SRV 10 5 8080 test1.ipn.dev."},
+			wantAdditionals: []string{"test1.ipn.dev. A 1.2.3.4"},
+		},
+		{
+			name:        "txt",
+			qname:       "svc.ipn.dev.",
+			qtype:       dns.TypeTXT,
+			wantAnswers: []string{"svc.ipn.dev. TXT [hello]"},
+		},
+		{
+			name:            "mx",
+			qname:           "svc.ipn.dev.",
+			qtype:           dns.TypeMX,
+			wantAnswers:     []string{"svc.ipn.dev. MX 10 test2.ipn.dev."},
+			wantAdditionals: []string{"test2.ipn.dev. AAAA 1:203:405:607:809:a0b:c0d:e0f"},
+		},
+		{
+			name:  "a-records-only-name",
+			qname: "svc.ipn.dev.",
+			qtype: dns.TypeA,
+		},
+		{
+			name:  "txt-hosts-only-name",
+			qname: "test1.ipn.dev.",
+			qtype: dns.TypeTXT,
+		},
+		{
+			name:        "cname-a",
+			qname:       "alias.ipn.dev.",
+			qtype:       dns.TypeA,
+			wantAnswers: []string{"alias.ipn.dev. CNAME test1.ipn.dev.", "test1.ipn.dev. A 1.2.3.4"},
+		},
+		{
+			name:  "cname-chain",
+			qname: "alias2.ipn.dev.",
+			qtype: dns.TypeA,
+			wantAnswers: []string{
+				"alias2.ipn.dev. CNAME alias.ipn.dev.",
+				"alias.ipn.dev. CNAME test1.ipn.dev.",
+				"test1.ipn.dev. A 1.2.3.4",
+			},
+		},
+		{
+			name:        "cname-query",
+			qname:       "alias2.ipn.dev.",
+			qtype:       dns.TypeCNAME,
+			wantAnswers: []string{"alias2.ipn.dev. CNAME alias.ipn.dev."},
+		},
+		{
+			name:        "cname-out-of-zone",
+			qname:       "ext.ipn.dev.",
+			qtype:       dns.TypeA,
+			wantAnswers: []string{"ext.ipn.dev. CNAME example.com."},
+		},
+		{
+			name:        "cname-loop",
+			qname:       "loop1.ipn.dev.",
+			qtype:       dns.TypeA,
+			wantAnswers: []string{"loop1.ipn.dev. CNAME loop2.ipn.dev.", "loop2.ipn.dev. CNAME loop1.ipn.dev."},
+		},
+		{
+			name:     "nxdomain",
+			qname:    "missing.ipn.dev.",
+			qtype:    dns.TypeSRV,
+			wantCode: dns.RCodeNameError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := syncRespond(r, dnspacket(tt.qname, tt.qtype, noEdns))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m dns.Message
+			if err := m.Unpack(res); err != nil {
+				t.Fatal(err)
+			}
+			if m.RCode != tt.wantCode {
+				t.Errorf("rcode = %v; want %v", m.RCode, tt.wantCode)
+			}
+			if got := formatResources(m.Answers); !reflect.DeepEqual(got, tt.wantAnswers) {
+				t.Errorf("answers = %q; want %q", got, tt.wantAnswers)
+			}
+			if got := formatResources(m.Additionals); !reflect.DeepEqual(got, tt.wantAdditionals) {
+				t.Errorf("additionals = %q; want %q", got, tt.wantAdditionals)
+			}
+		})
+	}
+}
+
+// formatResources returns rrs in a compact zone file-like form.
+func formatResources(rrs []dns.Resource) []string {
+	var ret []string
+	for _, rr := range rrs {
+		var data string
+		switch b := rr.Body.(type) {
+		case *dns.AResource:
+			data = "A " + netip.AddrFrom4(b.A).String()
+		case *dns.AAAAResource:
+			data = "AAAA " + netip.AddrFrom16(b.AAAA).String()
+		case *dns.CNAMEResource:
+			data = "CNAME " + b.CNAME.String()
+		case *dns.TXTResource:
+			data = fmt.Sprintf("TXT %v", b.TXT)
+		case *dns.SRVResource:
+			data = fmt.Sprintf("SRV %d %d %d %v", b.Priority, b.Weight, b.Port, b.Target)
+		case *dns.MXResource:
+			data = fmt.Sprintf("MX %d %v", b.Pref, b.MX)
+		default:
+			data = rr.Body.GoString()
+		}
+		ret = append(ret, rr.Header.Name.String()+" "+data)
+	}
+	return ret
+}
@@ -59,7 +59,7 @@ type packet struct {
 
 // Config is a resolver configuration.
 // Given a Config, queries are resolved in the following order:
-// If the query is an exact match for an entry in LocalHosts, return that.
+// If the query is an exact match for an entry in LocalHosts or Records, return that.
 // Else if the query suffix matches an entry in LocalDomains, return NXDOMAIN.
 // Else forward the query to the most specific matching entry in Routes.
 // Else return SERVFAIL.
@@ -71,6 +71,8 @@ type Config struct {
 	Routes map[dnsname.FQDN][]*dnstype.Resolver
 	// LocalHosts is a map of FQDNs to corresponding IPs.
 	Hosts map[dnsname.FQDN][]netip.Addr
+	// Records is a map of FQDNs to their CNAME, TXT, SRV and MX records.
+	Records map[dnsname.FQDN][]Record
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
@@ -81,7 +83,11 @@ type Config struct {
 func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 	w.WriteString("{Routes:")
 	WriteRoutes(w, c.Routes)
-	fmt.Fprintf(w, " Hosts:%v LocalDomains:[", len(c.Hosts))
+	fmt.Fprintf(w, " Hosts:%v", len(c.Hosts))
+	if len(c.Records) > 0 {
+		fmt.Fprintf(w, " Records:%v", len(c.Records))
+	}
+	w.WriteString(" LocalDomains:[")
 	space := false
 	arpa := 0
 	for _, d := range c.LocalDomains {
@@ -184,6 +190,8 @@ type Resolver struct {
 	saveConfigForTests func(cfg Config) // used in tests to capture resolver config
 	// forwarder forwards requests to upstream nameservers.
 	forwarder *forwarder
+	// queryLog is the log of recent queries, for debugging.
+	queryLog queryLog
 
 	// closed signals all goroutines to stop.
 	closed chan struct{}
@@ -195,6 +203,7 @@ type Resolver struct {
 	localDomains []dnsname.FQDN
 	hostToIP     map[dnsname.FQDN][]netip.Addr
 	ipToHost     map[netip.Addr]dnsname.FQDN
+	records      map[dnsname.FQDN][]Record
 }
 
 type ForwardLinkSelector interface {
@@ -244,6 +253,7 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	r.localDomains = cfg.LocalDomains
 	r.hostToIP = cfg.Hosts
 	r.ipToHost = reverse
+	r.records = cfg.Records
 	return nil
 }
 
@@ -261,12 +271,34 @@ func (r *Resolver) Close() {
 	r.forwarder.Close()
 }
 
+// GetUpstreamResolvers returns the upstream resolvers that a query for
+// name would be forwarded to if it's not answered locally. It returns nil
+// if there are none.
+func (r *Resolver) GetUpstreamResolvers(name dnsname.FQDN) []*dnstype.Resolver {
+	var ret []*dnstype.Resolver
+	for _, rr := range r.forwarder.resolvers(name) {
+		ret = append(ret, rr.name)
+	}
+	return ret
+}
+
 // dnsQueryTimeout is not intended to be user-visible (the users
 // DNS resolver will retry well before that), just put an upper
 // bound on per-query resource usage.
 const dnsQueryTimeout = 10 * time.Second
 
 func (r *Resolver) Query(ctx context.Context, bs []byte, from netip.AddrPort) ([]byte, error) {
+	if !r.queryLog.enabled() {
+		return r.query(ctx, bs, from)
+	}
+	start := time.Now()
+	qi := new(queryInfo)
+	res, err := r.query(withQueryInfo(ctx, qi), bs, from)
+	r.logQuery(start, from, bs, res, err, qi, false)
+	return res, err
+}
+
+func (r *Resolver) query(ctx context.Context, bs []byte, from netip.AddrPort) ([]byte, error) {
 	metricDNSQueryLocal.Add(1)
 	select {
 	case <-r.closed:
@@ -324,6 +356,17 @@ func parseExitNodeQuery(q []byte) *response {
 // and a nil error.
 // TODO: figure out if we even need an error result.
 func (r *Resolver) HandleExitNodeDNSQuery(ctx context.Context, q []byte, from netip.AddrPort, allowName func(name string) bool) (res []byte, err error) {
+	if !r.queryLog.enabled() {
+		return r.handleExitNodeDNSQuery(ctx, q, from, allowName)
+	}
+	start := time.Now()
+	qi := &queryInfo{forwarded: true}
+	res, err = r.handleExitNodeDNSQuery(withQueryInfo(ctx, qi), q, from, allowName)
+	r.logQuery(start, from, q, res, err, qi, true)
+	return res, err
+}
+
+func (r *Resolver) handleExitNodeDNSQuery(ctx context.Context, q []byte, from netip.AddrPort, allowName func(name string) bool) (res []byte, err error) {
 	metricDNSExitProxyQuery.Add(1)
 	ch := make(chan packet, 1)
 
@@ -585,10 +628,16 @@ func (r *Resolver) resolveLocal(domain dnsname.FQDN, typ dns.Type) (netip.Addr,
 
 	r.mu.Lock()
 	hosts := r.hostToIP
+	records := r.records
 	localDomains := r.localDomains
 	r.mu.Unlock()
 
 	addrs, found := hosts[domain]
+	if !found {
+		// A name with only non-address records exists, but has no
+		// addresses.
+		_, found = records[domain]
+	}
 	if !found {
 		for _, suffix := range localDomains {
 			if suffix.Contains(domain) {
@@ -808,6 +857,11 @@ type response struct {
 
 	// NSs are the responses to an NS query.
 	NSs []*net.NS
+
+	// Answers and Additionals are the records of a response from the
+	// local zone's non-address records. Answers follow any of the above.
+	Answers     []dns.Resource
+	Additionals []dns.Resource
 }
 
 var dnsParserPool = &sync.Pool{
@@ -1003,7 +1057,7 @@ func marshalResponse(resp *response) ([]byte, error) {
 	// before, but for now (2021-12-09) enable it at least when
 	// there's more than 1 record (which was never the case
 	// before), where it really helps.
-	if len(resp.IPs) > 1 {
+	if len(resp.IPs) > 1 || len(resp.Answers)+len(resp.Additionals) > 1 {
 		builder.EnableCompression()
 	}
 
@@ -1055,6 +1109,22 @@ func marshalResponse(resp *response) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	for _, rr := range resp.Answers {
+		if err := marshalResource(rr, &builder); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(resp.Additionals) > 0 {
+		if err := builder.StartAdditionals(); err != nil {
+			return nil, err
+		}
+		for _, rr := range resp.Additionals {
+			if err := marshalResource(rr, &builder); err != nil {
+				return nil, err
+			}
+		}
+	}
 
 	return builder.Finish()
 }
@@ -1229,6 +1299,22 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 		return r.respondReverse(query, name, parser.response())
 	}
 
+	answers, additionals, ok, err := r.resolveLocalRecords(name, parser.Question.Type)
+	if err != nil {
+		metricDNSResolveLocalRecordsError.Add(1)
+		r.logf("resolveLocalRecords(%q): %v", name, err)
+		resp := parser.response()
+		resp.Header.RCode = dns.RCodeServerFailure
+		return marshalResponse(resp)
+	}
+	if ok {
+		resp := parser.response()
+		resp.Header.RCode = dns.RCodeSuccess
+		resp.Answers = answers
+		resp.Additionals = additionals
+		return marshalResponse(resp)
+	}
+
 	ip, rcode := r.resolveLocal(name, parser.Question.Type)
 	if rcode == dns.RCodeRefused {
 		return nil, errNotOurName // sentinel error return value: it requests forwarding
@@ -1294,6 +1380,10 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSFwdErrorContext         = clientmetric.NewCounter("dns_query_fwd_error_context")
 	metricDNSFwdErrorContextGotError = clientmetric.NewCounter("dns_query_fwd_error_context_got_error")
 
+	metricDNSFwdCacheHit   = clientmetric.NewCounter("dns_query_fwd_cache_hit")
+	metricDNSFwdCacheMiss  = clientmetric.NewCounter("dns_query_fwd_cache_miss")
+	metricDNSFwdCacheFlush = clientmetric.NewCounter("dns_query_fwd_cache_flush")
+
 	metricDNSFwdErrorType      = clientmetric.NewCounter("dns_query_fwd_error_type")
 	metricDNSFwdErrorParseAddr = clientmetric.NewCounter("dns_query_fwd_error_parse_addr")
 	metricDNSFwdTruncated      = clientmetric.NewCounter("dns_query_fwd_truncated")
@@ -1312,6 +1402,11 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSFwdDoHErrorTransport = clientmetric.NewCounter("dns_query_fwd_doh_error_transport")
 	metricDNSFwdDoHErrorBody      = clientmetric.NewCounter("dns_query_fwd_doh_error_body")
 
+	metricDNSFwdDoT               = clientmetric.NewCounter("dns_query_fwd_dot")
+	metricDNSFwdDoTErrorTransport = clientmetric.NewCounter("dns_query_fwd_dot_error_transport")
+
+	metricDNSFwdEncryptedErrorServer = clientmetric.NewCounter("dns_query_fwd_encrypted_error_server")
+
 	metricDNSResolveLocal             = clientmetric.NewCounter("dns_resolve_local")
 	metricDNSResolveLocalErrorOnion   = clientmetric.NewCounter("dns_resolve_local_error_onion")
 	metricDNSResolveLocalErrorMissing = clientmetric.NewCounter("dns_resolve_local_error_missing")
@@ -1324,6 +1419,11 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSResolveLocalNoAll        = clientmetric.NewCounter("dns_resolve_local_no_all")
 	metricDNSResolveNotImplType       = clientmetric.NewCounter("dns_resolve_local_not_impl_type")
 	metricDNSResolveNoRecordType      = clientmetric.NewCounter("dns_resolve_local_no_record_type")
+	metricDNSResolveLocalRecords      = clientmetric.NewCounter("dns_resolve_local_records")
+	metricDNSResolveLocalRecordsError = clientmetric.NewCounter("dns_resolve_local_records_error")
+	metricDNSResolveLocalCNAMELoop    = clientmetric.NewCounter("dns_resolve_local_cname_loop")
+
+	metricDNSQueryLogDropped = clientmetric.NewCounter("dns_query_log_dropped")
 
 	metricDNSReverseMissBonjour = clientmetric.NewCounter("dns_reverse_miss_bonjour")
 	metricDNSReverseMissOther   = clientmetric.NewCounter("dns_reverse_miss_other")
@@ -377,6 +377,40 @@ func TestResolveLocal(t *testing.T) {
 	}
 }
 
+func TestGetUpstreamResolvers(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+
+	corp := &dnstype.Resolver{Addr: "10.0.0.53"}
+	def := &dnstype.Resolver{Addr: "192.0.2.53"}
+	r.SetConfig(Config{
+		Routes: map[dnsname.FQDN][]*dnstype.Resolver{
+			"corp.example.com.": {corp},
+			".":                 {def},
+		},
+	})
+
+	tests := []struct {
+		name dnsname.FQDN
+		want []*dnstype.Resolver
+	}{
+		{"host.corp.example.com.", []*dnstype.Resolver{corp}},
+		{"corp.example.com.", []*dnstype.Resolver{corp}},
+		{"www.example.com.", []*dnstype.Resolver{def}},
+	}
+	for _, tt := range tests {
+		got := r.GetUpstreamResolvers(tt.name)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GetUpstreamResolvers(%q) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	r.SetConfig(Config{})
+	if got := r.GetUpstreamResolvers("www.example.com."); got != nil {
+		t.Errorf("with no routes, got %v; want nil", got)
+	}
+}
+
 func TestResolveLocalReverse(t *testing.T) {
 	r := newResolver(t)
 	defer r.Close()
@@ -101,5 +101,17 @@ func (c *Cache[Value]) removeElement(e *list.Element) {
 	delete(c.m, e.Value.(*entry[Value]).key)
 }
 
+// ForEach calls fn for each item in the cache, most recently used
+// first. fn must not modify the cache.
+func (c *Cache[Value]) ForEach(fn func(key Tuple, value Value)) {
+	if c.ll == nil {
+		return
+	}
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		ent := e.Value.(*entry[Value])
+		fn(ent.key, ent.value)
+	}
+}
+
 // Len returns the number of items in the cache.
 func (c *Cache[Value]) Len() int { return len(c.m) }
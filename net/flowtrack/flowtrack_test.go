@@ -80,3 +80,20 @@ func TestCache(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestCacheForEach(t *testing.T) {
+	c := &Cache[int]{}
+	c.ForEach(func(Tuple, int) { t.Fatal("called for empty cache") })
+
+	k1 := Tuple{Src: netip.MustParseAddrPort("1.1.1.1:1"), Dst: netip.MustParseAddrPort("1.1.1.1:1")}
+	k2 := Tuple{Src: netip.MustParseAddrPort("1.1.1.1:1"), Dst: netip.MustParseAddrPort("2.2.2.2:2")}
+	c.Add(k1, 1)
+	c.Add(k2, 2)
+	c.Get(k1)
+
+	var got []int
+	c.ForEach(func(k Tuple, v int) { got = append(got, v) })
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("ForEach values = %v; want [1 2], most recently used first", got)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netcheck
+
+import (
+	"slices"
+	"time"
+)
+
+// maxHistory is the number of reports a Client keeps in its history.
+// At the usual rate of a report every 20-30 seconds, that's about the
+// last hour.
+const maxHistory = 150
+
+// HistoryEntry is a report in a Client's history.
+type HistoryEntry struct {
+	// Time is when the report completed.
+	Time time.Time
+
+	// Report is the report. It must not be modified.
+	Report *Report
+
+	// Full is whether the report was a full report, rather than an
+	// incremental one.
+	Full bool
+
+	// LinkChange is whether NoteLinkChange was called since the
+	// previous report in the history.
+	LinkChange bool
+}
+
+// NoteLinkChange records that the network changed, to be marked on the
+// next report added to the history.
+func (c *Client) NoteLinkChange() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.linkChanged = true
+}
+
+// History returns the client's most recent reports, oldest first.
+func (c *Client) History() []HistoryEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.history)
+}
+
+// addToHistory adds r, which finished at now, to the history, dropping the
+// oldest report if the history is full.
+func (c *Client) addToHistory(r *Report, now time.Time, full bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.history) >= maxHistory {
+		c.history = slices.Delete(c.history, 0, len(c.history)-maxHistory+1)
+	}
+	c.history = append(c.history, HistoryEntry{
+		Time:       now,
+		Report:     r,
+		Full:       full,
+		LinkChange: c.linkChanged,
+	})
+	c.linkChanged = false
+}
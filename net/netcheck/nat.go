@@ -0,0 +1,251 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netcheck
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/net/neterror"
+	"tailscale.com/net/stun"
+	"tailscale.com/util/mak"
+)
+
+// NATBehavior describes how a NAT's mapping or filtering of UDP depends on
+// the remote endpoint, in the terms of RFC 4787 and RFC 5780.
+type NATBehavior string
+
+const (
+	// NATEndpointIndependent is mapping that reuses the same public
+	// ip:port for all destinations, or filtering that accepts packets
+	// from anywhere once we've sent to anywhere. It's the friendliest to
+	// direct connections.
+	NATEndpointIndependent NATBehavior = "endpoint-independent"
+
+	// NATAddressDependent is mapping that picks a public ip:port per
+	// destination IP, or filtering that only accepts packets from IPs
+	// we've sent to.
+	NATAddressDependent NATBehavior = "address-dependent"
+
+	// NATAddressAndPortDependent is mapping that picks a public ip:port
+	// per destination ip:port, or filtering that only accepts packets
+	// from ip:ports we've sent to. Mapping of this kind is often called
+	// a "symmetric NAT" and usually prevents direct connections.
+	NATAddressAndPortDependent NATBehavior = "address-and-port-dependent"
+
+	// NATAddressDependentOrStricter is mapping that's known to pick a
+	// public ip:port per destination IP, but not whether it also does
+	// per destination port, because no STUN server was probed on two
+	// ports.
+	NATAddressDependentOrStricter NATBehavior = "address-dependent-or-stricter"
+
+	// NATAddressDependentOrLooser is filtering that accepts packets from
+	// other ports of IPs we've sent to, but not known whether it accepts
+	// them from other IPs, because the STUN server only has an alternate
+	// port, not an alternate IP.
+	NATAddressDependentOrLooser NATBehavior = "address-dependent-or-looser"
+)
+
+const (
+	// natProbeTimeout is how long the NAT tests wait for a response
+	// before retransmitting or, after natProbeAttempts, concluding
+	// that the response was filtered.
+	natProbeTimeout = 250 * time.Millisecond
+	// natProbeAttempts is how many times the NAT tests send each
+	// request, so that a lost packet isn't mistaken for filtering.
+	natProbeAttempts = 2
+)
+
+// noteMapping4 records the IPv4 ip:port that the STUN server at dst saw
+// us as, for classifying mapping behavior. If the server supports RFC
+// 5780 and is the first seen to, it's also recorded for the NAT tests.
+//
+// Servers with only an alternate port, like cmd/derper, advertise an
+// OTHER-ADDRESS with the unspecified IP, which is taken to mean dst's IP.
+func (rs *reportState) noteMapping4(dst netip.AddrPort, res stunResponse) {
+	if !res.mapped.Addr().Is4() {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	mak.Set(&rs.mappings4, dst, res.mapped)
+	other := res.other
+	if !rs.natServer.IsValid() && other.Addr().Is4() && other.Port() != dst.Port() {
+		if other.Addr().IsUnspecified() {
+			other = netip.AddrPortFrom(dst.Addr(), other.Port())
+		}
+		rs.natServer, rs.natOther = dst, other
+	}
+}
+
+// runNATTests classifies the NAT's mapping and filtering behavior, as
+// described in RFC 5780 Section 4, and records them in rs.report.
+//
+// Mapping behavior is inferred from the IPv4 ip:ports seen by all the STUN
+// servers probed. If one of them supports RFC 5780, its alternate
+// addresses are probed too, and it's used to test filtering by asking it
+// to respond from them. If it only has an alternate port, filtering can't
+// be told apart between endpoint-independent and address-dependent.
+func (rs *reportState) runNATTests(ctx context.Context) {
+	if rs.incremental {
+		// Like HairPinning, these are only measured in full reports.
+		rs.mu.Lock()
+		if last := rs.c.last; last != nil {
+			rs.report.NATMapping = last.NATMapping
+			rs.report.NATFiltering = last.NATFiltering
+		}
+		rs.mu.Unlock()
+		return
+	}
+
+	rs.mu.Lock()
+	server, other := rs.natServer, rs.natOther
+	rs.mu.Unlock()
+
+	var filtering NATBehavior
+	if server.IsValid() && rs.c.SendPacket != nil {
+		// Test filtering first, so that the mapping tests' packets to
+		// the alternate addresses don't open the filter for its
+		// responses from them.
+		filtering = rs.natFilteringTest(ctx, server, other)
+		var dsts []netip.AddrPort
+		if other.Addr() != server.Addr() {
+			dsts = append(dsts, netip.AddrPortFrom(other.Addr(), server.Port())) // RFC 5780 Section 4.3 test II
+		}
+		dsts = append(dsts, other) // test III
+		var wg sync.WaitGroup
+		for _, dst := range dsts {
+			wg.Add(1)
+			go func(dst netip.AddrPort) {
+				defer wg.Done()
+				if res, ok := rs.natProbe(ctx, dst, false, false); ok {
+					rs.noteMapping4(dst, res)
+				}
+			}(dst)
+		}
+		wg.Wait()
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.report.NATMapping = classifyNATMapping(rs.mappings4)
+	rs.report.NATFiltering = filtering
+}
+
+// natFilteringTest runs the filtering tests of RFC 5780 Section 4.4
+// against the STUN server at server, whose alternate address is other. It
+// returns the empty string if they're inconclusive.
+func (rs *reportState) natFilteringTest(ctx context.Context, server, other netip.AddrPort) NATBehavior {
+	// Test II asks for the response from the alternate IP and port, if
+	// the server has an alternate IP, and test III from the alternate
+	// port only. They don't affect each other, so run them at once
+	// rather than waiting out one's timeout before sending the other.
+	portOnly := other.Addr() == server.Addr()
+	var (
+		wg            sync.WaitGroup
+		resII, resIII stunResponse
+		okII, okIII   bool
+	)
+	if !portOnly {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resII, okII = rs.natProbe(ctx, server, true, true)
+		}()
+	}
+	resIII, okIII = rs.natProbe(ctx, server, false, true)
+	wg.Wait()
+
+	switch {
+	case okII:
+		if resII.src != other {
+			rs.c.vlogf("NAT filtering test: response came from %v, not %v", resII.src, other)
+			return ""
+		}
+		return NATEndpointIndependent
+	case okIII:
+		if want := netip.AddrPortFrom(server.Addr(), other.Port()); resIII.src != want {
+			rs.c.vlogf("NAT filtering test: response came from %v, not %v", resIII.src, want)
+			return ""
+		}
+		if portOnly {
+			return NATAddressDependentOrLooser
+		}
+		return NATAddressDependent
+	case ctx.Err() != nil:
+		return ""
+	}
+	return NATAddressAndPortDependent
+}
+
+// natProbe sends a STUN binding request to dst, asking for the response to
+// come from the server's alternate IP, port, or both, as specified, and
+// waits for it. It reports whether a response arrived.
+func (rs *reportState) natProbe(ctx context.Context, dst netip.AddrPort, changeIP, changePort bool) (res stunResponse, ok bool) {
+	txID := stun.NewTxID()
+	req := stun.Request(txID)
+	if changeIP || changePort {
+		req = stun.RequestChange(txID, changeIP, changePort)
+	}
+
+	ch := make(chan stunResponse, 1) // inFlight funcs are called at most once
+	rs.mu.Lock()
+	rs.inFlight[txID] = func(res stunResponse) { ch <- res }
+	rs.mu.Unlock()
+	defer func() {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		delete(rs.inFlight, txID)
+	}()
+
+	for i := 0; i < natProbeAttempts; i++ {
+		if _, err := rs.c.SendPacket(req, dst); err != nil && !neterror.TreatAsLostUDP(err) {
+			rs.c.vlogf("NAT test probe to %v: %v", dst, err)
+			return res, false
+		}
+		t := time.NewTimer(natProbeTimeout)
+		select {
+		case res = <-ch:
+			t.Stop()
+			return res, true
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return res, false
+		}
+	}
+	return res, false
+}
+
+// classifyNATMapping classifies NAT mapping behavior from mappings, the
+// IPv4 ip:port that each STUN server saw us as, keyed by the server's
+// ip:port. It returns the empty string if the mappings don't tell.
+func classifyNATMapping(mappings map[netip.AddrPort]netip.AddrPort) NATBehavior {
+	var diffIP, variesByIP, diffPort, variesByPort bool
+	for a, ma := range mappings {
+		for b, mb := range mappings {
+			switch {
+			case a.Addr() != b.Addr():
+				diffIP = true
+				variesByIP = variesByIP || ma != mb
+			case a.Port() != b.Port():
+				diffPort = true
+				variesByPort = variesByPort || ma != mb
+			}
+		}
+	}
+	switch {
+	case variesByPort:
+		return NATAddressAndPortDependent
+	case variesByIP && diffPort:
+		return NATAddressDependent
+	case variesByIP:
+		return NATAddressDependentOrStricter
+	case diffIP && !variesByIP:
+		return NATEndpointIndependent
+	}
+	return ""
+}
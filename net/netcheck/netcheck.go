@@ -100,6 +100,17 @@ type Report struct {
 	// (on IPv4).
 	HairPinning opt.Bool
 
+	// NATMapping is how the NAT's choice of our public IPv4 address and
+	// port depends on the destination, as classified by RFC 5780 style
+	// tests. Empty means unknown. See NATBehavior.
+	NATMapping NATBehavior
+
+	// NATFiltering is how the NAT's acceptance of incoming IPv4 packets
+	// depends on where we've previously sent packets to, as classified by
+	// RFC 5780 style tests. Empty means unknown, including when no STUN
+	// server supporting RFC 5780 is available. See NATBehavior.
+	NATFiltering NATBehavior
+
 	// UPnP is whether UPnP appears present on the LAN.
 	// Empty means not checked.
 	UPnP opt.Bool
@@ -209,6 +220,9 @@ type Client struct {
 	lastFull time.Time             // time of last full (non-incremental) report
 	curState *reportState          // non-nil if we're in a call to GetReport
 	resolver *dnscache.Resolver    // only set if UseDNSCache is true
+
+	history     []HistoryEntry // recent reports, oldest first; see History
+	linkChanged bool           // NoteLinkChange was called since the last report
 }
 
 func (c *Client) enoughRegions() int {
@@ -313,7 +327,11 @@ func (c *Client) ReceiveSTUNPacket(pkt []byte, src netip.AddrPort) {
 	}
 	rs.mu.Unlock()
 	if ok {
-		onDone(addrPort)
+		onDone(stunResponse{
+			mapped: addrPort,
+			src:    netip.AddrPortFrom(src.Addr().Unmap(), src.Port()),
+			other:  stun.ParseOtherAddress(pkt),
+		})
 	}
 }
 
@@ -533,10 +551,20 @@ type reportState struct {
 
 	mu            sync.Mutex
 	sentHairCheck bool
-	report        *Report                            // to be returned by GetReport
-	inFlight      map[stun.TxID]func(netip.AddrPort) // called without c.mu held
+	report        *Report                          // to be returned by GetReport
+	inFlight      map[stun.TxID]func(stunResponse) // called without c.mu held
 	gotEP4        string
 	timers        []*time.Timer
+	mappings4     map[netip.AddrPort]netip.AddrPort // STUN server => our IPv4 ip:port it saw
+	natServer     netip.AddrPort                    // first STUN server seen supporting RFC 5780
+	natOther      netip.AddrPort                    // natServer's alternate address
+}
+
+// stunResponse is a STUN binding response to a probe.
+type stunResponse struct {
+	mapped netip.AddrPort // our ip:port, as seen by the server
+	src    netip.AddrPort // where the response came from
+	other  netip.AddrPort // the server's RFC 5780 OTHER-ADDRESS, if any
 }
 
 func (rs *reportState) anyUDP() bool {
@@ -598,36 +626,45 @@ func (rs *reportState) startHairCheckLocked(dst netip.AddrPort) {
 
 func (rs *reportState) waitHairCheck(ctx context.Context) {
 	rs.mu.Lock()
-	defer rs.mu.Unlock()
 	ret := rs.report
 	if rs.incremental {
 		if rs.c.last != nil {
 			ret.HairPinning = rs.c.last.HairPinning
 		}
+		rs.mu.Unlock()
 		return
 	}
-	if !rs.sentHairCheck {
+	sent := rs.sentHairCheck
+	rs.mu.Unlock()
+	if !sent {
 		return
 	}
 
+	// Wait without holding rs.mu, so that the NAT tests running
+	// alongside can still receive their STUN responses.
+	var hairPinning opt.Bool
+
 	// First, check whether we have a value before we check for timeouts.
 	select {
 	case <-rs.gotHairSTUN:
-		ret.HairPinning.Set(true)
-		return
+		hairPinning.Set(true)
 	default:
+		// Now, wait for a response or a timeout.
+		select {
+		case <-rs.gotHairSTUN:
+			hairPinning.Set(true)
+		case <-rs.hairTimeout:
+			rs.c.vlogf("hairCheck timeout")
+			hairPinning.Set(false)
+		case <-ctx.Done():
+			rs.c.vlogf("hairCheck context timeout")
+			return
+		}
 	}
 
-	// Now, wait for a response or a timeout.
-	select {
-	case <-rs.gotHairSTUN:
-		ret.HairPinning.Set(true)
-	case <-rs.hairTimeout:
-		rs.c.vlogf("hairCheck timeout")
-		ret.HairPinning.Set(false)
-	case <-ctx.Done():
-		rs.c.vlogf("hairCheck context timeout")
-	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	ret.HairPinning = hairPinning
 }
 
 func (rs *reportState) stopTimers() {
@@ -766,7 +803,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 	rs := &reportState{
 		c:           c,
 		report:      newReport(),
-		inFlight:    map[stun.TxID]func(netip.AddrPort){},
+		inFlight:    map[stun.TxID]func(stunResponse){},
 		hairTX:      stun.NewTxID(), // random payload
 		gotHairSTUN: make(chan netip.AddrPort, 1),
 		hairTimeout: make(chan struct{}),
@@ -945,12 +982,21 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 		captivePortalStop()
 	}
 
+	// The NAT tests wait for responses of their own, so run them
+	// alongside the hairpin and port mapping checks rather than after.
+	natDone := make(chan struct{})
+	go func() {
+		defer close(natDone)
+		rs.runNATTests(ctx)
+		c.vlogf("NAT tests done")
+	}()
 	rs.waitHairCheck(ctx)
 	c.vlogf("hairCheck done")
 	if !c.SkipExternalNetwork && c.PortMapper != nil {
 		rs.waitPortMap.Wait()
 		c.vlogf("portMap done")
 	}
+	<-natDone
 	rs.stopTimers()
 
 	// Try HTTPS and ICMP latency check if all STUN probes failed due to
@@ -1023,6 +1069,7 @@ func (c *Client) finishAndStoreReport(rs *reportState, dm *tailcfg.DERPMap) *Rep
 	rs.mu.Unlock()
 
 	c.addReportHistoryAndSetPreferredDERP(report, dm.View())
+	c.addToHistory(report, c.timeNow(), !rs.incremental)
 	c.logConciseReport(report, dm)
 
 	return report
@@ -1309,6 +1356,12 @@ func (c *Client) logConciseReport(r *Report, dm *tailcfg.DERPMap) {
 		}
 		fmt.Fprintf(w, " mapvarydest=%v", r.MappingVariesByDestIP)
 		fmt.Fprintf(w, " hair=%v", r.HairPinning)
+		if r.NATMapping != "" {
+			fmt.Fprintf(w, " natmap=%v", r.NATMapping)
+		}
+		if r.NATFiltering != "" {
+			fmt.Fprintf(w, " natfilter=%v", r.NATFiltering)
+		}
 		if r.AnyPortMappingChecked() {
 			fmt.Fprintf(w, " portmap=%v%v%v", conciseOptBool(r.UPnP, "U"), conciseOptBool(r.PMP, "M"), conciseOptBool(r.PCP, "C"))
 		} else {
@@ -1516,8 +1569,11 @@ func (rs *reportState) runProbe(ctx context.Context, dm *tailcfg.DERPMap, probe
 	sent := time.Now() // after DNS lookup above
 
 	rs.mu.Lock()
-	rs.inFlight[txID] = func(ipp netip.AddrPort) {
-		rs.addNodeLatency(node, ipp, time.Since(sent))
+	rs.inFlight[txID] = func(res stunResponse) {
+		rs.addNodeLatency(node, res.mapped, time.Since(sent))
+		if probe.proto == probeIPv4 {
+			rs.noteMapping4(addr, res)
+		}
 		cancelSet() // abort other nodes in this set
 	}
 	rs.mu.Unlock()
@@ -23,6 +23,8 @@
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
+	"tailscale.com/tstest/natlab"
+	"tailscale.com/types/nettype"
 )
 
 func TestHairpinSTUN(t *testing.T) {
@@ -190,6 +192,212 @@ func TestBasic(t *testing.T) {
 	}
 }
 
+func TestNATBehavior(t *testing.T) {
+	tests := []struct {
+		nat           natlab.NATType
+		fw            natlab.FirewallType
+		portOnly      bool // STUN server has an alternate port but not IP, like cmd/derper
+		wantMapping   NATBehavior
+		wantFiltering NATBehavior
+	}{
+		{natlab.EndpointIndependentNAT, natlab.EndpointIndependentFirewall, false, NATEndpointIndependent, NATEndpointIndependent},
+		{natlab.EndpointIndependentNAT, natlab.AddressAndPortDependentFirewall, false, NATEndpointIndependent, NATAddressAndPortDependent},
+		{natlab.AddressDependentNAT, natlab.AddressDependentFirewall, false, NATAddressDependent, NATAddressDependent},
+		{natlab.AddressAndPortDependentNAT, natlab.EndpointIndependentFirewall, false, NATAddressAndPortDependent, NATEndpointIndependent},
+		{natlab.AddressAndPortDependentNAT, natlab.AddressAndPortDependentFirewall, false, NATAddressAndPortDependent, NATAddressAndPortDependent},
+		{natlab.EndpointIndependentNAT, natlab.EndpointIndependentFirewall, true, "", NATAddressDependentOrLooser},
+		{natlab.EndpointIndependentNAT, natlab.AddressDependentFirewall, true, "", NATAddressDependentOrLooser},
+		{natlab.AddressAndPortDependentNAT, natlab.AddressAndPortDependentFirewall, true, NATAddressAndPortDependent, NATAddressAndPortDependent},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("%v_%v", tt.wantMapping, tt.wantFiltering)
+		if tt.portOnly {
+			name = "port_only_" + name
+		}
+		t.Run(name, func(t *testing.T) {
+			inet := natlab.NewInternet()
+			lan := &natlab.Network{
+				Name:    "lan",
+				Prefix4: netip.MustParsePrefix("192.168.0.0/24"),
+			}
+			mstun := &natlab.Machine{Name: "stun"}
+			mstunAlt := &natlab.Machine{Name: "stun-alt"}
+			nat := &natlab.Machine{Name: "nat"}
+			m := &natlab.Machine{Name: "m"}
+			stunIf := mstun.Attach("eth0", inet)
+			stunAltIf := mstunAlt.Attach("eth0", inet)
+			natWAN := nat.Attach("wan", inet)
+			natLAN := nat.Attach("lan", lan)
+			m.Attach("eth0", lan)
+			lan.SetDefaultGateway(natLAN)
+			nat.PacketHandler = &natlab.SNAT44{
+				Machine:           nat,
+				ExternalInterface: natWAN,
+				Type:              tt.nat,
+				Firewall: &natlab.Firewall{
+					TrustedInterface: natLAN,
+					Type:             tt.fw,
+				},
+			}
+
+			var altLn nettype.PacketListener
+			if !tt.portOnly {
+				altLn = mstunAlt
+			}
+			stunAddr, cleanup := stuntest.ServeRFC5780(t, mstun, stunIf.V4(), altLn, stunAltIf.V4())
+			defer cleanup()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			pc, err := m.ListenPacket(ctx, "udp4", ":0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			c := &Client{
+				Logf:                t.Logf,
+				SkipExternalNetwork: true,
+				SendPacket:          pc.(nettype.PacketConn).WriteToUDPAddrPort,
+			}
+			go func() {
+				var buf [64 << 10]byte
+				for {
+					n, src, err := pc.(nettype.PacketConn).ReadFromUDPAddrPort(buf[:])
+					if err != nil {
+						return
+					}
+					c.ReceiveSTUNPacket(buf[:n], src)
+				}
+			}()
+
+			r, err := c.GetReport(ctx, stuntest.DERPMapOf(stunAddr.String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.NATMapping != tt.wantMapping {
+				t.Errorf("NATMapping = %q; want %q", r.NATMapping, tt.wantMapping)
+			}
+			if r.NATFiltering != tt.wantFiltering {
+				t.Errorf("NATFiltering = %q; want %q", r.NATFiltering, tt.wantFiltering)
+			}
+		})
+	}
+}
+
+func TestClassifyNATMapping(t *testing.T) {
+	ap := netip.MustParseAddrPort
+	tests := []struct {
+		name     string
+		mappings map[netip.AddrPort]netip.AddrPort
+		want     NATBehavior
+	}{
+		{
+			name: "one_server",
+			mappings: map[netip.AddrPort]netip.AddrPort{
+				ap("1.0.0.1:3478"): ap("9.9.9.9:1000"),
+			},
+			want: "",
+		},
+		{
+			name: "same_across_ips",
+			mappings: map[netip.AddrPort]netip.AddrPort{
+				ap("1.0.0.1:3478"): ap("9.9.9.9:1000"),
+				ap("2.0.0.1:3478"): ap("9.9.9.9:1000"),
+			},
+			want: NATEndpointIndependent,
+		},
+		{
+			name: "varies_by_ip_only_untested_ports",
+			mappings: map[netip.AddrPort]netip.AddrPort{
+				ap("1.0.0.1:3478"): ap("9.9.9.9:1000"),
+				ap("2.0.0.1:3478"): ap("9.9.9.9:1001"),
+			},
+			want: NATAddressDependentOrStricter,
+		},
+		{
+			name: "varies_by_ip_not_port",
+			mappings: map[netip.AddrPort]netip.AddrPort{
+				ap("1.0.0.1:3478"): ap("9.9.9.9:1000"),
+				ap("2.0.0.1:3478"): ap("9.9.9.9:1001"),
+				ap("2.0.0.1:3479"): ap("9.9.9.9:1001"),
+			},
+			want: NATAddressDependent,
+		},
+		{
+			name: "varies_by_port",
+			mappings: map[netip.AddrPort]netip.AddrPort{
+				ap("1.0.0.1:3478"): ap("9.9.9.9:1000"),
+				ap("2.0.0.1:3478"): ap("9.9.9.9:1001"),
+				ap("2.0.0.1:3479"): ap("9.9.9.9:1002"),
+			},
+			want: NATAddressAndPortDependent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyNATMapping(tt.mappings); got != tt.want {
+				t.Errorf("classifyNATMapping = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+
+	c := &Client{
+		Logf:              t.Logf,
+		testEnoughRegions: 1,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Standalone(ctx, "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	dm := stuntest.DERPMapOf(stunAddr.String())
+	r1, err := c.GetReport(ctx, dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.NoteLinkChange()
+	r2, err := c.GetReport(ctx, dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := c.History()
+	if len(h) != 2 {
+		t.Fatalf("got %d history entries; want 2", len(h))
+	}
+	if h[0].Report != r1 || h[1].Report != r2 {
+		t.Errorf("history reports don't match those returned by GetReport")
+	}
+	if !h[0].Full || h[1].Full {
+		t.Errorf("Full = %v, %v; want true, false", h[0].Full, h[1].Full)
+	}
+	if h[0].LinkChange || !h[1].LinkChange {
+		t.Errorf("LinkChange = %v, %v; want false, true", h[0].LinkChange, h[1].LinkChange)
+	}
+	if h[1].Time.Before(h[0].Time) {
+		t.Errorf("history not in order: %v, %v", h[0].Time, h[1].Time)
+	}
+
+	// The history is bounded, dropping the oldest reports.
+	start := time.Now()
+	for i := 0; i < maxHistory; i++ {
+		c.addToHistory(&Report{}, start.Add(time.Duration(i)*time.Second), false)
+	}
+	h = c.History()
+	if len(h) != maxHistory {
+		t.Fatalf("got %d history entries; want %d", len(h), maxHistory)
+	}
+	if h[0].Time != start || h[len(h)-1].Time != start.Add((maxHistory-1)*time.Second) {
+		t.Errorf("history spans %v to %v; want the most recent entries", h[0].Time, h[len(h)-1].Time)
+	}
+}
+
 func TestWorksWhenUDPBlocked(t *testing.T) {
 	blackhole, err := net.ListenPacket("udp4", "127.0.0.1:0")
 	if err != nil {
@@ -13,13 +13,19 @@
 package socks5
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/netip"
+	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"tailscale.com/types/logger"
@@ -92,6 +98,25 @@ type Server struct {
 	// Username and Password, if set, are the credential clients must provide.
 	Username string
 	Password string
+
+	// UDPIdleTimeout optionally specifies how long a UDP ASSOCIATE
+	// relay may go without a datagram in either direction before it
+	// is torn down. If zero, defaultUDPIdleTimeout is used.
+	UDPIdleTimeout time.Duration
+}
+
+// defaultUDPIdleTimeout is the default value of Server.UDPIdleTimeout.
+const defaultUDPIdleTimeout = 2 * time.Minute
+
+// maxUDPPacketSize is the largest UDP datagram we relay, including
+// the SOCKS5 UDP request header.
+const maxUDPPacketSize = 1 << 16
+
+func (s *Server) udpIdleTimeout() time.Duration {
+	if s.UDPIdleTimeout > 0 {
+		return s.UDPIdleTimeout
+	}
+	return defaultUDPIdleTimeout
 }
 
 func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -177,14 +202,22 @@ func (c *Conn) handleRequest() error {
 		c.clientConn.Write(buf)
 		return err
 	}
-	if req.command != connect {
+	c.request = req
+
+	switch req.command {
+	case connect:
+		return c.handleTCP()
+	case udpAssociate:
+		return c.handleUDP()
+	default:
 		res := &response{reply: commandNotSupported}
 		buf, _ := res.marshal()
 		c.clientConn.Write(buf)
 		return fmt.Errorf("unsupported command %v", req.command)
 	}
-	c.request = req
+}
 
+func (c *Conn) handleTCP() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	srv, err := c.srv.dial(
@@ -205,19 +238,9 @@ func (c *Conn) handleRequest() error {
 	}
 	serverPort, _ := strconv.Atoi(serverPortStr)
 
-	var bindAddrType addrType
-	if ip := net.ParseIP(serverAddr); ip != nil {
-		if ip.To4() != nil {
-			bindAddrType = ipv4
-		} else {
-			bindAddrType = ipv6
-		}
-	} else {
-		bindAddrType = domainName
-	}
 	res := &response{
 		reply:        success,
-		bindAddrType: bindAddrType,
+		bindAddrType: addrTypeOf(serverAddr),
 		bindAddr:     serverAddr,
 		bindPort:     uint16(serverPort),
 	}
@@ -246,6 +269,229 @@ func (c *Conn) handleRequest() error {
 	return <-errc
 }
 
+// handleUDP handles a UDP ASSOCIATE request as described in RFC 1928,
+// section 7. It opens a UDP relay socket on the same local address
+// that the client used to reach us over TCP, tells the client about it,
+// and then relays datagrams between the client and the destinations
+// named in each datagram's header until either the TCP control
+// connection is closed or the association is idle for too long.
+func (c *Conn) handleUDP() error {
+	localAddr, err := netip.ParseAddrPort(c.clientConn.LocalAddr().String())
+	if err != nil {
+		res := &response{reply: generalFailure}
+		buf, _ := res.marshal()
+		c.clientConn.Write(buf)
+		return fmt.Errorf("unable to determine local address for UDP relay: %w", err)
+	}
+	clientUDPConn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(localAddr.Addr().Unmap(), 0)))
+	if err != nil {
+		res := &response{reply: generalFailure}
+		buf, _ := res.marshal()
+		c.clientConn.Write(buf)
+		return err
+	}
+	defer clientUDPConn.Close()
+
+	bindAddr := clientUDPConn.LocalAddr().(*net.UDPAddr).AddrPort()
+	res := &response{
+		reply:        success,
+		bindAddrType: addrTypeOf(bindAddr.Addr().String()),
+		bindAddr:     bindAddr.Addr().String(),
+		bindPort:     bindAddr.Port(),
+	}
+	buf, err := res.marshal()
+	if err != nil {
+		res = &response{reply: generalFailure}
+		buf, _ = res.marshal()
+		c.clientConn.Write(buf)
+		return err
+	}
+	c.clientConn.Write(buf)
+
+	a := &udpAssociation{
+		srv:        c.srv,
+		clientConn: clientUDPConn,
+		targets:    make(map[string]net.Conn),
+	}
+	if remote, err := netip.ParseAddrPort(c.clientConn.RemoteAddr().String()); err == nil {
+		a.clientIP = remote.Addr().Unmap()
+	}
+	a.clientPort = c.request.port
+	defer a.close()
+
+	// The association terminates when the TCP connection that the
+	// UDP ASSOCIATE request arrived on terminates.
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(io.Discard, c.clientConn)
+		errc <- err
+	}()
+	go func() {
+		errc <- a.run()
+	}()
+	err = <-errc
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return err
+}
+
+// udpAssociation is the state of a single UDP ASSOCIATE relay.
+type udpAssociation struct {
+	srv        *Server
+	clientConn *net.UDPConn // relay socket the client sends to
+
+	// clientIP and clientPort restrict which source address we
+	// accept datagrams from. clientIP is the address of the TCP
+	// control connection's peer; clientPort is the port the client
+	// said it would send from, or zero if it didn't know.
+	clientIP   netip.Addr
+	clientPort uint16
+
+	lastActive atomic.Int64 // unix nanos of last datagram in either direction
+
+	mu         sync.Mutex
+	clientAddr netip.AddrPort      // set on first datagram from the client
+	targets    map[string]net.Conn // keyed by "host:port" destination
+	closed     bool
+}
+
+// run reads datagrams from the client and forwards them to their
+// destinations. It returns when the relay socket is closed or the
+// association has been idle for longer than the server's
+// UDP idle timeout.
+func (a *udpAssociation) run() error {
+	idle := a.srv.udpIdleTimeout()
+	a.touch()
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		a.clientConn.SetReadDeadline(time.Now().Add(idle))
+		n, src, err := a.clientConn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if time.Since(time.Unix(0, a.lastActive.Load())) >= idle {
+					return fmt.Errorf("UDP association idle for %v", idle)
+				}
+				continue
+			}
+			return err
+		}
+		if !a.acceptFrom(src) {
+			continue
+		}
+		req, data, err := parseUDPRequest(buf[:n])
+		if err != nil {
+			a.srv.logf("dropping UDP datagram from %v: %v", src, err)
+			continue
+		}
+		if req.frag != 0 {
+			// Fragmentation is optional per RFC 1928, section 7.
+			// We don't implement reassembly, so drop fragments.
+			continue
+		}
+		a.touch()
+		target, err := a.targetConn(req)
+		if err != nil {
+			a.srv.logf("UDP dial to %v:%v failed: %v", req.addr.addr, req.addr.port, err)
+			continue
+		}
+		if _, err := target.Write(data); err != nil {
+			a.srv.logf("UDP write to %v:%v failed: %v", req.addr.addr, req.addr.port, err)
+		}
+	}
+}
+
+func (a *udpAssociation) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+// acceptFrom reports whether a datagram from src belongs to this
+// association. The first acceptable source address is remembered and
+// replies are sent there.
+func (a *udpAssociation) acceptFrom(src netip.AddrPort) bool {
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.clientAddr.IsValid() {
+		return src == a.clientAddr
+	}
+	if a.clientIP.IsValid() && src.Addr() != a.clientIP {
+		return false
+	}
+	if a.clientPort != 0 && src.Port() != a.clientPort {
+		return false
+	}
+	a.clientAddr = src
+	return true
+}
+
+// targetConn returns the connection to use for datagrams destined to
+// req's address, dialing it with the server's Dialer if needed.
+func (a *udpAssociation) targetConn(req *udpRequest) (net.Conn, error) {
+	hostPort := net.JoinHostPort(req.addr.addr, strconv.Itoa(int(req.addr.port)))
+	a.mu.Lock()
+	if c, ok := a.targets[hostPort]; ok {
+		a.mu.Unlock()
+		return c, nil
+	}
+	a.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := a.srv.dial(ctx, "udp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		c.Close()
+		return nil, net.ErrClosed
+	}
+	a.targets[hostPort] = c
+	go a.relayFromTarget(c, req.addr)
+	return c, nil
+}
+
+// relayFromTarget copies datagrams arriving on target back to the
+// client, prefixed with the UDP request header naming addr as their
+// source.
+func (a *udpAssociation) relayFromTarget(target net.Conn, addr socksAddr) {
+	hdr, err := (&udpRequest{addr: addr}).marshal()
+	if err != nil {
+		a.srv.logf("UDP reply header for %v: %v", addr.addr, err)
+		return
+	}
+	buf := make([]byte, maxUDPPacketSize)
+	copy(buf, hdr)
+	for {
+		n, err := target.Read(buf[len(hdr):])
+		if err != nil {
+			return
+		}
+		a.touch()
+		a.mu.Lock()
+		dst := a.clientAddr
+		a.mu.Unlock()
+		if _, err := a.clientConn.WriteToUDPAddrPort(buf[:len(hdr)+n], dst); err != nil {
+			return
+		}
+	}
+}
+
+// close closes all the association's target connections.
+func (a *udpAssociation) close() {
+	a.clientConn.Close()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	for k, c := range a.targets {
+		c.Close()
+		delete(a.targets, k)
+	}
+}
+
 // parseClientGreeting parses a request initiation packet.
 func parseClientGreeting(r io.Reader, authMethod byte) error {
 	var hdr [2]byte
@@ -315,52 +561,138 @@ func parseClientRequest(r io.Reader) (*request, error) {
 	cmd := hdr[1]
 	destAddrType := addrType(hdr[3])
 
-	var destination string
-	var port uint16
+	addr, err := parseAddr(r, destAddrType)
+	if err != nil {
+		return nil, err
+	}
+	return &request{
+		command:      commandType(cmd),
+		destination:  addr.addr,
+		port:         addr.port,
+		destAddrType: destAddrType,
+	}, nil
+}
+
+// socksAddr is an address as encoded in SOCKS5 requests, replies
+// and UDP datagram headers: an address type, the address itself,
+// and a port.
+type socksAddr struct {
+	addrType addrType
+	addr     string
+	port     uint16
+}
+
+// addrTypeOf returns the SOCKS5 address type to use to encode addr.
+func addrTypeOf(addr string) addrType {
+	if ip := net.ParseIP(addr); ip != nil {
+		if ip.To4() != nil {
+			return ipv4
+		}
+		return ipv6
+	}
+	return domainName
+}
 
-	if destAddrType == ipv4 {
+// parseAddr reads an address of type typ followed by a port from r.
+func parseAddr(r io.Reader, typ addrType) (socksAddr, error) {
+	var addr string
+	switch typ {
+	case ipv4:
 		var ip [4]byte
-		_, err = io.ReadFull(r, ip[:])
-		if err != nil {
-			return nil, fmt.Errorf("could not read IPv4 address")
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return socksAddr{}, fmt.Errorf("could not read IPv4 address")
 		}
-		destination = net.IP(ip[:]).String()
-	} else if destAddrType == domainName {
+		addr = net.IP(ip[:]).String()
+	case domainName:
 		var dstSizeByte [1]byte
-		_, err = io.ReadFull(r, dstSizeByte[:])
-		if err != nil {
-			return nil, fmt.Errorf("could not read domain name size")
+		if _, err := io.ReadFull(r, dstSizeByte[:]); err != nil {
+			return socksAddr{}, fmt.Errorf("could not read domain name size")
 		}
 		dstSize := int(dstSizeByte[0])
 		domainName := make([]byte, dstSize)
-		_, err = io.ReadFull(r, domainName)
-		if err != nil {
-			return nil, fmt.Errorf("could not read domain name")
+		if _, err := io.ReadFull(r, domainName); err != nil {
+			return socksAddr{}, fmt.Errorf("could not read domain name")
 		}
-		destination = string(domainName)
-	} else if destAddrType == ipv6 {
+		addr = string(domainName)
+	case ipv6:
 		var ip [16]byte
-		_, err = io.ReadFull(r, ip[:])
-		if err != nil {
-			return nil, fmt.Errorf("could not read IPv6 address")
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return socksAddr{}, fmt.Errorf("could not read IPv6 address")
 		}
-		destination = net.IP(ip[:]).String()
-	} else {
-		return nil, fmt.Errorf("unsupported address type")
+		addr = net.IP(ip[:]).String()
+	default:
+		return socksAddr{}, fmt.Errorf("unsupported address type")
 	}
 	var portBytes [2]byte
-	_, err = io.ReadFull(r, portBytes[:])
+	if _, err := io.ReadFull(r, portBytes[:]); err != nil {
+		return socksAddr{}, fmt.Errorf("could not read port")
+	}
+	return socksAddr{
+		addrType: typ,
+		addr:     addr,
+		port:     binary.BigEndian.Uint16(portBytes[:]),
+	}, nil
+}
+
+// appendTo appends the address and port to b, without the
+// leading address type byte.
+func (a socksAddr) appendTo(b []byte) ([]byte, error) {
+	switch a.addrType {
+	case ipv4:
+		ip := net.ParseIP(a.addr).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", a.addr)
+		}
+		b = append(b, ip...)
+	case domainName:
+		if len(a.addr) > 255 {
+			return nil, fmt.Errorf("invalid domain name %q", a.addr)
+		}
+		b = append(b, byte(len(a.addr)))
+		b = append(b, a.addr...)
+	case ipv6:
+		ip := net.ParseIP(a.addr).To16()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", a.addr)
+		}
+		b = append(b, ip...)
+	default:
+		return nil, fmt.Errorf("unsupported address type")
+	}
+	return binary.BigEndian.AppendUint16(b, a.port), nil
+}
+
+// udpRequest is the header that prefixes every datagram relayed
+// through a UDP ASSOCIATE relay, as described in RFC 1928, section 7.
+type udpRequest struct {
+	frag byte
+	addr socksAddr
+}
+
+// parseUDPRequest parses the UDP request header at the start of
+// pkt, returning the header and the remaining payload.
+func parseUDPRequest(pkt []byte) (*udpRequest, []byte, error) {
+	if len(pkt) < 4 {
+		return nil, nil, fmt.Errorf("short UDP request header")
+	}
+	if pkt[0] != 0 || pkt[1] != 0 {
+		return nil, nil, fmt.Errorf("invalid UDP request reserved bytes")
+	}
+	r := bytes.NewReader(pkt[4:])
+	addr, err := parseAddr(r, addrType(pkt[3]))
 	if err != nil {
-		return nil, fmt.Errorf("could not read port")
+		return nil, nil, err
 	}
-	port = binary.BigEndian.Uint16(portBytes[:])
+	data := pkt[len(pkt)-r.Len():]
+	return &udpRequest{frag: pkt[2], addr: addr}, data, nil
+}
 
-	return &request{
-		command:      commandType(cmd),
-		destination:  destination,
-		port:         port,
-		destAddrType: destAddrType,
-	}, nil
+// marshal returns the wire encoding of the UDP request header.
+func (u *udpRequest) marshal() ([]byte, error) {
+	pkt := make([]byte, 4, 4+1+255+2)
+	pkt[2] = u.frag
+	pkt[3] = byte(u.addr.addrType)
+	return u.addr.appendTo(pkt)
 }
 
 // response contains the contents of
@@ -387,31 +719,14 @@ func (res *response) marshal() ([]byte, error) {
 		return pkt, nil
 	}
 
-	var addr []byte
-	switch res.bindAddrType {
-	case ipv4:
-		addr = net.ParseIP(res.bindAddr).To4()
-		if addr == nil {
-			return nil, fmt.Errorf("invalid IPv4 address for binding")
-		}
-	case domainName:
-		if len(res.bindAddr) > 255 {
-			return nil, fmt.Errorf("invalid domain name for binding")
-		}
-		addr = make([]byte, 0, len(res.bindAddr)+1)
-		addr = append(addr, byte(len(res.bindAddr)))
-		addr = append(addr, []byte(res.bindAddr)...)
-	case ipv6:
-		addr = net.ParseIP(res.bindAddr).To16()
-		if addr == nil {
-			return nil, fmt.Errorf("invalid IPv6 address for binding")
-		}
-	default:
-		return nil, fmt.Errorf("unsupported address type")
+	addr := socksAddr{
+		addrType: res.bindAddrType,
+		addr:     res.bindAddr,
+		port:     res.bindPort,
+	}
+	pkt, err := addr.appendTo(pkt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind address: %w", err)
 	}
-
-	pkt = append(pkt, addr...)
-	pkt = binary.BigEndian.AppendUint16(pkt, uint16(res.bindPort))
-
 	return pkt, nil
 }
@@ -8,7 +8,9 @@
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"testing"
+	"time"
 
 	"golang.org/x/net/proxy"
 )
@@ -152,3 +154,173 @@ func TestReadPassword(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func udpEchoServer(conn net.PacketConn) {
+	var buf [1024]byte
+	n, addr, err := conn.ReadFrom(buf[:])
+	if err != nil {
+		panic(err)
+	}
+	_, err = conn.WriteTo(buf[:n], addr)
+	if err != nil {
+		panic(err)
+	}
+	conn.Close()
+}
+
+func TestUDP(t *testing.T) {
+	// UDP echo server which we'll use SOCKS5 to reach
+	echoServer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoAddr := echoServer.LocalAddr().(*net.UDPAddr).AddrPort()
+	go udpEchoServer(echoServer)
+
+	// SOCKS5 server
+	socks5, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go socks5Server(socks5)
+
+	// Perform the handshake and UDP ASSOCIATE request by hand;
+	// golang.org/x/net/proxy only speaks CONNECT.
+	conn, err := net.Dial("tcp", socks5.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{socks5Version, 1, noAuthRequired}); err != nil {
+		t.Fatal(err)
+	}
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		t.Fatal(err)
+	}
+	if greeting != [2]byte{socks5Version, noAuthRequired} {
+		t.Fatalf("greeting = %v", greeting)
+	}
+	if _, err := conn.Write([]byte{socks5Version, byte(udpAssociate), 0, byte(ipv4), 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if replyCode(hdr[1]) != success {
+		t.Fatalf("UDP ASSOCIATE reply = %v", hdr[1])
+	}
+	relay, err := parseAddr(conn, addrType(hdr[3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udpConn, err := net.Dial("udp", net.JoinHostPort(relay.addr, strconv.Itoa(int(relay.port))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	req := &udpRequest{addr: socksAddr{
+		addrType: ipv4,
+		addr:     echoAddr.Addr().String(),
+		port:     echoAddr.Port(),
+	}}
+	pkt, err := req.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := udpConn.Write(append(pkt, "Test"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, data, err := parseUDPRequest(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.addr != req.addr {
+		t.Errorf("reply source = %+v; want %+v", res.addr, req.addr)
+	}
+	if string(data) != "Test" {
+		t.Fatalf("got: %q want: Test", data)
+	}
+}
+
+func TestParseUDPRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		pkt      []byte
+		wantErr  bool
+		wantFrag byte
+		wantAddr socksAddr
+		wantData string
+	}{
+		{
+			name:     "ipv4",
+			pkt:      []byte{0, 0, 0, byte(ipv4), 100, 64, 0, 1, 0, 53, 'h', 'i'},
+			wantAddr: socksAddr{addrType: ipv4, addr: "100.64.0.1", port: 53},
+			wantData: "hi",
+		},
+		{
+			name:     "domain",
+			pkt:      append([]byte{0, 0, 0, byte(domainName), 3, 'f', 'o', 'o', 1, 187}, "data"...),
+			wantAddr: socksAddr{addrType: domainName, addr: "foo", port: 443},
+			wantData: "data",
+		},
+		{
+			name:     "fragment",
+			pkt:      []byte{0, 0, 1, byte(ipv4), 1, 2, 3, 4, 0, 80},
+			wantFrag: 1,
+			wantAddr: socksAddr{addrType: ipv4, addr: "1.2.3.4", port: 80},
+		},
+		{
+			name:    "short",
+			pkt:     []byte{0, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "bad-reserved",
+			pkt:     []byte{0, 1, 0, byte(ipv4), 1, 2, 3, 4, 0, 80},
+			wantErr: true,
+		},
+		{
+			name:    "truncated-addr",
+			pkt:     []byte{0, 0, 0, byte(ipv6), 1, 2, 3, 4},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, data, err := parseUDPRequest(tt.pkt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if req.frag != tt.wantFrag {
+				t.Errorf("frag = %v; want %v", req.frag, tt.wantFrag)
+			}
+			if req.addr != tt.wantAddr {
+				t.Errorf("addr = %+v; want %+v", req.addr, tt.wantAddr)
+			}
+			if string(data) != tt.wantData {
+				t.Errorf("data = %q; want %q", data, tt.wantData)
+			}
+			back, err := req.marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := append(back, data...); string(got) != string(tt.pkt) {
+				t.Errorf("round trip = %v; want %v", got, tt.pkt)
+			}
+		})
+	}
+}
@@ -51,6 +51,7 @@ type SockStat struct {
 	LabelMagicsockConnUDP6   Label = 9  // wgengine/magicsock/magicsock.go
 	LabelNetlogLogger        Label = 10 // wgengine/netlog/logger.go
 	LabelSockstatlogLogger   Label = 11 // log/sockstatlog/logger.go
+	LabelDNSForwarderDoT     Label = 12 // net/dns/resolver/dot.go
 )
 
 // WithSockStats instruments a context so that sockets created with it will
@@ -18,19 +18,26 @@ func RunClient(direction Direction, duration time.Duration, host string) ([]Resu
 	if err != nil {
 		return nil, err
 	}
+	return RunClientConn(conn, direction, duration)
+}
 
+// RunClientConn runs a speedtest over conn, which must be connected to a
+// speedtest server, and closes conn when done.
+// It returns any errors that come up in the tests.
+// If there are no errors in the test, it returns a slice of results.
+func RunClientConn(conn net.Conn, direction Direction, duration time.Duration) ([]Result, error) {
 	conf := config{TestDuration: duration, Version: version, Direction: direction}
 
 	defer conn.Close()
 	encoder := json.NewEncoder(conn)
 
-	if err = encoder.Encode(conf); err != nil {
+	if err := encoder.Encode(conf); err != nil {
 		return nil, err
 	}
 
 	var response configResponse
 	decoder := json.NewDecoder(conn)
-	if err = decoder.Decode(&response); err != nil {
+	if err := decoder.Decode(&response); err != nil {
 		return nil, err
 	}
 	if response.Error != "" {
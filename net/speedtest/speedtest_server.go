@@ -26,19 +26,23 @@ func Serve(l net.Listener) error {
 		if err != nil {
 			return err
 		}
-		err = handleConnection(conn)
+		err = ServeConn(conn)
 		if err != nil {
 			return err
 		}
 	}
 }
 
-// handleConnection handles the initial exchange between the server and the client.
+// ServeConn runs the server side of a single speedtest on conn, which it
+// closes when done. It's used by Serve, and by servers that accept
+// speedtest connections through other means, like the peerAPI.
+//
+// It handles the initial exchange between the server and the client.
 // It reads the testconfig message into a config struct. If any errors occur with
 // the testconfig (specifically, if there is a version mismatch), it will return those
 // errors to the client with a configResponse. After the exchange, it will start
 // the speed test.
-func handleConnection(conn net.Conn) error {
+func ServeConn(conn net.Conn) error {
 	defer conn.Close()
 	var conf config
 
@@ -61,6 +65,12 @@ func handleConnection(conn net.Conn) error {
 		return err
 	}
 
+	if conf.TestDuration < MinDuration || conf.TestDuration > MaxDuration {
+		err = fmt.Errorf("test duration %v out of range; must be between %v and %v", conf.TestDuration, MinDuration, MaxDuration)
+		encoder.Encode(configResponse{Error: err.Error()})
+		return err
+	}
+
 	// Start the test
 	encoder.Encode(configResponse{})
 	_, err = doTest(conn, conf)
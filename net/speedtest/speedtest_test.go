@@ -81,3 +81,35 @@ type state struct {
 		t.Error("server error:", err)
 	}
 }
+
+func TestRunClientConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- ServeConn(c2) }()
+
+	results, err := RunClientConn(c1, Upload, MinDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || !results[len(results)-1].Total {
+		t.Errorf("got %d results; want per-interval results and a total", len(results))
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("server error: %v", err)
+	}
+}
+
+func TestServeConnBadDuration(t *testing.T) {
+	for _, d := range []time.Duration{time.Second, MaxDuration + time.Second} {
+		c1, c2 := net.Pipe()
+		errc := make(chan error, 1)
+		go func() { errc <- ServeConn(c2) }()
+
+		if _, err := RunClientConn(c1, Download, d); err == nil {
+			t.Errorf("duration %v: client unexpectedly succeeded", d)
+		}
+		if err := <-errc; err == nil {
+			t.Errorf("duration %v: server unexpectedly succeeded", d)
+		}
+	}
+}
@@ -25,6 +25,8 @@
 	// like an easy mistake for a server to make.
 	// And servers appear to send it.
 	attrXorMappedAddressAlt = 0x8020
+	attrChangeRequest       = 0x0003 // RFC 5780 Section 7.2
+	attrOtherAddress        = 0x802c // RFC 5780 Section 7.4
 
 	software       = "tailnode" // notably: 8 bytes long, so no padding
 	bindingRequest = "\x00\x01"
@@ -48,11 +50,42 @@ func NewTxID() TxID {
 // Request generates a binding request STUN packet.
 // The transaction ID, tID, should be a random sequence of bytes.
 func Request(tID TxID) []byte {
+	return request(tID, nil)
+}
+
+// RequestChange generates a binding request STUN packet with an RFC 5780
+// CHANGE-REQUEST attribute, asking the server to send its response from
+// its alternate IP address, its alternate port, or both. Servers that
+// don't support RFC 5780 respond from the address the request was sent to.
+func RequestChange(tID TxID, changeIP, changePort bool) []byte {
+	var flags uint32
+	if changeIP {
+		flags |= changeIPFlag
+	}
+	if changePort {
+		flags |= changePortFlag
+	}
+	// Attribute CHANGE-REQUEST, RFC5780 Section 7.2.
+	attr := appendU16(nil, attrChangeRequest)
+	attr = appendU16(attr, 4)
+	attr = appendU32(attr, flags)
+	return request(tID, attr)
+}
+
+// Flags of the CHANGE-REQUEST attribute, RFC5780 Section 7.2.
+const (
+	changeIPFlag   = 0x4
+	changePortFlag = 0x2
+)
+
+// request generates a binding request STUN packet, including the encoded
+// attributes attrs between the SOFTWARE and FINGERPRINT attributes.
+func request(tID TxID, attrs []byte) []byte {
 	// STUN header, RFC5389 Section 6.
 	const lenAttrSoftware = 4 + len(software)
-	b := make([]byte, 0, headerLen+lenAttrSoftware+lenFingerprint)
+	b := make([]byte, 0, headerLen+lenAttrSoftware+len(attrs)+lenFingerprint)
 	b = append(b, bindingRequest...)
-	b = appendU16(b, uint16(lenAttrSoftware+lenFingerprint)) // number of bytes following header
+	b = appendU16(b, uint16(lenAttrSoftware+len(attrs)+lenFingerprint)) // number of bytes following header
 	b = append(b, magicCookie...)
 	b = append(b, tID[:]...)
 
@@ -61,6 +94,8 @@ func Request(tID TxID) []byte {
 	b = appendU16(b, uint16(len(software)))
 	b = append(b, software...)
 
+	b = append(b, attrs...)
+
 	// Attribute FINGERPRINT, RFC5389 Section 15.5.
 	fp := fingerPrint(b)
 	b = appendU16(b, attrNumFingerprint)
@@ -121,6 +156,25 @@ func ParseBindingRequest(b []byte) (TxID, error) {
 	return txID, nil
 }
 
+// ParseChangeRequest returns the flags of the RFC 5780 CHANGE-REQUEST
+// attribute of the binding request b, which should already have been
+// validated by ParseBindingRequest. Both are false if b has no such
+// attribute.
+func ParseChangeRequest(b []byte) (changeIP, changePort bool) {
+	if len(b) < headerLen {
+		return false, false
+	}
+	foreachAttr(b[headerLen:], func(attrType uint16, a []byte) error {
+		if attrType == attrChangeRequest && len(a) == 4 {
+			flags := binary.BigEndian.Uint32(a)
+			changeIP = flags&changeIPFlag != 0
+			changePort = flags&changePortFlag != 0
+		}
+		return nil
+	})
+	return changeIP, changePort
+}
+
 var (
 	ErrNotSTUN            = errors.New("response is not a STUN packet")
 	ErrNotSuccessResponse = errors.New("STUN packet is not a response")
@@ -190,6 +244,37 @@ func Response(txID TxID, addrPort netip.AddrPort) []byte {
 	return b
 }
 
+// ResponseWithOtherAddress generates a binding response like Response,
+// also including an RFC 5780 OTHER-ADDRESS attribute advertising other,
+// the server's alternate IP address and port.
+func ResponseWithOtherAddress(txID TxID, addrPort, other netip.AddrPort) []byte {
+	b := Response(txID, addrPort)
+	if b == nil {
+		return nil
+	}
+	otherAddr := other.Addr()
+	var fam byte
+	if otherAddr.Is4() {
+		fam = 1
+	} else if otherAddr.Is6() {
+		fam = 2
+	} else {
+		return nil
+	}
+
+	// Attribute OTHER-ADDRESS, RFC5780 Section 7.4, which has the
+	// format of MAPPED-ADDRESS.
+	b = appendU16(b, attrOtherAddress)
+	b = appendU16(b, uint16(4+otherAddr.BitLen()/8))
+	b = append(b,
+		0, // unused byte
+		fam)
+	b = appendU16(b, other.Port())
+	b = append(b, otherAddr.AsSlice()...)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerLen))
+	return b
+}
+
 // ParseResponse parses a successful binding response STUN packet.
 // The IP address is extracted from the XOR-MAPPED-ADDRESS attribute.
 func ParseResponse(b []byte) (tID TxID, addr netip.AddrPort, err error) {
@@ -249,6 +334,36 @@ func ParseResponse(b []byte) (tID TxID, addr netip.AddrPort, err error) {
 	return tID, netip.AddrPort{}, ErrMalformedAttrs
 }
 
+// ParseOtherAddress returns the address from the RFC 5780 OTHER-ADDRESS
+// attribute of the successful binding response b, which servers supporting
+// RFC 5780 include to advertise their alternate IP address and port. It
+// returns the zero value if b has no such attribute.
+func ParseOtherAddress(b []byte) netip.AddrPort {
+	if !Is(b) || b[0] != 0x01 || b[1] != 0x01 {
+		return netip.AddrPort{}
+	}
+	attrsLen := int(binary.BigEndian.Uint16(b[2:4]))
+	b = b[headerLen:]
+	if attrsLen > len(b) {
+		return netip.AddrPort{}
+	}
+	var other netip.AddrPort
+	foreachAttr(b[:attrsLen], func(attrType uint16, attr []byte) error {
+		if attrType != attrOtherAddress {
+			return nil
+		}
+		ipSlice, port, err := mappedAddress(attr)
+		if err != nil {
+			return err
+		}
+		if ip, ok := netip.AddrFromSlice(ipSlice); ok {
+			other = netip.AddrPortFrom(ip.Unmap(), port)
+		}
+		return nil
+	})
+	return other
+}
+
 func xorMappedAddress(tID TxID, b []byte) (addr []byte, port uint16, err error) {
 	// XOR-MAPPED-ADDRESS attribute, RFC5389 Section 15.2
 	if len(b) < 4 {
@@ -283,3 +283,49 @@ func TestResponse(t *testing.T) {
 		}
 	}
 }
+
+func TestRequestChange(t *testing.T) {
+	for _, tt := range []struct{ changeIP, changePort bool }{
+		{false, false},
+		{true, false},
+		{false, true},
+		{true, true},
+	} {
+		tx := stun.NewTxID()
+		req := stun.RequestChange(tx, tt.changeIP, tt.changePort)
+		gotTx, err := stun.ParseBindingRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotTx != tx {
+			t.Errorf("original txID %q != got txID %q", tx, gotTx)
+		}
+		changeIP, changePort := stun.ParseChangeRequest(req)
+		if changeIP != tt.changeIP || changePort != tt.changePort {
+			t.Errorf("ParseChangeRequest = %v, %v; want %v, %v", changeIP, changePort, tt.changeIP, tt.changePort)
+		}
+	}
+	if changeIP, changePort := stun.ParseChangeRequest(stun.Request(stun.NewTxID())); changeIP || changePort {
+		t.Errorf("ParseChangeRequest of plain request = %v, %v; want false, false", changeIP, changePort)
+	}
+}
+
+func TestResponseWithOtherAddress(t *testing.T) {
+	tx := stun.NewTxID()
+	addr := netip.MustParseAddrPort("1.2.3.4:254")
+	other := netip.MustParseAddrPort("5.6.7.8:3479")
+	res := stun.ResponseWithOtherAddress(tx, addr, other)
+	tx2, addr2, err := stun.ParseResponse(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx2 != tx || addr2 != addr {
+		t.Errorf("ParseResponse = %x, %v; want %x, %v", tx2, addr2, tx, addr)
+	}
+	if got := stun.ParseOtherAddress(res); got != other {
+		t.Errorf("ParseOtherAddress = %v; want %v", got, other)
+	}
+	if got := stun.ParseOtherAddress(stun.Response(tx, addr)); got.IsValid() {
+		t.Errorf("ParseOtherAddress of plain response = %v; want none", got)
+	}
+}
@@ -90,6 +90,102 @@ func runSTUN(t testing.TB, pc nettype.PacketConn, stats *stunStats, done chan<-
 	}
 }
 
+// ServeRFC5780 starts a STUN server that supports the RFC 5780
+// CHANGE-REQUEST and OTHER-ADDRESS attributes used to classify NAT
+// behavior. It listens on two ports of each of ip, using ln, and altIP,
+// using altLn, which may be the same listener as ln. It returns its
+// primary address: ip on the first port.
+//
+// If altLn is nil, the server only listens on ip and, like cmd/derper,
+// advertises its alternate port with the unspecified IP in OTHER-ADDRESS
+// and ignores requests to change IP.
+func ServeRFC5780(t testing.TB, ln nettype.PacketListener, ip netip.Addr, altLn nettype.PacketListener, altIP netip.Addr) (addr netip.AddrPort, cleanupFn func()) {
+	t.Helper()
+
+	// pcs and addrs are indexed by IP (ip, altIP) and then by port.
+	var pcs [2][2]nettype.PacketConn
+	var addrs [2][2]netip.AddrPort
+	var cleanups []func()
+	cleanup := func() {
+		for _, fn := range cleanups {
+			fn()
+		}
+	}
+	ips := []netip.Addr{ip, altIP}
+	if altLn == nil {
+		ips = ips[:1]
+	}
+	for j := 0; j < 2; j++ {
+		for i, a := range ips {
+			ln := ln
+			var port uint16 // the first listener of each port picks it
+			if i > 0 {
+				ln, port = altLn, addrs[0][j].Port()
+			}
+			pc, err := ln.ListenPacket(context.Background(), "udp4", netip.AddrPortFrom(a, port).String())
+			if err != nil {
+				cleanup()
+				t.Fatalf("failed to open STUN listener: %v", err)
+			}
+			pcs[i][j] = pc.(nettype.PacketConn)
+			addrs[i][j] = netip.AddrPortFrom(a, uint16(pc.LocalAddr().(*net.UDPAddr).Port))
+		}
+	}
+	for i := range ips {
+		for j := 0; j < 2; j++ {
+			pc, doneCh := pcs[i][j], make(chan struct{})
+			go runRFC5780(t, pcs, addrs, i, j, doneCh)
+			cleanups = append(cleanups, func() {
+				pc.Close()
+				<-doneCh
+			})
+		}
+	}
+	return addrs[0][0], cleanup
+}
+
+// runRFC5780 serves STUN requests received by pcs[i][j], responding from
+// the socket selected by each request's CHANGE-REQUEST attribute.
+func runRFC5780(t testing.TB, pcs [2][2]nettype.PacketConn, addrs [2][2]netip.AddrPort, i, j int, done chan<- struct{}) {
+	defer close(done)
+
+	var buf [64 << 10]byte
+	for {
+		n, src, err := pcs[i][j].ReadFromUDPAddrPort(buf[:])
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		src = netaddr.Unmap(src)
+		pkt := buf[:n]
+		txid, err := stun.ParseBindingRequest(pkt)
+		if err != nil {
+			continue
+		}
+		ri, rj := i, j
+		changeIP, changePort := stun.ParseChangeRequest(pkt)
+		if changeIP {
+			if pcs[1-i][j] == nil {
+				continue
+			}
+			ri = 1 - i
+		}
+		if changePort {
+			rj = 1 - j
+		}
+		other := addrs[1-i][1-j]
+		if pcs[1-i][1-j] == nil {
+			other = netip.AddrPortFrom(netip.IPv4Unspecified(), addrs[i][1-j].Port())
+		}
+		res := stun.ResponseWithOtherAddress(txid, src, other)
+		if _, err := pcs[ri][rj].WriteToUDPAddrPort(res, src); err != nil && !errors.Is(err, net.ErrClosed) {
+			t.Logf("STUN server write failed: %v", err)
+		}
+	}
+}
+
 func DERPMapOf(stun ...string) *tailcfg.DERPMap {
 	m := &tailcfg.DERPMap{
 		Regions: map[int]*tailcfg.DERPRegion{},
@@ -111,7 +111,8 @@
 //   - 70: 2023-08-16: removed most Debug fields; added NodeAttrDisable*, NodeAttrDebug* instead
 //   - 71: 2023-08-17: added NodeAttrOneCGNATEnable, NodeAttrOneCGNATDisable
 //   - 72: 2023-08-23: TS-2023-006 UPnP issue fixed; UPnP can now be used again
-const CurrentCapabilityVersion CapabilityVersion = 72
+//   - 73: 2023-09-05: Client serves CNAME, TXT, SRV and MX DNSConfig.ExtraRecords
+const CurrentCapabilityVersion CapabilityVersion = 73
 
 type StableID string
 
@@ -699,6 +700,19 @@ type NetInfo struct {
 	// It reports true even if there's no NAT involved.
 	HairPinning opt.Bool
 
+	// NATMapping is how the host's NAT picks its public IPv4 ip:port
+	// for each destination: "endpoint-independent",
+	// "address-dependent" or "address-and-port-dependent", per RFC
+	// 4787, or "address-dependent-or-stricter" if it's only known to
+	// depend on the destination IP. Empty means unknown.
+	NATMapping string `json:",omitempty"`
+
+	// NATFiltering is how the host's NAT or firewall filters incoming
+	// IPv4 packets, with the same values as NATMapping, or
+	// "address-dependent-or-looser" if it's only known not to depend on
+	// the source port. Empty means unknown.
+	NATFiltering string `json:",omitempty"`
+
 	// WorkingIPv6 is whether the host has IPv6 internet connectivity.
 	WorkingIPv6 opt.Bool
 
@@ -766,9 +780,9 @@ func (ni *NetInfo) String() string {
 	if ni == nil {
 		return "NetInfo(nil)"
 	}
-	return fmt.Sprintf("NetInfo{varies=%v hairpin=%v ipv6=%v ipv6os=%v udp=%v icmpv4=%v derp=#%v portmap=%v link=%q firewallmode=%q}",
-		ni.MappingVariesByDestIP, ni.HairPinning, ni.WorkingIPv6,
-		ni.OSHasIPv6, ni.WorkingUDP, ni.WorkingICMPv4,
+	return fmt.Sprintf("NetInfo{varies=%v hairpin=%v natmap=%q natfilter=%q ipv6=%v ipv6os=%v udp=%v icmpv4=%v derp=#%v portmap=%v link=%q firewallmode=%q}",
+		ni.MappingVariesByDestIP, ni.HairPinning, ni.NATMapping, ni.NATFiltering,
+		ni.WorkingIPv6, ni.OSHasIPv6, ni.WorkingUDP, ni.WorkingICMPv4,
 		ni.PreferredDERP, ni.portMapSummary(), ni.LinkType, ni.FirewallMode)
 }
 
@@ -808,6 +822,8 @@ func (ni *NetInfo) BasicallyEqual(ni2 *NetInfo) bool {
 	}
 	return ni.MappingVariesByDestIP == ni2.MappingVariesByDestIP &&
 		ni.HairPinning == ni2.HairPinning &&
+		ni.NATMapping == ni2.NATMapping &&
+		ni.NATFiltering == ni2.NATFiltering &&
 		ni.WorkingIPv6 == ni2.WorkingIPv6 &&
 		ni.OSHasIPv6 == ni2.OSHasIPv6 &&
 		ni.WorkingUDP == ni2.WorkingUDP &&
@@ -1234,6 +1250,9 @@ type CapGrant struct {
 	PeerCapabilityWakeOnLAN PeerCapability = "https://tailscale.com/cap/wake-on-lan"
 	// PeerCapabilityIngress grants the ability for a peer to send ingress traffic.
 	PeerCapabilityIngress PeerCapability = "https://tailscale.com/cap/ingress"
+	// PeerCapabilitySpeedtest grants the ability for a peer to run a
+	// throughput test ("tailscale speedtest") against this node.
+	PeerCapabilitySpeedtest PeerCapability = "https://tailscale.com/cap/speedtest"
 )
 
 // PeerCapMap is a map of capabilities to their optional values. It is valid for
@@ -1419,10 +1438,19 @@ type DNSRecord struct {
 
 	// Type is the DNS record type.
 	// Empty means A or AAAA, depending on value.
-	// Other values are currently ignored.
+	// As of CapabilityVersion 73, "CNAME", "TXT", "SRV" and "MX"
+	// are also supported. Other values are currently ignored.
 	Type string `json:",omitempty"`
 
-	// Value is the IP address in string form.
+	// Value is the record's value in string form: for A and AAAA
+	// records, the IP address. For other types, it's the record's
+	// data in zone file format, without the name, TTL, class or type:
+	//
+	//	CNAME: "target.example.com"
+	//	TXT:   the text, which may be longer than 255 bytes
+	//	SRV:   "priority weight port target.example.com"
+	//	MX:    "preference mail.example.com"
+	//
 	// TODO(bradfitz): if we ever add support for record types
 	// with non-UTF8 binary data, add ValueBytes []byte that
 	// would take precedence.
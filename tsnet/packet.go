@@ -0,0 +1,233 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tsnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"tailscale.com/net/netaddr"
+	"tailscale.com/types/nettype"
+)
+
+const (
+	// packetQueueLen is the number of received datagrams a packetConn
+	// buffers before it starts dropping them.
+	packetQueueLen = 128
+
+	// packetFlowIdleTimeout is how long a flow may go without receiving a
+	// datagram before it's forgotten.
+	packetFlowIdleTimeout = 2 * time.Minute
+
+	// maxPacketSize is the largest datagram a packetConn reads without
+	// truncation.
+	maxPacketSize = 64 << 10
+)
+
+// errNoFlow is returned by packetConn.WriteTo for addresses that haven't
+// sent any datagrams to the packetConn recently.
+var errNoFlow = errors.New("no recent datagrams from address")
+
+// packetConn is the net.PacketConn returned by Server.ListenPacket.
+//
+// Netstack hands tsnet a connected socket per flow (remote IP:port) to the
+// port; packetConn reads from all of them into one queue, and routes writes
+// back to the flow for the destination address.
+type packetConn struct {
+	s     *Server
+	keys  []listenKey
+	laddr *net.UDPAddr
+
+	incoming chan packet
+	done     chan struct{} // closed by closeLocked
+
+	mu              sync.Mutex
+	closed          bool
+	flows           map[netip.AddrPort]nettype.ConnPacketConn
+	readDeadline    time.Time
+	writeDeadline   time.Time
+	deadlineChanged chan struct{} // closed and replaced when readDeadline changes
+}
+
+type packet struct {
+	b   []byte
+	src netip.AddrPort
+}
+
+func newPacketConn(s *Server, keys []listenKey, laddr *net.UDPAddr) *packetConn {
+	return &packetConn{
+		s:               s,
+		keys:            keys,
+		laddr:           laddr,
+		incoming:        make(chan packet, packetQueueLen),
+		done:            make(chan struct{}),
+		flows:           make(map[netip.AddrPort]nettype.ConnPacketConn),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+// handleFlow reads datagrams from c, a socket connected to src, into pc's
+// queue until c fails, pc is closed, or the flow is idle for
+// packetFlowIdleTimeout.
+func (pc *packetConn) handleFlow(src netip.AddrPort, c nettype.ConnPacketConn) {
+	src = netaddr.Unmap(src)
+	pc.mu.Lock()
+	if pc.closed {
+		pc.mu.Unlock()
+		c.Close()
+		return
+	}
+	if old, ok := pc.flows[src]; ok {
+		old.Close()
+	}
+	pc.flows[src] = c
+	pc.mu.Unlock()
+
+	defer func() {
+		pc.mu.Lock()
+		if pc.flows[src] == c {
+			delete(pc.flows, src)
+		}
+		pc.mu.Unlock()
+		c.Close()
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		c.SetReadDeadline(time.Now().Add(packetFlowIdleTimeout))
+		n, err := c.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case pc.incoming <- packet{bytes.Clone(buf[:n]), src}:
+		case <-pc.done:
+			return
+		default:
+			// Queue is full; drop the datagram, as the kernel would.
+		}
+	}
+}
+
+func (pc *packetConn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: pc.keys[0].network, Source: pc.laddr, Addr: addr, Err: err}
+}
+
+func (pc *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		pc.mu.Lock()
+		deadline, changed := pc.readDeadline, pc.deadlineChanged
+		pc.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, pc.opError("read", nil, os.ErrDeadlineExceeded)
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case p := <-pc.incoming:
+			if timer != nil {
+				timer.Stop()
+			}
+			return copy(b, p.b), net.UDPAddrFromAddrPort(p.src), nil
+		case <-pc.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return 0, nil, pc.opError("read", nil, net.ErrClosed)
+		case <-timeout:
+			return 0, nil, pc.opError("read", nil, os.ErrDeadlineExceeded)
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+func (pc *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, pc.opError("write", addr, fmt.Errorf("unsupported address type %T", addr))
+	}
+	dst := netaddr.Unmap(ua.AddrPort())
+
+	pc.mu.Lock()
+	closed := pc.closed
+	c, ok := pc.flows[dst]
+	deadline := pc.writeDeadline
+	pc.mu.Unlock()
+	if closed {
+		return 0, pc.opError("write", addr, net.ErrClosed)
+	}
+	if !ok {
+		return 0, pc.opError("write", addr, errNoFlow)
+	}
+	c.SetWriteDeadline(deadline)
+	return c.Write(b)
+}
+
+func (pc *packetConn) LocalAddr() net.Addr { return pc.laddr }
+
+func (pc *packetConn) SetDeadline(t time.Time) error {
+	pc.SetReadDeadline(t)
+	return pc.SetWriteDeadline(t)
+}
+
+func (pc *packetConn) SetReadDeadline(t time.Time) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.readDeadline = t
+	close(pc.deadlineChanged)
+	pc.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+func (pc *packetConn) SetWriteDeadline(t time.Time) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.writeDeadline = t
+	return nil
+}
+
+func (pc *packetConn) Close() error {
+	pc.s.mu.Lock()
+	defer pc.s.mu.Unlock()
+	return pc.closeLocked()
+}
+
+// closeLocked closes the packetConn and all its flows.
+// It must be called with pc.s.mu held.
+func (pc *packetConn) closeLocked() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return pc.opError("close", nil, net.ErrClosed)
+	}
+	pc.closed = true
+	close(pc.done)
+	for _, c := range pc.flows {
+		c.Close()
+	}
+	for _, key := range pc.keys {
+		if v, ok := pc.s.packetListeners[key]; ok && v == pc {
+			delete(pc.s.packetListeners, key)
+		}
+	}
+	return nil
+}
+
+// Server returns the tsnet Server associated with the PacketConn.
+func (pc *packetConn) Server() *Server { return pc.s }
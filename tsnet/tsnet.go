@@ -45,8 +45,10 @@
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/proxymux"
 	"tailscale.com/net/socks5"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/smallzstd"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsd"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
@@ -112,6 +114,37 @@ type Server struct {
 	// field at zero unless you know what you are doing.
 	Port uint16
 
+	// The following fields are applied to the node's preferences when the
+	// Server starts, before it first logs in. They replace any values
+	// previously saved in the Store. Invalid values cause Start (and thus
+	// Up, Listen and Dial) to fail.
+
+	// AdvertiseTags optionally specifies the ACL tags ("tag:foo") to
+	// request for the node.
+	AdvertiseTags []string
+
+	// AdvertiseRoutes optionally specifies the subnet routes to advertise
+	// to the tailnet. The prefixes must be masked (10.0.0.0/24, not
+	// 10.0.0.1/24). Incoming traffic for these routes is only forwarded
+	// by the program itself; tsnet does not route packets to the host's
+	// network.
+	AdvertiseRoutes []netip.Prefix
+
+	// AdvertiseExitNode, if true, advertises the node as an exit node.
+	AdvertiseExitNode bool
+
+	// RunSSH, if true, runs a Tailscale SSH server on the node.
+	// The program must import tailscale.com/ssh/tailssh for this to work.
+	RunSSH bool
+
+	// ShieldsUp, if true, blocks all incoming connections from the
+	// tailnet.
+	ShieldsUp bool
+
+	// AcceptRoutes, if true, accepts subnet routes advertised by other
+	// nodes.
+	AcceptRoutes bool
+
 	getCertForTesting func(*tls.ClientHelloInfo) (*tls.Certificate, error)
 
 	initOnce         sync.Once
@@ -133,10 +166,11 @@ type Server struct {
 	logtail          *logtail.Logger
 	logid            logid.PublicID
 
-	mu        sync.Mutex
-	listeners map[listenKey]*listener
-	dialer    *tsdial.Dialer
-	closed    bool
+	mu              sync.Mutex
+	listeners       map[listenKey]*listener
+	packetListeners map[listenKey]*packetConn
+	dialer          *tsdial.Dialer
+	closed          bool
 }
 
 // Dial connects to the address on the tailnet.
@@ -384,6 +418,9 @@ func (s *Server) Close() error {
 	for _, ln := range s.listeners {
 		ln.closeLocked()
 	}
+	for _, pc := range s.packetListeners {
+		pc.closeLocked()
+	}
 
 	wg.Wait()
 	s.closed = true
@@ -464,6 +501,10 @@ func (s *Server) start() (reterr error) {
 		s.hostname = prog
 	}
 
+	if err := s.checkPrefFields(); err != nil {
+		return err
+	}
+
 	s.rootPath = s.Dir
 	if s.Store != nil {
 		_, isMemStore := s.Store.(*mem.Store)
@@ -532,6 +573,9 @@ func (s *Server) start() (reterr error) {
 	s.dialer.NetstackDialTCP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
 		return ns.DialContextTCP(ctx, dst)
 	}
+	s.dialer.NetstackDialUDP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
+		return ns.DialContextUDP(ctx, dst)
+	}
 
 	if s.Store == nil {
 		stateFile := filepath.Join(s.rootPath, "tailscaled.state")
@@ -566,6 +610,7 @@ func (s *Server) start() (reterr error) {
 	prefs.Hostname = s.hostname
 	prefs.WantRunning = true
 	prefs.ControlURL = s.ControlURL
+	s.applyPrefFields(prefs)
 	authKey := s.getAuthKey()
 	err = lb.Start(ipn.Options{
 		UpdatePrefs: prefs,
@@ -603,6 +648,41 @@ func (s *Server) start() (reterr error) {
 	return nil
 }
 
+// checkPrefFields reports whether the Server fields that are applied to the
+// node's preferences are valid.
+func (s *Server) checkPrefFields() error {
+	for _, tag := range s.AdvertiseTags {
+		if err := tailcfg.CheckTag(tag); err != nil {
+			return fmt.Errorf("invalid tag %q in AdvertiseTags: %w", tag, err)
+		}
+	}
+	for _, r := range s.AdvertiseRoutes {
+		if !r.IsValid() {
+			return errors.New("invalid prefix in AdvertiseRoutes")
+		}
+		if r != r.Masked() {
+			return fmt.Errorf("route %v in AdvertiseRoutes has non-address bits set; expected %v", r, r.Masked())
+		}
+		if r.Bits() == 0 {
+			return fmt.Errorf("route %v in AdvertiseRoutes is an exit route; use AdvertiseExitNode instead", r)
+		}
+	}
+	return nil
+}
+
+// applyPrefFields sets the fields of prefs that are controlled by Server
+// fields. The fields must have been validated with checkPrefFields.
+func (s *Server) applyPrefFields(prefs *ipn.Prefs) {
+	prefs.AdvertiseTags = slices.Clone(s.AdvertiseTags)
+	prefs.AdvertiseRoutes = slices.Clone(s.AdvertiseRoutes)
+	if s.AdvertiseExitNode {
+		prefs.AdvertiseRoutes = append(prefs.AdvertiseRoutes, tsaddr.ExitRoutes()...)
+	}
+	prefs.RunSSH = s.RunSSH
+	prefs.ShieldsUp = s.ShieldsUp
+	prefs.RouteAll = s.AcceptRoutes
+}
+
 func (s *Server) startLogger(closePool *closeOnErrorPool) error {
 	if testenv.InTest() {
 		return nil
@@ -713,8 +793,8 @@ func networkForFamily(netBase string, is6 bool) string {
 	panic("unexpected")
 }
 
-// listenerForDstAddr returns a listener for the provided network and
-// destination IP/port. It matches from most specific to least specific.
+// listenKeysForDstAddr returns the listenKeys that match the provided
+// network and destination IP/port, from most specific to least specific.
 // For example:
 //
 //   - ("tcp4", IP, port)
@@ -723,17 +803,41 @@ func networkForFamily(netBase string, is6 bool) string {
 //   - ("tcp", "", port)
 //
 // The netBase is "tcp" or "udp" (without any '4' or '6' suffix).
-func (s *Server) listenerForDstAddr(netBase string, dst netip.AddrPort, funnel bool) (_ *listener, ok bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func listenKeysForDstAddr(netBase string, dst netip.AddrPort, funnel bool) []listenKey {
+	keys := make([]listenKey, 0, 4)
 	for _, a := range [2]netip.Addr{0: dst.Addr()} {
 		for _, net := range [2]string{
 			networkForFamily(netBase, dst.Addr().Is6()),
 			netBase,
 		} {
-			if ln, ok := s.listeners[listenKey{net, a, dst.Port(), funnel}]; ok {
-				return ln, true
-			}
+			keys = append(keys, listenKey{net, a, dst.Port(), funnel})
+		}
+	}
+	return keys
+}
+
+// listenerForDstAddr returns a listener for the provided network and
+// destination IP/port. It matches from most specific to least specific,
+// as documented on listenKeysForDstAddr.
+func (s *Server) listenerForDstAddr(netBase string, dst netip.AddrPort, funnel bool) (_ *listener, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range listenKeysForDstAddr(netBase, dst, funnel) {
+		if ln, ok := s.listeners[key]; ok {
+			return ln, true
+		}
+	}
+	return nil, false
+}
+
+// packetConnForDstAddr returns the PacketConn from ListenPacket for the
+// provided UDP destination IP/port, if any.
+func (s *Server) packetConnForDstAddr(dst netip.AddrPort) (_ *packetConn, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range listenKeysForDstAddr("udp", dst, false) {
+		if pc, ok := s.packetListeners[key]; ok {
+			return pc, true
 		}
 	}
 	return nil, false
@@ -769,6 +873,9 @@ func (s *Server) getTCPHandlerForFlow(src, dst netip.AddrPort) (handler func(net
 }
 
 func (s *Server) getUDPHandlerForFlow(src, dst netip.AddrPort) (handler func(nettype.ConnPacketConn), intercept bool) {
+	if pc, ok := s.packetConnForDstAddr(dst); ok {
+		return func(c nettype.ConnPacketConn) { pc.handleFlow(src, c) }, true
+	}
 	ln, ok := s.listenerForDstAddr("udp", dst, false)
 	if !ok {
 		return nil, true // don't handle, don't forward to localhost
@@ -982,36 +1089,86 @@ func (s *Server) ListenFunnel(network, addr string, opts ...FunnelOption) (net.L
 	listenOnBoth    = listenOn("listen-on-both")
 )
 
-func (s *Server) listen(network, addr string, lnOn listenOn) (net.Listener, error) {
-	switch network {
-	case "", "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
-	default:
-		return nil, errors.New("unsupported network type")
-	}
+// parseListenAddr parses the addr argument to Listen or ListenPacket for
+// the given network.
+func parseListenAddr(network, addr string) (bindHostOrZero netip.Addr, port uint16, err error) {
 	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, fmt.Errorf("tsnet: %w", err)
+		return bindHostOrZero, 0, fmt.Errorf("tsnet: %w", err)
 	}
-	port, err := net.LookupPort(network, portStr)
-	if err != nil || port < 0 || port > math.MaxUint16 {
+	port32, err := net.LookupPort(network, portStr)
+	if err != nil || port32 < 0 || port32 > math.MaxUint16 {
 		// LookupPort returns an error on out of range values so the bounds
 		// checks on port should be unnecessary, but harmless. If they do
 		// match, worst case this error message says "invalid port: <nil>".
-		return nil, fmt.Errorf("invalid port: %w", err)
+		return bindHostOrZero, 0, fmt.Errorf("invalid port: %w", err)
 	}
-	var bindHostOrZero netip.Addr
 	if host != "" {
 		bindHostOrZero, err = netip.ParseAddr(host)
 		if err != nil {
-			return nil, fmt.Errorf("invalid Listen addr %q; host part must be empty or IP literal", host)
+			return bindHostOrZero, 0, fmt.Errorf("invalid Listen addr %q; host part must be empty or IP literal", host)
 		}
 		if strings.HasSuffix(network, "4") && !bindHostOrZero.Is4() {
-			return nil, fmt.Errorf("invalid non-IPv4 addr %v for network %q", host, network)
+			return bindHostOrZero, 0, fmt.Errorf("invalid non-IPv4 addr %v for network %q", host, network)
 		}
 		if strings.HasSuffix(network, "6") && !bindHostOrZero.Is6() {
-			return nil, fmt.Errorf("invalid non-IPv6 addr %v for network %q", host, network)
+			return bindHostOrZero, 0, fmt.Errorf("invalid non-IPv6 addr %v for network %q", host, network)
 		}
 	}
+	return bindHostOrZero, uint16(port32), nil
+}
+
+// ListenPacket announces a UDP port on the Tailscale network.
+//
+// Datagrams from all remote addresses to the port are read from the single
+// returned PacketConn, whose ReadFrom reports each datagram's tailnet source
+// address. WriteTo only supports addresses that have sent datagrams to the
+// PacketConn in the last couple of minutes, as is the case when replying to
+// clients. To send to other addresses, use Dial.
+//
+// The network must be "udp", "udp4" or "udp6".
+// It will start the server if it has not been started yet.
+func (s *Server) ListenPacket(network, addr string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("tsnet: unsupported network type %q for ListenPacket", network)
+	}
+	bindHostOrZero, port, err := parseListenAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+
+	key := listenKey{network, bindHostOrZero, port, false}
+	laddr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(bindHostOrZero, port))
+	pc := newPacketConn(s, []listenKey{key}, laddr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.listeners[key]; ok {
+		return nil, fmt.Errorf("tsnet: listener already open for %s, %s", network, addr)
+	}
+	if _, ok := s.packetListeners[key]; ok {
+		return nil, fmt.Errorf("tsnet: listener already open for %s, %s", network, addr)
+	}
+	mak.Set(&s.packetListeners, key, pc)
+	return pc, nil
+}
+
+func (s *Server) listen(network, addr string, lnOn listenOn) (net.Listener, error) {
+	switch network {
+	case "", "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, errors.New("unsupported network type")
+	}
+	bindHostOrZero, port, err := parseListenAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
 
 	if err := s.Start(); err != nil {
 		return nil, err
@@ -1020,12 +1177,12 @@ func (s *Server) listen(network, addr string, lnOn listenOn) (net.Listener, erro
 	var keys []listenKey
 	switch lnOn {
 	case listenOnTailnet:
-		keys = append(keys, listenKey{network, bindHostOrZero, uint16(port), false})
+		keys = append(keys, listenKey{network, bindHostOrZero, port, false})
 	case listenOnFunnel:
-		keys = append(keys, listenKey{network, bindHostOrZero, uint16(port), true})
+		keys = append(keys, listenKey{network, bindHostOrZero, port, true})
 	case listenOnBoth:
-		keys = append(keys, listenKey{network, bindHostOrZero, uint16(port), false})
-		keys = append(keys, listenKey{network, bindHostOrZero, uint16(port), true})
+		keys = append(keys, listenKey{network, bindHostOrZero, port, false})
+		keys = append(keys, listenKey{network, bindHostOrZero, port, true})
 	}
 
 	ln := &listener{
@@ -1037,7 +1194,8 @@ func (s *Server) listen(network, addr string, lnOn listenOn) (net.Listener, erro
 	}
 	s.mu.Lock()
 	for _, key := range keys {
-		if _, ok := s.listeners[key]; ok {
+		_, ok := s.listeners[key]
+		if _, pok := s.packetListeners[key]; ok || pok {
 			s.mu.Unlock()
 			return nil, fmt.Errorf("tsnet: listener already open for %s, %s", network, addr)
 		}
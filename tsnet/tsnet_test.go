@@ -23,6 +23,7 @@
 	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -90,6 +91,172 @@ func TestListenerPort(t *testing.T) {
 	}
 }
 
+func TestListenPacketNetwork(t *testing.T) {
+	errNone := errors.New("sentinel start error")
+
+	tests := []struct {
+		network string
+		addr    string
+		wantErr bool
+	}{
+		{"udp", ":53", false},
+		{"udp4", "100.102.104.108:53", false},
+		{"udp6", "100.102.104.108:53", true},
+		{"udp", "not-an-ip:53", true},
+		{"tcp", ":53", true},
+		{"", ":53", true},
+	}
+	for _, tt := range tests {
+		s := &Server{}
+		s.initOnce.Do(func() { s.initErr = errNone })
+		_, err := s.ListenPacket(tt.network, tt.addr)
+		gotErr := err != nil && err != errNone
+		if gotErr != tt.wantErr {
+			t.Errorf("ListenPacket(%q, %q) error = %v, want %v", tt.network, tt.addr, gotErr, tt.wantErr)
+		}
+	}
+}
+
+func TestPrefFields(t *testing.T) {
+	s := &Server{
+		AdvertiseTags:     []string{"tag:server"},
+		AdvertiseRoutes:   []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+		AdvertiseExitNode: true,
+		RunSSH:            true,
+		ShieldsUp:         true,
+		AcceptRoutes:      true,
+	}
+	if err := s.checkPrefFields(); err != nil {
+		t.Fatal(err)
+	}
+	prefs := ipn.NewPrefs()
+	s.applyPrefFields(prefs)
+	if !slices.Equal(prefs.AdvertiseTags, s.AdvertiseTags) {
+		t.Errorf("AdvertiseTags = %v; want %v", prefs.AdvertiseTags, s.AdvertiseTags)
+	}
+	wantRoutes := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+	}
+	if !slices.Equal(prefs.AdvertiseRoutes, wantRoutes) {
+		t.Errorf("AdvertiseRoutes = %v; want %v", prefs.AdvertiseRoutes, wantRoutes)
+	}
+	if len(s.AdvertiseRoutes) != 1 {
+		t.Errorf("applyPrefFields modified Server.AdvertiseRoutes: %v", s.AdvertiseRoutes)
+	}
+	if !prefs.RunSSH || !prefs.ShieldsUp || !prefs.RouteAll {
+		t.Errorf("RunSSH, ShieldsUp, RouteAll = %v, %v, %v; want all true", prefs.RunSSH, prefs.ShieldsUp, prefs.RouteAll)
+	}
+
+	for _, bad := range []*Server{
+		{AdvertiseTags: []string{"server"}},
+		{AdvertiseTags: []string{"tag:"}},
+		{AdvertiseRoutes: []netip.Prefix{{}}},
+		{AdvertiseRoutes: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/24")}},
+		{AdvertiseRoutes: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}},
+	} {
+		if err := bad.checkPrefFields(); err == nil {
+			t.Errorf("checkPrefFields succeeded for tags %q, routes %v", bad.AdvertiseTags, bad.AdvertiseRoutes)
+		}
+	}
+
+	// Validation errors are returned from Up.
+	bad := &Server{AdvertiseTags: []string{"nope"}, Dir: t.TempDir()}
+	if _, err := bad.Up(context.Background()); err == nil || !strings.Contains(err.Error(), "AdvertiseTags") {
+		t.Errorf("Up error = %v; want AdvertiseTags error", err)
+	}
+}
+
+func TestPacketConnFlows(t *testing.T) {
+	s := &Server{}
+	key := listenKey{network: "udp", port: 53}
+	pc := newPacketConn(s, []listenKey{key}, &net.UDPAddr{Port: 53})
+	s.packetListeners = map[listenKey]*packetConn{key: pc}
+
+	// Each client stands in for a remote node, and flow for netstack's
+	// socket for the client's flow.
+	type client struct {
+		conn *net.UDPConn
+		flow *net.UDPConn
+		src  netip.AddrPort // address the flow is reported as
+	}
+	var clients []client
+	for _, src := range []string{"100.64.0.1:1000", "[fd7a:115c:a1e0::1]:1000"} {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		flow, err := net.DialUDP("udp", nil, c.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cl := client{c, flow, netip.MustParseAddrPort(src)}
+		clients = append(clients, cl)
+		go pc.handleFlow(cl.src, flow)
+	}
+
+	buf := make([]byte, 100)
+	for i, cl := range clients {
+		msg := fmt.Sprintf("query %d", i)
+		var n int
+		var from net.Addr
+		// Retry until handleFlow has started reading.
+		for tries := 0; ; tries++ {
+			if _, err := cl.conn.WriteTo([]byte(msg), cl.flow.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			pc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			var err error
+			n, from, err = pc.ReadFrom(buf)
+			if err == nil {
+				break
+			}
+			if tries == 50 {
+				t.Fatal(err)
+			}
+		}
+		if got := string(buf[:n]); got != msg {
+			t.Errorf("got %q; want %q", got, msg)
+		}
+		if got := from.(*net.UDPAddr).AddrPort(); got != cl.src {
+			t.Errorf("source = %v; want %v", got, cl.src)
+		}
+		if _, err := pc.WriteTo([]byte("reply"), from); err != nil {
+			t.Fatal(err)
+		}
+		cl.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := cl.conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != "reply" {
+			t.Errorf("reply = %q", got)
+		}
+	}
+
+	if _, err := pc.WriteTo([]byte("x"), net.UDPAddrFromAddrPort(netip.MustParseAddrPort("100.64.0.9:1"))); !errors.Is(err, errNoFlow) {
+		t.Errorf("WriteTo unknown address = %v; want errNoFlow", err)
+	}
+
+	pc.SetReadDeadline(time.Time{})
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := pc.ReadFrom(buf)
+		errc <- err
+	}()
+	if err := pc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ReadFrom after Close = %v; want net.ErrClosed", err)
+	}
+	if len(s.packetListeners) != 0 {
+		t.Errorf("packetListeners not cleaned up: %v", s.packetListeners)
+	}
+}
+
 var verboseDERP = flag.Bool("verbose-derp", false, "if set, print DERP and STUN logs")
 var verboseNodes = flag.Bool("verbose-nodes", false, "if set, print tsnet.Server logs")
 
@@ -281,6 +448,65 @@ func TestConn(t *testing.T) {
 	}
 }
 
+func TestPacketConn(t *testing.T) {
+	tstest.ResourceCheck(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	controlURL := startControl(t)
+	s1, s1ip := startServer(t, ctx, controlURL, "s1")
+	s2, s2ip := startServer(t, ctx, controlURL, "s2")
+
+	lc2, err := s2.LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ping to make sure the connection is up.
+	if _, err := lc2.Ping(ctx, s1ip, tailcfg.PingICMP); err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := s1.ListenPacket("udp", ":5353")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	c, err := s2.Dial(ctx, "udp", fmt.Sprintf("%s:5353", s1ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	pc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hello" {
+		t.Errorf("got %q; want %q", got, "hello")
+	}
+	if got := from.(*net.UDPAddr).AddrPort().Addr(); got != s2ip {
+		t.Errorf("source = %v; want %v", got, s2ip)
+	}
+
+	if _, err := pc.WriteTo([]byte("world"), from); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, err = c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "world" {
+		t.Errorf("got %q; want %q", got, "world")
+	}
+}
+
 func TestLoopbackLocalAPI(t *testing.T) {
 	flakytest.Mark(t, "https://github.com/tailscale/tailscale/issues/8557")
 	tstest.ResourceCheck(t)
@@ -0,0 +1,574 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package testcontrol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/hujson"
+	"tailscale.com/tailcfg"
+)
+
+// Policy is a tailnet policy file, in the same HuJSON format as used by
+// the Tailscale admin console. Only a subset of it is supported: groups,
+// tagOwners, hosts, acls, ssh, nodeAttrs and autoApprovers.
+//
+// Aliases in policies can be user login names ("user-1@fake-control.example.net"),
+// "group:", "tag:" and host names, IPs or CIDRs, "*", and "autogroup:members",
+// "autogroup:tagged" and (as a destination) "autogroup:self".
+type Policy struct {
+	Groups        map[string][]string `json:"groups,omitempty"`    // "group:eng" => members
+	TagOwners     map[string][]string `json:"tagOwners,omitempty"` // "tag:server" => owners
+	Hosts         map[string]string   `json:"hosts,omitempty"`     // name => IP or CIDR
+	ACLs          []ACL               `json:"acls,omitempty"`
+	SSH           []SSHRule           `json:"ssh,omitempty"`
+	NodeAttrs     []NodeAttrGrant     `json:"nodeAttrs,omitempty"`
+	AutoApprovers *AutoApprovers      `json:"autoApprovers,omitempty"`
+}
+
+// ACL is an entry in a Policy's "acls" section.
+type ACL struct {
+	Action string   `json:"action"` // must be "accept"
+	Proto  string   `json:"proto,omitempty"`
+	Src    []string `json:"src"`
+	Dst    []string `json:"dst"` // "alias:ports"
+}
+
+// SSHRule is an entry in a Policy's "ssh" section.
+type SSHRule struct {
+	Action          string   `json:"action"` // must be "accept"
+	Src             []string `json:"src"`
+	Dst             []string `json:"dst"`
+	Users           []string `json:"users"`
+	Recorder        []string `json:"recorder,omitempty"`
+	EnforceRecorder bool     `json:"enforceRecorder,omitempty"`
+}
+
+// NodeAttrGrant is an entry in a Policy's "nodeAttrs" section.
+type NodeAttrGrant struct {
+	Target []string `json:"target"`
+	Attr   []string `json:"attr"`
+}
+
+// AutoApprovers is a Policy's "autoApprovers" section.
+type AutoApprovers struct {
+	Routes   map[string][]string `json:"routes,omitempty"` // CIDR => approvers
+	ExitNode []string            `json:"exitNode,omitempty"`
+}
+
+// ParsePolicy parses and validates a HuJSON policy file.
+func ParsePolicy(b []byte) (*Policy, error) {
+	b, err := hujson.Standardize(b)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *Policy) validate() error {
+	for name, members := range p.Groups {
+		if !strings.HasPrefix(name, "group:") {
+			return fmt.Errorf("group %q: name must start with \"group:\"", name)
+		}
+		for _, m := range members {
+			if strings.HasPrefix(m, "group:") {
+				return fmt.Errorf("group %q: nested groups are not supported", name)
+			}
+		}
+	}
+	for tag := range p.TagOwners {
+		if !strings.HasPrefix(tag, "tag:") {
+			return fmt.Errorf("tagOwners %q: name must start with \"tag:\"", tag)
+		}
+	}
+	for name, v := range p.Hosts {
+		if _, err := parsePrefix(v); err != nil {
+			return fmt.Errorf("host %q: %w", name, err)
+		}
+	}
+	for i, a := range p.ACLs {
+		if a.Action != "accept" {
+			return fmt.Errorf("acls[%d]: unsupported action %q", i, a.Action)
+		}
+		if _, err := parseProto(a.Proto); err != nil {
+			return fmt.Errorf("acls[%d]: %w", i, err)
+		}
+		if err := p.validateAliases(a.Src); err != nil {
+			return fmt.Errorf("acls[%d] src: %w", i, err)
+		}
+		for _, d := range a.Dst {
+			alias, _, err := parseDst(d)
+			if err != nil {
+				return fmt.Errorf("acls[%d] dst: %w", i, err)
+			}
+			if err := p.validateAliases([]string{alias}); err != nil {
+				return fmt.Errorf("acls[%d] dst: %w", i, err)
+			}
+		}
+	}
+	for i, r := range p.SSH {
+		if r.Action != "accept" {
+			return fmt.Errorf("ssh[%d]: unsupported action %q", i, r.Action)
+		}
+		if len(r.Users) == 0 {
+			return fmt.Errorf("ssh[%d]: no users", i)
+		}
+		if err := p.validateAliases(r.Src); err != nil {
+			return fmt.Errorf("ssh[%d] src: %w", i, err)
+		}
+		if err := p.validateAliases(r.Dst); err != nil {
+			return fmt.Errorf("ssh[%d] dst: %w", i, err)
+		}
+		if err := p.validateAliases(r.Recorder); err != nil {
+			return fmt.Errorf("ssh[%d] recorder: %w", i, err)
+		}
+	}
+	for i, na := range p.NodeAttrs {
+		if err := p.validateAliases(na.Target); err != nil {
+			return fmt.Errorf("nodeAttrs[%d] target: %w", i, err)
+		}
+	}
+	if aa := p.AutoApprovers; aa != nil {
+		for r, approvers := range aa.Routes {
+			if _, err := netip.ParsePrefix(r); err != nil {
+				return fmt.Errorf("autoApprovers route %q: %w", r, err)
+			}
+			if err := p.validateAliases(approvers); err != nil {
+				return fmt.Errorf("autoApprovers route %q: %w", r, err)
+			}
+		}
+		if err := p.validateAliases(aa.ExitNode); err != nil {
+			return fmt.Errorf("autoApprovers exitNode: %w", err)
+		}
+	}
+	return nil
+}
+
+func (p *Policy) validateAliases(aliases []string) error {
+	for _, a := range aliases {
+		switch {
+		case a == "*", a == "autogroup:members", a == "autogroup:tagged", a == "autogroup:self":
+		case strings.HasPrefix(a, "autogroup:"):
+			return fmt.Errorf("unsupported alias %q", a)
+		case strings.HasPrefix(a, "group:"):
+			if _, ok := p.Groups[a]; !ok {
+				return fmt.Errorf("undefined group %q", a)
+			}
+		case strings.HasPrefix(a, "tag:"):
+			if _, ok := p.TagOwners[a]; !ok {
+				return fmt.Errorf("tag %q has no tagOwners entry", a)
+			}
+		case strings.Contains(a, "@"):
+		default:
+			if _, ok := p.Hosts[a]; ok {
+				continue
+			}
+			if _, err := parsePrefix(a); err != nil {
+				return fmt.Errorf("unknown alias %q", a)
+			}
+		}
+	}
+	return nil
+}
+
+// parsePrefix parses an IP address or CIDR.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// parseProto parses an ACL "proto" value into IP protocol numbers. An empty
+// proto returns nil, meaning the default protocols.
+func parseProto(proto string) ([]int, error) {
+	switch proto {
+	case "":
+		return nil, nil
+	case "tcp":
+		return []int{6}, nil
+	case "udp":
+		return []int{17}, nil
+	case "icmp":
+		return []int{1, 58}, nil
+	case "sctp":
+		return []int{132}, nil
+	}
+	n, err := strconv.ParseUint(proto, 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported proto %q", proto)
+	}
+	return []int{int(n)}, nil
+}
+
+// parseDst splits an ACL destination of the form "alias:ports" into its
+// alias and port ranges. Ports are "*" or a comma-separated list of ports
+// and port ranges ("22", "80,443", "8000-8999").
+func parseDst(dst string) (alias string, ports []tailcfg.PortRange, err error) {
+	i := strings.LastIndexByte(dst, ':')
+	if i < 0 {
+		return "", nil, fmt.Errorf("dst %q: missing ports", dst)
+	}
+	alias, portStr := dst[:i], dst[i+1:]
+	if alias == "" {
+		return "", nil, fmt.Errorf("dst %q: missing alias", dst)
+	}
+	if portStr == "*" {
+		return alias, []tailcfg.PortRange{tailcfg.PortRangeAny}, nil
+	}
+	for _, s := range strings.Split(portStr, ",") {
+		first, last, isRange := strings.Cut(s, "-")
+		f, err := strconv.ParseUint(first, 10, 16)
+		if err != nil {
+			return "", nil, fmt.Errorf("dst %q: bad port %q", dst, s)
+		}
+		l := f
+		if isRange {
+			l, err = strconv.ParseUint(last, 10, 16)
+			if err != nil || l < f {
+				return "", nil, fmt.Errorf("dst %q: bad port range %q", dst, s)
+			}
+		}
+		ports = append(ports, tailcfg.PortRange{First: uint16(f), Last: uint16(l)})
+	}
+	return alias, ports, nil
+}
+
+// policyNode is a node as seen by a policy: its owner (if untagged), its
+// approved tags and its approved subnet routes.
+type policyNode struct {
+	n      *tailcfg.Node
+	login  string // owner's login name; empty if the node is tagged
+	tags   []string
+	routes []netip.Prefix
+}
+
+// policyEval evaluates a Policy against the nodes in a tailnet.
+type policyEval struct {
+	p      *Policy
+	nodes  []*policyNode
+	byNode map[tailcfg.NodeID]*policyNode
+}
+
+// newPolicyEval returns a policyEval for p and nodes. loginOf returns the
+// login name of a user.
+func newPolicyEval(p *Policy, nodes []*tailcfg.Node, loginOf func(tailcfg.UserID) string) *policyEval {
+	e := &policyEval{
+		p:      p,
+		byNode: make(map[tailcfg.NodeID]*policyNode),
+	}
+	for _, n := range nodes {
+		pn := &policyNode{n: n}
+		login := loginOf(n.User)
+		if n.Hostinfo.Valid() {
+			for _, tag := range n.Hostinfo.RequestTags().AsSlice() {
+				if owners, ok := p.TagOwners[tag]; ok && e.ownedBy(owners, login) {
+					pn.tags = append(pn.tags, tag)
+				}
+			}
+		}
+		if len(pn.tags) == 0 {
+			pn.login = login
+		}
+		e.nodes = append(e.nodes, pn)
+		e.byNode[n.ID] = pn
+	}
+	for _, pn := range e.nodes {
+		pn.routes = e.approvedRoutes(pn)
+	}
+	return e
+}
+
+// ownedBy reports whether login is one of the tag owners in owners.
+func (e *policyEval) ownedBy(owners []string, login string) bool {
+	for _, o := range owners {
+		switch {
+		case o == login, o == "autogroup:members", o == "autogroup:admin":
+			return true
+		case strings.HasPrefix(o, "group:"):
+			if slices.Contains(e.p.Groups[o], login) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// approvedRoutes returns the routes advertised by pn that are approved by
+// the policy's autoApprovers.
+func (e *policyEval) approvedRoutes(pn *policyNode) []netip.Prefix {
+	aa := e.p.AutoApprovers
+	if aa == nil || !pn.n.Hostinfo.Valid() {
+		return nil
+	}
+	var ret []netip.Prefix
+	for _, r := range pn.n.Hostinfo.RoutableIPs().AsSlice() {
+		if r.Bits() == 0 {
+			if e.matchesAny(aa.ExitNode, pn) {
+				ret = append(ret, r)
+			}
+			continue
+		}
+		for ps, approvers := range aa.Routes {
+			p, err := netip.ParsePrefix(ps)
+			if err != nil || p.Bits() > r.Bits() || !p.Contains(r.Addr()) {
+				continue
+			}
+			if e.matchesAny(approvers, pn) {
+				ret = append(ret, r)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// matches reports whether the node alias matches pn. Aliases for IPs and
+// CIDRs don't match any node.
+func (e *policyEval) matches(alias string, pn *policyNode) bool {
+	switch {
+	case alias == "*":
+		return true
+	case alias == "autogroup:members":
+		return pn.login != ""
+	case alias == "autogroup:tagged":
+		return len(pn.tags) > 0
+	case strings.HasPrefix(alias, "group:"):
+		return pn.login != "" && slices.Contains(e.p.Groups[alias], pn.login)
+	case strings.HasPrefix(alias, "tag:"):
+		return slices.Contains(pn.tags, alias)
+	case strings.Contains(alias, "@"):
+		return pn.login == alias
+	}
+	return false
+}
+
+func (e *policyEval) matchesAny(aliases []string, pn *policyNode) bool {
+	for _, a := range aliases {
+		if e.matches(a, pn) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefix returns the prefix for an alias that's a host name, IP or CIDR.
+func (e *policyEval) prefix(alias string) (netip.Prefix, bool) {
+	if v, ok := e.p.Hosts[alias]; ok {
+		alias = v
+	}
+	p, err := parsePrefix(alias)
+	return p, err == nil
+}
+
+// srcIPs returns the FilterRule.SrcIPs for the source aliases. If only is
+// non-nil, only nodes it reports true for are included.
+func (e *policyEval) srcIPs(aliases []string, only func(*policyNode) bool) []string {
+	var ret []string
+	for _, a := range aliases {
+		if a == "*" && only == nil {
+			return []string{"*"}
+		}
+		if p, ok := e.prefix(a); ok {
+			ret = append(ret, p.String())
+			continue
+		}
+		for _, pn := range e.nodes {
+			if e.matches(a, pn) && (only == nil || only(pn)) {
+				for _, addr := range pn.n.Addresses {
+					ret = append(ret, addr.String())
+				}
+			}
+		}
+	}
+	slices.Sort(ret)
+	return slices.Compact(ret)
+}
+
+// PacketFilter returns the packet filter for node n.
+//
+// Only rules whose destinations include n's addresses or approved routes
+// are included, as only those affect what n accepts.
+func (e *policyEval) PacketFilter(n *tailcfg.Node) []tailcfg.FilterRule {
+	self := e.byNode[n.ID]
+	if self == nil {
+		return nil
+	}
+	var ret []tailcfg.FilterRule
+	for _, acl := range e.p.ACLs {
+		proto, _ := parseProto(acl.Proto)
+		var dsts, selfDsts []tailcfg.NetPortRange
+		for _, d := range acl.Dst {
+			alias, ports, err := parseDst(d)
+			if err != nil {
+				continue
+			}
+			var ips []string
+			switch {
+			case alias == "*":
+				ips = []string{"*"}
+			case alias == "autogroup:self":
+				if self.login != "" {
+					for _, addr := range n.Addresses {
+						for _, pr := range ports {
+							selfDsts = append(selfDsts, tailcfg.NetPortRange{IP: addr.String(), Ports: pr})
+						}
+					}
+				}
+				continue
+			default:
+				if p, ok := e.prefix(alias); ok {
+					if overlapsAny(p, n.Addresses) || overlapsAny(p, self.routes) {
+						ips = []string{p.String()}
+					}
+				} else if e.matches(alias, self) {
+					for _, addr := range n.Addresses {
+						ips = append(ips, addr.String())
+					}
+				}
+			}
+			for _, ip := range ips {
+				for _, pr := range ports {
+					dsts = append(dsts, tailcfg.NetPortRange{IP: ip, Ports: pr})
+				}
+			}
+		}
+		if len(dsts) > 0 {
+			if src := e.srcIPs(acl.Src, nil); len(src) > 0 {
+				ret = append(ret, tailcfg.FilterRule{SrcIPs: src, DstPorts: dsts, IPProto: proto})
+			}
+		}
+		if len(selfDsts) > 0 {
+			sameUser := func(pn *policyNode) bool { return pn.login == self.login }
+			if src := e.srcIPs(acl.Src, sameUser); len(src) > 0 {
+				ret = append(ret, tailcfg.FilterRule{SrcIPs: src, DstPorts: selfDsts, IPProto: proto})
+			}
+		}
+	}
+	return ret
+}
+
+func overlapsAny(p netip.Prefix, ps []netip.Prefix) bool {
+	for _, q := range ps {
+		if p.Overlaps(q) {
+			return true
+		}
+	}
+	return false
+}
+
+// SSHPolicy returns the SSH policy for node n.
+func (e *policyEval) SSHPolicy(n *tailcfg.Node) *tailcfg.SSHPolicy {
+	self := e.byNode[n.ID]
+	pol := new(tailcfg.SSHPolicy)
+	if self == nil {
+		return pol
+	}
+	for _, r := range e.p.SSH {
+		var only func(*policyNode) bool
+		switch {
+		case slices.Contains(r.Dst, "autogroup:self") && self.login != "":
+			only = func(pn *policyNode) bool { return pn.login == self.login }
+		case e.matchesAny(r.Dst, self):
+		default:
+			continue
+		}
+		var principals []*tailcfg.SSHPrincipal
+		if only == nil && slices.Contains(r.Src, "*") {
+			principals = []*tailcfg.SSHPrincipal{{Any: true}}
+		} else {
+			for _, pn := range e.nodes {
+				if !e.matchesAny(r.Src, pn) || (only != nil && !only(pn)) {
+					continue
+				}
+				for _, addr := range pn.n.Addresses {
+					principals = append(principals, &tailcfg.SSHPrincipal{NodeIP: addr.Addr().String()})
+				}
+			}
+		}
+		if len(principals) == 0 {
+			continue
+		}
+		users := map[string]string{}
+		for _, u := range r.Users {
+			if u == "autogroup:nonroot" {
+				users["*"] = "="
+				if _, ok := users["root"]; !ok {
+					users["root"] = ""
+				}
+				continue
+			}
+			users[u] = u
+		}
+		action := &tailcfg.SSHAction{
+			Accept:                   true,
+			AllowAgentForwarding:     true,
+			AllowLocalPortForwarding: true,
+		}
+		for _, pn := range e.nodes {
+			if e.matchesAny(r.Recorder, pn) && len(pn.n.Addresses) > 0 {
+				action.Recorders = append(action.Recorders, netip.AddrPortFrom(pn.n.Addresses[0].Addr(), 80))
+			}
+		}
+		if r.EnforceRecorder && len(r.Recorder) > 0 {
+			action.OnRecordingFailure = &tailcfg.SSHRecorderFailureAction{
+				RejectSessionWithMessage:    "# Failed to start session recording.",
+				TerminateSessionWithMessage: "# Failed to record session.",
+			}
+		}
+		pol.Rules = append(pol.Rules, &tailcfg.SSHRule{
+			Principals: principals,
+			SSHUsers:   users,
+			Action:     action,
+		})
+	}
+	return pol
+}
+
+// NodeAttrs returns the node attributes granted to n.
+func (e *policyEval) NodeAttrs(n *tailcfg.Node) []string {
+	self := e.byNode[n.ID]
+	if self == nil {
+		return nil
+	}
+	var ret []string
+	for _, na := range e.p.NodeAttrs {
+		if e.matchesAny(na.Target, self) {
+			ret = append(ret, na.Attr...)
+		}
+	}
+	return ret
+}
+
+// Tags returns the approved tags of node n.
+func (e *policyEval) Tags(n *tailcfg.Node) []string {
+	if pn := e.byNode[n.ID]; pn != nil {
+		return pn.tags
+	}
+	return nil
+}
+
+// Routes returns the approved subnet routes of node n.
+func (e *policyEval) Routes(n *tailcfg.Node) []netip.Prefix {
+	if pn := e.byNode[n.ID]; pn != nil {
+		return pn.routes
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package testcontrol
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+const testPolicy = `{
+	// Comments and trailing commas are allowed.
+	"groups": {
+		"group:eng": ["alice@example.com"],
+	},
+	"tagOwners": {
+		"tag:server":   ["group:eng"],
+		"tag:recorder": ["alice@example.com"],
+	},
+	"hosts": {
+		"corp": "10.0.0.0/24",
+	},
+	"acls": [
+		{"action": "accept", "src": ["group:eng"], "dst": ["tag:server:22,80"]},
+		{"action": "accept", "proto": "udp", "src": ["bob@example.com"], "dst": ["corp:53"]},
+		{"action": "accept", "src": ["autogroup:members"], "dst": ["autogroup:self:*"]},
+	],
+	"ssh": [
+		{
+			"action": "accept",
+			"src": ["group:eng"],
+			"dst": ["tag:server"],
+			"users": ["autogroup:nonroot"],
+			"recorder": ["tag:recorder"],
+			"enforceRecorder": true,
+		},
+	],
+	"nodeAttrs": [
+		{"target": ["tag:server"], "attr": ["funnel"]},
+	],
+	"autoApprovers": {
+		"routes": {"10.0.0.0/16": ["tag:server"]},
+	},
+}`
+
+func testPolicyNodes() []*tailcfg.Node {
+	node := func(id tailcfg.NodeID, user tailcfg.UserID, ip string, hi *tailcfg.Hostinfo) *tailcfg.Node {
+		addr := netip.MustParsePrefix(ip + "/32")
+		return &tailcfg.Node{
+			ID:         id,
+			User:       user,
+			Addresses:  []netip.Prefix{addr},
+			AllowedIPs: []netip.Prefix{addr},
+			Hostinfo:   hi.View(),
+		}
+	}
+	return []*tailcfg.Node{
+		node(1, 1, "100.64.0.1", &tailcfg.Hostinfo{}), // alice's laptop
+		node(2, 2, "100.64.0.2", &tailcfg.Hostinfo{}), // bob's laptop
+		node(3, 1, "100.64.0.3", &tailcfg.Hostinfo{ // server owned by alice
+			RequestTags: []string{"tag:server"},
+			RoutableIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("192.168.0.0/24")},
+		}),
+		node(4, 2, "100.64.0.4", &tailcfg.Hostinfo{ // bob can't own tag:server
+			RequestTags: []string{"tag:server"},
+		}),
+		node(5, 1, "100.64.0.5", &tailcfg.Hostinfo{RequestTags: []string{"tag:recorder"}}),
+		node(6, 1, "100.64.0.6", &tailcfg.Hostinfo{}), // alice's desktop
+	}
+}
+
+func newTestPolicyEval(t *testing.T) (*policyEval, []*tailcfg.Node) {
+	t.Helper()
+	p, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := testPolicyNodes()
+	logins := map[tailcfg.UserID]string{1: "alice@example.com", 2: "bob@example.com"}
+	return newPolicyEval(p, nodes, func(uid tailcfg.UserID) string { return logins[uid] }), nodes
+}
+
+func TestPolicyTagsAndRoutes(t *testing.T) {
+	pe, nodes := newTestPolicyEval(t)
+	if got := pe.Tags(nodes[2]); !reflect.DeepEqual(got, []string{"tag:server"}) {
+		t.Errorf("server tags = %v", got)
+	}
+	if got := pe.Tags(nodes[3]); got != nil {
+		t.Errorf("bob's tags = %v; want none", got)
+	}
+	want := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
+	if got := pe.Routes(nodes[2]); !reflect.DeepEqual(got, want) {
+		t.Errorf("server routes = %v; want %v", got, want)
+	}
+	if got := pe.NodeAttrs(nodes[2]); !reflect.DeepEqual(got, []string{"funnel"}) {
+		t.Errorf("server attrs = %v", got)
+	}
+	if got := pe.NodeAttrs(nodes[0]); got != nil {
+		t.Errorf("laptop attrs = %v; want none", got)
+	}
+}
+
+func TestPolicyPacketFilter(t *testing.T) {
+	pe, nodes := newTestPolicyEval(t)
+
+	got := pe.PacketFilter(nodes[2])
+	want := []tailcfg.FilterRule{
+		{
+			SrcIPs: []string{"100.64.0.1/32", "100.64.0.6/32"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "100.64.0.3/32", Ports: tailcfg.PortRange{First: 22, Last: 22}},
+				{IP: "100.64.0.3/32", Ports: tailcfg.PortRange{First: 80, Last: 80}},
+			},
+		},
+		{
+			SrcIPs:   []string{"100.64.0.2/32", "100.64.0.4/32"}, // node 4 stays bob's
+			DstPorts: []tailcfg.NetPortRange{{IP: "10.0.0.0/24", Ports: tailcfg.PortRange{First: 53, Last: 53}}},
+			IPProto:  []int{17},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("server filter:\n got %+v\nwant %+v", got, want)
+	}
+
+	got = pe.PacketFilter(nodes[0])
+	want = []tailcfg.FilterRule{
+		{
+			SrcIPs:   []string{"100.64.0.1/32", "100.64.0.6/32"},
+			DstPorts: []tailcfg.NetPortRange{{IP: "100.64.0.1/32", Ports: tailcfg.PortRangeAny}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("laptop filter:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestPolicySSH(t *testing.T) {
+	pe, nodes := newTestPolicyEval(t)
+
+	got := pe.SSHPolicy(nodes[2])
+	want := &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{{
+		Principals: []*tailcfg.SSHPrincipal{{NodeIP: "100.64.0.1"}, {NodeIP: "100.64.0.6"}},
+		SSHUsers:   map[string]string{"*": "=", "root": ""},
+		Action: &tailcfg.SSHAction{
+			Accept:                   true,
+			AllowAgentForwarding:     true,
+			AllowLocalPortForwarding: true,
+			Recorders:                []netip.AddrPort{netip.MustParseAddrPort("100.64.0.5:80")},
+			OnRecordingFailure: &tailcfg.SSHRecorderFailureAction{
+				RejectSessionWithMessage:    "# Failed to start session recording.",
+				TerminateSessionWithMessage: "# Failed to record session.",
+			},
+		},
+	}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("server SSH policy:\n got %+v\nwant %+v", got.Rules[0], want.Rules[0])
+	}
+
+	if got := pe.SSHPolicy(nodes[0]); len(got.Rules) != 0 {
+		t.Errorf("laptop SSH policy has %d rules; want 0", len(got.Rules))
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+	}{
+		{"bad-json", `{"acls": [}`},
+		{"bad-action", `{"acls": [{"action": "deny", "src": ["*"], "dst": ["*:*"]}]}`},
+		{"undefined-group", `{"acls": [{"action": "accept", "src": ["group:nope"], "dst": ["*:*"]}]}`},
+		{"undefined-tag", `{"acls": [{"action": "accept", "src": ["tag:nope"], "dst": ["*:*"]}]}`},
+		{"missing-ports", `{"acls": [{"action": "accept", "src": ["*"], "dst": ["*"]}]}`},
+		{"bad-port-range", `{"acls": [{"action": "accept", "src": ["*"], "dst": ["*:90-80"]}]}`},
+		{"bad-proto", `{"acls": [{"action": "accept", "proto": "nope", "src": ["*"], "dst": ["*:*"]}]}`},
+		{"ssh-check", `{"ssh": [{"action": "check", "src": ["*"], "dst": ["*"], "users": ["root"]}]}`},
+		{"bad-host", `{"hosts": {"x": "not-an-ip"}}`},
+		{"bad-route", `{"autoApprovers": {"routes": {"10.0.0.0": ["*"]}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParsePolicy([]byte(tt.policy)); err == nil {
+				t.Error("unexpected success")
+			}
+		})
+	}
+}
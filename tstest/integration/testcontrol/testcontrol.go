@@ -77,7 +77,8 @@ type Server struct {
 	authPath      map[string]*AuthPath
 	nodeKeyAuthed map[key.NodePublic]bool // key => true once authenticated
 	pingReqsToAdd map[key.NodePublic]*tailcfg.PingRequest
-	allExpired    bool // All nodes will be told their node key is expired.
+	allExpired    bool    // All nodes will be told their node key is expired.
+	policy        *Policy // nil means allow all traffic and no SSH
 }
 
 // BaseURL returns the server's base URL, without trailing slash.
@@ -178,6 +179,37 @@ func (s *Server) SetExpireAllNodes(expired bool) {
 	}
 }
 
+// SetPolicy sets the tailnet policy used to compute the packet filter, SSH
+// policy, node attributes, tags and subnet routes sent to nodes, and
+// notifies all nodes of the change. A nil policy restores the default of
+// allowing all traffic.
+func (s *Server) SetPolicy(p *Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.policy = p
+
+	for _, node := range s.nodes {
+		sendUpdate(s.updates[node.ID], updateSelfChanged)
+	}
+}
+
+// policyEval returns an evaluator for the current policy against the
+// current set of nodes, or nil if there's no policy.
+func (s *Server) policyEval() *policyEval {
+	s.mu.Lock()
+	p := s.policy
+	logins := make(map[tailcfg.UserID]string, len(s.users))
+	for _, u := range s.users {
+		logins[u.ID] = u.LoginName
+	}
+	s.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	return newPolicyEval(p, s.AllNodes(), func(uid tailcfg.UserID) string { return logins[uid] })
+}
+
 type AuthPath struct {
 	nodeKey key.NodePublic
 
@@ -791,7 +823,14 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 
 func packetFilterWithIngressCaps() []tailcfg.FilterRule {
 	out := slices.Clone(tailcfg.FilterAllowAll)
-	out = append(out, tailcfg.FilterRule{
+	out = append(out, ingressCapGrantRule())
+	return out
+}
+
+// ingressCapGrantRule returns a FilterRule granting the ingress capability
+// to all peers.
+func ingressCapGrantRule() tailcfg.FilterRule {
+	return tailcfg.FilterRule{
 		SrcIPs: []string{"*"},
 		CapGrant: []tailcfg.CapGrant{
 			{
@@ -799,8 +838,7 @@ func packetFilterWithIngressCaps() []tailcfg.FilterRule {
 				Caps: []tailcfg.PeerCapability{tailcfg.PeerCapabilityIngress},
 			},
 		},
-	})
-	return out
+	}
 }
 
 // MapResponse generates a MapResponse for a MapRequest.
@@ -835,6 +873,13 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 		ControlTime:     &t,
 	}
 
+	pe := s.policyEval()
+	if pe != nil {
+		res.PacketFilter = append(pe.PacketFilter(node), ingressCapGrantRule())
+		res.SSHPolicy = pe.SSHPolicy(node)
+		node.Capabilities = append(node.Capabilities, pe.NodeAttrs(node)...)
+	}
+
 	s.mu.Lock()
 	nodeMasqs := s.masquerades[node.Key]
 	s.mu.Unlock()
@@ -853,6 +898,11 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 			p.Addresses[0] = netip.PrefixFrom(peerAddress, peerAddress.BitLen())
 			p.AllowedIPs[0] = netip.PrefixFrom(peerAddress, peerAddress.BitLen())
 		}
+		if pe != nil {
+			p.Tags = pe.Tags(p)
+			p.PrimaryRoutes = pe.Routes(p)
+			p.AllowedIPs = append(p.AllowedIPs, p.PrimaryRoutes...)
+		}
 		res.Peers = append(res.Peers, p)
 	}
 
@@ -875,6 +925,11 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 		v6Prefix,
 	}
 	res.Node.AllowedIPs = res.Node.Addresses
+	if pe != nil {
+		res.Node.Tags = pe.Tags(node)
+		res.Node.PrimaryRoutes = pe.Routes(node)
+		res.Node.AllowedIPs = append(slices.Clip(res.Node.Addresses), res.Node.PrimaryRoutes...)
+	}
 
 	// Consume the PingRequest while protected by mutex if it exists
 	s.mu.Lock()
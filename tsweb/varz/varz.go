@@ -107,6 +107,9 @@ func writePromExpVar(w io.Writer, prefix string, kv expvar.KeyValue) {
 			writePromExpVar(w, name+"_", kv)
 		})
 		return
+	case PrometheusWriter:
+		v.WritePrometheus(w, name)
+		return
 	case PrometheusMetricsReflectRooter:
 		root := v.PrometheusMetricsReflectRoot()
 		rv := reflect.ValueOf(root)
@@ -263,6 +266,17 @@ type PrometheusMetricsReflectRooter interface {
 	PrometheusMetricsReflectRoot() any
 }
 
+// PrometheusWriter is an optional interface that expvar.Var implementations
+// can implement to write their own metrics in Prometheus format, such as
+// metrics with per-key labels that change over time.
+type PrometheusWriter interface {
+	expvar.Var
+
+	// WritePrometheus writes the metrics to w. Metric names must start
+	// with name.
+	WritePrometheus(w io.Writer, name string)
+}
+
 var expvarDo = expvar.Do // pulled out for tests
 
 func writeMemstats(w io.Writer, ms *runtime.MemStats) {
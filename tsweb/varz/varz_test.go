@@ -5,6 +5,8 @@
 
 import (
 	"expvar"
+	"fmt"
+	"io"
 	"net/http/httptest"
 	"reflect"
 	"strings"
@@ -230,6 +232,12 @@ func() *expvar.Map {
 			expvar.Func(func() any { return "1.2.3-foo15" }),
 			"foo_version{version=\"1.2.3-foo15\"} 1\n",
 		},
+		{
+			"prometheus_writer",
+			"foo",
+			promWriterVar{},
+			"# TYPE foo_bar counter\nfoo_bar{k=\"a\"} 1\n",
+		},
 		{
 			"field_ordering",
 			"foo",
@@ -320,6 +328,15 @@ type SomeTestOfFieldNamesSorting struct {
 	BarBC int64 `json:"bar_b" metrictype:"counter"`
 }
 
+// promWriterVar implements PrometheusWriter for TestVarzHandler.
+type promWriterVar struct{}
+
+func (promWriterVar) String() string { return "{}" } // expvar JSON; unused in test
+
+func (promWriterVar) WritePrometheus(w io.Writer, name string) {
+	fmt.Fprintf(w, "# TYPE %s_bar counter\n%s_bar{k=\"a\"} 1\n", name, name)
+}
+
 // someExpVarWithFieldNamesSorting returns an expvar.Var that
 // implements PrometheusMetricsReflectRooter for TestVarzHandler.
 func someExpVarWithFieldNamesSorting() expvar.Var {
@@ -8,6 +8,7 @@
 
 import (
 	"net/netip"
+	"slices"
 )
 
 // Resolver is the configuration for one DNS resolver.
@@ -16,11 +17,12 @@ type Resolver struct {
 	//  - A plain IP address for a "classic" UDP+TCP DNS resolver.
 	//    This is the common format as sent by the control plane.
 	//  - An IP:port, for tests.
-	//  - "https://resolver.com/path" for DNS over HTTPS; currently
-	//    as of 2022-09-08 only used for certain well-known resolvers
-	//    (see the publicdns package) for which the IP addresses to dial DoH are
-	//    known ahead of time, so bootstrap DNS resolution is not required.
-	//  - [TODO] "tls://resolver.com" for DNS over TCP+TLS
+	//  - "https://resolver.com/path" for DNS over HTTPS (RFC 8484).
+	//    For well-known resolvers (see the publicdns package), the IP
+	//    addresses to dial are known ahead of time; for others, see
+	//    BootstrapResolution.
+	//  - "tls://resolver.com" or "tls://resolver.com:port" for DNS over
+	//    TLS (RFC 7858). The port defaults to 853.
 	Addr string `json:",omitempty"`
 
 	// BootstrapResolution is an optional suggested resolution for the
@@ -28,9 +30,9 @@ type Resolver struct {
 	// address directly.
 	// BootstrapResolution may be empty, in which case clients should
 	// look up the DoT/DoH server using their local "classic" DNS
-	// resolver.
-	//
-	// As of 2022-09-08, BootstrapResolution is not yet used.
+	// resolver. That isn't possible for resolvers for all domains, as the
+	// local resolver is then Tailscale's own, so those are ignored if
+	// BootstrapResolution is empty, unless they're well-known.
 	BootstrapResolution []netip.Addr `json:",omitempty"`
 }
 
@@ -51,3 +53,14 @@ func (r *Resolver) IPPort() (ipp netip.AddrPort, ok bool) {
 	}
 	return
 }
+
+// Equal reports whether r and other are equal.
+func (r *Resolver) Equal(other *Resolver) bool {
+	if r == nil || other == nil {
+		return r == other
+	}
+	if r == other {
+		return true
+	}
+	return r.Addr == other.Addr && slices.Equal(r.BootstrapResolution, other.BootstrapResolution)
+}
@@ -89,13 +89,15 @@ func New() *Sink {
 
 // Type Sink handles callbacks with packets to be logged,
 // formatting them into a pcap stream which is mirrored to
-// all registered outputs.
+// all registered outputs, and writing them to any registered
+// rings.
 type Sink struct {
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 
 	mu         sync.Mutex
 	outputs    set.HandleSet[io.Writer]
+	rings      set.HandleSet[*Ring]
 	flushTimer *time.Timer // or nil if none running
 }
 
@@ -126,16 +128,42 @@ func (s *Sink) RegisterOutput(w io.Writer) (unregister func()) {
 	}
 }
 
-// NumOutputs returns the number of outputs registered with the sink.
+// RegisterRing connects a ring to this sink, which will be
+// written to with the packets matching its filter. A function
+// is returned which unregisters the ring when called.
+//
+// The ring is closed when the sink is closed, but not when
+// it's unregistered.
+func (s *Sink) RegisterRing(r *Ring) (unregister func()) {
+	select {
+	case <-s.ctx.Done():
+		r.Close()
+		return func() {}
+	default:
+	}
+
+	s.mu.Lock()
+	hnd := s.rings.Add(r)
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.rings, hnd)
+	}
+}
+
+// NumOutputs returns the number of outputs and rings registered
+// with the sink.
 func (s *Sink) NumOutputs() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return len(s.outputs)
+	return len(s.outputs) + len(s.rings)
 }
 
 // Close shuts down the sink. Future calls to LogPacket
 // are ignored, and any registered output that implements
-// io.Closer is closed.
+// io.Closer is closed, as are registered rings.
 func (s *Sink) Close() error {
 	s.ctxCancel()
 	s.mu.Lock()
@@ -151,6 +179,10 @@ func (s *Sink) Close() error {
 		}
 	}
 	s.outputs = nil
+	for _, r := range s.rings {
+		r.Close()
+	}
+	s.rings = nil
 	return nil
 }
 
@@ -188,6 +220,7 @@ func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.Cap
 	defer bufferPool.Put(b)
 
 	writePktHeader(b, when, len(data)+extraLen)
+	hdrLen := b.Len()
 
 	// Custom tailscale debugging data
 	binary.Write(b, binary.LittleEndian, uint16(path))
@@ -216,6 +249,9 @@ func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.Cap
 			continue
 		}
 	}
+	for _, r := range s.rings {
+		r.logPacket(path, when, data, b.Bytes()[hdrLen:], meta)
+	}
 	for _, hnd := range hadError {
 		if o, ok := s.outputs[hnd].(io.Closer); ok {
 			o.Close()
@@ -232,6 +268,9 @@ func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.Cap
 					f.Flush()
 				}
 			}
+			for _, r := range s.rings {
+				r.flush()
+			}
 			s.flushTimer = nil
 		})
 	}
@@ -0,0 +1,483 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+)
+
+// String returns the name of the path, as used in pcapng comments.
+func (p Path) String() string {
+	switch p {
+	case FromLocal:
+		return "FromLocal"
+	case FromPeer:
+		return "FromPeer"
+	case SynthesizedToLocal:
+		return "SynthesizedToLocal"
+	case SynthesizedToPeer:
+		return "SynthesizedToPeer"
+	case PathDisco:
+		return "Disco"
+	}
+	return "Path" + strconv.Itoa(int(p))
+}
+
+// Filter selects the packets written to a Ring.
+//
+// A packet matches if it matches any of the values of each non-empty
+// field: for example, a Filter with two Peers and one Port matches packets
+// to or from either peer that have that port. The zero Filter matches all
+// packets.
+type Filter struct {
+	Peers  []netip.Addr    // source or destination address
+	Protos []ipproto.Proto // IP protocol
+	Ports  []uint16        // source or destination port
+}
+
+// IsEmpty reports whether f matches all packets.
+func (f *Filter) IsEmpty() bool {
+	return f == nil || len(f.Peers)+len(f.Protos)+len(f.Ports) == 0
+}
+
+// ParseFilter parses a filter expression: a sequence of clauses "peer IP",
+// "proto NAME" and "port N", optionally separated by "and", in the style of
+// BPF. The protocol may be "tcp", "udp", "icmp", "sctp" or a number.
+//
+// Unlike in BPF, clauses of the same kind are alternatives, so "peer
+// 100.64.0.1 peer 100.64.0.2 port 22" matches port 22 traffic of either
+// peer. The empty expression matches all packets.
+func ParseFilter(expr string) (*Filter, error) {
+	f := new(Filter)
+	words := strings.Fields(expr)
+	for len(words) > 0 {
+		kind := words[0]
+		if kind == "and" {
+			words = words[1:]
+			continue
+		}
+		if len(words) < 2 {
+			return nil, fmt.Errorf("filter: missing value after %q", kind)
+		}
+		v := words[1]
+		words = words[2:]
+		switch kind {
+		case "peer", "host":
+			ip, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("filter: invalid peer: %w", err)
+			}
+			f.Peers = append(f.Peers, ip)
+		case "proto":
+			switch v {
+			case "tcp":
+				f.Protos = append(f.Protos, ipproto.TCP)
+			case "udp":
+				f.Protos = append(f.Protos, ipproto.UDP)
+			case "icmp":
+				f.Protos = append(f.Protos, ipproto.ICMPv4, ipproto.ICMPv6)
+			case "sctp":
+				f.Protos = append(f.Protos, ipproto.SCTP)
+			default:
+				n, err := strconv.ParseUint(v, 10, 8)
+				if err != nil {
+					return nil, fmt.Errorf("filter: invalid proto %q", v)
+				}
+				f.Protos = append(f.Protos, ipproto.Proto(n))
+			}
+		case "port":
+			n, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("filter: invalid port %q", v)
+			}
+			f.Ports = append(f.Ports, uint16(n))
+		default:
+			return nil, fmt.Errorf("filter: unknown clause %q", kind)
+		}
+	}
+	return f, nil
+}
+
+// String returns f as an expression accepted by ParseFilter.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	var words []string
+	for _, ip := range f.Peers {
+		words = append(words, "peer", ip.String())
+	}
+	for _, p := range f.Protos {
+		words = append(words, "proto", strconv.Itoa(int(p)))
+	}
+	for _, p := range f.Ports {
+		words = append(words, "port", strconv.Itoa(int(p)))
+	}
+	return strings.Join(words, " ")
+}
+
+// Match reports whether the IP packet pkt matches f. Packets that aren't
+// IP packets, such as disco frames, only match the empty filter.
+func (f *Filter) Match(pkt []byte) bool {
+	if f.IsEmpty() {
+		return true
+	}
+	var p packet.Parsed
+	p.Decode(pkt)
+	if p.IPVersion == 0 {
+		return false
+	}
+	if len(f.Peers) > 0 && !slices.Contains(f.Peers, p.Src.Addr()) && !slices.Contains(f.Peers, p.Dst.Addr()) {
+		return false
+	}
+	if len(f.Protos) > 0 && !slices.Contains(f.Protos, p.IPProto) {
+		return false
+	}
+	if len(f.Ports) > 0 && !slices.Contains(f.Ports, p.Src.Port()) && !slices.Contains(f.Ports, p.Dst.Port()) {
+		return false
+	}
+	return true
+}
+
+// Defaults for RingOptions.
+const (
+	DefaultRingFileSize = 16 << 20
+	DefaultRingFiles    = 8
+)
+
+// RingOptions configures a Ring.
+type RingOptions struct {
+	// Dir is the directory the capture files are written to. It's
+	// created if needed.
+	Dir string
+
+	// FileSize is the size at which a new file is started. If zero,
+	// DefaultRingFileSize is used.
+	FileSize int64
+
+	// Files is the maximum number of files kept, including the one being
+	// written; the oldest are removed. If zero, DefaultRingFiles is used.
+	Files int
+
+	// Filter selects the packets captured. If nil, all packets are.
+	Filter *Filter
+}
+
+// Ring writes packets to a ring of size-bounded pcapng files in a
+// directory, for capturing problems without anybody attached to a live
+// capture. Register it with Sink.RegisterRing.
+//
+// Each packet's Path and any NAT performed on it are recorded in the
+// packet's pcapng comment, as well as in the Tailscale header understood
+// by the Wireshark dissector (DissectorLua). Files are named by the time
+// they were started, so that they sort oldest first.
+type Ring struct {
+	opts RingOptions
+
+	mu    sync.Mutex
+	f     *os.File // or nil if no file is open
+	bw    *bufio.Writer
+	size  int64 // of f, including buffered data
+	files []string
+	err   error // first write error, after which the ring stops
+}
+
+// ringFilePrefix and ringFileSuffix surround the start time in the names
+// of ring files.
+const (
+	ringFilePrefix = "capture-"
+	ringFileSuffix = ".pcapng"
+	ringTimeFormat = "20060102-150405.000000"
+)
+
+// NewRing returns a Ring that writes files to opts.Dir. Existing capture
+// files in the directory count towards the ring's limit.
+func NewRing(opts RingOptions) (*Ring, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("capture ring directory not set")
+	}
+	if opts.FileSize <= 0 {
+		opts.FileSize = DefaultRingFileSize
+	}
+	if opts.Files <= 0 {
+		opts.Files = DefaultRingFiles
+	}
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := RingFiles(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Ring{opts: opts, files: files}, nil
+}
+
+// RingFiles returns the paths of the capture files written by a Ring in
+// dir, oldest first.
+func RingFiles(dir string) ([]string, error) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, ent := range ents {
+		if name := ent.Name(); ent.Type().IsRegular() && strings.HasPrefix(name, ringFilePrefix) && strings.HasSuffix(name, ringFileSuffix) {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Options returns the ring's options, with defaults filled in.
+func (r *Ring) Options() RingOptions {
+	return r.opts
+}
+
+// Files returns the paths of the ring's capture files, oldest first.
+func (r *Ring) Files() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.files)
+}
+
+// Err returns the error that stopped the ring writing packets, if any.
+func (r *Ring) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// ringFileName returns the path of a ring file in dir started at when.
+func ringFileName(dir string, when time.Time) string {
+	return filepath.Join(dir, ringFilePrefix+when.UTC().Format(ringTimeFormat)+ringFileSuffix)
+}
+
+// logPacket writes a packet captured on path at when, if it matches the
+// ring's filter. The pkt is the IP packet and payload is the pcap record
+// data: the Tailscale header followed by pkt.
+func (r *Ring) logPacket(path Path, when time.Time, pkt, payload []byte, meta packet.CaptureMeta) {
+	if !r.opts.Filter.Match(pkt) {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	if err := r.writeLocked(path, when, payload, meta); err != nil {
+		r.err = err
+		r.closeLocked()
+	}
+}
+
+func (r *Ring) writeLocked(path Path, when time.Time, payload []byte, meta packet.CaptureMeta) error {
+	if r.f != nil && r.size >= r.opts.FileSize {
+		if err := r.closeLocked(); err != nil {
+			return err
+		}
+	}
+	if r.f == nil {
+		if err := r.openLocked(when); err != nil {
+			return err
+		}
+	}
+	n, err := writeEnhancedPacketBlock(r.bw, when, payload, pcapngComment(path, meta), pcapngDirection(path))
+	r.size += int64(n)
+	return err
+}
+
+// openLocked starts a new file, removing the oldest files beyond the
+// ring's limit.
+func (r *Ring) openLocked(when time.Time) error {
+	name := ringFileName(r.opts.Dir, when)
+	if len(r.files) > 0 && name <= r.files[len(r.files)-1] {
+		// The clock went backwards, or an earlier file has the same
+		// time; keep the order of the names.
+		last := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(r.files[len(r.files)-1]), ringFilePrefix), ringFileSuffix)
+		t, err := time.Parse(ringTimeFormat, last)
+		if err != nil {
+			return err
+		}
+		name = ringFileName(r.opts.Dir, t.Add(time.Microsecond))
+	}
+	for len(r.files) >= r.opts.Files {
+		if err := os.Remove(r.files[0]); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		r.files = r.files[1:]
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	r.f = f
+	r.bw = bufio.NewWriter(f)
+	r.files = append(r.files, name)
+	n, err := writePcapngHeader(r.bw)
+	r.size = int64(n)
+	return err
+}
+
+func (r *Ring) closeLocked() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.bw.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	r.f, r.bw = nil, nil
+	return err
+}
+
+// flush writes any buffered packets to the current file.
+func (r *Ring) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.bw != nil && r.err == nil {
+		if err := r.bw.Flush(); err != nil {
+			r.err = err
+			r.closeLocked()
+		}
+	}
+}
+
+// Close flushes and closes the current file. The files are kept.
+func (r *Ring) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = errors.New("capture ring closed")
+	}
+	return r.closeLocked()
+}
+
+// pcapngComment returns the comment recorded for a packet on path.
+func pcapngComment(path Path, meta packet.CaptureMeta) string {
+	s := "path=" + path.String()
+	if meta.DidSNAT {
+		s += " snat=" + meta.OriginalSrc.String()
+	}
+	if meta.DidDNAT {
+		s += " dnat=" + meta.OriginalDst.String()
+	}
+	return s
+}
+
+// pcapngDirection returns the epb_flags direction of packets on path,
+// relative to the local host.
+func pcapngDirection(path Path) uint32 {
+	switch path {
+	case FromPeer, SynthesizedToLocal:
+		return 1 // inbound
+	case FromLocal, SynthesizedToPeer:
+		return 2 // outbound
+	}
+	return 0 // unknown
+}
+
+// pcapng block types and option codes, from the pcapng specification.
+const (
+	pcapngSectionHeader      = 0x0A0D0D0A
+	pcapngInterfaceDesc      = 0x00000001
+	pcapngEnhancedPacket     = 0x00000006
+	pcapngByteOrderMagic     = 0x1A2B3C4D
+	pcapngOptEndOfOpt        = 0
+	pcapngOptComment         = 1
+	pcapngOptEPBFlags        = 2
+	pcapngLinkTypeUser0      = 147
+	pcapngSnapLen            = 65535
+	pcapngSectionLenUnknown  = 0xFFFFFFFFFFFFFFFF
+	pcapngBlockOverheadBytes = 12 // type, length, trailing length
+)
+
+// pad4 returns the padding needed to align n to four bytes.
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// writePcapngHeader writes a section header block and the block of the
+// single interface, whose packets have the same format as in the pcap
+// stream. It returns the number of bytes written.
+func writePcapngHeader(w *bufio.Writer) (int, error) {
+	var b []byte
+	le := binary.LittleEndian
+	const shbLen = pcapngBlockOverheadBytes + 16
+	b = le.AppendUint32(b, pcapngSectionHeader)
+	b = le.AppendUint32(b, shbLen)
+	b = le.AppendUint32(b, pcapngByteOrderMagic)
+	b = le.AppendUint16(b, 1) // version major
+	b = le.AppendUint16(b, 0) // version minor
+	b = le.AppendUint64(b, pcapngSectionLenUnknown)
+	b = le.AppendUint32(b, shbLen)
+
+	const idbLen = pcapngBlockOverheadBytes + 8
+	b = le.AppendUint32(b, pcapngInterfaceDesc)
+	b = le.AppendUint32(b, idbLen)
+	b = le.AppendUint16(b, pcapngLinkTypeUser0)
+	b = le.AppendUint16(b, 0) // reserved
+	b = le.AppendUint32(b, pcapngSnapLen)
+	b = le.AppendUint32(b, idbLen)
+	return w.Write(b)
+}
+
+// writeEnhancedPacketBlock writes payload as an enhanced packet block with
+// the provided comment and direction flags, timestamped in microseconds.
+// It returns the number of bytes written.
+func writeEnhancedPacketBlock(w *bufio.Writer, when time.Time, payload []byte, comment string, direction uint32) (int, error) {
+	le := binary.LittleEndian
+	optLen := 4 + len(comment) + pad4(len(comment)) // opt_comment
+	if direction != 0 {
+		optLen += 8 // epb_flags
+	}
+	optLen += 4 // opt_endofopt
+	blockLen := pcapngBlockOverheadBytes + 20 + len(payload) + pad4(len(payload)) + optLen
+
+	var hdr [pcapngBlockOverheadBytes + 20 - 4]byte
+	us := uint64(when.UnixMicro())
+	le.PutUint32(hdr[0:], pcapngEnhancedPacket)
+	le.PutUint32(hdr[4:], uint32(blockLen))
+	le.PutUint32(hdr[8:], 0) // interface ID
+	le.PutUint32(hdr[12:], uint32(us>>32))
+	le.PutUint32(hdr[16:], uint32(us))
+	le.PutUint32(hdr[20:], uint32(len(payload))) // captured length
+	le.PutUint32(hdr[24:], uint32(len(payload))) // original length
+	w.Write(hdr[:])
+	w.Write(payload)
+	w.Write(make([]byte, pad4(len(payload))))
+
+	var opts []byte
+	opts = le.AppendUint16(opts, pcapngOptComment)
+	opts = le.AppendUint16(opts, uint16(len(comment)))
+	opts = append(opts, comment...)
+	opts = append(opts, make([]byte, pad4(len(comment)))...)
+	if direction != 0 {
+		opts = le.AppendUint16(opts, pcapngOptEPBFlags)
+		opts = le.AppendUint16(opts, 4)
+		opts = le.AppendUint32(opts, direction)
+	}
+	opts = le.AppendUint16(opts, pcapngOptEndOfOpt)
+	opts = le.AppendUint16(opts, 0)
+	opts = le.AppendUint32(opts, uint32(blockLen))
+	if _, err := w.Write(opts); err != nil {
+		return 0, err
+	}
+	return blockLen, nil
+}
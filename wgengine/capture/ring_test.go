@@ -0,0 +1,180 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+)
+
+func udp4(src, dst string) []byte {
+	s, d := netip.MustParseAddrPort(src), netip.MustParseAddrPort(dst)
+	return packet.Generate(packet.UDP4Header{
+		IP4Header: packet.IP4Header{IPProto: ipproto.UDP, Src: s.Addr(), Dst: d.Addr()},
+		SrcPort:   s.Port(),
+		DstPort:   d.Port(),
+	}, []byte("hello"))
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    *Filter
+		wantErr bool
+	}{
+		{expr: "", want: &Filter{}},
+		{expr: "peer 100.64.0.1 and proto tcp and port 22", want: &Filter{
+			Peers:  []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+			Protos: []ipproto.Proto{ipproto.TCP},
+			Ports:  []uint16{22},
+		}},
+		{expr: "host fd7a:115c:a1e0::1 proto icmp proto 132", want: &Filter{
+			Peers:  []netip.Addr{netip.MustParseAddr("fd7a:115c:a1e0::1")},
+			Protos: []ipproto.Proto{ipproto.ICMPv4, ipproto.ICMPv6, ipproto.SCTP},
+		}},
+		{expr: "peer", wantErr: true},
+		{expr: "peer bogus", wantErr: true},
+		{expr: "port 70000", wantErr: true},
+		{expr: "proto ip", wantErr: true},
+		{expr: "net 10.0.0.0/8", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFilter(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseFilter(%q) error = %v; want error: %v", tt.expr, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseFilter(%q) = %+v; want %+v", tt.expr, got, tt.want)
+		}
+		if got != nil {
+			again, err := ParseFilter(got.String())
+			if err != nil || !reflect.DeepEqual(again, got) {
+				t.Errorf("ParseFilter(%q.String()) = %+v, %v; want %+v", tt.expr, again, err, got)
+			}
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	pkt := udp4("100.64.0.1:1234", "100.64.0.2:53")
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"peer 100.64.0.2", true},
+		{"peer 100.64.0.3", false},
+		{"peer 100.64.0.3 peer 100.64.0.1", true},
+		{"proto udp port 53", true},
+		{"proto tcp port 53", false},
+		{"port 1234", true},
+		{"port 22", false},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Match(pkt); got != tt.want {
+			t.Errorf("%q.Match = %v; want %v", tt.expr, got, tt.want)
+		}
+	}
+	f, _ := ParseFilter("port 53")
+	if f.Match([]byte("not an IP packet")) {
+		t.Error("filter matched a non-IP packet")
+	}
+}
+
+// readPcapng returns the comments of the enhanced packet blocks in the
+// pcapng file name, checking its structure.
+func readPcapng(t *testing.T, name string) (comments []string) {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	for i := 0; len(b) > 0; i++ {
+		typ, n := le.Uint32(b), int(le.Uint32(b[4:]))
+		if n%4 != 0 || n > len(b) || le.Uint32(b[n-4:]) != uint32(n) {
+			t.Fatalf("%s: bad block %d length %d", name, i, n)
+		}
+		switch {
+		case i == 0 && typ != pcapngSectionHeader, i == 1 && typ != pcapngInterfaceDesc, i > 1 && typ != pcapngEnhancedPacket:
+			t.Fatalf("%s: block %d has type %#x", name, i, typ)
+		case typ == pcapngEnhancedPacket:
+			caplen := int(le.Uint32(b[20:]))
+			opts := b[28+caplen+pad4(caplen) : n-4]
+			if code, olen := le.Uint16(opts), int(le.Uint16(opts[2:])); code == pcapngOptComment {
+				comments = append(comments, string(opts[4:4+olen]))
+			}
+		}
+		b = b[n:]
+	}
+	return comments
+}
+
+func TestRing(t *testing.T) {
+	dir := t.TempDir()
+	f, err := ParseFilter("port 53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRing(RingOptions{Dir: dir, FileSize: 200, Files: 3, Filter: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New()
+	s.RegisterRing(r)
+	if s.NumOutputs() != 1 {
+		t.Errorf("NumOutputs = %d; want 1", s.NumOutputs())
+	}
+
+	now := time.Now()
+	s.LogPacket(FromLocal, now, udp4("100.64.0.1:1234", "100.64.0.2:80"), packet.CaptureMeta{})
+	// The packets have the same time, so the files' start times collide.
+	for i := 0; i < 10; i++ {
+		s.LogPacket(FromPeer, now, udp4("100.64.0.2:53", "100.64.0.1:1234"), packet.CaptureMeta{
+			DidDNAT:     true,
+			OriginalDst: netip.MustParseAddrPort("100.100.100.100:1234"),
+		})
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := r.Files()
+	if len(files) != 3 {
+		t.Fatalf("files = %q; want 3", files)
+	}
+	onDisk, err := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(onDisk, files) {
+		t.Errorf("files on disk = %q; want %q", onDisk, files)
+	}
+	var total int
+	for _, name := range files {
+		comments := readPcapng(t, name)
+		for _, c := range comments {
+			if want := "path=FromPeer dnat=100.100.100.100:1234"; c != want {
+				t.Errorf("%s: comment = %q; want %q", name, c, want)
+			}
+		}
+		total += len(comments)
+	}
+	if total == 0 || total >= 10 {
+		t.Errorf("ring has %d packets; want some of the 10 matching packets", total)
+	}
+}
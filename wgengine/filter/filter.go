@@ -9,6 +9,7 @@
 	"net/netip"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go4.org/netipx"
@@ -17,6 +18,7 @@
 	"tailscale.com/net/netaddr"
 	"tailscale.com/net/packet"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
 	"tailscale.com/tstime/rate"
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
@@ -49,6 +51,13 @@ type Filter struct {
 	// capability grants, partitioned by source IP address family.
 	cap4, cap6 matches
 
+	// rules are the matches the filter was created with, and hits
+	// counts the packets that each accepted. ruleIdx4 and ruleIdx6
+	// map indexes in matches4 and matches6 to indexes in rules.
+	rules              []Match
+	hits               []atomic.Uint64
+	ruleIdx4, ruleIdx6 []int
+
 	// state is the connection tracking state attached to this
 	// filter. It is used to allow incoming traffic that is a response
 	// to an outbound connection that this node made, even if those
@@ -61,7 +70,41 @@ type Filter struct {
 // filterState is a state cache of past seen packets.
 type filterState struct {
 	mu  sync.Mutex
-	lru *flowtrack.Cache[struct{}] // from flowtrack.Tuple -> struct{}
+	lru *flowtrack.Cache[flowState] // from flowtrack.Tuple of expected return traffic -> flowState
+
+	// accepted tracks the incoming flows that were accepted by a rule,
+	// sharded by flow so that it doesn't serialize packets of different
+	// flows on mu. Unlike lru, it's only used to report flows, not to
+	// accept packets.
+	accepted [acceptedShards]acceptedShard
+}
+
+// acceptedShards is the number of shards of filterState.accepted.
+const acceptedShards = 8
+
+// acceptedShard is a shard of filterState.accepted.
+type acceptedShard struct {
+	mu    sync.Mutex
+	flows flowtrack.Cache[flowState]
+}
+
+// acceptedShard returns the shard of s.accepted that tracks t.
+func (s *filterState) acceptedShard(t flowtrack.Tuple) *acceptedShard {
+	a := t.Src.Addr().As16()
+	h := a[15] ^ byte(t.Src.Port()) ^ byte(t.Dst.Port())
+	return &s.accepted[h%acceptedShards]
+}
+
+// flowState is the tracked state of a flow.
+type flowState struct {
+	created  mono.Time
+	lastSeen mono.Time
+
+	// rule is the rule that accepted an incoming flow, and ruleIndex its
+	// index in the rules of the filter it belonged to, which may have
+	// since been replaced. It's nil for outgoing flows.
+	rule      *Match
+	ruleIndex int
 }
 
 // lruMax is the size of the LRU cache in filterState.
@@ -178,27 +221,32 @@ func New(matches []Match, localNets *netipx.IPSet, logIPs *netipx.IPSet, shareSt
 		state = shareStateWith.state
 	} else {
 		state = &filterState{
-			lru: &flowtrack.Cache[struct{}]{MaxEntries: lruMax},
+			lru: &flowtrack.Cache[flowState]{MaxEntries: lruMax},
+		}
+		for i := range state.accepted {
+			state.accepted[i].flows.MaxEntries = lruMax / acceptedShards
 		}
 	}
 	f := &Filter{
-		logf:     logf,
-		matches4: matchesFamily(matches, netip.Addr.Is4),
-		matches6: matchesFamily(matches, netip.Addr.Is6),
-		cap4:     capMatchesFunc(matches, netip.Addr.Is4),
-		cap6:     capMatchesFunc(matches, netip.Addr.Is6),
-		local:    localNets,
-		logIPs:   logIPs,
-		state:    state,
-	}
+		logf:   logf,
+		cap4:   capMatchesFunc(matches, netip.Addr.Is4),
+		cap6:   capMatchesFunc(matches, netip.Addr.Is6),
+		rules:  matches,
+		hits:   make([]atomic.Uint64, len(matches)),
+		local:  localNets,
+		logIPs: logIPs,
+		state:  state,
+	}
+	f.matches4, f.ruleIdx4 = matchesFamily(matches, netip.Addr.Is4)
+	f.matches6, f.ruleIdx6 = matchesFamily(matches, netip.Addr.Is6)
 	return f
 }
 
 // matchesFamily returns the subset of ms for which keep(srcNet.IP)
-// and keep(dstNet.IP) are both true.
-func matchesFamily(ms matches, keep func(netip.Addr) bool) matches {
-	var ret matches
-	for _, m := range ms {
+// and keep(dstNet.IP) are both true, and the index in ms of each
+// returned match.
+func matchesFamily(ms matches, keep func(netip.Addr) bool) (ret matches, idx []int) {
+	for i, m := range ms {
 		var retm Match
 		retm.IPProto = m.IPProto
 		for _, src := range m.Srcs {
@@ -213,9 +261,10 @@ func matchesFamily(ms matches, keep func(netip.Addr) bool) matches {
 		}
 		if len(retm.Srcs) > 0 && len(retm.Dsts) > 0 {
 			ret = append(ret, retm)
+			idx = append(idx, i)
 		}
 	}
-	return ret
+	return ret, idx
 }
 
 // capMatchesFunc returns a copy of the subset of ms for which keep(srcNet.IP)
@@ -303,26 +352,95 @@ func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction
 // CheckTCP determines whether TCP traffic from srcIP to dstIP:dstPort
 // is allowed.
 func (f *Filter) CheckTCP(srcIP, dstIP netip.Addr, dstPort uint16) Response {
-	pkt := &packet.Parsed{}
-	pkt.Decode(dummyPacket) // initialize private fields
-	switch {
-	case (srcIP.Is4() && dstIP.Is6()) || (srcIP.Is6() && srcIP.Is4()):
+	pkt, ok := synthesizedPacket(ipproto.TCP, netip.AddrPortFrom(srcIP, 0), netip.AddrPortFrom(dstIP, dstPort))
+	if !ok {
 		// Mismatched address families, no filters will
 		// match.
 		return Drop
-	case srcIP.Is4():
+	}
+
+	// Don't count the synthesized packet as a rule hit.
+	return f.runIn(pkt, 0, false)
+}
+
+// synthesizedPacket returns a packet of proto from src to dst for
+// evaluating the filter, or false if src and dst are of different address
+// families. A TCP packet is a SYN.
+func synthesizedPacket(proto ipproto.Proto, src, dst netip.AddrPort) (*packet.Parsed, bool) {
+	pkt := &packet.Parsed{}
+	pkt.Decode(dummyPacket) // initialize private fields
+	switch {
+	case src.Addr().Is4() != dst.Addr().Is4() || !src.Addr().IsValid():
+		return nil, false
+	case src.Addr().Is4():
 		pkt.IPVersion = 4
-	case srcIP.Is6():
-		pkt.IPVersion = 6
 	default:
-		panic("unreachable")
+		pkt.IPVersion = 6
+	}
+	pkt.Src = src
+	pkt.Dst = dst
+	pkt.IPProto = proto
+	if proto == ipproto.TCP {
+		pkt.TCPFlags = packet.TCPSyn
+	}
+	return pkt, true
+}
+
+// CheckResult is the result of Filter.Check.
+type CheckResult struct {
+	Response Response
+	Why      string // why the filter reached Response, as it would log
+
+	// RuleIndex is the index of the rule that accepted the packet, in
+	// the order the filter was created with, or -1 if none did; Rule is
+	// that rule.
+	RuleIndex int
+	Rule      Match
+
+	// Caps are the capabilities the packet's source has when talking to
+	// its destination.
+	Caps tailcfg.PeerCapMap
+}
+
+// Check reports how the filter would handle a packet of proto from src to
+// dst: one received from a peer if outgoing is false, or one sent to a peer
+// if it's true. A TCP packet is a SYN, and an ICMP one isn't a response.
+//
+// Unlike RunIn and RunOut, Check doesn't count rule hits or track flows,
+// though incoming UDP and SCTP packets are accepted if they match tracked
+// return traffic.
+func (f *Filter) Check(proto ipproto.Proto, src, dst netip.AddrPort, outgoing bool) CheckResult {
+	res := CheckResult{RuleIndex: -1}
+	pkt, ok := synthesizedPacket(proto, src, dst)
+	if !ok {
+		res.Response, res.Why = Drop, "mismatched address families"
+		return res
+	}
+	if !outgoing {
+		res.Caps = f.CapsWithValues(src.Addr(), dst.Addr())
 	}
-	pkt.Src = netip.AddrPortFrom(srcIP, 0)
-	pkt.Dst = netip.AddrPortFrom(dstIP, dstPort)
-	pkt.IPProto = ipproto.TCP
-	pkt.TCPFlags = packet.TCPSyn
 
-	return f.RunIn(pkt, 0)
+	dir := in
+	if outgoing {
+		dir = out
+	}
+	res.Response, res.Why = f.pre(pkt, 0, dir)
+	if res.Response == Accept || res.Response == Drop {
+		return res
+	}
+	switch {
+	case outgoing:
+		// Like runOut, without tracking the flow.
+		res.Response, res.Why = Accept, "ok out"
+	case pkt.IPVersion == 4:
+		res.Response, res.Why, res.RuleIndex = f.runIn4(pkt)
+	default:
+		res.Response, res.Why, res.RuleIndex = f.runIn6(pkt)
+	}
+	if res.RuleIndex >= 0 {
+		res.Rule = f.rules[res.RuleIndex]
+	}
+	return res
 }
 
 // CapsWithValues appends to base the capabilities that srcIP has talking
@@ -358,34 +476,139 @@ func (f *Filter) CapsWithValues(srcIP, dstIP netip.Addr) tailcfg.PeerCapMap {
 // incoming) filter.
 func (f *Filter) ShieldsUp() bool { return f.shieldsUp }
 
+// RuleHits describes a rule of the filter and how many packets it has
+// accepted.
+type RuleHits struct {
+	Match Match
+	Hits  uint64
+}
+
+// RuleHits returns the filter's rules, in the order it was created with,
+// and the number of packets each has accepted since. For TCP, only SYN
+// packets are counted; other TCP packets are accepted without checking
+// the rules.
+func (f *Filter) RuleHits() []RuleHits {
+	ret := make([]RuleHits, len(f.rules))
+	for i := range f.rules {
+		ret[i] = RuleHits{Match: f.rules[i], Hits: f.hits[i].Load()}
+	}
+	return ret
+}
+
+// Flow is a flow tracked by the filter.
+type Flow struct {
+	flowtrack.Tuple // as sent by the flow's initiator
+
+	// Outgoing reports whether the flow was initiated by this node.
+	// Outgoing UDP and SCTP flows are tracked so that their return
+	// traffic is accepted.
+	Outgoing bool
+
+	// Created is when the flow was first seen, and LastSeen is when a
+	// packet of it was last seen.
+	Created  time.Time
+	LastSeen time.Time
+
+	// Rule is the rule that accepted an incoming flow, and RuleIndex is
+	// its index in the rules of the filter that accepted it, which may
+	// be a previous filter. RuleIndex is -1 for outgoing flows.
+	Rule      Match
+	RuleIndex int
+}
+
+// Flows returns the flows tracked by the filter's connection tracking
+// state, which may be shared with previous filters, most recently seen
+// first. The number of flows tracked is bounded, so older flows may
+// have been forgotten.
+func (f *Filter) Flows() []Flow {
+	var ret []Flow
+	f.state.mu.Lock()
+	f.state.lru.ForEach(func(t flowtrack.Tuple, fs flowState) {
+		// The lru is keyed by the expected return traffic.
+		t.Src, t.Dst = t.Dst, t.Src
+		ret = append(ret, Flow{
+			Tuple:     t,
+			Outgoing:  true,
+			Created:   fs.created.WallTime(),
+			LastSeen:  fs.lastSeen.WallTime(),
+			RuleIndex: -1,
+		})
+	})
+	f.state.mu.Unlock()
+	for i := range f.state.accepted {
+		sh := &f.state.accepted[i]
+		sh.mu.Lock()
+		sh.flows.ForEach(func(t flowtrack.Tuple, fs flowState) {
+			ret = append(ret, Flow{
+				Tuple:     t,
+				Created:   fs.created.WallTime(),
+				LastSeen:  fs.lastSeen.WallTime(),
+				Rule:      *fs.rule,
+				RuleIndex: fs.ruleIndex,
+			})
+		})
+		sh.mu.Unlock()
+	}
+	slices.SortStableFunc(ret, func(a, b Flow) int { return b.LastSeen.Compare(a.LastSeen) })
+	return ret
+}
+
 // RunIn determines whether this node is allowed to receive q from a
 // Tailscale peer.
 func (f *Filter) RunIn(q *packet.Parsed, rf RunFlags) Response {
+	return f.runIn(q, rf, true)
+}
+
+// runIn implements RunIn. If track is true, packets accepted by a rule
+// are counted in the rule's hits and their flows are tracked.
+func (f *Filter) runIn(q *packet.Parsed, rf RunFlags, track bool) Response {
 	dir := in
-	r := f.pre(q, rf, dir)
+	r, _ := f.pre(q, rf, dir)
 	if r == Accept || r == Drop {
 		// already logged
 		return r
 	}
 
 	var why string
+	rule := -1
 	switch q.IPVersion {
 	case 4:
-		r, why = f.runIn4(q)
+		r, why, rule = f.runIn4(q)
 	case 6:
-		r, why = f.runIn6(q)
+		r, why, rule = f.runIn6(q)
 	default:
 		r, why = Drop, "not-ip"
 	}
+	if track && rule >= 0 {
+		f.acceptedByRule(q, rule)
+	}
 	f.logRateLimit(rf, q, dir, r, why)
 	return r
 }
 
+// acceptedByRule counts a hit of f.rules[rule], which accepted q, and
+// tracks q's flow. It only locks the flow's shard of f.state.accepted, not
+// f.state.mu, to keep contention off the per-packet path.
+func (f *Filter) acceptedByRule(q *packet.Parsed, rule int) {
+	f.hits[rule].Add(1)
+	t := flowtrack.Tuple{Proto: q.IPProto, Src: q.Src, Dst: q.Dst}
+	now := mono.Now()
+
+	sh := f.state.acceptedShard(t)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if fs, ok := sh.flows.Get(t); ok && fs.rule == &f.rules[rule] {
+		fs.lastSeen = now
+		return
+	}
+	sh.flows.Add(t, flowState{created: now, lastSeen: now, rule: &f.rules[rule], ruleIndex: rule})
+}
+
 // RunOut determines whether this node is allowed to send q to a
 // Tailscale peer.
 func (f *Filter) RunOut(q *packet.Parsed, rf RunFlags) Response {
 	dir := out
-	r := f.pre(q, rf, dir)
+	r, _ := f.pre(q, rf, dir)
 	if r == Accept || r == Drop {
 		// already logged
 		return r
@@ -406,12 +629,12 @@ func unknownProtoString(proto ipproto.Proto) string {
 	return s
 }
 
-func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string) {
+func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string, rule int) {
 	// A compromised peer could try to send us packets for
 	// destinations we didn't explicitly advertise. This check is to
 	// prevent that.
 	if !f.local.Contains(q.Dst.Addr()) {
-		return Drop, "destination not allowed"
+		return Drop, "destination not allowed", -1
 	}
 
 	switch q.IPProto {
@@ -422,10 +645,10 @@ func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string) {
 			//  We could choose to reject all packets that aren't
 			//  related to an existing ICMP-Echo, TCP, or UDP
 			//  session.
-			return Accept, "icmp response ok"
-		} else if f.matches4.matchIPsOnly(q) {
+			return Accept, "icmp response ok", -1
+		} else if i := f.matches4.matchIPsOnly(q); i >= 0 {
 			// If any port is open to an IP, allow ICMP to it.
-			return Accept, "icmp ok"
+			return Accept, "icmp ok", f.ruleIdx4[i]
 		}
 	case ipproto.TCP:
 		// For TCP, we want to allow *outgoing* connections,
@@ -437,41 +660,44 @@ func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string) {
 		// It happens to also be much faster.
 		// TODO(apenwarr): Skip the rest of decoding in this path?
 		if !q.IsTCPSyn() {
-			return Accept, "tcp non-syn"
+			return Accept, "tcp non-syn", -1
 		}
-		if f.matches4.match(q) {
-			return Accept, "tcp ok"
+		if i := f.matches4.match(q); i >= 0 {
+			return Accept, "tcp ok", f.ruleIdx4[i]
 		}
 	case ipproto.UDP, ipproto.SCTP:
 		t := flowtrack.Tuple{Proto: q.IPProto, Src: q.Src, Dst: q.Dst}
 
 		f.state.mu.Lock()
-		_, ok := f.state.lru.Get(t)
+		fs, ok := f.state.lru.Get(t)
+		if ok {
+			fs.lastSeen = mono.Now()
+		}
 		f.state.mu.Unlock()
 
 		if ok {
-			return Accept, "cached"
+			return Accept, "cached", -1
 		}
-		if f.matches4.match(q) {
-			return Accept, "ok"
+		if i := f.matches4.match(q); i >= 0 {
+			return Accept, "ok", f.ruleIdx4[i]
 		}
 	case ipproto.TSMP:
-		return Accept, "tsmp ok"
+		return Accept, "tsmp ok", -1
 	default:
-		if f.matches4.matchProtoAndIPsOnlyIfAllPorts(q) {
-			return Accept, "other-portless ok"
+		if i := f.matches4.matchProtoAndIPsOnlyIfAllPorts(q); i >= 0 {
+			return Accept, "other-portless ok", f.ruleIdx4[i]
 		}
-		return Drop, unknownProtoString(q.IPProto)
+		return Drop, unknownProtoString(q.IPProto), -1
 	}
-	return Drop, "no rules matched"
+	return Drop, "no rules matched", -1
 }
 
-func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
+func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string, rule int) {
 	// A compromised peer could try to send us packets for
 	// destinations we didn't explicitly advertise. This check is to
 	// prevent that.
 	if !f.local.Contains(q.Dst.Addr()) {
-		return Drop, "destination not allowed"
+		return Drop, "destination not allowed", -1
 	}
 
 	switch q.IPProto {
@@ -482,10 +708,10 @@ func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
 			//  We could choose to reject all packets that aren't
 			//  related to an existing ICMP-Echo, TCP, or UDP
 			//  session.
-			return Accept, "icmp response ok"
-		} else if f.matches6.matchIPsOnly(q) {
+			return Accept, "icmp response ok", -1
+		} else if i := f.matches6.matchIPsOnly(q); i >= 0 {
 			// If any port is open to an IP, allow ICMP to it.
-			return Accept, "icmp ok"
+			return Accept, "icmp ok", f.ruleIdx6[i]
 		}
 	case ipproto.TCP:
 		// For TCP, we want to allow *outgoing* connections,
@@ -497,33 +723,36 @@ func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
 		// It happens to also be much faster.
 		// TODO(apenwarr): Skip the rest of decoding in this path?
 		if q.IPProto == ipproto.TCP && !q.IsTCPSyn() {
-			return Accept, "tcp non-syn"
+			return Accept, "tcp non-syn", -1
 		}
-		if f.matches6.match(q) {
-			return Accept, "tcp ok"
+		if i := f.matches6.match(q); i >= 0 {
+			return Accept, "tcp ok", f.ruleIdx6[i]
 		}
 	case ipproto.UDP, ipproto.SCTP:
 		t := flowtrack.Tuple{Proto: q.IPProto, Src: q.Src, Dst: q.Dst}
 
 		f.state.mu.Lock()
-		_, ok := f.state.lru.Get(t)
+		fs, ok := f.state.lru.Get(t)
+		if ok {
+			fs.lastSeen = mono.Now()
+		}
 		f.state.mu.Unlock()
 
 		if ok {
-			return Accept, "cached"
+			return Accept, "cached", -1
 		}
-		if f.matches6.match(q) {
-			return Accept, "ok"
+		if i := f.matches6.match(q); i >= 0 {
+			return Accept, "ok", f.ruleIdx6[i]
 		}
 	case ipproto.TSMP:
-		return Accept, "tsmp ok"
+		return Accept, "tsmp ok", -1
 	default:
-		if f.matches6.matchProtoAndIPsOnlyIfAllPorts(q) {
-			return Accept, "other-portless ok"
+		if i := f.matches6.matchProtoAndIPsOnlyIfAllPorts(q); i >= 0 {
+			return Accept, "other-portless ok", f.ruleIdx6[i]
 		}
-		return Drop, unknownProtoString(q.IPProto)
+		return Drop, unknownProtoString(q.IPProto), -1
 	}
-	return Drop, "no rules matched"
+	return Drop, "no rules matched", -1
 }
 
 // runIn runs the output-specific part of the filter logic.
@@ -534,8 +763,13 @@ func (f *Filter) runOut(q *packet.Parsed) (r Response, why string) {
 			Proto: q.IPProto,
 			Src:   q.Dst, Dst: q.Src, // src/dst reversed
 		}
+		now := mono.Now()
 		f.state.mu.Lock()
-		f.state.lru.Add(tuple, struct{}{})
+		if fs, ok := f.state.lru.Get(tuple); ok {
+			fs.lastSeen = now
+		} else {
+			f.state.lru.Add(tuple, flowState{created: now, lastSeen: now, ruleIndex: -1})
+		}
 		f.state.mu.Unlock()
 	}
 	return Accept, "ok out"
@@ -563,35 +797,35 @@ func (d direction) String() string {
 
 var gcpDNSAddr = netaddr.IPv4(169, 254, 169, 254)
 
-// pre runs the direction-agnostic filter logic. dir is only used for
-// logging.
-func (f *Filter) pre(q *packet.Parsed, rf RunFlags, dir direction) Response {
+// pre runs the direction-agnostic filter logic, returning the verdict and
+// why, if any. dir is only used for logging.
+func (f *Filter) pre(q *packet.Parsed, rf RunFlags, dir direction) (Response, string) {
 	if len(q.Buffer()) == 0 {
 		// wireguard keepalive packet, always permit.
-		return Accept
+		return Accept, "keepalive"
 	}
 	if len(q.Buffer()) < 20 {
 		f.logRateLimit(rf, q, dir, Drop, "too short")
-		return Drop
+		return Drop, "too short"
 	}
 
 	if q.Dst.Addr().IsMulticast() {
 		f.logRateLimit(rf, q, dir, Drop, "multicast")
-		return Drop
+		return Drop, "multicast"
 	}
 	if q.Dst.Addr().IsLinkLocalUnicast() && q.Dst.Addr() != gcpDNSAddr {
 		f.logRateLimit(rf, q, dir, Drop, "link-local-unicast")
-		return Drop
+		return Drop, "link-local-unicast"
 	}
 
 	if q.IPProto == ipproto.Fragment {
 		// Fragments after the first always need to be passed through.
 		// Very small fragments are considered Junk by Parsed.
 		f.logRateLimit(rf, q, dir, Accept, "fragment")
-		return Accept
+		return Accept, "fragment"
 	}
 
-	return noVerdict
+	return noVerdict, ""
 }
 
 // loggingAllowed reports whether p can appear in logs at all.
@@ -10,6 +10,7 @@
 	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -135,7 +136,7 @@ type InOut struct {
 		if test.p.IPVersion == 6 {
 			aclFunc = acl.runIn6
 		}
-		if got, why := aclFunc(&test.p); test.want != got {
+		if got, why, _ := aclFunc(&test.p); test.want != got {
 			t.Errorf("#%d runIn got=%v want=%v why=%q packet:%v", i, got, test.want, why, test.p)
 		}
 		if test.p.IPProto == ipproto.TCP {
@@ -150,7 +151,7 @@ type InOut struct {
 			}
 			// TCP and UDP are treated equivalently in the filter - verify that.
 			test.p.IPProto = ipproto.UDP
-			if got, why := aclFunc(&test.p); test.want != got {
+			if got, why, _ := aclFunc(&test.p); test.want != got {
 				t.Errorf("#%d runIn (UDP) got=%v want=%v why=%q packet:%v", i, got, test.want, why, test.p)
 			}
 		}
@@ -196,6 +197,120 @@ func TestUDPState(t *testing.T) {
 	}
 }
 
+func TestFlowsAndRuleHits(t *testing.T) {
+	acl := newFilter(t.Logf)
+
+	// An outgoing UDP flow, then its return traffic.
+	out := parsed(ipproto.UDP, "119.119.119.119", "102.102.102.102", 4242, 53)
+	acl.RunOut(&out, 0)
+	back := parsed(ipproto.UDP, "102.102.102.102", "119.119.119.119", 53, 4242)
+	if got := acl.RunIn(&back, 0); got != Accept {
+		t.Fatalf("return traffic = %v; want Accept", got)
+	}
+
+	// An incoming TCP connection accepted by rule 3, twice, and one
+	// that's dropped.
+	syn := parsed(ipproto.TCP, "2.2.2.2", "8.1.1.1", 1234, 22)
+	syn.TCPFlags = packet.TCPSyn
+	for i := 0; i < 2; i++ {
+		if got := acl.RunIn(&syn, 0); got != Accept {
+			t.Fatalf("SYN = %v; want Accept", got)
+		}
+	}
+	denied := parsed(ipproto.TCP, "3.3.3.3", "8.1.1.1", 1234, 22)
+	denied.TCPFlags = packet.TCPSyn
+	if got := acl.RunIn(&denied, 0); got != Drop {
+		t.Fatalf("denied SYN = %v; want Drop", got)
+	}
+	// Synthesized checks aren't counted.
+	acl.CheckTCP(netip.MustParseAddr("2.2.2.2"), netip.MustParseAddr("8.1.1.1"), 22)
+
+	hits := acl.RuleHits()
+	if len(hits) != 11 {
+		t.Fatalf("RuleHits has %d rules; want 11", len(hits))
+	}
+	for i, h := range hits {
+		want := uint64(0)
+		if i == 3 {
+			want = 2
+		}
+		if h.Hits != want {
+			t.Errorf("rule %d (%v) hits = %d; want %d", i, h.Match, h.Hits, want)
+		}
+	}
+
+	flows := acl.Flows()
+	if len(flows) != 2 {
+		t.Fatalf("Flows = %+v; want 2 flows", flows)
+	}
+	for _, f := range flows {
+		switch {
+		case f.Outgoing:
+			if f.Src != out.Src || f.Dst != out.Dst || f.Proto != ipproto.UDP || f.RuleIndex != -1 {
+				t.Errorf("outgoing flow = %+v; want %v => %v", f, out.Src, out.Dst)
+			}
+		default:
+			if f.Src != syn.Src || f.Dst != syn.Dst || f.RuleIndex != 3 || f.Rule.String() != hits[3].Match.String() {
+				t.Errorf("incoming flow = %+v; want %v => %v by rule 3", f, syn.Src, syn.Dst)
+			}
+		}
+		if f.Created.IsZero() || f.LastSeen.Before(f.Created) {
+			t.Errorf("flow %v: Created, LastSeen = %v, %v", f.Tuple, f.Created, f.LastSeen)
+		}
+	}
+
+	// Flows are kept by a filter that shares state, but hits aren't.
+	acl2 := New(acl.rules, acl.local, acl.logIPs, acl, t.Logf)
+	if got := len(acl2.Flows()); got != 2 {
+		t.Errorf("new filter has %d flows; want 2", got)
+	}
+	if got := acl2.RuleHits()[3].Hits; got != 0 {
+		t.Errorf("new filter rule 3 hits = %d; want 0", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	acl := newFilter(t.Logf)
+	ap := netip.MustParseAddrPort
+	tests := []struct {
+		name     string
+		proto    ipproto.Proto
+		src, dst string
+		outgoing bool
+		want     Response
+		wantRule int
+	}{
+		{"tcp-allowed", ipproto.TCP, "2.2.2.2:0", "8.1.1.1:22", false, Accept, 3},
+		{"tcp-denied", ipproto.TCP, "3.3.3.3:0", "8.1.1.1:22", false, Drop, -1},
+		{"udp-allowed", ipproto.UDP, "1.1.1.1:0", "1.2.3.4:443", false, Accept, 5},
+		{"icmp-allowed", ipproto.ICMPv4, "8.1.1.1:0", "5.6.7.8:0", false, Accept, 0},
+		{"v6", ipproto.TCP, "[::2]:0", "[2001::2]:22", false, Accept, 7},
+		{"not-local", ipproto.TCP, "2.2.2.2:0", "8.2.1.1:22", false, Drop, -1},
+		{"multicast", ipproto.UDP, "1.1.1.1:0", "224.0.0.1:5353", false, Drop, -1},
+		{"outgoing", ipproto.UDP, "1.2.3.4:5000", "9.9.9.9:53", true, Accept, -1},
+		{"mixed-families", ipproto.TCP, "2.2.2.2:0", "[2001::2]:22", false, Drop, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := acl.Check(tt.proto, ap(tt.src), ap(tt.dst), tt.outgoing)
+			if got.Response != tt.want || got.RuleIndex != tt.wantRule {
+				t.Errorf("Check = %v (%q), rule %d; want %v, rule %d", got.Response, got.Why, got.RuleIndex, tt.want, tt.wantRule)
+			}
+			if got.RuleIndex >= 0 && got.Rule.String() != acl.rules[got.RuleIndex].String() {
+				t.Errorf("Rule = %v; want %v", got.Rule, acl.rules[got.RuleIndex])
+			}
+		})
+	}
+	for i, rh := range acl.RuleHits() {
+		if rh.Hits != 0 {
+			t.Errorf("rule %d has %d hits after Check; want 0", i, rh.Hits)
+		}
+	}
+	if flows := acl.Flows(); len(flows) != 0 {
+		t.Errorf("Flows after Check = %+v; want none", flows)
+	}
+}
+
 func TestNoAllocs(t *testing.T) {
 	acl := newFilter(t.Logf)
 
@@ -327,6 +442,30 @@ func BenchmarkFilter(b *testing.B) {
 	}
 }
 
+// BenchmarkFilterParallel measures RunIn with many goroutines receiving
+// packets of distinct flows accepted by a rule, as when several peers send
+// to this node at once.
+func BenchmarkFilterParallel(b *testing.B) {
+	for _, proto := range []ipproto.Proto{ipproto.UDP, ipproto.ICMPv4} {
+		b.Run(proto.String(), func(b *testing.B) {
+			acl := newFilter(b.Logf)
+			var next atomic.Uint32
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine sends from its own source port.
+				port := uint16(1000 + next.Add(1))
+				pkt := raw4(proto, "8.1.1.1", "1.2.3.4", port, 22, 0)
+				for pb.Next() {
+					q := &packet.Parsed{}
+					q.Decode(pkt)
+					acl.RunIn(q, 0)
+				}
+			})
+		})
+	}
+}
+
 func TestPreFilter(t *testing.T) {
 	packets := []struct {
 		desc string
@@ -345,7 +484,7 @@ func TestPreFilter(t *testing.T) {
 	for _, testPacket := range packets {
 		p := &packet.Parsed{}
 		p.Decode(testPacket.b)
-		got := f.pre(p, LogDrops|LogAccepts, in)
+		got, _ := f.pre(p, LogDrops|LogAccepts, in)
 		if got != testPacket.want {
 			t.Errorf("%q got=%v want=%v packet:\n%s", testPacket.desc, got, testPacket.want, packet.Hexdump(testPacket.b))
 		}
@@ -865,7 +1004,7 @@ func TestMatchesMatchProtoAndIPsOnlyIfAllPorts(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			matches := matches{tt.m}
-			got := matches.matchProtoAndIPsOnlyIfAllPorts(&tt.p)
+			got := matches.matchProtoAndIPsOnlyIfAllPorts(&tt.p) >= 0
 			if got != tt.want {
 				t.Errorf("got = %v; want %v", got, tt.want)
 			}
@@ -99,8 +99,10 @@ func (m Match) String() string {
 
 type matches []Match
 
-func (ms matches) match(q *packet.Parsed) bool {
-	for _, m := range ms {
+// match returns the index in ms of the first Match that q matches, or -1 if
+// none does.
+func (ms matches) match(q *packet.Parsed) int {
+	for i, m := range ms {
 		if !protoInList(q.IPProto, m.IPProto) {
 			continue
 		}
@@ -114,31 +116,33 @@ func (ms matches) match(q *packet.Parsed) bool {
 			if !dst.Ports.contains(q.Dst.Port()) {
 				continue
 			}
-			return true
+			return i
 		}
 	}
-	return false
+	return -1
 }
 
-func (ms matches) matchIPsOnly(q *packet.Parsed) bool {
-	for _, m := range ms {
+// matchIPsOnly is like match, but ignores the protocol and ports.
+func (ms matches) matchIPsOnly(q *packet.Parsed) int {
+	for i, m := range ms {
 		if !ipInList(q.Src.Addr(), m.Srcs) {
 			continue
 		}
 		for _, dst := range m.Dsts {
 			if dst.Net.Contains(q.Dst.Addr()) {
-				return true
+				return i
 			}
 		}
 	}
-	return false
+	return -1
 }
 
-// matchProtoAndIPsOnlyIfAllPorts reports q matches any Match in ms where the
-// Match if for the right IP Protocol and IP address, but ports are
-// ignored, as long as the match is for the entire uint16 port range.
-func (ms matches) matchProtoAndIPsOnlyIfAllPorts(q *packet.Parsed) bool {
-	for _, m := range ms {
+// matchProtoAndIPsOnlyIfAllPorts returns the index of the first Match in ms
+// that q matches, or -1, where the Match if for the right IP Protocol and IP
+// address, but ports are ignored, as long as the match is for the entire
+// uint16 port range.
+func (ms matches) matchProtoAndIPsOnlyIfAllPorts(q *packet.Parsed) int {
+	for i, m := range ms {
 		if !protoInList(q.IPProto, m.IPProto) {
 			continue
 		}
@@ -150,11 +154,11 @@ func (ms matches) matchProtoAndIPsOnlyIfAllPorts(q *packet.Parsed) bool {
 				continue
 			}
 			if dst.Net.Contains(q.Dst.Addr()) {
-				return true
+				return i
 			}
 		}
 	}
-	return false
+	return -1
 }
 
 func ipInList(ip netip.Addr, netlist []netip.Prefix) bool {
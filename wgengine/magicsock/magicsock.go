@@ -614,6 +614,8 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 		DERPLatency:           map[string]float64{},
 		MappingVariesByDestIP: report.MappingVariesByDestIP,
 		HairPinning:           report.HairPinning,
+		NATMapping:            string(report.NATMapping),
+		NATFiltering:          string(report.NATFiltering),
 		UPnP:                  report.UPnP,
 		PMP:                   report.PMP,
 		PCP:                   report.PCP,
@@ -2105,6 +2107,17 @@ func (c *Conn) shouldDoPeriodicReSTUNLocked() bool {
 
 func (c *Conn) onPortMapChanged() { c.ReSTUN("portmap-changed") }
 
+// NoteLinkChange records a major network change, to be marked in the
+// netcheck history.
+func (c *Conn) NoteLinkChange() {
+	c.netChecker.NoteLinkChange()
+}
+
+// NetcheckHistory returns the recent netcheck reports, oldest first.
+func (c *Conn) NetcheckHistory() []netcheck.HistoryEntry {
+	return c.netChecker.History()
+}
+
 // ReSTUN triggers an address discovery.
 // The provided why string is for debug logging only.
 func (c *Conn) ReSTUN(why string) {
@@ -0,0 +1,373 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/types/netlogtype"
+)
+
+// Versions of the export protocol supported by IPFIXSink.
+const (
+	IPFIXVersion    = 10 // IPFIX, RFC 7011
+	NetFlow9Version = 9  // NetFlow v9, RFC 3954
+)
+
+const (
+	// ipfixMaxPacketSize is the maximum size of an exported UDP packet,
+	// chosen to avoid fragmentation on typical paths.
+	ipfixMaxPacketSize = 1400
+
+	// ipfixTemplateRefresh is how often templates are resent, since
+	// collectors may miss them or restart (RFC 7011 section 10.3.6).
+	ipfixTemplateRefresh = time.Minute
+
+	ipfixTemplateIDv4 = 256
+	ipfixTemplateIDv6 = 257
+)
+
+// Information element IDs, from the IANA IPFIX registry. The IDs below 128
+// are the same as the NetFlow v9 field types.
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieFlowEndSysUpTime         = 21 // NetFlow v9 LAST_SWITCHED
+	ieFlowStartSysUpTime       = 22 // NetFlow v9 FIRST_SWITCHED
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowDirection            = 61
+	ieFlowStartMilliseconds    = 152 // IPFIX only
+	ieFlowEndMilliseconds      = 153 // IPFIX only
+)
+
+type ipfixField struct{ id, length uint16 }
+
+// ipfixTemplate returns the fields of the data records of templateID in
+// the given protocol version, in the order written by appendRecord.
+//
+// IPFIX records are timed in milliseconds since the Unix epoch. NetFlow
+// v9 has no such fields, so its records are timed in milliseconds of
+// system uptime, like the packet header's.
+func ipfixTemplate(version, templateID uint16) []ipfixField {
+	addrLen := uint16(4)
+	srcAddr, dstAddr := uint16(ieSourceIPv4Address), uint16(ieDestinationIPv4Address)
+	if templateID == ipfixTemplateIDv6 {
+		addrLen = 16
+		srcAddr, dstAddr = ieSourceIPv6Address, ieDestinationIPv6Address
+	}
+	start, end := ipfixField{ieFlowStartMilliseconds, 8}, ipfixField{ieFlowEndMilliseconds, 8}
+	if version == NetFlow9Version {
+		start, end = ipfixField{ieFlowStartSysUpTime, 4}, ipfixField{ieFlowEndSysUpTime, 4}
+	}
+	return []ipfixField{
+		{srcAddr, addrLen},
+		{dstAddr, addrLen},
+		{ieSourceTransportPort, 2},
+		{ieDestinationTransportPort, 2},
+		{ieProtocolIdentifier, 1},
+		{ieFlowDirection, 1},
+		{ieOctetDeltaCount, 8},
+		{iePacketDeltaCount, 8},
+		start,
+		end,
+	}
+}
+
+// ipfixRecordSize returns the size of a data record of templateID in the
+// given protocol version.
+func ipfixRecordSize(version, templateID uint16) int {
+	n := 0
+	for _, f := range ipfixTemplate(version, templateID) {
+		n += int(f.length)
+	}
+	return n
+}
+
+// ipfixFlow is a unidirectional flow, exported as a data record.
+type ipfixFlow struct {
+	src, dst   netip.AddrPort
+	proto      uint8
+	egress     bool
+	bytes, pkt uint64
+}
+
+// templateID returns the template of the flow's data record.
+func (f *ipfixFlow) templateID() uint16 {
+	if f.src.Addr().Is6() || f.dst.Addr().Is6() {
+		return ipfixTemplateIDv6
+	}
+	return ipfixTemplateIDv4
+}
+
+// IPFIXSink is a Sink that exports the connections in messages as flow
+// records over UDP, using IPFIX or NetFlow v9.
+//
+// Each connection is exported as up to two unidirectional flows: an
+// egress flow from its source to its destination with the transmitted
+// counts, and an ingress flow in the reverse direction with the received
+// counts. Flows are timed by the start and end of the message. Physical
+// traffic isn't exported, since it isn't flows between the addresses that
+// collectors know.
+type IPFIXSink struct {
+	conn     net.Conn
+	version  uint16
+	domainID uint32
+	started  time.Time // for the NetFlow v9 system uptime
+
+	mu            sync.Mutex
+	seq           uint32    // the next sequence number
+	lastTemplates time.Time // when templates were last sent
+	pkt           ipfixPacket
+}
+
+// NewIPFIXSink returns an IPFIXSink that exports flows to the collector at
+// the UDP address "host:port", using version IPFIXVersion or
+// NetFlow9Version. The domainID is the observation domain ID (IPFIX) or
+// source ID (NetFlow v9) of the exported packets.
+func NewIPFIXSink(collector string, version uint16, domainID uint32) (*IPFIXSink, error) {
+	if version != IPFIXVersion && version != NetFlow9Version {
+		return nil, fmt.Errorf("unsupported IPFIX version %d", version)
+	}
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+	return &IPFIXSink{
+		conn:     conn,
+		version:  version,
+		domainID: domainID,
+		started:  time.Now(),
+	}, nil
+}
+
+// WriteMessage implements Sink.
+func (s *IPFIXSink) WriteMessage(m *netlogtype.Message) error {
+	var flows []ipfixFlow
+	for _, traffic := range [][]netlogtype.ConnectionCounts{m.VirtualTraffic, m.SubnetTraffic, m.ExitTraffic} {
+		for _, cc := range traffic {
+			if !cc.Src.Addr().IsValid() && !cc.Dst.Addr().IsValid() {
+				continue
+			}
+			if cc.TxPackets > 0 || cc.TxBytes > 0 {
+				flows = append(flows, ipfixFlow{src: cc.Src, dst: cc.Dst, proto: uint8(cc.Proto), egress: true, bytes: cc.TxBytes, pkt: cc.TxPackets})
+			}
+			if cc.RxPackets > 0 || cc.RxBytes > 0 {
+				flows = append(flows, ipfixFlow{src: cc.Dst, dst: cc.Src, proto: uint8(cc.Proto), bytes: cc.RxBytes, pkt: cc.RxPackets})
+			}
+		}
+	}
+	if len(flows) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.pkt.reset(s.version)
+	if now.Sub(s.lastTemplates) >= ipfixTemplateRefresh {
+		s.pkt.appendTemplates()
+		s.lastTemplates = now
+	}
+	start, end := uint64(m.Start.UnixMilli()), uint64(m.End.UnixMilli())
+	if s.version == NetFlow9Version {
+		start, end = uint64(s.uptime(m.Start)), uint64(s.uptime(m.End))
+	}
+	for i := range flows {
+		f := &flows[i]
+		if !s.pkt.fits(ipfixRecordSize(s.version, f.templateID())) {
+			if err := s.sendLocked(now); err != nil {
+				return err
+			}
+			s.pkt.reset(s.version)
+		}
+		s.pkt.appendRecord(f, start, end)
+	}
+	return s.sendLocked(now)
+}
+
+// sendLocked finishes and sends s.pkt. s.mu must be held.
+func (s *IPFIXSink) sendLocked(now time.Time) error {
+	var b []byte
+	switch s.version {
+	case IPFIXVersion:
+		// The sequence number counts the data records sent before.
+		b = s.pkt.finish(uint32(now.Unix()), s.seq, s.domainID, 0)
+		s.seq += uint32(s.pkt.dataRecords)
+	case NetFlow9Version:
+		// The sequence number counts the packets sent before.
+		b = s.pkt.finish(uint32(now.Unix()), s.seq, s.domainID, s.uptime(now))
+		s.seq++
+	}
+	_, err := s.conn.Write(b)
+	return err
+}
+
+// uptime returns t as NetFlow v9 system uptime: milliseconds since s
+// started, modulo 2^32.
+func (s *IPFIXSink) uptime(t time.Time) uint32 {
+	return uint32(t.Sub(s.started).Milliseconds())
+}
+
+// Close implements Sink.
+func (s *IPFIXSink) Close() error {
+	return s.conn.Close()
+}
+
+// ipfixPacket builds an IPFIX or NetFlow v9 packet.
+type ipfixPacket struct {
+	version     uint16
+	b           []byte
+	setStart    int    // offset of the open set's header, or 0 if none
+	setID       uint16 // ID of the open set
+	dataRecords int
+	records     int // including template records
+}
+
+// Sizes of the packet headers and of a set header.
+const (
+	ipfixHeaderSize    = 16
+	netflow9HeaderSize = 20
+	ipfixSetHeaderSize = 4
+)
+
+func (p *ipfixPacket) headerSize() int {
+	if p.version == NetFlow9Version {
+		return netflow9HeaderSize
+	}
+	return ipfixHeaderSize
+}
+
+func (p *ipfixPacket) reset(version uint16) {
+	p.version = version
+	p.b = append(p.b[:0], make([]byte, p.headerSize())...)
+	p.setStart, p.setID = 0, 0
+	p.dataRecords, p.records = 0, 0
+}
+
+// fits reports whether a data record of n bytes fits in the packet,
+// including the header of a new set and its padding.
+func (p *ipfixPacket) fits(n int) bool {
+	return p.records == 0 || len(p.b)+ipfixSetHeaderSize+n+3 <= ipfixMaxPacketSize
+}
+
+// openSet makes id the open set, closing any other.
+func (p *ipfixPacket) openSet(id uint16) {
+	if p.setStart != 0 && p.setID == id {
+		return
+	}
+	p.closeSet()
+	p.setStart, p.setID = len(p.b), id
+	p.b = append(p.b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(p.b[p.setStart:], id)
+}
+
+// closeSet pads the open set to a multiple of four bytes, as NetFlow v9
+// requires, and fills in its length.
+func (p *ipfixPacket) closeSet() {
+	if p.setStart == 0 {
+		return
+	}
+	for p.version == NetFlow9Version && (len(p.b)-p.setStart)%4 != 0 {
+		p.b = append(p.b, 0)
+	}
+	binary.BigEndian.PutUint16(p.b[p.setStart+2:], uint16(len(p.b)-p.setStart))
+	p.setStart = 0
+}
+
+func (p *ipfixPacket) appendTemplates() {
+	setID := uint16(2) // IPFIX template set
+	if p.version == NetFlow9Version {
+		setID = 0 // NetFlow v9 template FlowSet
+	}
+	p.openSet(setID)
+	for _, id := range []uint16{ipfixTemplateIDv4, ipfixTemplateIDv6} {
+		fields := ipfixTemplate(p.version, id)
+		p.b = binary.BigEndian.AppendUint16(p.b, id)
+		p.b = binary.BigEndian.AppendUint16(p.b, uint16(len(fields)))
+		for _, f := range fields {
+			p.b = binary.BigEndian.AppendUint16(p.b, f.id)
+			p.b = binary.BigEndian.AppendUint16(p.b, f.length)
+		}
+		p.records++
+	}
+}
+
+// appendRecord appends a data record for f, which started and ended at the
+// given times: in Unix milliseconds for IPFIX, or system uptime for
+// NetFlow v9.
+func (p *ipfixPacket) appendRecord(f *ipfixFlow, start, end uint64) {
+	id := f.templateID()
+	p.openSet(id)
+	if id == ipfixTemplateIDv6 {
+		src, dst := f.src.Addr().As16(), f.dst.Addr().As16()
+		if !f.src.Addr().IsValid() {
+			src = [16]byte{}
+		}
+		if !f.dst.Addr().IsValid() {
+			dst = [16]byte{}
+		}
+		p.b = append(p.b, src[:]...)
+		p.b = append(p.b, dst[:]...)
+	} else {
+		src, dst := [4]byte{}, [4]byte{}
+		if f.src.Addr().Is4() {
+			src = f.src.Addr().As4()
+		}
+		if f.dst.Addr().Is4() {
+			dst = f.dst.Addr().As4()
+		}
+		p.b = append(p.b, src[:]...)
+		p.b = append(p.b, dst[:]...)
+	}
+	p.b = binary.BigEndian.AppendUint16(p.b, f.src.Port())
+	p.b = binary.BigEndian.AppendUint16(p.b, f.dst.Port())
+	var direction byte // ingress
+	if f.egress {
+		direction = 1
+	}
+	p.b = append(p.b, f.proto, direction)
+	p.b = binary.BigEndian.AppendUint64(p.b, f.bytes)
+	p.b = binary.BigEndian.AppendUint64(p.b, f.pkt)
+	if p.version == NetFlow9Version {
+		p.b = binary.BigEndian.AppendUint32(p.b, uint32(start))
+		p.b = binary.BigEndian.AppendUint32(p.b, uint32(end))
+	} else {
+		p.b = binary.BigEndian.AppendUint64(p.b, start)
+		p.b = binary.BigEndian.AppendUint64(p.b, end)
+	}
+	p.dataRecords++
+	p.records++
+}
+
+// finish closes the open set, fills in the packet header and returns the
+// packet. The uptime is only used by NetFlow v9.
+func (p *ipfixPacket) finish(exportTime, seq, domainID, uptime uint32) []byte {
+	p.closeSet()
+	h := p.b[:p.headerSize()]
+	binary.BigEndian.PutUint16(h[0:], p.version)
+	if p.version == NetFlow9Version {
+		binary.BigEndian.PutUint16(h[2:], uint16(p.records))
+		binary.BigEndian.PutUint32(h[4:], uptime)
+		binary.BigEndian.PutUint32(h[8:], exportTime)
+		binary.BigEndian.PutUint32(h[12:], seq)
+		binary.BigEndian.PutUint32(h[16:], domainID)
+	} else {
+		binary.BigEndian.PutUint16(h[2:], uint16(len(p.b)))
+		binary.BigEndian.PutUint32(h[4:], exportTime)
+		binary.BigEndian.PutUint32(h[8:], seq)
+		binary.BigEndian.PutUint32(h[12:], domainID)
+	}
+	return p.b
+}
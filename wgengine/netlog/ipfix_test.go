@@ -0,0 +1,205 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+)
+
+// parseIPFIX parses an IPFIX or NetFlow v9 packet written by IPFIXSink,
+// returning its sequence number, the IDs of its template records, and its
+// data records in a compact form.
+func parseIPFIX(t *testing.T, b []byte) (version uint16, seq uint32, templates []uint16, records []string) {
+	t.Helper()
+	version = binary.BigEndian.Uint16(b)
+	hlen, templateSetID := ipfixHeaderSize, uint16(2)
+	switch version {
+	case IPFIXVersion:
+		if n := int(binary.BigEndian.Uint16(b[2:])); n != len(b) {
+			t.Fatalf("IPFIX length = %d; want %d", n, len(b))
+		}
+		seq = binary.BigEndian.Uint32(b[8:])
+	case NetFlow9Version:
+		hlen, templateSetID = netflow9HeaderSize, 0
+		seq = binary.BigEndian.Uint32(b[12:])
+	default:
+		t.Fatalf("unknown version %d", version)
+	}
+	var count int
+	wantCount := int(binary.BigEndian.Uint16(b[2:]))
+	for b = b[hlen:]; len(b) > 0; {
+		id, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if version == NetFlow9Version && n%4 != 0 {
+			t.Fatalf("set length %d isn't padded", n)
+		}
+		set := b[ipfixSetHeaderSize:n]
+		b = b[n:]
+		if id == templateSetID {
+			for len(set) > 0 {
+				tid, nfields := binary.BigEndian.Uint16(set), int(binary.BigEndian.Uint16(set[2:]))
+				templates = append(templates, tid)
+				for i, f := range ipfixTemplate(version, tid) {
+					fb := set[4+4*i:]
+					if got := (ipfixField{binary.BigEndian.Uint16(fb), binary.BigEndian.Uint16(fb[2:])}); got != f {
+						t.Fatalf("template %d field %d = %v; want %v", tid, i, got, f)
+					}
+				}
+				set = set[4+4*nfields:]
+				count++
+			}
+			continue
+		}
+		size := ipfixRecordSize(version, id)
+		for len(set) >= size {
+			r := set[:size]
+			set = set[size:]
+			alen := 4
+			if id == ipfixTemplateIDv6 {
+				alen = 16
+			}
+			src, _ := netip.AddrFromSlice(r[:alen])
+			dst, _ := netip.AddrFromSlice(r[alen : 2*alen])
+			r = r[2*alen:]
+			var dur uint64
+			if version == NetFlow9Version {
+				dur = uint64(binary.BigEndian.Uint32(r[26:]) - binary.BigEndian.Uint32(r[22:]))
+			} else {
+				dur = binary.BigEndian.Uint64(r[30:]) - binary.BigEndian.Uint64(r[22:])
+			}
+			records = append(records, fmt.Sprintf("%v:%d -> %v:%d proto=%d egress=%d bytes=%d pkts=%d dur=%d",
+				src, binary.BigEndian.Uint16(r), dst, binary.BigEndian.Uint16(r[2:]), r[4], r[5],
+				binary.BigEndian.Uint64(r[6:]), binary.BigEndian.Uint64(r[14:]), dur))
+			count++
+		}
+	}
+	if version == NetFlow9Version && count != wantCount {
+		t.Fatalf("NetFlow v9 count = %d; want %d", wantCount, count)
+	}
+	return version, seq, templates, records
+}
+
+func TestIPFIXSink(t *testing.T) {
+	for _, version := range []uint16{IPFIXVersion, NetFlow9Version} {
+		t.Run(fmt.Sprint(version), func(t *testing.T) {
+			pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			s, err := NewIPFIXSink(pc.LocalAddr().String(), version, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			read := func() []byte {
+				t.Helper()
+				buf := make([]byte, 2*ipfixMaxPacketSize)
+				pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+				n, _, err := pc.ReadFrom(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n > ipfixMaxPacketSize {
+					t.Fatalf("packet size %d exceeds %d", n, ipfixMaxPacketSize)
+				}
+				return buf[:n]
+			}
+
+			if err := s.WriteMessage(testMessage()); err != nil {
+				t.Fatal(err)
+			}
+			gotVersion, seq, templates, records := parseIPFIX(t, read())
+			if gotVersion != version || seq != 0 {
+				t.Errorf("version, seq = %d, %d; want %d, 0", gotVersion, seq, version)
+			}
+			if want := []uint16{ipfixTemplateIDv4, ipfixTemplateIDv6}; !reflect.DeepEqual(templates, want) {
+				t.Errorf("templates = %v; want %v", templates, want)
+			}
+			want := []string{
+				"100.64.0.1:1234 -> 100.64.0.2:22 proto=6 egress=1 bytes=200 pkts=2 dur=5000",
+				"100.64.0.2:22 -> 100.64.0.1:1234 proto=6 egress=0 bytes=300 pkts=3 dur=5000",
+				"fd7a:115c:a1e0::1:5353 -> fd00::1:53 proto=17 egress=1 bytes=80 pkts=1 dur=5000",
+			}
+			if !reflect.DeepEqual(records, want) {
+				t.Errorf("records = %q; want %q", records, want)
+			}
+
+			// A large message is split across packets, without templates.
+			m := testMessage()
+			m.SubnetTraffic = nil
+			for i := 0; i < 100; i++ {
+				m.VirtualTraffic = append(m.VirtualTraffic, netlogtype.ConnectionCounts{
+					Connection: netlogtype.Connection{
+						Proto: ipproto.UDP,
+						Src:   netip.AddrPortFrom(netip.MustParseAddr("100.64.0.1"), uint16(1000+i)),
+						Dst:   netip.MustParseAddrPort("100.64.0.3:53"),
+					},
+					Counts: netlogtype.Counts{TxPackets: 1, TxBytes: 60},
+				})
+			}
+			if err := s.WriteMessage(m); err != nil {
+				t.Fatal(err)
+			}
+			wantSeq := uint32(1) // packets
+			if version == IPFIXVersion {
+				wantSeq = 3 // data records
+			}
+			var total int
+			for total < 102 {
+				_, seq, templates, records := parseIPFIX(t, read())
+				if seq != wantSeq {
+					t.Errorf("seq = %d; want %d", seq, wantSeq)
+				}
+				if len(templates) > 0 {
+					t.Errorf("templates resent: %v", templates)
+				}
+				if len(records) == 0 {
+					t.Fatal("packet without records")
+				}
+				total += len(records)
+				if version == IPFIXVersion {
+					wantSeq += uint32(len(records))
+				} else {
+					wantSeq++
+				}
+			}
+			if total != 102 {
+				t.Errorf("got %d records; want 102", total)
+			}
+		})
+	}
+}
+
+func TestIPFIXTemplateTimeFields(t *testing.T) {
+	ids := func(version uint16) []uint16 {
+		var ret []uint16
+		for _, f := range ipfixTemplate(version, ipfixTemplateIDv4) {
+			ret = append(ret, f.id)
+		}
+		return ret
+	}
+	// NetFlow v9 (RFC 3954) has no flowStart/EndMilliseconds field types.
+	for _, id := range ids(NetFlow9Version) {
+		if id >= 128 {
+			t.Errorf("NetFlow v9 template uses IPFIX-only element %d", id)
+		}
+	}
+	if got := ids(NetFlow9Version); !slices.Contains(got, ieFlowStartSysUpTime) || !slices.Contains(got, ieFlowEndSysUpTime) {
+		t.Errorf("NetFlow v9 template = %v; want FIRST_SWITCHED and LAST_SWITCHED", got)
+	}
+	if got := ids(IPFIXVersion); !slices.Contains(got, ieFlowStartMilliseconds) || !slices.Contains(got, ieFlowEndMilliseconds) {
+		t.Errorf("IPFIX template = %v; want flowStartMilliseconds and flowEndMilliseconds", got)
+	}
+}
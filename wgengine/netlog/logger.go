@@ -8,7 +8,7 @@
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -24,6 +24,7 @@
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/smallzstd"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
 	"tailscale.com/types/netlogtype"
 	"tailscale.com/util/multierr"
@@ -54,6 +55,7 @@ type Logger struct {
 	stats  *connstats.Statistics
 	tun    Device
 	sock   Device
+	sinks  []Sink
 
 	addrs    map[netip.Addr]bool
 	prefixes map[netip.Prefix]bool
@@ -63,7 +65,7 @@ type Logger struct {
 func (nl *Logger) Running() bool {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
-	return nl.logger != nil
+	return nl.stats != nil
 }
 
 var testClient *http.Client
@@ -93,51 +95,46 @@ func (nl *Logger) Running() bool {
 // The IP protocol and source port are always zero.
 // The sock is used to populated the PhysicalTraffic field in Message.
 // The netMon parameter is optional; if non-nil it's used to do faster interface lookups.
+//
+// In addition to the upload, messages are written to any local sinks
+// configured by the TS_NETLOG_FILE and TS_NETLOG_IPFIX environment
+// variables (see FileSink and IPFIXSink). If nodeLogID or domainLogID is
+// zero, as it is when network logging isn't enabled for the node by the
+// control plane, messages are only written to the sinks.
 func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID logid.PrivateID, tun, sock Device, netMon *netmon.Monitor) error {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
-	if nl.logger != nil {
-		return fmt.Errorf("network logger already running for %v", nl.logger.PrivateID().Public())
+	if nl.stats != nil {
+		return errors.New("network logger already running")
 	}
 
-	// Startup a log stream to Tailscale's logging service.
 	logf := log.Printf
-	httpc := &http.Client{Transport: logpolicy.NewLogtailTransport(logtail.DefaultHost, netMon, logf)}
-	if testClient != nil {
-		httpc = testClient
+	if !nodeLogID.IsZero() && !domainLogID.IsZero() {
+		nl.logger = newUploader(nodeLogID, domainLogID, netMon, logf)
 	}
-	nl.logger = logtail.NewLogger(logtail.Config{
-		Collection:    "tailtraffic.log.tailscale.io",
-		PrivateID:     nodeLogID,
-		CopyPrivateID: domainLogID,
-		Stderr:        io.Discard,
-		// TODO(joetsai): Set Buffer? Use an in-memory buffer for now.
-		NewZstdEncoder: func() logtail.Encoder {
-			w, err := smallzstd.NewEncoder(nil)
-			if err != nil {
-				panic(err)
-			}
-			return w
-		},
-		HTTPC: httpc,
 
-		// Include process sequence numbers to identify missing samples.
-		IncludeProcID:       true,
-		IncludeProcSequence: true,
-	}, logf)
-	nl.logger.SetSockstatsLabel(sockstats.LabelNetlogLogger)
+	// Open any local sinks. Failing to do so doesn't stop the upload.
+	sinks := sinksFromEnv(logf)
+	nl.sinks = sinks
+	sinkLogf := logger.RateLimitedFn(logf, time.Minute, 1, 1)
 
 	// Startup a data structure to track per-connection statistics.
 	// There is a maximum size for individual log messages that logtail
 	// can upload to the Tailscale log service, so stay below this limit.
 	const maxLogSize = 256 << 10
 	const maxConns = (maxLogSize - netlogtype.MaxMessageJSONSize) / netlogtype.MaxConnectionCountsJSONSize
+	uploader := nl.logger
 	nl.stats = connstats.NewStatistics(pollPeriod, maxConns, func(start, end time.Time, virtual, physical map[netlogtype.Connection]netlogtype.Counts) {
 		nl.mu.Lock()
 		addrs := nl.addrs
 		prefixes := nl.prefixes
 		nl.mu.Unlock()
-		recordStatistics(nl.logger, nodeID, start, end, virtual, physical, addrs, prefixes)
+		m := recordStatistics(uploader, nodeID, start, end, virtual, physical, addrs, prefixes)
+		if m != nil {
+			if err := writeSinks(sinks, m); err != nil {
+				sinkLogf("netlog: writing to local sinks: %v", err)
+			}
+		}
 	})
 
 	// Register the connection tracker into the TUN device.
@@ -157,7 +154,38 @@ func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID lo
 	return nil
 }
 
-func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start, end time.Time, connstats, sockStats map[netlogtype.Connection]netlogtype.Counts, addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool) {
+// newUploader starts a log stream to Tailscale's logging service.
+func newUploader(nodeLogID, domainLogID logid.PrivateID, netMon *netmon.Monitor, logf logger.Logf) *logtail.Logger {
+	httpc := &http.Client{Transport: logpolicy.NewLogtailTransport(logtail.DefaultHost, netMon, logf)}
+	if testClient != nil {
+		httpc = testClient
+	}
+	lt := logtail.NewLogger(logtail.Config{
+		Collection:    "tailtraffic.log.tailscale.io",
+		PrivateID:     nodeLogID,
+		CopyPrivateID: domainLogID,
+		Stderr:        io.Discard,
+		// TODO(joetsai): Set Buffer? Use an in-memory buffer for now.
+		NewZstdEncoder: func() logtail.Encoder {
+			w, err := smallzstd.NewEncoder(nil)
+			if err != nil {
+				panic(err)
+			}
+			return w
+		},
+		HTTPC: httpc,
+
+		// Include process sequence numbers to identify missing samples.
+		IncludeProcID:       true,
+		IncludeProcSequence: true,
+	}, logf)
+	lt.SetSockstatsLabel(sockstats.LabelNetlogLogger)
+	return lt
+}
+
+// recordStatistics logs a message with the provided statistics to logger,
+// if non-nil, returning the message, or nil if there was no traffic to log.
+func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start, end time.Time, connstats, sockStats map[netlogtype.Connection]netlogtype.Counts, addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool) *netlogtype.Message {
 	m := netlogtype.Message{NodeID: nodeID, Start: start.UTC(), End: end.UTC()}
 
 	classifyAddr := func(a netip.Addr) (isTailscale, withinRoute bool) {
@@ -208,12 +236,17 @@ func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start
 	}
 
 	if len(m.VirtualTraffic)+len(m.SubnetTraffic)+len(m.ExitTraffic)+len(m.PhysicalTraffic) > 0 {
+		if logger == nil {
+			return &m
+		}
 		if b, err := json.Marshal(m); err != nil {
 			logger.Logf("json.Marshal error: %v", err)
 		} else {
 			logger.Logf("%s", b)
 		}
+		return &m
 	}
+	return nil
 }
 
 func makeRouteMaps(cfg *router.Config) (addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool) {
@@ -255,7 +288,7 @@ func (nl *Logger) ReconfigRoutes(cfg *router.Config) {
 func (nl *Logger) Shutdown(ctx context.Context) error {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
-	if nl.logger == nil {
+	if nl.stats == nil {
 		return nil
 	}
 
@@ -265,7 +298,11 @@ func (nl *Logger) Shutdown(ctx context.Context) error {
 	nl.sock.SetStatistics(nil)
 	nl.tun.SetStatistics(nil)
 	err1 := nl.stats.Shutdown(ctx)
-	err2 := nl.logger.Shutdown(ctx)
+	var err2 error
+	if nl.logger != nil {
+		err2 = nl.logger.Shutdown(ctx)
+	}
+	err3 := closeSinks(nl.sinks)
 	nl.mu.Lock()
 
 	// Purge state.
@@ -273,8 +310,9 @@ func (nl *Logger) Shutdown(ctx context.Context) error {
 	nl.stats = nil
 	nl.tun = nil
 	nl.sock = nil
+	nl.sinks = nil
 	nl.addrs = nil
 	nl.prefixes = nil
 
-	return multierr.New(err1, err2)
+	return multierr.New(err1, err2, err3)
 }
@@ -0,0 +1,242 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netlogtype"
+	"tailscale.com/util/multierr"
+)
+
+// Sink is a local destination for network flow log messages, in addition
+// to the upload to the log service.
+type Sink interface {
+	// WriteMessage records m. It's called from a single goroutine, at
+	// most once per poll period, and must not retain m.
+	WriteMessage(m *netlogtype.Message) error
+
+	// Close flushes any buffered data and releases the sink's resources.
+	Close() error
+}
+
+var (
+	// sinkFile is the path of a file to write messages to, as JSON lines;
+	// see FileSink.
+	sinkFile = envknob.RegisterString("TS_NETLOG_FILE")
+
+	// sinkIPFIX is the "host:port" of an IPFIX collector to export flows
+	// to over UDP; see IPFIXSink.
+	sinkIPFIX = envknob.RegisterString("TS_NETLOG_IPFIX")
+
+	// sinkIPFIXNetFlow9 makes the exporter use NetFlow v9 instead of
+	// IPFIX.
+	sinkIPFIXNetFlow9 = envknob.RegisterBool("TS_NETLOG_IPFIX_NETFLOW9")
+)
+
+// HasLocalSinks reports whether local sinks are configured by the
+// TS_NETLOG_FILE or TS_NETLOG_IPFIX environment variables, in which case
+// a Logger should be started even when network logging isn't enabled for
+// the node by the control plane.
+func HasLocalSinks() bool {
+	return sinkFile() != "" || sinkIPFIX() != ""
+}
+
+// sinksFromEnv returns the sinks configured by environment variables.
+func sinksFromEnv(logf logger.Logf) []Sink {
+	var sinks []Sink
+	if path := sinkFile(); path != "" {
+		s, err := NewFileSink(path, 0, 0)
+		if err != nil {
+			logf("netlog: file sink: %v", err)
+		} else {
+			sinks = append(sinks, s)
+		}
+	}
+	if collector := sinkIPFIX(); collector != "" {
+		version := uint16(IPFIXVersion)
+		if sinkIPFIXNetFlow9() {
+			version = NetFlow9Version
+		}
+		s, err := NewIPFIXSink(collector, version, 0)
+		if err != nil {
+			logf("netlog: IPFIX sink: %v", err)
+		} else {
+			sinks = append(sinks, s)
+		}
+	}
+	return sinks
+}
+
+// writeSinks writes m to each of sinks.
+func writeSinks(sinks []Sink, m *netlogtype.Message) error {
+	var errs []error
+	for _, s := range sinks {
+		if err := s.WriteMessage(m); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return multierr.New(errs...)
+}
+
+// closeSinks closes each of sinks.
+func closeSinks(sinks []Sink) error {
+	var errs []error
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return multierr.New(errs...)
+}
+
+const (
+	// DefaultFileSinkMaxSize is the default size at which a FileSink
+	// rotates its file.
+	DefaultFileSinkMaxSize = 10 << 20
+
+	// DefaultFileSinkMaxFiles is the default number of rotated files that a
+	// FileSink keeps, in addition to the one being written.
+	DefaultFileSinkMaxFiles = 5
+)
+
+// FileSink is a Sink that writes messages to a file as JSON lines, in
+// the format of the uploaded log messages, which cmd/netlogfmt can read.
+//
+// When the file reaches its maximum size, it's renamed with a ".1"
+// suffix, any existing ".1" file is renamed to ".2", and so on, and a new
+// file is started. Files beyond the maximum count are removed.
+type FileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	bw   *bufio.Writer
+	size int64 // of f, including buffered data
+}
+
+// fileSinkMessage is the JSON form of a message written by FileSink.
+type fileSinkMessage struct {
+	Logged time.Time `json:"logged"`
+	*netlogtype.Message
+}
+
+// NewFileSink returns a FileSink that writes to path, appending to it if
+// it exists. If maxSize or maxFiles are zero, DefaultFileSinkMaxSize and
+// DefaultFileSinkMaxFiles are used.
+func NewFileSink(path string, maxSize int64, maxFiles int) (*FileSink, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultFileSinkMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultFileSinkMaxFiles
+	}
+	s := &FileSink{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := s.openLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) openLocked() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.bw = bufio.NewWriter(f)
+	s.size = fi.Size()
+	return nil
+}
+
+// WriteMessage implements Sink.
+func (s *FileSink) WriteMessage(m *netlogtype.Message) error {
+	b, err := json.Marshal(fileSinkMessage{Logged: time.Now().UTC(), Message: m})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	var rotateErr error
+	if s.size > 0 && s.size+int64(len(b)) > s.maxSize {
+		// If rotation fails, keep writing to the current file and
+		// try again next time.
+		rotateErr = s.rotateLocked()
+		if s.f == nil {
+			return rotateErr
+		}
+	}
+	n, err := s.bw.Write(b)
+	s.size += int64(n)
+	if err == nil {
+		// Messages are written at most every few seconds, so flush
+		// each one so that readers of the file see whole messages.
+		err = s.bw.Flush()
+	}
+	return multierr.New(rotateErr, err)
+}
+
+// rotateLocked closes the current file, shifts the rotated files and opens
+// a new file. If rotation fails, it reopens the current file, so that s
+// remains usable unless that fails too. s.mu must be held.
+func (s *FileSink) rotateLocked() error {
+	err := s.closeLocked()
+	if err == nil {
+		err = s.shiftFiles()
+	}
+	if err2 := s.openLocked(); err2 != nil {
+		return multierr.New(err, err2)
+	}
+	return err
+}
+
+// shiftFiles renames the file at s.path and the rotated files, removing
+// the oldest.
+func (s *FileSink) shiftFiles() error {
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxFiles))
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(s.path, s.path+".1")
+}
+
+func (s *FileSink) closeLocked() error {
+	if s.f == nil {
+		return nil
+	}
+	err1 := s.bw.Flush()
+	err2 := s.f.Close()
+	s.f, s.bw = nil, nil
+	return multierr.New(err1, err2)
+}
+
+// Close implements Sink.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeLocked()
+}
@@ -0,0 +1,231 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/net/connstats"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/logid"
+	"tailscale.com/types/netlogtype"
+)
+
+func testMessage() *netlogtype.Message {
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	return &netlogtype.Message{
+		NodeID: "n123456CNTRL",
+		Start:  start,
+		End:    start.Add(pollPeriod),
+		VirtualTraffic: []netlogtype.ConnectionCounts{{
+			Connection: netlogtype.Connection{
+				Proto: ipproto.TCP,
+				Src:   netip.MustParseAddrPort("100.64.0.1:1234"),
+				Dst:   netip.MustParseAddrPort("100.64.0.2:22"),
+			},
+			Counts: netlogtype.Counts{TxPackets: 2, TxBytes: 200, RxPackets: 3, RxBytes: 300},
+		}},
+		SubnetTraffic: []netlogtype.ConnectionCounts{{
+			Connection: netlogtype.Connection{
+				Proto: ipproto.UDP,
+				Src:   netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:5353"),
+				Dst:   netip.MustParseAddrPort("[fd00::1]:53"),
+			},
+			Counts: netlogtype.Counts{TxPackets: 1, TxBytes: 80},
+		}},
+		PhysicalTraffic: []netlogtype.ConnectionCounts{{
+			Connection: netlogtype.Connection{
+				Src: netip.MustParseAddrPort("100.64.0.2:0"),
+				Dst: netip.MustParseAddrPort("192.168.0.2:41641"),
+			},
+			Counts: netlogtype.Counts{TxPackets: 2, TxBytes: 264},
+		}},
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netlog.json")
+	line, err := json.Marshal(fileSinkMessage{Message: testMessage()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotate after every two messages, keeping two rotated files.
+	s, err := NewFileSink(path, int64(2*len(line)+len(line)/2), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := s.WriteMessage(testMessage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteMessage(testMessage()); err == nil {
+		t.Error("WriteMessage after Close succeeded")
+	}
+
+	for _, tt := range []struct {
+		name string
+		want int
+	}{
+		{path, 1},
+		{path + ".1", 2},
+		{path + ".2", 2},
+		{path + ".3", 0},
+	} {
+		f, err := os.Open(tt.name)
+		if tt.want == 0 {
+			if err == nil {
+				f.Close()
+				t.Errorf("%s exists; want it removed", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var got fileSinkMessage
+			if err := json.Unmarshal(sc.Bytes(), &got); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if got.Logged.IsZero() || got.NodeID != "n123456CNTRL" || len(got.VirtualTraffic) != 1 {
+				t.Errorf("%s: unexpected message %s", tt.name, sc.Bytes())
+			}
+			n++
+		}
+		f.Close()
+		if n != tt.want {
+			t.Errorf("%s has %d messages; want %d", tt.name, n, tt.want)
+		}
+	}
+}
+
+func TestFileSinkRotateError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "netlog.json")
+	s, err := NewFileSink(path, 1, 1) // rotate before every write
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.WriteMessage(testMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A non-empty directory in the way makes the rename fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "x"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteMessage(testMessage()); err == nil {
+		t.Error("WriteMessage succeeded despite failed rotation")
+	}
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both messages were kept, and once the rename works again, the
+	// file is rotated.
+	if err := s.WriteMessage(testMessage()); err != nil {
+		t.Fatalf("WriteMessage after failed rotation: %v", err)
+	}
+	for name, want := range map[string]int{path + ".1": 2, path: 1} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := bytes.Count(b, []byte("\n")); n != want {
+			t.Errorf("%s has %d lines; want %d", name, n, want)
+		}
+	}
+}
+
+func TestFileSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netlog.json")
+	for i := 0; i < 2; i++ {
+		s, err := NewFileSink(path, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteMessage(testMessage()); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for _, c := range b {
+		if c == '\n' {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("file has %d lines; want 2", n)
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s.1", path)); err == nil {
+		t.Errorf("file was rotated; want it appended to")
+	}
+}
+
+type testDevice struct{ stats *connstats.Statistics }
+
+func (d *testDevice) SetStatistics(s *connstats.Statistics) { d.stats = s }
+
+func TestStartupLocalSinksOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netlog.json")
+	envknob.Setenv("TS_NETLOG_FILE", path)
+	defer envknob.Setenv("TS_NETLOG_FILE", "")
+	if !HasLocalSinks() {
+		t.Fatal("HasLocalSinks = false with TS_NETLOG_FILE set")
+	}
+
+	// Without log IDs, the logger runs for its sinks but doesn't upload.
+	var nl Logger
+	sock := new(testDevice)
+	if err := nl.Startup("n123456CNTRL", logid.PrivateID{}, logid.PrivateID{}, nil, sock, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !nl.Running() {
+		t.Fatal("logger not running")
+	}
+	if nl.logger != nil {
+		t.Fatal("logger uploading without log IDs")
+	}
+	sock.stats.UpdateTxPhysical(netip.MustParseAddr("100.64.0.2"), netip.MustParseAddrPort("192.168.0.2:41641"), 100)
+	if err := nl.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if nl.Running() {
+		t.Fatal("logger still running after Shutdown")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m netlogtype.Message
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("file has %q: %v", b, err)
+	}
+	if len(m.PhysicalTraffic) != 1 || m.PhysicalTraffic[0].TxBytes != 100 {
+		t.Errorf("PhysicalTraffic = %+v; want 100 bytes sent", m.PhysicalTraffic)
+	}
+}
@@ -39,6 +39,7 @@
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/logid"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/views"
 	"tailscale.com/util/clientmetric"
@@ -819,9 +820,14 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	netLogIDsNowValid := !newLogIDs.NodeID.IsZero() && !newLogIDs.DomainID.IsZero()
 	netLogIDsWasValid := !oldLogIDs.NodeID.IsZero() && !oldLogIDs.DomainID.IsZero()
 	netLogIDsChanged := netLogIDsNowValid && netLogIDsWasValid && newLogIDs != oldLogIDs
-	netLogRunning := netLogIDsNowValid && !routerCfg.Equal(&router.Config{})
-	if envknob.NoLogsNoSupport() {
-		netLogRunning = false
+	netLogUpload := netLogIDsNowValid && !envknob.NoLogsNoSupport()
+	netLogRunning := netLogUpload && !routerCfg.Equal(&router.Config{})
+	if netlog.HasLocalSinks() {
+		// The network logger also runs for its local sinks, uploading
+		// only while the IDs are valid, so restart it whenever they
+		// change.
+		netLogIDsChanged = newLogIDs != oldLogIDs
+		netLogRunning = !routerCfg.Equal(&router.Config{})
 	}
 
 	// TODO(bradfitz,danderson): maybe delete this isDNSIPOverTailscale
@@ -886,9 +892,14 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	// Startup the network logger.
 	// Do this before configuring the router so that we capture initial packets.
 	if netLogRunning && !e.networkLogger.Running() {
-		nid := cfg.NetworkLogging.NodeID
-		tid := cfg.NetworkLogging.DomainID
-		e.logf("wgengine: Reconfig: starting up network logger (node:%s tailnet:%s)", nid.Public(), tid.Public())
+		var nid, tid logid.PrivateID
+		if netLogUpload {
+			nid = cfg.NetworkLogging.NodeID
+			tid = cfg.NetworkLogging.DomainID
+			e.logf("wgengine: Reconfig: starting up network logger (node:%s tailnet:%s)", nid.Public(), tid.Public())
+		} else {
+			e.logf("wgengine: Reconfig: starting up network logger for local sinks only")
+		}
 		if err := e.networkLogger.Startup(cfg.NodeID, nid, tid, e.tundev, e.magicConn, e.netMon); err != nil {
 			e.logf("wgengine: Reconfig: error starting up network logger: %v", err)
 		}
@@ -1142,6 +1153,7 @@ func (e *userspaceEngine) linkChange(delta *netmon.ChangeDelta) {
 	if changed {
 		why = "link-change-major"
 		metricNumMajorChanges.Add(1)
+		e.magicConn.NoteLinkChange()
 		e.magicConn.Rebind()
 	} else {
 		metricNumMinorChanges.Add(1)